@@ -0,0 +1,370 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"path"
+	"slices"
+	"strings"
+	"time"
+
+	"identity-metadata-server/internal/shared"
+
+	"github.com/gin-gonic/gin"
+	"github.com/rs/zerolog/log"
+	"github.com/spf13/viper"
+)
+
+// AdminRole defines what an admin host is allowed to do.
+type AdminRole int
+
+const (
+	// AdminRoleNone is assigned to all hosts that are not admins.
+	AdminRoleNone AdminRole = iota
+	// AdminRoleReader can call read-only admin endpoints.
+	AdminRoleReader
+	// AdminRoleOperator can call all admin endpoints.
+	AdminRoleOperator
+)
+
+// String returns the name of the role as used in logs.
+func (r AdminRole) String() string {
+	switch r {
+	case AdminRoleReader:
+		return "reader"
+	case AdminRoleOperator:
+		return "operator"
+	default:
+		return "none"
+	}
+}
+
+// adminHostContextKey stores the hostname of the admin calling an admin
+// endpoint in the gin context.
+const adminHostContextKey = "adminHost"
+
+// hostListed returns true if the given hostname is part of the host list
+// stored under key. Hostnames are compared case-insensitively.
+// Admin rights are bound to hostnames instead of identities, because an
+// identity (service account) is usually shared by many hosts, while the
+// hostname of a certificate can only change through an approved renewal.
+func hostListed(key, host string) bool {
+	return slices.ContainsFunc(viper.GetStringSlice(key), func(listed string) bool {
+		return strings.EqualFold(listed, host)
+	})
+}
+
+// adminRoleFor returns the role configured for the given hostname.
+// Operators are also allowed to read.
+func adminRoleFor(host string) AdminRole {
+	switch {
+	case hostListed("server.admin.operators", host):
+		return AdminRoleOperator
+	case hostListed("server.admin.readers", host):
+		return AdminRoleReader
+	default:
+		return AdminRoleNone
+	}
+}
+
+// RequireAdminRole returns a middleware that only lets clients with at least
+// the given role pass. Every call, including rejected ones, is written to the
+// audit log.
+func RequireAdminRole(crl *CertificateRevocationList, required AdminRole) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		audit := func(client *IdentityClient, role AdminRole, err error) {
+			entry := log.Info().
+				Bool("audit", true).
+				Str("clientIP", c.ClientIP()).
+				Str("method", c.Request.Method).
+				Str("path", c.Request.URL.Path).
+				Str("role", role.String()).
+				Int("status", c.Writer.Status())
+			if client != nil {
+				entry = entry.Str("host", client.Host).Str("identity", client.Identity)
+			}
+			entry.Err(err).Msg("Admin API call")
+		}
+
+		client, err := NewClientFromContext(c, crl)
+		if err != nil {
+			shared.HttpError(c, http.StatusInternalServerError, err)
+			c.Abort()
+			audit(nil, AdminRoleNone, err)
+			return
+		}
+
+		role := adminRoleFor(client.Host)
+		if role < required {
+			shared.HttpError(c, http.StatusForbidden, ErrorAdminRoleRequired)
+			c.Abort()
+			audit(client, role, ErrorAdminRoleRequired)
+			return
+		}
+
+		c.Set(adminHostContextKey, client.Host)
+		c.Next()
+		audit(client, role, nil)
+	}
+}
+
+// HandleAdminCRLRequest returns the state of the certificate revocation list.
+func HandleAdminCRLRequest(c *gin.Context, crl *CertificateRevocationList) {
+	c.JSON(http.StatusOK, crl.Status())
+}
+
+// AdminKeyResponse describes a signing key of the server.
+type AdminKeyResponse struct {
+	KeyID      string    `json:"kid"`
+	Algorithm  string    `json:"alg"`
+	ActiveFrom time.Time `json:"activeFrom"`
+	RetiredAt  time.Time `json:"retiredAt"`
+	Active     bool      `json:"active"`
+	Published  bool      `json:"published"`
+}
+
+// HandleAdminKeysRequest returns all loaded signing keys.
+func HandleAdminKeysRequest(c *gin.Context) {
+	ring := serverKeys.Load()
+	if ring == nil {
+		shared.HttpError(c, http.StatusInternalServerError, ErrorSigningKeyNotLoaded)
+		return
+	}
+
+	now := time.Now()
+	active := ring.activeKey(now)
+	published := ring.publishedKeys(now)
+
+	keys := make([]AdminKeyResponse, 0, len(ring.keys))
+	for i, key := range ring.keys {
+		keys = append(keys, AdminKeyResponse{
+			KeyID:      key.keyID,
+			Algorithm:  key.method.Alg(),
+			ActiveFrom: key.activeFrom,
+			RetiredAt:  ring.retiredAt(i),
+			Active:     key == active,
+			Published:  slices.Contains(published, key),
+		})
+	}
+
+	c.JSON(http.StatusOK, keys)
+}
+
+// AdminPolicyRuleResponse describes a TokenPolicyRule.
+type AdminPolicyRuleResponse struct {
+	Hosts       []string `json:"hosts"`
+	Identities  []string `json:"identities"`
+	MaxLifetime string   `json:"maxLifetime,omitempty"`
+	Audiences   []string `json:"audiences"`
+}
+
+// AdminPolicyResponse describes the active TokenPolicy.
+type AdminPolicyResponse struct {
+	Loaded            bool                      `json:"loaded"`
+	MaxLifetime       string                    `json:"maxLifetime,omitempty"`
+	RestrictAudiences bool                      `json:"restrictAudiences"`
+	Audiences         []string                  `json:"audiences"`
+	Rules             []AdminPolicyRuleResponse `json:"rules"`
+	Deny              TokenPolicyDenyList       `json:"deny"`
+}
+
+// formatLifetime returns the given lifetime as duration string. 0 means
+// unrestricted and is returned as empty string.
+func formatLifetime(lifetime time.Duration) string {
+	if lifetime == 0 {
+		return ""
+	}
+	return lifetime.String()
+}
+
+// HandleAdminPolicyRequest returns the active token issuance policy.
+func HandleAdminPolicyRequest(c *gin.Context) {
+	policy := tokenPolicy.Load()
+	if policy == nil {
+		c.JSON(http.StatusOK, AdminPolicyResponse{})
+		return
+	}
+
+	response := AdminPolicyResponse{
+		Loaded:            true,
+		MaxLifetime:       formatLifetime(policy.MaxLifetime),
+		RestrictAudiences: policy.RestrictAudiences,
+		Audiences:         policy.Audiences,
+		Rules:             make([]AdminPolicyRuleResponse, 0, len(policy.Rules)),
+		Deny:              policy.Deny,
+	}
+	for _, rule := range policy.Rules {
+		response.Rules = append(response.Rules, AdminPolicyRuleResponse{
+			Hosts:       rule.Hosts,
+			Identities:  rule.Identities,
+			MaxLifetime: formatLifetime(rule.MaxLifetime),
+			Audiences:   rule.Audiences,
+		})
+	}
+
+	c.JSON(http.StatusOK, response)
+}
+
+// HandleAdminClientsRequest returns the client inventory.
+// The optional query parameters take a duration, e.g. "168h":
+// `seenWithin` returns clients seen within the duration,
+// `notSeenFor` returns clients not seen for the duration and
+// `expiresWithin` returns clients whose certificate expires within the duration.
+func HandleAdminClientsRequest(c *gin.Context) {
+	now := time.Now()
+	filter := InventoryFilter{}
+
+	parseErrors := error(nil)
+	parseWindow := func(name string, sign time.Duration) time.Time {
+		param := c.Query(name)
+		if len(param) == 0 {
+			return time.Time{}
+		}
+		window, err := time.ParseDuration(param)
+		if err != nil {
+			parseErrors = errors.Join(parseErrors, fmt.Errorf("invalid %s: %w", name, err))
+			return time.Time{}
+		}
+		return now.Add(sign * window)
+	}
+
+	filter.SeenAfter = parseWindow("seenWithin", -1)
+	filter.NotSeenSince = parseWindow("notSeenFor", -1)
+	filter.ExpiresBefore = parseWindow("expiresWithin", 1)
+
+	if parseErrors != nil {
+		shared.HttpError(c, http.StatusBadRequest, parseErrors)
+		return
+	}
+
+	c.JSON(http.StatusOK, clientInventory.Entries(filter))
+}
+
+// HandleAdminReloadRequest reloads key material, policies and trust roots.
+// See ServerReloader.Reload.
+func HandleAdminReloadRequest(c *gin.Context, reloader *ServerReloader) {
+	if err := reloader.Reload(c.Request.Context()); err != nil {
+		shared.HttpError(c, http.StatusInternalServerError, err)
+		return
+	}
+	c.Status(http.StatusOK)
+}
+
+// AdminRenewalResponse describes the active renewal hints.
+type AdminRenewalResponse struct {
+	Active bool `json:"active"`
+	*RenewalRotation
+	CAExpiryWindow string `json:"caExpiryWindow,omitempty"`
+}
+
+// newAdminRenewalResponse describes the given renewal hints.
+func newAdminRenewalResponse(hints *RenewalHints) AdminRenewalResponse {
+	response := AdminRenewalResponse{
+		RenewalRotation: hints.Rotation(),
+	}
+	response.Active = response.RenewalRotation != nil
+	if hints.caExpiryWindow > 0 {
+		response.CAExpiryWindow = hints.caExpiryWindow.String()
+	}
+	return response
+}
+
+// HandleAdminRenewalRequest returns the active renewal rotation.
+func HandleAdminRenewalRequest(c *gin.Context, hints *RenewalHints) {
+	c.JSON(http.StatusOK, newAdminRenewalResponse(hints))
+}
+
+// HandleAdminSetRenewalRequest asks all clients matching the posted
+// RenewalRotation to renew their certificate. If not set, issuedBefore and
+// renewBy default to now, i.e. all current certificates are renewed as soon
+// as possible.
+func HandleAdminSetRenewalRequest(c *gin.Context, hints *RenewalHints) {
+	rotation := RenewalRotation{}
+	if err := c.BindJSON(&rotation); err != nil {
+		shared.HttpError(c, http.StatusBadRequest, err)
+		return
+	}
+
+	for _, pattern := range rotation.Hosts {
+		if _, err := path.Match(pattern, ""); err != nil {
+			shared.HttpError(c, http.StatusBadRequest, fmt.Errorf("invalid host pattern %q: %w", pattern, err))
+			return
+		}
+	}
+
+	now := time.Now()
+	if rotation.IssuedBefore.IsZero() {
+		rotation.IssuedBefore = now
+	}
+	if rotation.RenewBy.IsZero() {
+		rotation.RenewBy = now
+	}
+
+	log.Warn().
+		Time("issuedBefore", rotation.IssuedBefore).
+		Time("renewBy", rotation.RenewBy).
+		Strs("hosts", rotation.Hosts).
+		Msg("Early renewal of client certificates requested")
+
+	hints.SetRotation(&rotation)
+	c.JSON(http.StatusOK, newAdminRenewalResponse(hints))
+}
+
+// HandleAdminClearRenewalRequest removes the active renewal rotation.
+func HandleAdminClearRenewalRequest(c *gin.Context, hints *RenewalHints) {
+	log.Info().Msg("Early renewal of client certificates cancelled")
+	hints.SetRotation(nil)
+	c.JSON(http.StatusOK, newAdminRenewalResponse(hints))
+}
+
+// HandleAdminPendingRenewalsRequest returns all renewals waiting for an
+// approval or to be picked up by the client.
+func HandleAdminPendingRenewalsRequest(c *gin.Context, pending *PendingRenewalStore) {
+	renewals, err := pending.List()
+	if err != nil {
+		shared.HttpError(c, http.StatusInternalServerError, err)
+		return
+	}
+	c.JSON(http.StatusOK, renewals)
+}
+
+// HandleAdminApproveRenewalRequest approves the pending renewal with the ID
+// given as path parameter. The certificate is issued when the client sends
+// the renewal request again.
+func HandleAdminApproveRenewalRequest(c *gin.Context, pending *PendingRenewalStore) {
+	renewal, err := pending.Approve(c.Param("id"), c.GetString(adminHostContextKey))
+	if err != nil {
+		shared.HttpError(c, http.StatusInternalServerError, err)
+		return
+	}
+
+	log.Info().
+		Str("id", renewal.ID).
+		Str("host", renewal.Host).
+		Str("requestedHost", renewal.RequestedHost).
+		Strs("requestedAddresses", renewal.RequestedAddresses).
+		Str("approvedBy", renewal.ApprovedBy).
+		Msg("Pending renewal approved")
+
+	c.JSON(http.StatusOK, renewal)
+}
+
+// HandleAdminRejectRenewalRequest rejects the pending renewal with the ID
+// given as path parameter. Clients sending the same request again are
+// rejected until the retention period ends.
+func HandleAdminRejectRenewalRequest(c *gin.Context, pending *PendingRenewalStore) {
+	renewal, err := pending.Reject(c.Param("id"), c.GetString(adminHostContextKey))
+	if err != nil {
+		shared.HttpError(c, http.StatusInternalServerError, err)
+		return
+	}
+
+	log.Info().
+		Str("id", renewal.ID).
+		Str("host", renewal.Host).
+		Str("rejectedBy", renewal.RejectedBy).
+		Msg("Pending renewal rejected")
+
+	c.JSON(http.StatusOK, renewal)
+}
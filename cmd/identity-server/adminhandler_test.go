@@ -0,0 +1,82 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+)
+
+// newTestAdminRouter returns a router exposing a reader and an operator
+// endpoint. The returned function calls the given path with a certificate.
+func newTestAdminRouter(crl *CertificateRevocationList) func(cert *x509.Certificate, method, path string) *httptest.ResponseRecorder {
+	router := gin.New()
+	admin := router.Group("/admin")
+	admin.GET("/crl", RequireAdminRole(crl, AdminRoleReader), func(c *gin.Context) { HandleAdminCRLRequest(c, crl) })
+	admin.POST("/noop", RequireAdminRole(crl, AdminRoleOperator), func(c *gin.Context) { c.Status(http.StatusNoContent) })
+
+	return func(cert *x509.Certificate, method, path string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(method, path, nil)
+		r.RemoteAddr = testClientOrigin + ":12345"
+		r.TLS = &tls.ConnectionState{}
+		if cert != nil {
+			r.TLS.PeerCertificates = []*x509.Certificate{cert}
+		}
+		router.ServeHTTP(w, r)
+		return w
+	}
+}
+
+func TestRequireAdminRole(t *testing.T) {
+	assert := assert.New(t)
+	defer viper.Reset()
+
+	cert, crl := newTestClientCertificate(t, "admin.example.com")
+	call := newTestAdminRouter(crl)
+
+	// Not an admin
+	assert.Equal(http.StatusUnauthorized, call(nil, http.MethodGet, "/admin/crl").Code)
+	assert.Equal(http.StatusForbidden, call(cert, http.MethodGet, "/admin/crl").Code)
+
+	// Readers cannot call operator endpoints
+	viper.Set("server.admin.readers", []string{"admin.example.com"})
+	assert.Equal(http.StatusOK, call(cert, http.MethodGet, "/admin/crl").Code)
+	assert.Equal(http.StatusForbidden, call(cert, http.MethodPost, "/admin/noop").Code)
+
+	// Operators can call all endpoints
+	viper.Set("server.admin.operators", []string{"ADMIN.example.com"})
+	assert.Equal(http.StatusOK, call(cert, http.MethodGet, "/admin/crl").Code)
+	assert.Equal(http.StatusNoContent, call(cert, http.MethodPost, "/admin/noop").Code)
+}
+
+func TestHandleAdminCRLRequest(t *testing.T) {
+	assert := assert.New(t)
+	defer viper.Reset()
+
+	certs, crl := newTestClientCertificates(t, "admin.example.com", "host.example.com")
+	crl.authority = newTestAuthority(certs...)
+	viper.Set("server.admin.readers", []string{"admin.example.com"})
+
+	assert.NoError(crl.Update(context.Background()))
+	crl.AddRevoked("0a0b", time.Now().Add(time.Hour))
+
+	w := newTestAdminRouter(crl)(certs[0], http.MethodGet, "/admin/crl")
+	assert.Equal(http.StatusOK, w.Code)
+
+	status := CertificateRevocationListStatus{}
+	assert.NoError(json.Unmarshal(w.Body.Bytes(), &status))
+	assert.Equal(1, status.Count)
+	assert.Equal(1, status.Pending)
+	assert.WithinDuration(time.Now(), status.LastUpdate, time.Minute)
+	assert.WithinDuration(time.Now().Add(time.Hour), status.NextUpdate, time.Minute)
+	assert.Empty(status.LastError)
+}
@@ -0,0 +1,310 @@
+package main
+
+import (
+	"context"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/rs/zerolog/log"
+	"github.com/spf13/viper"
+)
+
+// AnomalyAction defines how the AnomalyDetector reacts to a detected anomaly.
+type AnomalyAction string
+
+const (
+	// AnomalyActionNone only reports the anomaly.
+	AnomalyActionNone AnomalyAction = "none"
+	// AnomalyActionQuarantine rejects all requests using the certificate for
+	// the configured quarantine duration.
+	AnomalyActionQuarantine AnomalyAction = "quarantine"
+	// AnomalyActionRevoke revokes the certificate.
+	AnomalyActionRevoke AnomalyAction = "revoke"
+)
+
+const (
+	anomalyTypeInvalidOrigin    = "invalid_origin"
+	anomalyTypeConcurrentOrigin = "concurrent_origins"
+)
+
+// AnomalyDetectorConfig configures the AnomalyDetector.
+// A threshold of 0 disables the corresponding check.
+type AnomalyDetectorConfig struct {
+	// InvalidOriginThreshold is the number of requests from an origin not
+	// listed in the certificate within InvalidOriginWindow that is treated
+	// as anomaly.
+	InvalidOriginThreshold int
+	InvalidOriginWindow    time.Duration
+
+	// ConcurrentOriginThreshold is the number of different valid origins
+	// using the same certificate within ConcurrentOriginWindow that is
+	// treated as anomaly.
+	ConcurrentOriginThreshold int
+	ConcurrentOriginWindow    time.Duration
+
+	Action             AnomalyAction
+	QuarantineDuration time.Duration
+}
+
+// AnomalyRevokeFunc revokes the given certificate.
+type AnomalyRevokeFunc func(ctx context.Context, cert *x509.Certificate) error
+
+// AnomalyDetector tracks the use of client certificates per serial number
+// and reports certificates that are likely used by someone else than the
+// host they were issued to.
+type AnomalyDetector struct {
+	config AnomalyDetectorConfig
+	revoke AnomalyRevokeFunc
+	guard  *sync.Mutex
+
+	// invalidOrigins holds the times of invalid origin requests per serial.
+	invalidOrigins map[string][]time.Time
+	// origins holds the last use of each valid origin per serial.
+	origins map[string]map[string]time.Time
+	// quarantined holds the end of the quarantine per serial.
+	quarantined map[string]time.Time
+	// lastSweep is the last time expired events were removed.
+	lastSweep time.Time
+
+	invalidOriginCount prometheus.Counter
+	detectedCount      *prometheus.CounterVec
+	quarantinedGauge   prometheus.GaugeFunc
+}
+
+var (
+	// anomalyDetector checks all authenticated client requests.
+	// It is replaced by initAnomalyDetector during startup.
+	anomalyDetector = NewAnomalyDetector(AnomalyDetectorConfig{}, nil)
+)
+
+// NewAnomalyDetector creates a new detector. revoke may be nil if the
+// revoke action is not used.
+func NewAnomalyDetector(config AnomalyDetectorConfig, revoke AnomalyRevokeFunc) *AnomalyDetector {
+	detector := &AnomalyDetector{
+		config:         config,
+		revoke:         revoke,
+		guard:          new(sync.Mutex),
+		invalidOrigins: make(map[string][]time.Time),
+		origins:        make(map[string]map[string]time.Time),
+		quarantined:    make(map[string]time.Time),
+	}
+
+	detector.invalidOriginCount = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "identity_server",
+		Subsystem: "anomaly",
+		Name:      "invalid_origin_total",
+		Help:      "Total number of requests with a valid certificate from an origin not listed in the certificate.",
+	})
+	detector.detectedCount = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "identity_server",
+		Subsystem: "anomaly",
+		Name:      "detected_total",
+		Help:      "Total number of detected certificate anomalies by type and action taken.",
+	}, []string{"type", "action"})
+	detector.quarantinedGauge = prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace: "identity_server",
+		Subsystem: "anomaly",
+		Name:      "quarantined_certificates",
+		Help:      "Number of certificates currently in quarantine.",
+	}, func() float64 {
+		return float64(detector.QuarantinedCount(time.Now()))
+	})
+
+	return detector
+}
+
+// initAnomalyDetector creates the detector configured in server.anomalyDetection.
+func initAnomalyDetector(revoke AnomalyRevokeFunc) error {
+	config := AnomalyDetectorConfig{
+		InvalidOriginThreshold:    viper.GetInt("server.anomalyDetection.invalidOrigin.threshold"),
+		InvalidOriginWindow:       viper.GetDuration("server.anomalyDetection.invalidOrigin.window"),
+		ConcurrentOriginThreshold: viper.GetInt("server.anomalyDetection.concurrentOrigins.threshold"),
+		ConcurrentOriginWindow:    viper.GetDuration("server.anomalyDetection.concurrentOrigins.window"),
+		Action:                    AnomalyAction(viper.GetString("server.anomalyDetection.action")),
+		QuarantineDuration:        viper.GetDuration("server.anomalyDetection.quarantineDuration"),
+	}
+
+	switch config.Action {
+	case AnomalyActionNone, AnomalyActionQuarantine:
+	case AnomalyActionRevoke:
+		if revoke == nil {
+			return fmt.Errorf("anomaly action %q requires client certificate verification", config.Action)
+		}
+	default:
+		return fmt.Errorf("unknown anomaly action %q", config.Action)
+	}
+
+	anomalyDetector = NewAnomalyDetector(config, revoke)
+	return nil
+}
+
+// collectors returns the metrics of the detector for registration.
+func (d *AnomalyDetector) collectors() []prometheus.Collector {
+	return []prometheus.Collector{d.invalidOriginCount, d.detectedCount, d.quarantinedGauge}
+}
+
+// ReportInvalidOrigin records a request with a valid certificate from an
+// origin not listed in the certificate.
+func (d *AnomalyDetector) ReportInvalidOrigin(client *IdentityClient, origin net.IP, now time.Time) {
+	d.invalidOriginCount.Inc()
+	if d.config.InvalidOriginThreshold <= 0 {
+		return
+	}
+
+	d.guard.Lock()
+	events := append(pruneBefore(d.invalidOrigins[client.SerialNumber], now.Add(-d.config.InvalidOriginWindow)), now)
+	detected := len(events) >= d.config.InvalidOriginThreshold
+	if detected {
+		delete(d.invalidOrigins, client.SerialNumber)
+	} else {
+		d.invalidOrigins[client.SerialNumber] = events
+	}
+	d.sweep(now)
+	d.guard.Unlock()
+
+	if detected {
+		d.handleAnomaly(client, anomalyTypeInvalidOrigin, origin, len(events), now)
+	}
+}
+
+// ReportUse records a request from a valid origin.
+func (d *AnomalyDetector) ReportUse(client *IdentityClient, origin net.IP, now time.Time) {
+	if d.config.ConcurrentOriginThreshold <= 0 {
+		return
+	}
+
+	d.guard.Lock()
+	origins, exists := d.origins[client.SerialNumber]
+	if !exists {
+		origins = make(map[string]time.Time)
+		d.origins[client.SerialNumber] = origins
+	}
+
+	origins[origin.String()] = now
+	for ip, lastUse := range origins {
+		if now.Sub(lastUse) > d.config.ConcurrentOriginWindow {
+			delete(origins, ip)
+		}
+	}
+
+	numOrigins := len(origins)
+	detected := numOrigins >= d.config.ConcurrentOriginThreshold
+	if detected {
+		delete(d.origins, client.SerialNumber)
+	}
+	d.sweep(now)
+	d.guard.Unlock()
+
+	if detected {
+		d.handleAnomaly(client, anomalyTypeConcurrentOrigin, origin, numOrigins, now)
+	}
+}
+
+// IsQuarantined returns true if the given serial is in quarantine.
+func (d *AnomalyDetector) IsQuarantined(hexSerial string, now time.Time) bool {
+	d.guard.Lock()
+	defer d.guard.Unlock()
+
+	until, exists := d.quarantined[hexSerial]
+	return exists && now.Before(until)
+}
+
+// QuarantinedCount returns the number of serials in quarantine.
+func (d *AnomalyDetector) QuarantinedCount(now time.Time) int {
+	d.guard.Lock()
+	defer d.guard.Unlock()
+
+	count := 0
+	for _, until := range d.quarantined {
+		if now.Before(until) {
+			count++
+		}
+	}
+	return count
+}
+
+// handleAnomaly reports a detected anomaly and executes the configured action.
+func (d *AnomalyDetector) handleAnomaly(client *IdentityClient, anomalyType string, origin net.IP, count int, now time.Time) {
+	action := d.config.Action
+	if len(action) == 0 {
+		action = AnomalyActionNone
+	}
+
+	d.detectedCount.WithLabelValues(anomalyType, string(action)).Inc()
+	log.Warn().
+		Bool("alert", true).
+		Str("type", anomalyType).
+		Str("action", string(action)).
+		Str("host", client.Host).
+		Str("identity", client.Identity).
+		Str("serial", client.SerialNumber).
+		Str("origin", origin.String()).
+		Int("count", count).
+		Msg("Detected anomalous use of client certificate")
+
+	switch action {
+	case AnomalyActionQuarantine:
+		d.guard.Lock()
+		d.quarantined[client.SerialNumber] = now.Add(d.config.QuarantineDuration)
+		d.guard.Unlock()
+
+	case AnomalyActionRevoke:
+		// Revoking calls the CA, which must not block the request
+		go func() {
+			ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+			defer cancel()
+
+			if err := d.revoke(ctx, client.Certificate); err != nil {
+				log.Error().Err(err).Str("serial", client.SerialNumber).Msg("Failed to revoke anomalous client certificate")
+				return
+			}
+			log.Warn().Str("host", client.Host).Str("serial", client.SerialNumber).Msg("Revoked anomalous client certificate")
+		}()
+	}
+}
+
+// sweep removes expired events of all serials. To keep the costs low, this
+// is done at most once per minute. Must be called with the guard locked.
+func (d *AnomalyDetector) sweep(now time.Time) {
+	if now.Sub(d.lastSweep) < time.Minute {
+		return
+	}
+	d.lastSweep = now
+
+	for serial, events := range d.invalidOrigins {
+		if events = pruneBefore(events, now.Add(-d.config.InvalidOriginWindow)); len(events) == 0 {
+			delete(d.invalidOrigins, serial)
+		} else {
+			d.invalidOrigins[serial] = events
+		}
+	}
+	for serial, origins := range d.origins {
+		for ip, lastUse := range origins {
+			if now.Sub(lastUse) > d.config.ConcurrentOriginWindow {
+				delete(origins, ip)
+			}
+		}
+		if len(origins) == 0 {
+			delete(d.origins, serial)
+		}
+	}
+	for serial, until := range d.quarantined {
+		if !now.Before(until) {
+			delete(d.quarantined, serial)
+		}
+	}
+}
+
+// pruneBefore removes all times before the given cutoff from the sorted list.
+func pruneBefore(events []time.Time, cutoff time.Time) []time.Time {
+	for i, event := range events {
+		if !event.Before(cutoff) {
+			return events[i:]
+		}
+	}
+	return events[:0]
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"context"
+	"crypto/x509"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAnomalyDetectorInvalidOrigin(t *testing.T) {
+	assert := assert.New(t)
+
+	certs, _ := newTestClientCertificates(t, "a.example.com", "b.example.com")
+	clientA, err := NewClientFromCert(certs[0])
+	assert.NoError(err)
+	clientB, err := NewClientFromCert(certs[1])
+	assert.NoError(err)
+
+	detector := NewAnomalyDetector(AnomalyDetectorConfig{
+		InvalidOriginThreshold: 3,
+		InvalidOriginWindow:    10 * time.Minute,
+		Action:                 AnomalyActionQuarantine,
+		QuarantineDuration:     time.Hour,
+	}, nil)
+
+	now := time.Now()
+	origin := net.ParseIP("10.0.0.2")
+
+	// Events outside of the window are not counted
+	detector.ReportInvalidOrigin(clientA, origin, now.Add(-20*time.Minute))
+	detector.ReportInvalidOrigin(clientA, origin, now.Add(-time.Minute))
+	detector.ReportInvalidOrigin(clientB, origin, now)
+	detector.ReportInvalidOrigin(clientA, origin, now)
+	assert.False(detector.IsQuarantined(clientA.SerialNumber, now))
+
+	detector.ReportInvalidOrigin(clientA, origin, now)
+	assert.True(detector.IsQuarantined(clientA.SerialNumber, now))
+	assert.False(detector.IsQuarantined(clientB.SerialNumber, now))
+	assert.False(detector.IsQuarantined(clientA.SerialNumber, now.Add(2*time.Hour)))
+
+	assert.Equal(1, detector.QuarantinedCount(now))
+	assert.Equal(5.0, testutil.ToFloat64(detector.invalidOriginCount))
+	assert.Equal(1.0, testutil.ToFloat64(detector.detectedCount.WithLabelValues(anomalyTypeInvalidOrigin, string(AnomalyActionQuarantine))))
+}
+
+func TestAnomalyDetectorConcurrentOrigins(t *testing.T) {
+	assert := assert.New(t)
+
+	certs, _ := newTestClientCertificates(t, "a.example.com")
+	client, err := NewClientFromCert(certs[0])
+	assert.NoError(err)
+
+	revoked := make(chan *x509.Certificate, 1)
+	detector := NewAnomalyDetector(AnomalyDetectorConfig{
+		ConcurrentOriginThreshold: 2,
+		ConcurrentOriginWindow:    time.Minute,
+		Action:                    AnomalyActionRevoke,
+	}, func(ctx context.Context, cert *x509.Certificate) error {
+		revoked <- cert
+		return nil
+	})
+
+	now := time.Now()
+
+	// Repeated use from the same origin or origins used one after another
+	// are not an anomaly.
+	detector.ReportUse(client, net.ParseIP("10.0.0.1"), now.Add(-5*time.Minute))
+	detector.ReportUse(client, net.ParseIP("10.0.0.2"), now.Add(-time.Minute/2))
+	detector.ReportUse(client, net.ParseIP("10.0.0.2"), now)
+	assert.Equal(0.0, testutil.ToFloat64(detector.detectedCount.WithLabelValues(anomalyTypeConcurrentOrigin, string(AnomalyActionRevoke))))
+
+	detector.ReportUse(client, net.ParseIP("10.0.0.1"), now)
+	assert.Equal(1.0, testutil.ToFloat64(detector.detectedCount.WithLabelValues(anomalyTypeConcurrentOrigin, string(AnomalyActionRevoke))))
+
+	select {
+	case cert := <-revoked:
+		assert.Equal(certs[0], cert)
+	case <-time.After(time.Second):
+		assert.Fail("certificate was not revoked")
+	}
+}
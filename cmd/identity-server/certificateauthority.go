@@ -3,139 +3,211 @@ package main
 import (
 	"context"
 	"crypto/x509"
-	"encoding/pem"
 	"errors"
 	"fmt"
-	"identity-metadata-server/internal/shared"
-	"io"
-	"net/http"
+	"identity-metadata-server/internal/certificates"
+	"net"
+	"slices"
+	"time"
 
 	"github.com/rs/zerolog/log"
+	"github.com/spf13/viper"
 )
 
 const (
 	certificateAuthorityScope = "https://www.googleapis.com/auth/cloud-platform"
 )
 
-// https://cloud.google.com/certificate-authority-service/docs/reference/rest/v1/projects.locations.caPools.certificateAuthorities#CertificateAuthorityData
-type CertificateAuthorityData struct {
-	Name       string `json:"name"`
-	AccessURLs struct {
-		RootCertificate string   `json:"caCertificateAccessUrl"`
-		RevocationLists []string `json:"crlAccessUrls"`
-	} `json:"accessUrls"`
-	RootCertificatePEMs []string `json:"pemCaCertificates"`
+// CertificatePoolConfig describes a single entry of the
+// server.certAuthority.pools list.
+type CertificatePoolConfig struct {
+	// Project is the ID of the project holding the CA pool.
+	Project string `mapstructure:"project"`
+	// Region is the location of the CA pool.
+	Region string `mapstructure:"region"`
+	// PoolName is the name of the CA pool.
+	PoolName string `mapstructure:"poolName"`
+	// Priority defines the order in which pools are used for issuance.
+	// Pools with a lower value are used first.
+	Priority int `mapstructure:"priority"`
+	// Origins is a list of CIDRs. If set, the pool only issues certificates
+	// for clients connecting from one of these networks.
+	Origins []string `mapstructure:"origins"`
 }
 
-// https://cloud.google.com/certificate-authority-service/docs/reference/rest/v1/projects.locations.caPools/fetchCaCerts#response-body
-type FetchCACertsResponse struct {
-	CACerts []struct {
-		Certificates []string `json:"certificates"`
-	} `json:"caCerts"`
+// NewCertificateAuthority creates the certificate authority backend
+// configured in server.certAuthority.backend.
+func NewCertificateAuthority() (certificates.Authority, error) {
+	return newCertificateAuthority("server.certAuthority", []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth})
 }
 
-// InitClientRootCA initializes the client root CA pool by fetching CA
-// certificates from Google Cloud's Certificate Authority service.
-// See https://cloud.google.com/certificate-authority-service/docs/reference/rest/v1/projects.locations.caPools/fetchCaCerts
-func InitClientRootCA(project, region, poolName string) ([]*x509.Certificate, *x509.CertPool, error) {
-	bearerToken, err := GetIdentityServerToken([]string{certificateAuthorityScope}, context.Background())
-	if err != nil {
-		return nil, nil, err
+// NewSPIFFECertificateAuthority creates the certificate authority backend
+// configured in server.spiffe.certAuthority.backend, which issues
+// X.509-SVIDs. If no backend is configured, nil is returned.
+func NewSPIFFECertificateAuthority() (certificates.Authority, error) {
+	if len(viper.GetString("server.spiffe.certAuthority.backend")) == 0 {
+		return nil, nil
 	}
-	url := fmt.Sprintf("https://privateca.googleapis.com/v1/projects/%s/locations/%s/caPools/%s:fetchCaCerts", project, region, poolName)
+	return newCertificateAuthority("server.spiffe.certAuthority", []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth})
+}
 
-	response, err := shared.HttpPOSTJson[FetchCACertsResponse](url, nil, map[string]string{
-		"Authorization": "Bearer " + bearerToken,
-	}, nil, 2, context.Background())
+// newCertificateAuthority creates the certificate authority backend
+// configured below the given key. The local backend issues certificates with
+// the given extended key usages, GCP CA pools define them in their issuance
+// policy.
+func newCertificateAuthority(key string, extKeyUsage []x509.ExtKeyUsage) (certificates.Authority, error) {
+	switch backend := viper.GetString(key + ".backend"); backend {
+	case "gcp":
+		poolConfigs := []CertificatePoolConfig{}
+		if err := viper.UnmarshalKey(key+".pools", &poolConfigs); err != nil {
+			return nil, errors.Join(err, fmt.Errorf("failed to parse %s.pools", key))
+		}
 
-	if err != nil {
-		return nil, nil, errors.Join(err, errors.New("failed to call fetchCaCerts"))
+		if len(poolConfigs) == 0 {
+			return newGCPAuthority(CertificatePoolConfig{
+				Project:  viper.GetString(key + ".project"),
+				Region:   viper.GetString(key + ".region"),
+				PoolName: viper.GetString(key + ".poolName"),
+			}), nil
+		}
+		return newGCPMultiAuthority(poolConfigs, viper.GetDuration(key+".poolTimeout"))
+
+	case "local":
+		return certificates.NewLocalAuthority(certificates.LocalAuthorityConfig{
+			CertificatePath: viper.GetString(key + ".local.certificate"),
+			KeyPath:         viper.GetString(key + ".local.key"),
+			StateDir:        viper.GetString(key + ".local.stateDir"),
+			CRLLifetime:     viper.GetDuration(key + ".local.crlLifetime"),
+			ExtKeyUsage:     extKeyUsage,
+		})
+
+	default:
+		return nil, fmt.Errorf("unknown certificate authority backend %q", backend)
 	}
+}
+
+// newGCPAuthority creates an authority for the given GCP CA pool.
+func newGCPAuthority(poolConfig CertificatePoolConfig) *certificates.GCPAuthority {
+	config := certificates.GCPCertificateAuthorityConfig{
+		ProjectID:       poolConfig.Project,
+		Location:        poolConfig.Region,
+		CertificatePool: poolConfig.PoolName,
+	}
+	return certificates.NewGCPAuthority(config, func(ctx context.Context) (string, error) {
+		return GetIdentityServerToken([]string{certificateAuthorityScope}, ctx)
+	})
+}
 
-	clientRootCAs := make([]*x509.Certificate, 0, len(response.CACerts))
-	clientRootCaPool := x509.NewCertPool()
-	for _, chain := range response.CACerts {
-		for _, pemData := range chain.Certificates {
-			// Decode the PEM block and parse the contained certificate (DER encoded)
-			for certData, remain := pem.Decode([]byte(pemData)); certData != nil; certData, remain = pem.Decode(remain) {
-				certificate, err := x509.ParseCertificate(certData.Bytes)
-				if err != nil {
-					log.Warn().Msgf("failed to parse CA cert: %s", err)
-					continue
-				}
-
-				clientRootCAs = append(clientRootCAs, certificate)
-				clientRootCaPool.AddCert(certificate)
+// newGCPMultiAuthority creates an authority using all given GCP CA pools.
+// poolTimeout is passed to certificates.NewMultiAuthority.
+func newGCPMultiAuthority(poolConfigs []CertificatePoolConfig, poolTimeout time.Duration) (*certificates.MultiAuthority, error) {
+	pools := make([]certificates.AuthorityPool, 0, len(poolConfigs))
+	for _, poolConfig := range poolConfigs {
+		name := fmt.Sprintf("%s/%s/%s", poolConfig.Project, poolConfig.Region, poolConfig.PoolName)
+
+		origins := make([]*net.IPNet, 0, len(poolConfig.Origins))
+		for _, cidr := range poolConfig.Origins {
+			_, network, err := net.ParseCIDR(cidr)
+			if err != nil {
+				return nil, errors.Join(err, fmt.Errorf("invalid origin of CA pool %s", name))
 			}
+			origins = append(origins, network)
 		}
-	}
 
-	if len(clientRootCAs) == 0 {
-		return nil, nil, errors.New("no CA certs found or all failed to parse")
+		pools = append(pools, certificates.AuthorityPool{
+			Name:      name,
+			Authority: newGCPAuthority(poolConfig),
+			Priority:  poolConfig.Priority,
+			Origins:   origins,
+		})
 	}
 
-	return clientRootCAs, clientRootCaPool, nil
+	return certificates.NewMultiAuthority(pools, poolTimeout)
 }
 
-// GetCertificateAuthority retrieves the certificate authority description from the given CA pool.
-// See https://cloud.google.com/certificate-authority-service/docs/reference/rest/v1/projects.locations.caPools.certificateAuthorities/get
-func GetCertificateAuthority(project, region, poolName, name string, ctx context.Context) (*CertificateAuthorityData, error) {
-	bearerToken, err := GetIdentityServerToken([]string{certificateAuthorityScope}, ctx)
-	if err != nil {
-		return nil, err
+// NewTrustCache creates the trust cache configured in
+// server.certAuthority.cacheDir. If no directory is configured, nil is
+// returned and nothing is cached.
+func NewTrustCache() (*certificates.TrustCache, error) {
+	cacheDir := viper.GetString("server.certAuthority.cacheDir")
+	if len(cacheDir) == 0 {
+		return nil, nil
 	}
-
-	url := fmt.Sprintf("https://privateca.googleapis.com/v1/projects/%s/locations/%s/caPools/%s/certificateAuthorities/%s",
-		project, region, poolName, name)
-
-	return shared.HttpGETJson[CertificateAuthorityData](url, nil, map[string]string{
-		"Authorization": "Bearer " + bearerToken,
-	}, nil, 2, ctx)
+	return certificates.NewTrustCache(cacheDir)
 }
 
-// GetRevokedCertificates retrieves the revoked certificates from all
-// certificate authorities in the given CA pool.
-// It returns a map of serial numbers of revoked certificates.
-// The keys of the map are the serial numbers, and the values are empty structs.
-func GetRevokedCertificates(project, region, poolName, name string, ctx context.Context) ([]x509.RevocationList, error) {
-	authority, err := GetCertificateAuthority(project, region, poolName, name, ctx)
+// InitClientRootCA initializes the client root CA pool by fetching the CA
+// certificates from the given certificate authority.
+// If cache is not nil, the fetched certificates are stored in it.
+// If only some authority pools could be reached, the certificates are
+// returned together with an error wrapping certificates.ErrPartialResult.
+// In this case the cached certificates are added and the cache is not
+// updated, so the certificates of the unavailable pools are kept.
+func InitClientRootCA(authority certificates.Authority, cache *certificates.TrustCache) ([]*x509.Certificate, *x509.CertPool, error) {
+	clientRootCAs, err := authority.RootCertificates(context.Background())
+	if errors.Is(err, certificates.ErrPartialResult) {
+		clientRootCAs = withCachedRootCertificates(clientRootCAs, cache)
+		return clientRootCAs, newCertPool(clientRootCAs), err
+	}
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
-	lists := make([]x509.RevocationList, 0)
-	processErrors := error(nil)
+	if len(clientRootCAs) == 0 {
+		return nil, nil, errors.New("no CA certs found or all failed to parse")
+	}
 
-	for _, crlURL := range authority.AccessURLs.RevocationLists {
-		rsp, err := shared.HttpGET(crlURL, nil, map[string]string{}, nil, 2, ctx)
-		if err != nil {
-			processErrors = errors.Join(processErrors, err)
-			continue
+	if cache != nil {
+		if err := cache.StoreRootCertificates(clientRootCAs); err != nil {
+			log.Warn().Err(err).Msg("Failed to cache client root CA")
 		}
+	}
 
-		body, _ := io.ReadAll(rsp.Body)
-		_ = rsp.Body.Close()
+	return clientRootCAs, newCertPool(clientRootCAs), nil
+}
 
-		if rsp.StatusCode != http.StatusOK {
-			err := fmt.Errorf("%d: %s", rsp.StatusCode, string(body))
-			processErrors = errors.Join(processErrors, err)
-			continue
-		}
+// LoadCachedClientRootCA initializes the client root CA pool from the
+// certificates stored in the given trust cache.
+func LoadCachedClientRootCA(cache *certificates.TrustCache) ([]*x509.Certificate, *x509.CertPool, error) {
+	if cache == nil {
+		return nil, nil, errors.New("no trust cache configured")
+	}
 
-		for pemBlock, remains := pem.Decode(body); pemBlock != nil; pemBlock, remains = pem.Decode(remains) {
-			if pemBlock.Type != "X509 CRL" {
-				processErrors = errors.Join(processErrors, fmt.Errorf("invalid PEM block type: %s", pemBlock.Type))
-				continue
-			}
-			crl, err := x509.ParseRevocationList(pemBlock.Bytes)
-			if err != nil || crl == nil {
-				processErrors = errors.Join(processErrors, err)
-				continue
-			}
+	clientRootCAs, err := cache.RootCertificates(time.Now())
+	if err != nil {
+		return nil, nil, err
+	}
 
-			lists = append(lists, *crl)
+	return clientRootCAs, newCertPool(clientRootCAs), nil
+}
+
+// withCachedRootCertificates adds the valid certificates stored in the given
+// trust cache to the given certificates, skipping known ones.
+func withCachedRootCertificates(certs []*x509.Certificate, cache *certificates.TrustCache) []*x509.Certificate {
+	if cache == nil {
+		return certs
+	}
+
+	cached, err := cache.RootCertificates(time.Now())
+	if err != nil {
+		log.Warn().Err(err).Msg("Failed to load cached client root CA")
+		return certs
+	}
+
+	merged := append([]*x509.Certificate{}, certs...)
+	for _, cert := range cached {
+		if !slices.ContainsFunc(merged, cert.Equal) {
+			merged = append(merged, cert)
 		}
 	}
+	return merged
+}
 
-	return lists, processErrors
+// newCertPool creates a certificate pool holding the given certificates.
+func newCertPool(certs []*x509.Certificate) *x509.CertPool {
+	pool := x509.NewCertPool()
+	for _, certificate := range certs {
+		pool.AddCert(certificate)
+	}
+	return pool
 }
@@ -1,15 +1,37 @@
 package main
 
 import (
+	"bytes"
 	"context"
 	"crypto/x509"
 	"encoding/hex"
+	"errors"
+	"fmt"
+	"identity-metadata-server/internal/certificates"
+	"slices"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/rs/zerolog/log"
 )
 
+// StaleCRLPolicy defines how the server behaves if the CRLs are past their
+// NextUpdate time plus a grace period.
+type StaleCRLPolicy string
+
+const (
+	// StaleCRLPolicyServe keeps accepting client certificates and logs a
+	// warning (fail-open).
+	StaleCRLPolicyServe = StaleCRLPolicy("serve")
+	// StaleCRLPolicyReject rejects client certificates with
+	// ErrorRevocationListStale (fail-closed).
+	StaleCRLPolicyReject = StaleCRLPolicy("reject")
+	// StaleCRLPolicyNotReady keeps accepting client certificates, but marks
+	// the server as not ready.
+	StaleCRLPolicyNotReady = StaleCRLPolicy("notReady")
+)
+
 // CertificateRevocationList manages a list of revoked certificates.
 // It can fetch the list of revoked certificates from a CA pool and check
 // if a given certificate is revoked.
@@ -17,14 +39,16 @@ import (
 type CertificateRevocationList struct {
 
 	// updateFunctionGuard is used to prevent multiple updates from happening at the same time.
-	// This mutex MUST only be used in the Update function to avoid deadlocks between the listGuard
+	// This mutex MUST only be used in the Update and LoadCached functions to avoid deadlocks between the listGuard
 	// and the updateFunctionGuard.
 	updateFunctionGuard *sync.Mutex
 
 	// listGuard is used to protect the revoked certificates map. Concurrent reads are
 	// allowed, but writes are exclusive. This is to allow multiple reads at the same time
 	// while still allowing updates to the map.
-	// A write lock on the listGuard MUST only be used in the Update function.
+	// A write lock on the listGuard MUST only be used in the Update,
+	// setRevocationLists and AddRevoked functions, and MUST NOT be held while acquiring the
+	// updateFunctionGuard.
 	listGuard *sync.RWMutex
 
 	// timer is used to refresh the revoked certificates after a certain interval.
@@ -38,60 +62,229 @@ type CertificateRevocationList struct {
 	// certificate in hex format. The value is an empty struct as we only test for existence.
 	revoked map[string]struct{}
 
-	// project, region, poolName and caName are used to identify the CA pool
-	// and the CA certificate authority. These values are used to fetch the revoked
-	// certificates from the CA pool.
-	project  string
-	region   string
-	poolName string
-	caName   string
-
-	// clientRootCAs contains the CA certificates this CRL is based on.
-	// This can be used for further verification of certificates in the CA pool.
-	clientRootCAs []*x509.Certificate
+	// lists contains the CRLs the revoked certificates were loaded from. It
+	// MUST only be used while holding the updateFunctionGuard.
+	lists []x509.RevocationList
+
+	// revokedByIssuer contains the serial numbers of revoked certificates per
+	// CA certificate that signed the CRL. The key is the issuerKey of the CA
+	// certificate. Serial numbers are only unique per issuer, so this is used
+	// to check certificates with a verified chain.
+	revokedByIssuer map[string]map[string]struct{}
+
+	// pending contains serial numbers that have been revoked through this
+	// server, but are not yet part of a published CRL. The value is the
+	// expiry date of the certificate, after which the entry is dropped.
+	pending map[string]time.Time
+
+	// lastUpdate, nextUpdate and lastError describe the state of the last
+	// call to Update. updateFailures counts the failed calls to Update since
+	// the last successful one. partialUpdate is set if the last call to
+	// Update only got the CRLs of some authority pools. They are protected by
+	// the listGuard.
+	lastUpdate     time.Time
+	nextUpdate     time.Time
+	lastError      error
+	updateFailures int
+	partialUpdate  bool
+
+	// crlThisUpdate and crlNextUpdate are the oldest ThisUpdate and NextUpdate
+	// times of the accepted CRLs. They are protected by the listGuard.
+	crlThisUpdate time.Time
+	crlNextUpdate time.Time
+
+	// nextUpdateByIssuer contains the oldest NextUpdate time of the accepted
+	// CRLs per issuerKey of the CA certificate that signed them. It is
+	// protected by the listGuard.
+	nextUpdateByIssuer map[string]time.Time
+
+	// stalePolicy and staleGracePeriod define the behavior once the CRLs are
+	// past crlNextUpdate. They are set by SetStalePolicy.
+	stalePolicy      StaleCRLPolicy
+	staleGracePeriod time.Duration
+
+	// staleWarned is set once a warning about stale CRLs has been logged, so
+	// the warning is not repeated on every request.
+	staleWarned atomic.Bool
+
+	// authority is used to fetch the CRLs.
+	authority certificates.Authority
+
+	// cache stores the last fetched CRLs on disk. If this is nil, CRLs are
+	// not cached.
+	cache *certificates.TrustCache
+
+	// trust contains the CA certificates this CRL is based on.
+	// This is used for further verification of certificates in the CA pool.
+	// The certificates can be replaced at runtime by calling SetClientRootCAs.
+	trust atomic.Pointer[clientTrust]
 
 	// maxUpdateInterval is the maximum duration after which the revoked certificates are refreshed.
 	// The interval is reset after each call to Update.
 	maxUpdateInterval time.Duration
+
+	// retryInterval is the duration after which a failed update is retried.
+	// If this is 0 or larger than maxUpdateInterval, maxUpdateInterval is used.
+	retryInterval time.Duration
 }
 
 // NewCertificateRevocationList creates a new CertificateRevocationList instance.
-// In order to initialise the list, the Update function must be called once.
-func NewCertificateRevocationList(clientRootCAs []*x509.Certificate, project, region, poolName, name string, updateInterval time.Duration) *CertificateRevocationList {
+// In order to initialise the list, the Update or LoadCached function must be
+// called once. Pass a nil cache to disable caching of fetched CRLs.
+func NewCertificateRevocationList(clientRootCAs []*x509.Certificate, authority certificates.Authority, cache *certificates.TrustCache, updateInterval, retryInterval time.Duration) *CertificateRevocationList {
 	crl := &CertificateRevocationList{
 		timer:               nil,
 		listGuard:           new(sync.RWMutex),
 		updateFunctionGuard: new(sync.Mutex),
 		revoked:             make(map[string]struct{}),
-		project:             project,
-		region:              region,
-		poolName:            poolName,
-		caName:              name,
+		revokedByIssuer:     make(map[string]map[string]struct{}),
+		pending:             make(map[string]time.Time),
+		nextUpdateByIssuer:  make(map[string]time.Time),
+		authority:           authority,
+		cache:               cache,
 		maxUpdateInterval:   updateInterval,
-		clientRootCAs:       clientRootCAs,
+		retryInterval:       retryInterval,
+		stalePolicy:         StaleCRLPolicyServe,
 		timerDone:           make(chan struct{}),
 	}
+	crl.trust.Store(newClientTrust(clientRootCAs))
 
 	return crl
 }
 
-// IsCertFromPool checks if the given certificate is from the CA pool stored
-// in the CertificateRevocationList.
-func (crl *CertificateRevocationList) IsCertFromPool(cert *x509.Certificate) bool {
+// ClientRootCAs returns the CA certificates currently used for verification.
+// This includes intermediate CA certificates.
+func (crl *CertificateRevocationList) ClientRootCAs() []*x509.Certificate {
+	return crl.trust.Load().certs
+}
+
+// Issuer returns the trusted CA certificate that signed the given
+// certificate or nil if the issuer is not known.
+func (crl *CertificateRevocationList) Issuer(cert *x509.Certificate) *x509.Certificate {
+	return crl.trust.Load().issuer(cert)
+}
+
+// SetClientRootCAs replaces the CA certificates used for verification.
+// Certificates and CRLs are checked against the new list right away. Call
+// Update afterwards to fetch the CRLs matching the new CA certificates.
+func (crl *CertificateRevocationList) SetClientRootCAs(clientRootCAs []*x509.Certificate) {
+	crl.trust.Store(newClientTrust(clientRootCAs))
+}
+
+// SetStalePolicy sets the behavior once the CRLs are older than their
+// NextUpdate time plus the given grace period.
+// This function is meant to be called once, before the server is started.
+func (crl *CertificateRevocationList) SetStalePolicy(policy StaleCRLPolicy, gracePeriod time.Duration) error {
+	switch policy {
+	case StaleCRLPolicyServe, StaleCRLPolicyReject, StaleCRLPolicyNotReady:
+	default:
+		return fmt.Errorf("unknown stale CRL policy %q", policy)
+	}
+
+	crl.stalePolicy = policy
+	crl.staleGracePeriod = gracePeriod
+	return nil
+}
+
+// IsStale returns true if the CRLs are past their NextUpdate time plus the
+// grace period at the given time. CRLs without a NextUpdate time never become
+// stale.
+func (crl *CertificateRevocationList) IsStale(now time.Time) bool {
+	crl.listGuard.RLock()
+	crlNextUpdate := crl.crlNextUpdate
+	crl.listGuard.RUnlock()
+
+	isStale := !crlNextUpdate.IsZero() && now.After(crlNextUpdate.Add(crl.staleGracePeriod))
+	if !isStale {
+		crl.staleWarned.Store(false)
+	} else if !crl.staleWarned.Swap(true) {
+		log.Warn().
+			Time("nextUpdate", crlNextUpdate).
+			Str("policy", string(crl.stalePolicy)).
+			Msg("Revoked certificate list is stale")
+	}
+	return isStale
+}
+
+// CheckFreshness returns ErrorRevocationListStale if the CRLs of a CA in
+// one of the given chains, as returned by VerifyChains, are stale at the given
+// time and the stale policy rejects client certificates. Certificates of CAs
+// with fresh CRLs are still accepted, so an unavailable authority pool does
+// not affect the certificates of other pools.
+func (crl *CertificateRevocationList) CheckFreshness(chains [][]*x509.Certificate, now time.Time) error {
+	if !crl.IsStale(now) || crl.stalePolicy != StaleCRLPolicyReject {
+		return nil
+	}
+
+	crl.listGuard.RLock()
+	defer crl.listGuard.RUnlock()
+
+	for _, chain := range chains {
+		for i := 1; i < len(chain); i++ {
+			nextUpdate, ok := crl.nextUpdateByIssuer[issuerKey(chain[i])]
+			if ok && now.After(nextUpdate.Add(crl.staleGracePeriod)) {
+				return ErrorRevocationListStale
+			}
+		}
+	}
+	return nil
+}
+
+// IsReady returns false if the CRLs are stale at the given time and the stale
+// policy marks the server as not ready.
+func (crl *CertificateRevocationList) IsReady(now time.Time) bool {
+	return crl.stalePolicy != StaleCRLPolicyNotReady || !crl.IsStale(now)
+}
+
+// VerifyChains builds all chains from the given certificate to one of the
+// CA certificates stored in the CertificateRevocationList. Intermediates sent
+// by the client are not used, so every CA in the chain has its CRLs loaded.
+// The certificate must be usable for client authentication. The returned
+// error is one of ErrorUnknownTrustRoot or ErrorCertificateUsage.
+func (crl *CertificateRevocationList) VerifyChains(cert *x509.Certificate) ([][]*x509.Certificate, error) {
 	if cert == nil {
-		return false
+		return nil, ErrorNoClientCert
+	}
+
+	chains, err := crl.trust.Load().verify(cert, time.Now())
+	if err != nil {
+		log.Debug().Err(err).Str("subject", cert.Subject.String()).Msg("Failed to verify certificate chain")
+		return nil, chainVerificationError(err)
 	}
+	return chains, nil
+}
 
-	for _, caCert := range crl.clientRootCAs {
-		if cert.CheckSignatureFrom(caCert) == nil {
+// IsChainRevoked checks if any certificate in one of the given chains, as
+// returned by VerifyChains, is revoked. Each certificate is checked against
+// the CRLs of its issuer only.
+func (crl *CertificateRevocationList) IsChainRevoked(chains [][]*x509.Certificate) bool {
+	crl.listGuard.RLock()
+	defer crl.listGuard.RUnlock()
+
+	for _, chain := range chains {
+		if len(chain) == 0 {
+			continue
+		}
+
+		// Revocations through this server are not bound to an issuer yet
+		if _, isPending := crl.pending[hex.EncodeToString(chain[0].SerialNumber.Bytes())]; isPending {
 			return true
 		}
+
+		for i := 0; i < len(chain)-1; i++ {
+			hexSerial := hex.EncodeToString(chain[i].SerialNumber.Bytes())
+			if _, isRevoked := crl.revokedByIssuer[issuerKey(chain[i+1])][hexSerial]; isRevoked {
+				return true
+			}
+		}
 	}
 	return false
 }
 
 // IsRevoked checks if the given certificate is revoked.
 // If the certificate is nil or has no serial number, it is considered revoked.
+// If no chain can be built for the certificate, the serial number is checked
+// against the CRLs of all issuers.
 func (crl *CertificateRevocationList) IsRevoked(cert *x509.Certificate) bool {
 	if cert == nil {
 		return true
@@ -101,8 +294,12 @@ func (crl *CertificateRevocationList) IsRevoked(cert *x509.Certificate) bool {
 		return true
 	}
 
-	hexSerial := hex.EncodeToString(cert.SerialNumber.Bytes())
-	return crl.IsSerialRevoked(hexSerial)
+	chains, err := crl.VerifyChains(cert)
+	if err != nil {
+		hexSerial := hex.EncodeToString(cert.SerialNumber.Bytes())
+		return crl.IsSerialRevoked(hexSerial)
+	}
+	return crl.IsChainRevoked(chains)
 }
 
 // IsSerialRevoked checks if the given serial number is revoked.
@@ -115,6 +312,72 @@ func (crl *CertificateRevocationList) IsSerialRevoked(hexSerial string) bool {
 	return isRevoked
 }
 
+// CertificateRevocationListStatus describes the state of a
+// CertificateRevocationList.
+type CertificateRevocationListStatus struct {
+	// Count is the number of revoked serials, including pending ones.
+	Count int `json:"count"`
+	// Pending is the number of serials revoked through this server, that are
+	// not yet part of a published CRL.
+	Pending int `json:"pending"`
+	// LastUpdate is the time of the last update that loaded CRLs.
+	LastUpdate time.Time `json:"lastUpdate"`
+	// NextUpdate is the time of the next scheduled update.
+	NextUpdate time.Time `json:"nextUpdate"`
+	// LastError is set if the last update failed.
+	LastError string `json:"lastError,omitempty"`
+	// Partial is true if the last update only got the CRLs of some
+	// authority pools. The last known CRLs of the other pools are kept and
+	// LastError contains their errors.
+	Partial bool `json:"partial"`
+	// UpdateFailures is the number of failed updates since the last
+	// successful one.
+	UpdateFailures int `json:"updateFailures"`
+	// CRLThisUpdate is the oldest ThisUpdate time of the loaded CRLs.
+	CRLThisUpdate time.Time `json:"crlThisUpdate"`
+	// CRLNextUpdate is the oldest NextUpdate time of the loaded CRLs.
+	CRLNextUpdate time.Time `json:"crlNextUpdate"`
+	// Stale is true if the CRLs are past CRLNextUpdate plus the grace period.
+	Stale bool `json:"stale"`
+}
+
+// Status returns the current state of the list.
+func (crl *CertificateRevocationList) Status() CertificateRevocationListStatus {
+	// IsStale acquires the listGuard on its own.
+	isStale := crl.IsStale(time.Now())
+
+	crl.listGuard.RLock()
+	defer crl.listGuard.RUnlock()
+
+	status := CertificateRevocationListStatus{
+		Count:          len(crl.revoked),
+		Pending:        len(crl.pending),
+		LastUpdate:     crl.lastUpdate,
+		NextUpdate:     crl.nextUpdate,
+		UpdateFailures: crl.updateFailures,
+		Partial:        crl.partialUpdate,
+		CRLThisUpdate:  crl.crlThisUpdate,
+		CRLNextUpdate:  crl.crlNextUpdate,
+		Stale:          isStale,
+	}
+	if crl.lastError != nil {
+		status.LastError = crl.lastError.Error()
+	}
+	return status
+}
+
+// AddRevoked marks the given serial number as revoked right away, without
+// waiting for the next CRL publication. The serial number is expected to be
+// in hex format. The entry is kept across updates until it is contained in a
+// fetched CRL or the certificate has expired.
+func (crl *CertificateRevocationList) AddRevoked(hexSerial string, notAfter time.Time) {
+	crl.listGuard.Lock()
+	defer crl.listGuard.Unlock()
+
+	crl.revoked[hexSerial] = struct{}{}
+	crl.pending[hexSerial] = notAfter
+}
+
 // StartUpdateTimer starts the timer to refresh the revoked certificates.
 func (crl *CertificateRevocationList) StartUpdateTimer() {
 	crl.updateFunctionGuard.Lock()
@@ -166,6 +429,9 @@ func (crl *CertificateRevocationList) StopUpdateTimer() {
 // certificates after a certain interval. The timer is stopped if it is
 // already running. The interval is determined by the CRL refresh interval
 // configured in the server settings.
+// If only some authority pools could be reached, their CRLs are applied
+// while the last known CRLs of the other pools are kept. The error of the
+// other pools is returned and the update is retried like a failed one.
 func (crl *CertificateRevocationList) Update(ctx context.Context) error {
 	crl.updateFunctionGuard.Lock()
 	defer crl.updateFunctionGuard.Unlock()
@@ -181,40 +447,154 @@ func (crl *CertificateRevocationList) Update(ctx context.Context) error {
 	// this is intended so that the deferred function uses the correct time for
 	// the next update
 	nextInvocation := time.Now().Add(crl.maxUpdateInterval)
+	var err error
 	defer func() {
 		log.Info().Time("nextUpdate", nextInvocation).Msg("Setting timer for next revoked certificate update")
 		if crl.timer != nil {
 			crl.timer.Reset(time.Until(nextInvocation))
 		}
+
+		crl.listGuard.Lock()
+		defer crl.listGuard.Unlock()
+		crl.nextUpdate = nextInvocation
+		crl.lastError = err
+		crl.partialUpdate = errors.Is(err, certificates.ErrPartialResult)
+		if err != nil {
+			crl.updateFailures++
+		}
+		if err == nil || crl.partialUpdate {
+			crl.lastUpdate = time.Now()
+		}
+		if err == nil {
+			crl.updateFailures = 0
+		}
 	}()
 
 	log.Info().Msg("Updating revoked certificate list")
 
-	// Get the revoked certificates from the CA pool
-	crls, err := GetRevokedCertificates(crl.project, crl.region, crl.poolName, crl.caName, ctx)
+	// Get the revoked certificates from the certificate authority
+	crls, err := crl.authority.RevocationLists(ctx)
+	if err != nil {
+		if crl.retryInterval > 0 && crl.retryInterval < crl.maxUpdateInterval {
+			nextInvocation = time.Now().Add(crl.retryInterval)
+		}
+		if !errors.Is(err, certificates.ErrPartialResult) {
+			return err
+		}
+
+		log.Warn().Err(err).Msg("Some revocation lists could not be fetched. Keeping the last known ones")
+		crls = crl.withKnownRevocationLists(crls)
+	}
+
+	if crl.cache != nil {
+		if cacheErr := crl.cache.StoreRevocationLists(crls); cacheErr != nil {
+			log.Warn().Err(cacheErr).Msg("Failed to cache revocation lists")
+		}
+	}
+
+	nextInvocation = crl.setRevocationLists(crls, nextInvocation)
+	return err
+}
+
+// withKnownRevocationLists adds the currently loaded or cached CRLs of all
+// issuers not covered by the given CRLs. This keeps the CRLs of authority
+// pools that could not be reached.
+// The caller MUST hold the updateFunctionGuard.
+func (crl *CertificateRevocationList) withKnownRevocationLists(crls []x509.RevocationList) []x509.RevocationList {
+	known := crl.lists
+	if crl.cache != nil {
+		cached, err := crl.cache.RevocationLists(crl.ClientRootCAs())
+		if err != nil {
+			log.Warn().Err(err).Msg("Failed to load cached revocation lists")
+		}
+		known = append(append([]x509.RevocationList{}, known...), cached...)
+	}
+
+	merged := append([]x509.RevocationList{}, crls...)
+	for _, list := range known {
+		isCovered := slices.ContainsFunc(merged, func(other x509.RevocationList) bool {
+			return bytes.Equal(list.RawIssuer, other.RawIssuer) && bytes.Equal(list.AuthorityKeyId, other.AuthorityKeyId)
+		})
+		if !isCovered {
+			merged = append(merged, list)
+		}
+	}
+	return merged
+}
+
+// LoadCached replaces the revoked certificates with the CRLs stored in the
+// trust cache. Only CRLs signed by the current client root CAs are used.
+// This is meant to be used if Update fails, e.g. because the certificate
+// authority cannot be reached.
+func (crl *CertificateRevocationList) LoadCached() error {
+	crl.updateFunctionGuard.Lock()
+	defer crl.updateFunctionGuard.Unlock()
+
+	if crl.cache == nil {
+		return errors.New("no trust cache configured")
+	}
+
+	crls, err := crl.cache.RevocationLists(crl.ClientRootCAs())
 	if err != nil {
 		return err
 	}
+	if len(crls) == 0 {
+		return errors.New("no cached revocation lists signed by the client root CAs")
+	}
 
+	log.Warn().Msg("Using cached revocation lists")
+	crl.setRevocationLists(crls, time.Now().Add(crl.maxUpdateInterval))
+	return nil
+}
+
+// setRevocationLists replaces the revoked certificates with the ones
+// contained in the given CRLs. CRLs not signed by one of the client root CAs
+// are ignored. The given nextInvocation is returned, adjusted to the earliest
+// next update time of the CRLs.
+// The caller MUST hold the updateFunctionGuard.
+func (crl *CertificateRevocationList) setRevocationLists(crls []x509.RevocationList, nextInvocation time.Time) time.Time {
 	// Use a temporary map so we can still use the old revoked certificates
 	// while we are reading the new ones.
 	revokedCertificates := make(map[string]struct{})
+	revokedByIssuer := make(map[string]map[string]struct{})
+	trust := crl.trust.Load()
+
+	// Track the oldest accepted CRL, as this is the first to become stale.
+	var crlThisUpdate, crlNextUpdate time.Time
+	nextUpdateByIssuer := make(map[string]time.Time)
+	accepted := make([]x509.RevocationList, 0, len(crls))
 
 	for _, list := range crls {
 
-		// We only accept CRLs that are signed by the client root CAs
+		// We only accept CRLs that are signed by the client CAs
 		// This is to prevent CRLs from other CAs from being accepted
-		validRoot := false
-		for _, caCert := range crl.clientRootCAs {
-			if list.CheckSignatureFrom(caCert) == nil {
-				validRoot = true
-				break
+		issuers := trust.issuers(&list)
+		if len(issuers) == 0 {
+			log.Error().Str("issuer", list.Issuer.String()).Msg("CRL is not signed by any of the client CAs")
+			continue
+		}
+
+		accepted = append(accepted, list)
+
+		// A CRL only covers certificates of the CA that signed it
+		issuerSerials := make([]map[string]struct{}, 0, len(issuers))
+		for _, issuer := range issuers {
+			key := issuerKey(issuer)
+			if _, ok := revokedByIssuer[key]; !ok {
+				revokedByIssuer[key] = make(map[string]struct{})
+			}
+			issuerSerials = append(issuerSerials, revokedByIssuer[key])
+
+			if nextUpdate, ok := nextUpdateByIssuer[key]; !list.NextUpdate.IsZero() && (!ok || list.NextUpdate.Before(nextUpdate)) {
+				nextUpdateByIssuer[key] = list.NextUpdate
 			}
 		}
 
-		if !validRoot {
-			log.Error().Msg("CRL is not signed by any of the client root CAs")
-			continue
+		if crlThisUpdate.IsZero() || list.ThisUpdate.Before(crlThisUpdate) {
+			crlThisUpdate = list.ThisUpdate
+		}
+		if !list.NextUpdate.IsZero() && (crlNextUpdate.IsZero() || list.NextUpdate.Before(crlNextUpdate)) {
+			crlNextUpdate = list.NextUpdate
 		}
 
 		// Make sure we adhere to the CRL next update time
@@ -232,18 +612,37 @@ func (crl *CertificateRevocationList) Update(ctx context.Context) error {
 			}
 			hexSerial := hex.EncodeToString(revokedCert.SerialNumber.Bytes())
 			revokedCertificates[hexSerial] = struct{}{}
+			for _, serials := range issuerSerials {
+				serials[hexSerial] = struct{}{}
+			}
 		}
 	}
 
-	// Attention: The write lock MUST only be used in this function.
-	// If a write lock is used somewhere else, you will likely create a deadlock because
-	// of the timerLock being active here.
+	// Attention: The write lock MUST only be used here, in Update and in AddRevoked.
+	// If a write lock is held while acquiring the updateFunctionGuard, you will
+	// likely create a deadlock because of the timerLock being active here.
 
 	crl.listGuard.Lock()
 	defer crl.listGuard.Unlock()
 
-	log.Info().Int("count", len(revokedCertificates)).Msg("Updated revoked certificate list")
+	// Keep local revocations until they have been published
+	now := time.Now()
+	for hexSerial, notAfter := range crl.pending {
+		_, isPublished := revokedCertificates[hexSerial]
+		if isPublished || now.After(notAfter) {
+			delete(crl.pending, hexSerial)
+			continue
+		}
+		revokedCertificates[hexSerial] = struct{}{}
+	}
+
+	log.Info().Int("count", len(revokedCertificates)).Int("pending", len(crl.pending)).Msg("Updated revoked certificate list")
 	crl.revoked = revokedCertificates
+	crl.revokedByIssuer = revokedByIssuer
+	crl.crlThisUpdate = crlThisUpdate
+	crl.crlNextUpdate = crlNextUpdate
+	crl.nextUpdateByIssuer = nextUpdateByIssuer
+	crl.lists = accepted
 
-	return nil
+	return nextInvocation
 }
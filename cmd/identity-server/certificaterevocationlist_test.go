@@ -0,0 +1,310 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"identity-metadata-server/internal/certificates"
+	"math/big"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// crlTestAuthority is a testAuthority publishing a fixed set of CRLs.
+// If err is set, fetching the CRLs fails.
+type crlTestAuthority struct {
+	*testAuthority
+	crls []x509.RevocationList
+	err  error
+}
+
+func (a *crlTestAuthority) RevocationLists(ctx context.Context) ([]x509.RevocationList, error) {
+	return a.crls, a.err
+}
+
+// newTestCRL creates a CA and a CRL signed by it, revoking the given serials.
+func newTestCRL(t *testing.T, thisUpdate, nextUpdate time.Time, serials ...int64) (*x509.Certificate, x509.RevocationList) {
+	ca := newTestCA(t, "test-ca", nil)
+	return ca.cert, ca.revocationList(t, thisUpdate, nextUpdate, serials...)
+}
+
+func TestCertificateRevocationListFreshness(t *testing.T) {
+	assert := assert.New(t)
+	now := time.Now()
+
+	ca := newTestCA(t, "test-ca", nil)
+	list := ca.revocationList(t, now.Add(-2*time.Hour), now.Add(-time.Hour), 42)
+	authority := &crlTestAuthority{testAuthority: newTestAuthority(), crls: []x509.RevocationList{list}}
+
+	crl := NewCertificateRevocationList([]*x509.Certificate{ca.cert}, authority, nil, time.Hour, time.Minute)
+	assert.Error(crl.SetStalePolicy("unknown", 0))
+	assert.NoError(crl.SetStalePolicy(StaleCRLPolicyReject, 30*time.Minute))
+
+	chains, err := crl.VerifyChains(ca.issue(t, 7, x509.ExtKeyUsageClientAuth))
+	assert.NoError(err)
+
+	// Nothing loaded yet, so nothing can be stale
+	assert.False(crl.IsStale(now))
+	assert.NoError(crl.CheckFreshness(chains, now))
+
+	assert.NoError(crl.Update(context.Background()))
+	assert.True(crl.IsSerialRevoked("2a"))
+
+	status := crl.Status()
+	assert.Equal(1, status.Count)
+	assert.True(status.Stale)
+	assert.Equal(list.NextUpdate.Unix(), status.CRLNextUpdate.Unix())
+	assert.Equal(list.ThisUpdate.Unix(), status.CRLThisUpdate.Unix())
+
+	// Within the grace period
+	assert.False(crl.IsStale(now.Add(-45 * time.Minute)))
+
+	assert.ErrorIs(crl.CheckFreshness(chains, now), ErrorRevocationListStale)
+	assert.True(crl.IsReady(now))
+
+	assert.NoError(crl.SetStalePolicy(StaleCRLPolicyNotReady, 30*time.Minute))
+	assert.NoError(crl.CheckFreshness(chains, now))
+	assert.False(crl.IsReady(now))
+
+	assert.NoError(crl.SetStalePolicy(StaleCRLPolicyServe, 30*time.Minute))
+	assert.NoError(crl.CheckFreshness(chains, now))
+	assert.True(crl.IsReady(now))
+}
+
+func TestCertificateRevocationListPartialUpdate(t *testing.T) {
+	assert := assert.New(t)
+	now := time.Now()
+
+	available := newTestCA(t, "available-ca", nil)
+	unavailable := newTestCA(t, "unavailable-ca", nil)
+	authority := &crlTestAuthority{testAuthority: newTestAuthority(), crls: []x509.RevocationList{
+		available.revocationList(t, now.Add(-time.Hour), now.Add(time.Hour), 1),
+		unavailable.revocationList(t, now.Add(-time.Hour), now.Add(time.Hour), 2),
+	}}
+
+	crl := NewCertificateRevocationList([]*x509.Certificate{available.cert, unavailable.cert}, authority, nil, time.Hour, time.Minute)
+	assert.NoError(crl.SetStalePolicy(StaleCRLPolicyReject, 0))
+	assert.NoError(crl.Update(context.Background()))
+
+	// The CRLs of the reachable pool are applied, the last known CRLs of the
+	// other pool are kept and its error is reported.
+	authority.crls = []x509.RevocationList{
+		available.revocationList(t, now.Add(-time.Hour), now.Add(time.Hour), 1, 3),
+	}
+	authority.err = errors.Join(certificates.ErrPartialResult, errors.New("unavailable: unreachable"))
+	assert.ErrorIs(crl.Update(context.Background()), certificates.ErrPartialResult)
+
+	assert.True(crl.IsRevoked(available.issue(t, 3, x509.ExtKeyUsageClientAuth)))
+	assert.True(crl.IsRevoked(unavailable.issue(t, 2, x509.ExtKeyUsageClientAuth)))
+
+	status := crl.Status()
+	assert.True(status.Partial)
+	assert.Contains(status.LastError, "unreachable")
+	assert.Equal(1, status.UpdateFailures)
+	assert.False(status.LastUpdate.IsZero())
+	assert.WithinDuration(now.Add(time.Minute), status.NextUpdate, 10*time.Second)
+
+	// Once the kept CRLs are stale, only certificates of their CA are rejected
+	later := now.Add(2 * time.Hour)
+	authority.crls = []x509.RevocationList{
+		available.revocationList(t, now.Add(-time.Hour), later.Add(time.Hour), 1, 3),
+	}
+	assert.ErrorIs(crl.Update(context.Background()), certificates.ErrPartialResult)
+
+	availableChains, err := crl.VerifyChains(available.issue(t, 4, x509.ExtKeyUsageClientAuth))
+	assert.NoError(err)
+	unavailableChains, err := crl.VerifyChains(unavailable.issue(t, 4, x509.ExtKeyUsageClientAuth))
+	assert.NoError(err)
+
+	assert.True(crl.IsStale(later))
+	assert.NoError(crl.CheckFreshness(availableChains, later))
+	assert.ErrorIs(crl.CheckFreshness(unavailableChains, later), ErrorRevocationListStale)
+
+	// A complete update clears the error
+	authority.err = nil
+	assert.NoError(crl.Update(context.Background()))
+
+	status = crl.Status()
+	assert.False(status.Partial)
+	assert.Empty(status.LastError)
+	assert.Equal(0, status.UpdateFailures)
+}
+
+func TestCertificateRevocationListUpdateFailures(t *testing.T) {
+	assert := assert.New(t)
+	now := time.Now()
+
+	ca, list := newTestCRL(t, now, now.Add(time.Hour))
+	authority := &crlTestAuthority{testAuthority: newTestAuthority(), err: errors.New("unreachable")}
+	crl := NewCertificateRevocationList([]*x509.Certificate{ca}, authority, nil, time.Hour, time.Minute)
+
+	assert.Error(crl.Update(context.Background()))
+	assert.Error(crl.Update(context.Background()))
+
+	status := crl.Status()
+	assert.Equal(2, status.UpdateFailures)
+	assert.NotEmpty(status.LastError)
+	assert.True(status.LastUpdate.IsZero())
+	assert.WithinDuration(now.Add(time.Minute), status.NextUpdate, 10*time.Second)
+
+	authority.crls = []x509.RevocationList{list}
+	authority.err = nil
+	assert.NoError(crl.Update(context.Background()))
+
+	status = crl.Status()
+	assert.Equal(0, status.UpdateFailures)
+	assert.Empty(status.LastError)
+	assert.False(status.LastUpdate.IsZero())
+	assert.False(status.Stale)
+}
+
+// testCA is a CA certificate with its key, used to build certificate chains.
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+}
+
+// newTestCA creates a CA certificate valid for the next hour. If parent is
+// nil, the certificate is self-signed.
+func newTestCA(t *testing.T, name string, parent *testCA) *testCA {
+	return newTestCAValidity(t, name, parent, time.Now().Add(-time.Hour), time.Now().Add(time.Hour))
+}
+
+// newTestCAValidity works like newTestCA, but the CA certificate is valid
+// between the given times.
+func newTestCAValidity(t *testing.T, name string, parent *testCA, notBefore, notAfter time.Time) *testCA {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             notBefore,
+		NotAfter:              notAfter,
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+	}
+
+	signer := &testCA{cert: template, key: key}
+	if parent != nil {
+		signer = parent
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, signer.cert, &key.PublicKey, signer.key)
+	assert.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	assert.NoError(t, err)
+
+	return &testCA{cert: cert, key: key}
+}
+
+// issue creates a client certificate with the given serial and usages.
+func (ca *testCA) issue(t *testing.T, serial int64, usages ...x509.ExtKeyUsage) *x509.Certificate {
+	return ca.sign(t, &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: "host.example.com"},
+		NotBefore:    time.Now().Add(-time.Minute),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  usages,
+	})
+}
+
+// issueClient creates a client certificate for the given hostname with the
+// identity test@example.com, usable from testClientOrigin.
+func (ca *testCA) issueClient(t *testing.T, hostname string, serial int64) *x509.Certificate {
+	template := CreateDummyCertificate(hostname, "test@example.com", []net.IP{net.ParseIP(testClientOrigin)})
+	template.SerialNumber = big.NewInt(serial)
+	template.NotBefore = time.Now().Add(-time.Minute)
+	template.NotAfter = time.Now().Add(time.Hour)
+	return ca.sign(t, template)
+}
+
+// sign creates a certificate for a new key from the given template, signed
+// by the CA.
+func (ca *testCA) sign(t *testing.T, template *x509.Certificate) *x509.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	assert.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	assert.NoError(t, err)
+	return cert
+}
+
+// revocationList creates a CRL signed by the CA revoking the given serials.
+func (ca *testCA) revocationList(t *testing.T, thisUpdate, nextUpdate time.Time, serials ...int64) x509.RevocationList {
+	entries := make([]x509.RevocationListEntry, 0, len(serials))
+	for _, serial := range serials {
+		entries = append(entries, x509.RevocationListEntry{SerialNumber: big.NewInt(serial), RevocationTime: thisUpdate})
+	}
+
+	der, err := x509.CreateRevocationList(rand.Reader, &x509.RevocationList{
+		Number:                    big.NewInt(1),
+		ThisUpdate:                thisUpdate,
+		NextUpdate:                nextUpdate,
+		RevokedCertificateEntries: entries,
+	}, ca.cert, ca.key)
+	assert.NoError(t, err)
+	list, err := x509.ParseRevocationList(der)
+	assert.NoError(t, err)
+	return *list
+}
+
+func TestCertificateRevocationListChains(t *testing.T) {
+	assert := assert.New(t)
+
+	root := newTestCA(t, "root", nil)
+	intermediate := newTestCA(t, "intermediate", root)
+	secondRoot := newTestCA(t, "second-root", nil)
+
+	// The same serial issued by two different CAs
+	viaIntermediate := intermediate.issue(t, 7, x509.ExtKeyUsageClientAuth)
+	viaSecondRoot := secondRoot.issue(t, 7, x509.ExtKeyUsageClientAuth)
+	serverOnly := root.issue(t, 8, x509.ExtKeyUsageServerAuth)
+	unknown := newTestCA(t, "unknown", nil).issue(t, 9, x509.ExtKeyUsageClientAuth)
+
+	authority := &crlTestAuthority{
+		testAuthority: newTestAuthority(),
+		crls: []x509.RevocationList{
+			intermediate.revocationList(t, time.Now(), time.Now().Add(time.Hour), 7),
+			secondRoot.revocationList(t, time.Now(), time.Now().Add(time.Hour)),
+		},
+	}
+
+	// Only the roots are known. The CRL of the intermediate is not loaded, so
+	// certificates it issued are rejected.
+	crl := NewCertificateRevocationList([]*x509.Certificate{root.cert, secondRoot.cert}, authority, nil, time.Hour, 0)
+	assert.NoError(crl.Update(context.Background()))
+
+	_, err := crl.VerifyChains(viaIntermediate)
+	assert.ErrorIs(err, ErrorUnknownTrustRoot)
+
+	_, err = crl.VerifyChains(serverOnly)
+	assert.ErrorIs(err, ErrorCertificateUsage)
+
+	_, err = crl.VerifyChains(unknown)
+	assert.ErrorIs(err, ErrorUnknownTrustRoot)
+
+	crl.SetClientRootCAs([]*x509.Certificate{root.cert, intermediate.cert, secondRoot.cert})
+	assert.NoError(crl.Update(context.Background()))
+
+	chains, err := crl.VerifyChains(viaIntermediate)
+	assert.NoError(err)
+	assert.Len(chains[0], 3)
+	assert.True(crl.IsChainRevoked(chains))
+	assert.True(crl.IsRevoked(viaIntermediate))
+
+	// Serial 7 is only revoked by the intermediate
+	assert.False(crl.IsRevoked(viaSecondRoot))
+	assert.True(crl.IsSerialRevoked("07"))
+}
@@ -0,0 +1,270 @@
+package main
+
+import (
+	"bytes"
+	"encoding/asn1"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"text/template"
+
+	"identity-metadata-server/pkg/identitytoken"
+
+	"github.com/rs/zerolog/log"
+	"github.com/spf13/viper"
+)
+
+// ClaimTemplateConfig describes a single additional claim.
+// Value is a text/template that is executed with claimTemplateData.
+type ClaimTemplateConfig struct {
+	Name  string `mapstructure:"name"`
+	Value string `mapstructure:"value"`
+}
+
+// claimTemplate is a parsed ClaimTemplateConfig.
+type claimTemplate struct {
+	name     string
+	template *template.Template
+}
+
+// ClaimMapping derives the token subject and additional claims from the
+// client certificate and the request origin.
+type ClaimMapping struct {
+	// subject is used to generate the `sub` claim. If nil, the hostname
+	// of the client is used.
+	subject *template.Template
+	// extra holds templates for additional top-level claims.
+	extra []claimTemplate
+}
+
+// claimTemplateSubject exposes the subject of the client certificate.
+type claimTemplateSubject struct {
+	CommonName         string
+	Organization       []string
+	OrganizationalUnit []string
+	Locality           []string
+	Province           []string
+	Country            []string
+}
+
+// claimTemplateData is passed to all claim templates.
+type claimTemplateData struct {
+	// Host is the hostname of the client, i.e. the certificate Common Name.
+	Host string
+	// Identity is the service account bound to the client.
+	Identity string
+	// Subject holds the subject fields of the client certificate.
+	Subject claimTemplateSubject
+	// URIs holds the URI SANs of the client certificate.
+	URIs []string
+	// DNSNames holds the DNS SANs of the client certificate.
+	DNSNames []string
+	// OriginIP is the IP address the request was sent from.
+	OriginIP string
+	// extensions maps extension OIDs (dot notation) to raw extension values.
+	extensions map[string][]byte
+}
+
+// Extension returns the value of the certificate extension with the given
+// OID in dot notation. String values are returned as is, all other values
+// are returned hex encoded. If the extension does not exist, an empty string
+// is returned.
+func (d claimTemplateData) Extension(oid string) string {
+	value, exists := d.extensions[oid]
+	if !exists {
+		return ""
+	}
+
+	var stringValue string
+	if rest, err := asn1.Unmarshal(value, &stringValue); err == nil && len(rest) == 0 {
+		return stringValue
+	}
+	return hex.EncodeToString(value)
+}
+
+// claimTemplateFuncs are available in all claim templates.
+var claimTemplateFuncs = template.FuncMap{
+	"first": func(values []string) string {
+		if len(values) == 0 {
+			return ""
+		}
+		return values[0]
+	},
+	"join":       strings.Join,
+	"lower":      strings.ToLower,
+	"upper":      strings.ToUpper,
+	"trimPrefix": func(prefix, value string) string { return strings.TrimPrefix(value, prefix) },
+	"trimSuffix": func(suffix, value string) string { return strings.TrimSuffix(value, suffix) },
+	"replace":    func(old, new, value string) string { return strings.ReplaceAll(value, old, new) },
+}
+
+var (
+	// claimMapping holds the currently active claim mapping.
+	// If no mapping is loaded, only the default claims are generated.
+	claimMapping atomic.Pointer[ClaimMapping]
+)
+
+// parseClaimTemplate parses a single claim template.
+func parseClaimTemplate(name, value string) (*template.Template, error) {
+	return template.New(name).
+		Funcs(claimTemplateFuncs).
+		Option("missingkey=zero").
+		Parse(value)
+}
+
+// NewClaimMapping parses the given subject template and claim templates.
+// If subjectTemplate is empty, the hostname is used as subject.
+func NewClaimMapping(subjectTemplate string, extra []ClaimTemplateConfig) (*ClaimMapping, error) {
+	mapping := ClaimMapping{
+		extra: make([]claimTemplate, 0, len(extra)),
+	}
+
+	if len(subjectTemplate) > 0 {
+		tmpl, err := parseClaimTemplate("sub", subjectTemplate)
+		if err != nil {
+			return nil, errors.Join(err, errors.New("failed to parse subject template"))
+		}
+		mapping.subject = tmpl
+	}
+
+	for _, claim := range extra {
+		switch {
+		case len(claim.Name) == 0:
+			return nil, errors.New("claim template without name")
+		case slices.Contains(identitytoken.ReservedClaims, claim.Name):
+			return nil, fmt.Errorf("claim %s is reserved", claim.Name)
+		case slices.ContainsFunc(mapping.extra, func(t claimTemplate) bool { return t.name == claim.Name }):
+			return nil, fmt.Errorf("claim %s is defined more than once", claim.Name)
+		}
+
+		tmpl, err := parseClaimTemplate(claim.Name, claim.Value)
+		if err != nil {
+			return nil, errors.Join(err, fmt.Errorf("failed to parse template for claim %s", claim.Name))
+		}
+		mapping.extra = append(mapping.extra, claimTemplate{
+			name:     claim.Name,
+			template: tmpl,
+		})
+	}
+
+	return &mapping, nil
+}
+
+// newClaimTemplateData collects all values available to claim templates.
+func newClaimTemplateData(client *IdentityClient, origin net.IP) claimTemplateData {
+	data := claimTemplateData{
+		Host:       client.Host,
+		Identity:   client.Identity,
+		extensions: map[string][]byte{},
+	}
+
+	if origin != nil {
+		data.OriginIP = origin.String()
+	}
+
+	if cert := client.Certificate; cert != nil {
+		data.Subject = claimTemplateSubject{
+			CommonName:         cert.Subject.CommonName,
+			Organization:       cert.Subject.Organization,
+			OrganizationalUnit: cert.Subject.OrganizationalUnit,
+			Locality:           cert.Subject.Locality,
+			Province:           cert.Subject.Province,
+			Country:            cert.Subject.Country,
+		}
+		data.DNSNames = cert.DNSNames
+
+		for _, uri := range cert.URIs {
+			data.URIs = append(data.URIs, uri.String())
+		}
+		for _, ext := range cert.Extensions {
+			data.extensions[ext.Id.String()] = ext.Value
+		}
+	}
+
+	return data
+}
+
+// Names returns the names of all additional claims.
+func (m *ClaimMapping) Names() []string {
+	if m == nil {
+		return nil
+	}
+
+	names := make([]string, 0, len(m.extra))
+	for _, claim := range m.extra {
+		names = append(names, claim.name)
+	}
+	return names
+}
+
+// Apply executes all templates for the given client and origin.
+// It returns the subject of the token and all additional claims. Claims
+// that evaluate to an empty string are omitted.
+func (m *ClaimMapping) Apply(client *IdentityClient, origin net.IP) (string, map[string]any, error) {
+	if m == nil {
+		return client.Host, nil, nil
+	}
+
+	data := newClaimTemplateData(client, origin)
+	execute := func(tmpl *template.Template) (string, error) {
+		buffer := bytes.Buffer{}
+		if err := tmpl.Execute(&buffer, data); err != nil {
+			return "", errors.Join(err, fmt.Errorf("failed to execute template for claim %s", tmpl.Name()))
+		}
+		return buffer.String(), nil
+	}
+
+	subject := client.Host
+	if m.subject != nil {
+		var err error
+		if subject, err = execute(m.subject); err != nil {
+			return "", nil, err
+		}
+		if len(subject) == 0 {
+			return "", nil, errors.New("subject template evaluated to an empty string")
+		}
+	}
+
+	claims := make(map[string]any, len(m.extra))
+	for _, claim := range m.extra {
+		value, err := execute(claim.template)
+		if err != nil {
+			return "", nil, err
+		}
+		if len(value) > 0 {
+			claims[claim.name] = value
+		}
+	}
+
+	return subject, claims, nil
+}
+
+// initClaimMapping parses the claim templates configured in server.claims.
+// Calling this function will atomically replace the active mapping, hence it
+// can also be used to reload the mapping. If parsing fails, the previously
+// loaded mapping is kept.
+func initClaimMapping() error {
+	extra := []ClaimTemplateConfig{}
+	if err := viper.UnmarshalKey("server.claims.extra", &extra); err != nil {
+		return errors.Join(err, errors.New("failed to parse server.claims.extra"))
+	}
+
+	subjectTemplate := viper.GetString("server.claims.subject")
+	if len(subjectTemplate) == 0 && len(extra) == 0 {
+		claimMapping.Store(nil)
+		return nil
+	}
+
+	mapping, err := NewClaimMapping(subjectTemplate, extra)
+	if err != nil {
+		return err
+	}
+
+	log.Info().Strs("claims", mapping.Names()).Msg("Loaded claim mapping")
+	claimMapping.Store(mapping)
+	return nil
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/json"
+	"net"
+	"net/url"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestClaimClient(t *testing.T) *IdentityClient {
+	cert := CreateDummyCertificate("host.prod.example.com", "test@example.com", []net.IP{net.ParseIP("10.0.0.1")})
+	cert.Subject.OrganizationalUnit = []string{"prod"}
+	cert.Subject.Locality = []string{"dus1"}
+
+	roleURI, err := url.Parse("spiffe://example.com/role/web")
+	assert.NoError(t, err)
+	cert.URIs = []*url.URL{roleURI}
+
+	roleValue, err := asn1.Marshal("frontend")
+	assert.NoError(t, err)
+	cert.Extensions = []pkix.Extension{{
+		Id:    asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 99999, 1},
+		Value: roleValue,
+	}}
+
+	client, err := NewClientFromCert(cert)
+	assert.NoError(t, err)
+	return client
+}
+
+func TestClaimMappingApply(t *testing.T) {
+	assert := assert.New(t)
+	client := newTestClaimClient(t)
+
+	mapping, err := NewClaimMapping("{{ .Host }}/{{ first .Subject.Locality }}", []ClaimTemplateConfig{
+		{Name: "env", Value: "{{ first .Subject.OrganizationalUnit }}"},
+		{Name: "role", Value: `{{ .Extension "1.3.6.1.4.1.99999.1" }}`},
+		{Name: "workload", Value: `{{ first .URIs | trimPrefix "spiffe://example.com/role/" }}`},
+		{Name: "origin", Value: "{{ .OriginIP }}"},
+		{Name: "team", Value: `{{ .Extension "1.2.3.4" }}`},
+	})
+	assert.NoError(err)
+	assert.Equal([]string{"env", "role", "workload", "origin", "team"}, mapping.Names())
+
+	subject, claims, err := mapping.Apply(client, net.ParseIP("10.0.0.1"))
+	assert.NoError(err)
+	assert.Equal("host.prod.example.com/dus1", subject)
+	assert.Equal(map[string]any{
+		"env":      "prod",
+		"role":     "frontend",
+		"workload": "web",
+		"origin":   "10.0.0.1",
+	}, claims)
+
+	// Without a mapping, the hostname is used as subject
+	subject, claims, err = (*ClaimMapping)(nil).Apply(client, nil)
+	assert.NoError(err)
+	assert.Equal(client.Host, subject)
+	assert.Nil(claims)
+}
+
+func TestClaimMappingValidation(t *testing.T) {
+	assert := assert.New(t)
+
+	_, err := NewClaimMapping("", []ClaimTemplateConfig{{Name: "sub", Value: "test"}})
+	assert.Error(err)
+
+	_, err = NewClaimMapping("", []ClaimTemplateConfig{{Value: "test"}})
+	assert.Error(err)
+
+	_, err = NewClaimMapping("", []ClaimTemplateConfig{{Name: "env", Value: "a"}, {Name: "env", Value: "b"}})
+	assert.Error(err)
+
+	_, err = NewClaimMapping("{{ .Host", nil)
+	assert.Error(err)
+
+	// An empty subject must not be issued
+	mapping, err := NewClaimMapping("{{ .OriginIP }}", nil)
+	assert.NoError(err)
+	_, _, err = mapping.Apply(newTestClaimClient(t), nil)
+	assert.Error(err)
+}
+
+func TestCustomClaimsExtra(t *testing.T) {
+	assert := assert.New(t)
+
+	claims := CustomClaims{
+		NodeClaims: NodeClaims{Identity: "test@example.com"},
+		Extra: map[string]any{
+			"env":         "prod",
+			"node_claims": "ignored",
+		},
+	}
+	claims.Subject = "host.example.com"
+
+	data, err := json.Marshal(claims)
+	assert.NoError(err)
+
+	decoded := map[string]any{}
+	assert.NoError(json.Unmarshal(data, &decoded))
+	assert.Equal("prod", decoded["env"])
+	assert.Equal("host.example.com", decoded["sub"])
+	assert.Equal(map[string]any{"identity": "test@example.com"}, decoded["node_claims"])
+}
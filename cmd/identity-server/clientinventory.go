@@ -0,0 +1,306 @@
+package main
+
+import (
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"identity-metadata-server/internal/certificates"
+
+	"github.com/rs/zerolog/log"
+	"github.com/spf13/viper"
+)
+
+// InventoryEntry holds everything known about a single host.
+type InventoryEntry struct {
+	Host      string    `json:"host"`
+	Identity  string    `json:"identity"`
+	Serial    string    `json:"serial"`
+	NotAfter  time.Time `json:"notAfter"`
+	Addresses []string  `json:"addresses"`
+	// LastSeen and Origin describe the last authenticated request.
+	LastSeen time.Time `json:"lastSeen"`
+	Origin   string    `json:"origin"`
+	// Audiences are the audiences of the last issued token.
+	Audiences []string `json:"audiences,omitempty"`
+	// LastRenewal is the time the last certificate was issued through this server.
+	LastRenewal time.Time `json:"lastRenewal,omitzero"`
+}
+
+// ClientInventory keeps one entry per host that authenticated with a client
+// certificate. If a path is set, the inventory is persisted as JSON file.
+// Changes are kept in memory and written by Flush, so authenticating clients
+// does not cause disk writes.
+type ClientInventory struct {
+	guard   *sync.RWMutex
+	entries map[string]InventoryEntry
+	dirty   bool
+
+	// path is the file the inventory is persisted to. If empty, the
+	// inventory is not persisted.
+	path string
+
+	// retention is the time after which hosts that have not been seen are
+	// removed. A value of 0 keeps hosts forever.
+	retention time.Duration
+
+	// flushTimer and flushDone are managed by StartFlushTimer.
+	flushTimer *time.Ticker
+	flushDone  chan struct{}
+}
+
+var (
+	// clientInventory holds all clients known to the server.
+	// It is replaced by initClientInventory during startup.
+	clientInventory = NewClientInventory("", 0)
+)
+
+// NewClientInventory creates an empty inventory persisted to the given path.
+// Call Load to read existing entries.
+func NewClientInventory(path string, retention time.Duration) *ClientInventory {
+	return &ClientInventory{
+		guard:     new(sync.RWMutex),
+		entries:   make(map[string]InventoryEntry),
+		path:      path,
+		retention: retention,
+		flushDone: make(chan struct{}),
+	}
+}
+
+// initClientInventory loads the inventory configured in server.inventory.
+func initClientInventory() error {
+	inventory := NewClientInventory(
+		viper.GetString("server.inventory.file"),
+		viper.GetDuration("server.inventory.retention"))
+
+	if err := inventory.Load(); err != nil {
+		return err
+	}
+
+	clientInventory = inventory
+	return nil
+}
+
+// update calls fn for the entry of the given host and marks the inventory as
+// changed. The entry is created if it does not exist.
+func (inv *ClientInventory) update(host string, fn func(*InventoryEntry)) {
+	inv.guard.Lock()
+	defer inv.guard.Unlock()
+
+	host = strings.ToLower(host)
+	entry := inv.entries[host]
+	entry.Host = host
+
+	fn(&entry)
+	inv.entries[host] = entry
+	inv.dirty = true
+}
+
+// setCertificate copies the certificate related fields to the entry.
+func (entry *InventoryEntry) setCertificate(cert *x509.Certificate) {
+	if len(cert.EmailAddresses) > 0 {
+		entry.Identity = cert.EmailAddresses[0]
+	}
+	entry.Serial = certificates.SerialToHex(cert)
+	entry.NotAfter = cert.NotAfter
+
+	entry.Addresses = make([]string, 0, len(cert.IPAddresses))
+	for _, ip := range cert.IPAddresses {
+		entry.Addresses = append(entry.Addresses, ip.String())
+	}
+}
+
+// Record stores the given client as seen at the given time.
+func (inv *ClientInventory) Record(client *IdentityClient, origin string, now time.Time) {
+	inv.update(client.Host, func(entry *InventoryEntry) {
+		// Requests using an older certificate must not replace a renewed one
+		if client.Certificate != nil && !client.Certificate.NotAfter.Before(entry.NotAfter) {
+			entry.setCertificate(client.Certificate)
+		}
+		entry.LastSeen = now
+		entry.Origin = origin
+	})
+}
+
+// RecordAudiences stores the audiences of a token issued to the given host.
+func (inv *ClientInventory) RecordAudiences(host string, audiences []string) {
+	inv.update(host, func(entry *InventoryEntry) {
+		entry.Audiences = audiences
+	})
+}
+
+// RecordRenewal stores a certificate issued at the given time.
+func (inv *ClientInventory) RecordRenewal(cert *x509.Certificate, now time.Time) {
+	inv.update(cert.Subject.CommonName, func(entry *InventoryEntry) {
+		entry.setCertificate(cert)
+		entry.LastRenewal = now
+	})
+}
+
+// InventoryFilter selects entries returned by ClientInventory.Entries.
+// Zero values match all entries.
+type InventoryFilter struct {
+	// SeenAfter matches hosts seen after the given time.
+	SeenAfter time.Time
+	// NotSeenSince matches hosts not seen since the given time.
+	NotSeenSince time.Time
+	// ExpiresBefore matches hosts with a certificate expiring before the
+	// given time.
+	ExpiresBefore time.Time
+}
+
+// matches returns true if the given entry matches all fields of the filter.
+func (f InventoryFilter) matches(entry InventoryEntry) bool {
+	switch {
+	case !f.SeenAfter.IsZero() && !entry.LastSeen.After(f.SeenAfter):
+		return false
+	case !f.NotSeenSince.IsZero() && entry.LastSeen.After(f.NotSeenSince):
+		return false
+	case !f.ExpiresBefore.IsZero() && !entry.NotAfter.Before(f.ExpiresBefore):
+		return false
+	default:
+		return true
+	}
+}
+
+// Entries returns all entries matching the given filter, most recently seen
+// entries first.
+func (inv *ClientInventory) Entries(filter InventoryFilter) []InventoryEntry {
+	inv.guard.RLock()
+	defer inv.guard.RUnlock()
+
+	entries := make([]InventoryEntry, 0, len(inv.entries))
+	for _, entry := range inv.entries {
+		if filter.matches(entry) {
+			entries = append(entries, entry)
+		}
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].LastSeen.After(entries[j].LastSeen)
+	})
+	return entries
+}
+
+// Load replaces all entries with the entries stored on disk. A missing file
+// contains no entries.
+func (inv *ClientInventory) Load() error {
+	if len(inv.path) == 0 {
+		return nil
+	}
+
+	data, err := os.ReadFile(inv.path)
+	switch {
+	case os.IsNotExist(err):
+		return nil
+	case err != nil:
+		return errors.Join(err, fmt.Errorf("failed to read client inventory from %s", inv.path))
+	}
+
+	stored := []InventoryEntry{}
+	if err := json.Unmarshal(data, &stored); err != nil {
+		return errors.Join(err, fmt.Errorf("failed to parse client inventory from %s", inv.path))
+	}
+
+	inv.guard.Lock()
+	defer inv.guard.Unlock()
+
+	inv.entries = make(map[string]InventoryEntry, len(stored))
+	for _, entry := range stored {
+		inv.entries[strings.ToLower(entry.Host)] = entry
+	}
+	inv.dirty = false
+	return nil
+}
+
+// Flush removes hosts that exceeded the retention period and writes the
+// inventory to disk if it has changed. The file is replaced atomically.
+func (inv *ClientInventory) Flush(now time.Time) error {
+	inv.guard.Lock()
+	defer inv.guard.Unlock()
+
+	if inv.retention > 0 {
+		for host, entry := range inv.entries {
+			if now.Sub(entry.LastSeen) > inv.retention && now.Sub(entry.LastRenewal) > inv.retention {
+				delete(inv.entries, host)
+				inv.dirty = true
+			}
+		}
+	}
+
+	if !inv.dirty || len(inv.path) == 0 {
+		return nil
+	}
+
+	stored := make([]InventoryEntry, 0, len(inv.entries))
+	for _, entry := range inv.entries {
+		stored = append(stored, entry)
+	}
+	sort.Slice(stored, func(i, j int) bool {
+		return stored[i].Host < stored[j].Host
+	})
+
+	data, err := json.MarshalIndent(stored, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmpFile, err := os.CreateTemp(filepath.Dir(inv.path), filepath.Base(inv.path)+".*")
+	if err != nil {
+		return errors.Join(err, fmt.Errorf("failed to write client inventory to %s", inv.path))
+	}
+	defer func() { _ = os.Remove(tmpFile.Name()) }()
+
+	_, err = tmpFile.Write(data)
+	if closeErr := tmpFile.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmpFile.Name(), inv.path)
+	}
+	if err != nil {
+		return errors.Join(err, fmt.Errorf("failed to write client inventory to %s", inv.path))
+	}
+
+	inv.dirty = false
+	return nil
+}
+
+// StartFlushTimer calls Flush in the given interval until StopFlushTimer is
+// called.
+func (inv *ClientInventory) StartFlushTimer(interval time.Duration) {
+	inv.flushTimer = time.NewTicker(interval)
+	go func() {
+		for {
+			select {
+			case <-inv.flushDone:
+				return
+			case now := <-inv.flushTimer.C:
+				if err := inv.Flush(now); err != nil {
+					log.Error().Err(err).Msg("Failed to store client inventory")
+				}
+			}
+		}
+	}()
+}
+
+// StopFlushTimer stops the timer started by StartFlushTimer and writes all
+// pending changes.
+func (inv *ClientInventory) StopFlushTimer() {
+	if inv.flushTimer != nil {
+		close(inv.flushDone)
+		inv.flushTimer.Stop()
+		inv.flushTimer = nil
+	}
+
+	if err := inv.Flush(time.Now()); err != nil {
+		log.Error().Err(err).Msg("Failed to store client inventory")
+	}
+}
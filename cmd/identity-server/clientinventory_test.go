@@ -0,0 +1,84 @@
+package main
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestClientInventory(t *testing.T) {
+	assert := assert.New(t)
+
+	certs, _ := newTestClientCertificates(t, "a.example.com", "b.example.com", "c.example.com")
+	path := filepath.Join(t.TempDir(), "inventory.json")
+	inventory := NewClientInventory(path, 24*time.Hour)
+	now := time.Now()
+
+	for i, cert := range certs {
+		client, err := NewClientFromCert(cert)
+		assert.NoError(err)
+		inventory.Record(client, testClientOrigin, now.Add(-time.Duration(i)*time.Hour))
+	}
+	inventory.RecordAudiences("A.example.com", []string{"https://a.example.com"})
+	inventory.RecordRenewal(certs[1], now)
+
+	entries := inventory.Entries(InventoryFilter{})
+	assert.Len(entries, 3)
+	assert.Equal("a.example.com", entries[0].Host)
+	assert.Equal("test@example.com", entries[0].Identity)
+	assert.Equal([]string{testClientOrigin}, entries[0].Addresses)
+	assert.Equal([]string{"https://a.example.com"}, entries[0].Audiences)
+	assert.Equal(certs[0].NotAfter, entries[0].NotAfter)
+	assert.Equal(now, entries[1].LastRenewal)
+
+	// Filters
+	assert.Len(inventory.Entries(InventoryFilter{SeenAfter: now.Add(-90 * time.Minute)}), 2)
+	assert.Len(inventory.Entries(InventoryFilter{NotSeenSince: now.Add(-90 * time.Minute)}), 1)
+	assert.Len(inventory.Entries(InventoryFilter{ExpiresBefore: now.Add(2 * time.Hour)}), 3)
+	assert.Empty(inventory.Entries(InventoryFilter{ExpiresBefore: now}))
+
+	// Entries survive a restart
+	assert.NoError(inventory.Flush(now))
+	restored := NewClientInventory(path, 24*time.Hour)
+	assert.NoError(restored.Load())
+	assert.Len(restored.Entries(InventoryFilter{}), 3)
+
+	// Hosts exceeding the retention are removed
+	assert.NoError(restored.Flush(now.Add(25 * time.Hour)))
+	restored = NewClientInventory(path, 24*time.Hour)
+	assert.NoError(restored.Load())
+	assert.Empty(restored.Entries(InventoryFilter{}))
+}
+
+func TestInventoryCollector(t *testing.T) {
+	assert := assert.New(t)
+
+	previous := clientInventory
+	defer func() { clientInventory = previous }()
+	clientInventory = NewClientInventory("", 0)
+
+	certs, _ := newTestClientCertificates(t, "a.example.com", "b.example.com")
+	for _, cert := range certs {
+		client, err := NewClientFromCert(cert)
+		assert.NoError(err)
+		clientInventory.Record(client, testClientOrigin, time.Now().Add(-48*time.Hour))
+	}
+
+	// Totals and 2 windows with expiring and not seen, no per host metrics
+	collector := newInventoryCollector([]int{1, 7})
+	assert.Equal(6, testutil.CollectAndCount(collector))
+	assert.Equal(2, testutil.CollectAndCount(collector, "identity_server_clients_expiring"))
+	assert.NoError(testutil.CollectAndCompare(collector, strings.NewReader(`
+# HELP identity_server_clients Number of hosts in the client inventory
+# TYPE identity_server_clients gauge
+identity_server_clients 2
+# HELP identity_server_clients_not_seen Number of hosts that have not been seen for the given number of days
+# TYPE identity_server_clients_not_seen gauge
+identity_server_clients_not_seen{days="1"} 2
+identity_server_clients_not_seen{days="7"} 0
+`), "identity_server_clients", "identity_server_clients_not_seen"))
+}
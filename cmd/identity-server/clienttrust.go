@@ -0,0 +1,105 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"time"
+)
+
+// clientTrust holds the CA certificates client certificates are verified
+// against. Self-signed certificates are used as roots, all other CA
+// certificates as intermediates.
+type clientTrust struct {
+	// certs contains all CA certificates, roots and intermediates.
+	certs []*x509.Certificate
+
+	roots         *x509.CertPool
+	intermediates *x509.CertPool
+}
+
+// newClientTrust sorts the given CA certificates into roots and
+// intermediates. If none of the certificates is self-signed, all of them are
+// used as roots, as the pool does not contain the full chain.
+func newClientTrust(certs []*x509.Certificate) *clientTrust {
+	trust := &clientTrust{
+		certs:         certs,
+		roots:         x509.NewCertPool(),
+		intermediates: x509.NewCertPool(),
+	}
+
+	hasRoot := false
+	for _, cert := range certs {
+		if isSelfSigned(cert) {
+			trust.roots.AddCert(cert)
+			hasRoot = true
+		} else {
+			trust.intermediates.AddCert(cert)
+		}
+	}
+
+	if !hasRoot {
+		trust.roots = newCertPool(certs)
+		trust.intermediates = x509.NewCertPool()
+	}
+	return trust
+}
+
+// isSelfSigned returns true if the given certificate is signed by itself.
+func isSelfSigned(cert *x509.Certificate) bool {
+	return bytes.Equal(cert.RawIssuer, cert.RawSubject) && cert.CheckSignatureFrom(cert) == nil
+}
+
+// verify builds all chains from the given certificate to one of the roots.
+// Chains are only built through the trusted intermediates, as the CRLs of
+// other CAs are not loaded and their revocations would go unnoticed.
+// The certificate must be usable for client authentication.
+func (trust *clientTrust) verify(cert *x509.Certificate, now time.Time) ([][]*x509.Certificate, error) {
+	return cert.Verify(x509.VerifyOptions{
+		Roots:         trust.roots,
+		Intermediates: trust.intermediates,
+		CurrentTime:   now,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	})
+}
+
+// issuers returns the CA certificates that signed the given CRL.
+func (trust *clientTrust) issuers(list *x509.RevocationList) []*x509.Certificate {
+	issuers := []*x509.Certificate{}
+	for _, caCert := range trust.certs {
+		if list.CheckSignatureFrom(caCert) == nil {
+			issuers = append(issuers, caCert)
+		}
+	}
+	return issuers
+}
+
+// issuer returns the CA certificate that signed the given certificate or nil
+// if it is not part of the trusted CA certificates.
+func (trust *clientTrust) issuer(cert *x509.Certificate) *x509.Certificate {
+	for _, caCert := range trust.certs {
+		if bytes.Equal(caCert.RawSubject, cert.RawIssuer) && cert.CheckSignatureFrom(caCert) == nil {
+			return caCert
+		}
+	}
+	return nil
+}
+
+// issuerKey identifies a CA certificate in the revoked certificates per
+// issuer.
+func issuerKey(caCert *x509.Certificate) string {
+	fingerprint := sha256.Sum256(caCert.Raw)
+	return hex.EncodeToString(fingerprint[:])
+}
+
+// chainVerificationError maps an error returned by clientTrust.verify to the
+// error returned to the client.
+func chainVerificationError(err error) error {
+	invalidErr := x509.CertificateInvalidError{}
+	if errors.As(err, &invalidErr) && invalidErr.Reason == x509.IncompatibleUsage {
+		return ErrorCertificateUsage
+	}
+	return ErrorUnknownTrustRoot
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// crlCollector exports the freshness of a CertificateRevocationList as
+// prometheus metrics.
+type crlCollector struct {
+	crl *CertificateRevocationList
+
+	age            *prometheus.Desc
+	entries        *prometheus.Desc
+	lastUpdate     *prometheus.Desc
+	nextUpdate     *prometheus.Desc
+	updateFailures *prometheus.Desc
+	stale          *prometheus.Desc
+}
+
+// newCRLCollector creates a collector for the given revocation list.
+func newCRLCollector(crl *CertificateRevocationList) *crlCollector {
+	return &crlCollector{
+		crl: crl,
+		age: prometheus.NewDesc(
+			"identity_server_crl_age_seconds",
+			"Time since the oldest loaded CRL has been published",
+			nil, nil),
+		entries: prometheus.NewDesc(
+			"identity_server_crl_entries",
+			"Number of revoked certificate serials, including revocations not yet published",
+			nil, nil),
+		lastUpdate: prometheus.NewDesc(
+			"identity_server_crl_last_update_timestamp_seconds",
+			"Time of the last successful CRL update",
+			nil, nil),
+		nextUpdate: prometheus.NewDesc(
+			"identity_server_crl_next_update_timestamp_seconds",
+			"Oldest NextUpdate time of the loaded CRLs",
+			nil, nil),
+		updateFailures: prometheus.NewDesc(
+			"identity_server_crl_update_failures",
+			"Number of consecutive failed CRL updates",
+			nil, nil),
+		stale: prometheus.NewDesc(
+			"identity_server_crl_stale",
+			"1 if the loaded CRLs are past their NextUpdate time plus the grace period",
+			nil, nil),
+	}
+}
+
+// Describe implements prometheus.Collector.
+func (cc *crlCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- cc.age
+	ch <- cc.entries
+	ch <- cc.lastUpdate
+	ch <- cc.nextUpdate
+	ch <- cc.updateFailures
+	ch <- cc.stale
+}
+
+// Collect implements prometheus.Collector.
+func (cc *crlCollector) Collect(ch chan<- prometheus.Metric) {
+	status := cc.crl.Status()
+
+	if !status.CRLThisUpdate.IsZero() {
+		ch <- prometheus.MustNewConstMetric(cc.age, prometheus.GaugeValue, time.Since(status.CRLThisUpdate).Seconds())
+	}
+	if !status.LastUpdate.IsZero() {
+		ch <- prometheus.MustNewConstMetric(cc.lastUpdate, prometheus.GaugeValue, float64(status.LastUpdate.Unix()))
+	}
+	if !status.CRLNextUpdate.IsZero() {
+		ch <- prometheus.MustNewConstMetric(cc.nextUpdate, prometheus.GaugeValue, float64(status.CRLNextUpdate.Unix()))
+	}
+
+	stale := 0.0
+	if status.Stale {
+		stale = 1
+	}
+
+	ch <- prometheus.MustNewConstMetric(cc.entries, prometheus.GaugeValue, float64(status.Count))
+	ch <- prometheus.MustNewConstMetric(cc.updateFailures, prometheus.GaugeValue, float64(status.UpdateFailures))
+	ch <- prometheus.MustNewConstMetric(cc.stale, prometheus.GaugeValue, stale)
+}
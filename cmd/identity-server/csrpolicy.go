@@ -0,0 +1,169 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/x509"
+	"fmt"
+	"identity-metadata-server/internal/shared"
+	"net/http"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	"github.com/spf13/viper"
+)
+
+const (
+	CSRKeyTypeRSA     = "rsa"
+	CSRKeyTypeECDSA   = "ecdsa"
+	CSRKeyTypeEd25519 = "ed25519"
+)
+
+// CSRPolicy defines which CSRs are accepted by /renew.
+type CSRPolicy struct {
+	// KeyTypes lists the accepted public key types, see CSRKeyType*.
+	KeyTypes []string
+	// MinRSABits is the minimum size of RSA keys.
+	MinRSABits int
+	// Curves lists the accepted elliptic curves of ECDSA keys, e.g. "P-256".
+	Curves []string
+
+	// RequireNewKey rejects CSRs reusing the key of the current certificate.
+	RequireNewKey bool
+	// RenewalWindow rejects renewals while the current certificate is valid
+	// for longer than this. A value of 0 does not add a restriction.
+	RenewalWindow time.Duration
+	// MaxLifetime is the lifetime of certificates issued if the client does
+	// not request a shorter one.
+	MaxLifetime time.Duration
+}
+
+var (
+	// csrPolicy holds the currently active CSR policy.
+	// If no policy is loaded, all CSRs are accepted.
+	csrPolicy atomic.Pointer[CSRPolicy]
+)
+
+// CheckKey returns an HTTP compatible error if the given public key is not
+// allowed by the policy.
+func (p *CSRPolicy) CheckKey(publicKey crypto.PublicKey) error {
+	switch key := publicKey.(type) {
+	case *rsa.PublicKey:
+		if !slices.Contains(p.KeyTypes, CSRKeyTypeRSA) {
+			return shared.NewErrorWithStatus(http.StatusUnprocessableEntity, "CSR key type RSA is not allowed")
+		}
+		if bits := key.N.BitLen(); bits < p.MinRSABits {
+			return shared.NewErrorWithStatus(http.StatusUnprocessableEntity, "CSR RSA key size of %d bits is below the minimum of %d bits", bits, p.MinRSABits)
+		}
+
+	case *ecdsa.PublicKey:
+		if !slices.Contains(p.KeyTypes, CSRKeyTypeECDSA) {
+			return shared.NewErrorWithStatus(http.StatusUnprocessableEntity, "CSR key type ECDSA is not allowed")
+		}
+		if curve := key.Curve.Params().Name; !slices.Contains(p.Curves, curve) {
+			return shared.NewErrorWithStatus(http.StatusUnprocessableEntity, "CSR ECDSA curve %s is not allowed", curve)
+		}
+
+	case ed25519.PublicKey:
+		if !slices.Contains(p.KeyTypes, CSRKeyTypeEd25519) {
+			return shared.NewErrorWithStatus(http.StatusUnprocessableEntity, "CSR key type Ed25519 is not allowed")
+		}
+
+	default:
+		return shared.NewErrorWithStatus(http.StatusUnprocessableEntity, "CSR key type %T is not supported", publicKey)
+	}
+
+	return nil
+}
+
+// CheckRenewal returns an HTTP compatible error if the CSR must not be used
+// to renew the given certificate at the given time. Early renewals, requested
+// by a renewal hint, are not restricted by the renewal window.
+func (p *CSRPolicy) CheckRenewal(csr *x509.CertificateRequest, cert *x509.Certificate, now time.Time, early bool) error {
+	if err := p.CheckKey(csr.PublicKey); err != nil {
+		return err
+	}
+
+	if p.RequireNewKey {
+		if key, ok := csr.PublicKey.(interface{ Equal(crypto.PublicKey) bool }); !ok || key.Equal(cert.PublicKey) {
+			return shared.NewErrorWithStatus(http.StatusUnprocessableEntity, "CSR must use a new key, the key of the current client certificate cannot be reused")
+		}
+	}
+
+	if remaining := cert.NotAfter.Sub(now); !early && p.RenewalWindow > 0 && remaining > p.RenewalWindow {
+		return shared.NewErrorWithStatus(http.StatusUnprocessableEntity,
+			"current client certificate is still valid for %s, renewal is allowed within %s of expiry",
+			remaining.Truncate(time.Second), p.RenewalWindow)
+	}
+
+	return nil
+}
+
+// Lifetime returns the lifetime of the certificate to issue for the requested
+// lifetime. A requested lifetime of 0 selects the maximum lifetime, larger
+// values are clamped to it.
+func (p *CSRPolicy) Lifetime(requested time.Duration) (time.Duration, error) {
+	switch {
+	case requested < 0:
+		return 0, shared.NewErrorWithStatus(http.StatusUnprocessableEntity, "requested certificate lifetime must not be negative")
+	case requested == 0 || requested > p.MaxLifetime:
+		return p.MaxLifetime, nil
+	default:
+		return requested, nil
+	}
+}
+
+// NewCSRPolicy creates a CSR policy and checks it for unknown key types.
+func NewCSRPolicy(keyTypes []string, minRSABits int, curves []string, requireNewKey bool, renewalWindow, maxLifetime time.Duration) (*CSRPolicy, error) {
+	policy := &CSRPolicy{
+		MinRSABits:    minRSABits,
+		Curves:        curves,
+		RequireNewKey: requireNewKey,
+		RenewalWindow: renewalWindow,
+		MaxLifetime:   maxLifetime,
+	}
+
+	for _, keyType := range keyTypes {
+		keyType = strings.ToLower(keyType)
+		switch keyType {
+		case CSRKeyTypeRSA, CSRKeyTypeECDSA, CSRKeyTypeEd25519:
+			policy.KeyTypes = append(policy.KeyTypes, keyType)
+		default:
+			return nil, fmt.Errorf("unknown CSR key type %q", keyType)
+		}
+	}
+
+	if renewalWindow > 0 && renewalWindow >= maxLifetime {
+		log.Warn().
+			Dur("renewalWindow", renewalWindow).
+			Dur("clientCertLifetime", maxLifetime).
+			Msg("CSR renewal window is not shorter than the client certificate lifetime, renewals are not restricted")
+	}
+
+	return policy, nil
+}
+
+// initCSRPolicy loads the CSR policy configured in server.csrPolicy.
+// Calling this function will atomically replace the active policy, hence it
+// can also be used to reload the policy. If loading fails, the previously
+// loaded policy is kept.
+func initCSRPolicy() error {
+	policy, err := NewCSRPolicy(
+		viper.GetStringSlice("server.csrPolicy.keyTypes"),
+		viper.GetInt("server.csrPolicy.minRSABits"),
+		viper.GetStringSlice("server.csrPolicy.curves"),
+		viper.GetBool("server.csrPolicy.requireNewKey"),
+		viper.GetDuration("server.csrPolicy.renewalWindow"),
+		viper.GetDuration("server.certAuthority.clientCertLifetime"))
+	if err != nil {
+		return err
+	}
+
+	csrPolicy.Store(policy)
+	return nil
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"identity-metadata-server/internal/shared"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// newTestPolicyCSR creates a client CSR signed with the given key.
+func newTestPolicyCSR(t *testing.T, key crypto.Signer) *x509.CertificateRequest {
+	der, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+		Subject:  pkix.Name{CommonName: "test"},
+		DNSNames: []string{"test"},
+	}, key)
+	assert.NoError(t, err)
+	csr, err := x509.ParseCertificateRequest(der)
+	assert.NoError(t, err)
+	return csr
+}
+
+func TestCSRPolicyCheckKey(t *testing.T) {
+	assert := assert.New(t)
+
+	policy, err := NewCSRPolicy([]string{"RSA", "ecdsa"}, 2048, []string{"P-256"}, false, 0, time.Hour)
+	assert.NoError(err)
+
+	_, err = NewCSRPolicy([]string{"dsa"}, 2048, nil, false, 0, time.Hour)
+	assert.Error(err)
+
+	rsaWeak, err := rsa.GenerateKey(rand.Reader, 1024)
+	assert.NoError(err)
+	rsaStrong, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.NoError(err)
+	ecP256, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(err)
+	ecP384, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	assert.NoError(err)
+	edKey, _, err := ed25519.GenerateKey(rand.Reader)
+	assert.NoError(err)
+
+	assert.NoError(policy.CheckKey(&rsaStrong.PublicKey))
+	assert.NoError(policy.CheckKey(&ecP256.PublicKey))
+
+	for _, key := range []crypto.PublicKey{&rsaWeak.PublicKey, &ecP384.PublicKey, edKey} {
+		err := policy.CheckKey(key)
+		assert.Error(err)
+		assert.Equal(http.StatusUnprocessableEntity, err.(shared.ErrorWithStatus).Code)
+	}
+}
+
+func TestCSRPolicyCheckRenewal(t *testing.T) {
+	assert := assert.New(t)
+	now := time.Now()
+
+	policy, err := NewCSRPolicy([]string{CSRKeyTypeECDSA}, 2048, []string{"P-256"}, true, 24*time.Hour, 30*24*time.Hour)
+	assert.NoError(err)
+
+	currentKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(err)
+	newKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(err)
+
+	cert := CreateDummyCertificate("test", "test@test", []net.IP{net.ParseIP("127.0.0.1")})
+	cert.PublicKey = &currentKey.PublicKey
+	cert.NotAfter = now.Add(12 * time.Hour)
+
+	assert.NoError(policy.CheckRenewal(newTestPolicyCSR(t, newKey), cert, now, false))
+
+	// Key reuse
+	assert.Error(policy.CheckRenewal(newTestPolicyCSR(t, currentKey), cert, now, false))
+	policy.RequireNewKey = false
+	assert.NoError(policy.CheckRenewal(newTestPolicyCSR(t, currentKey), cert, now, false))
+
+	// Outside of the renewal window
+	cert.NotAfter = now.Add(48 * time.Hour)
+	assert.Error(policy.CheckRenewal(newTestPolicyCSR(t, newKey), cert, now, false))
+	assert.NoError(policy.CheckRenewal(newTestPolicyCSR(t, newKey), cert, now, true))
+	policy.RenewalWindow = 0
+	assert.NoError(policy.CheckRenewal(newTestPolicyCSR(t, newKey), cert, now, false))
+}
+
+func TestCSRPolicyLifetime(t *testing.T) {
+	assert := assert.New(t)
+
+	policy, err := NewCSRPolicy(nil, 0, nil, false, 0, 24*time.Hour)
+	assert.NoError(err)
+
+	lifetime, err := policy.Lifetime(0)
+	assert.NoError(err)
+	assert.Equal(24*time.Hour, lifetime)
+
+	lifetime, err = policy.Lifetime(time.Hour)
+	assert.NoError(err)
+	assert.Equal(time.Hour, lifetime)
+
+	lifetime, err = policy.Lifetime(48 * time.Hour)
+	assert.NoError(err)
+	assert.Equal(24*time.Hour, lifetime)
+
+	_, err = policy.Lifetime(-time.Hour)
+	assert.Error(err)
+
+	_, err = parseRequestedLifetime("a week")
+	assert.Error(err)
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"net/http"
+	"reflect"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/spf13/viper"
+)
+
+// OpenIDConfiguration is the discovery document served at
+// /.well-known/openid-configuration.
+// See https://openid.net/specs/openid-connect-discovery-1_0.html#ProviderMetadata
+type OpenIDConfiguration struct {
+	Issuer                           string   `json:"issuer"`
+	JWKSURI                          string   `json:"jwks_uri"`
+	ResponseTypesSupported           []string `json:"response_types_supported"`
+	SubjectTypesSupported            []string `json:"subject_types_supported"`
+	IDTokenSigningAlgValuesSupported []string `json:"id_token_signing_alg_values_supported"`
+	ClaimsSupported                  []string `json:"claims_supported"`
+}
+
+// HandleDiscoveryRequest returns the OpenID Connect discovery document.
+// This allows relying parties to discover the JWKS through the issuer URL.
+func HandleDiscoveryRequest(c *gin.Context) {
+	// This endpoint is public, no need to check the client certificate
+	c.JSON(http.StatusOK, newOpenIDConfiguration(time.Now()))
+}
+
+// newOpenIDConfiguration builds the discovery document for the given time.
+// The list of signing algorithms is based on the keys published at that time.
+func newOpenIDConfiguration(now time.Time) OpenIDConfiguration {
+	issuer := viper.GetString("server.issuer")
+
+	return OpenIDConfiguration{
+		Issuer:                           issuer,
+		JWKSURI:                          strings.TrimSuffix(issuer, "/") + "/jwks.json",
+		ResponseTypesSupported:           []string{"id_token"},
+		SubjectTypesSupported:            []string{"public"},
+		IDTokenSigningAlgValuesSupported: serverKeys.Load().signingAlgorithms(now),
+		ClaimsSupported:                  supportedClaims(),
+	}
+}
+
+// supportedClaims returns the names of all claims CustomClaims can emit,
+// including the claims added by the claim mapping.
+// Claims of nested objects are returned in dot notation.
+func supportedClaims() []string {
+	names := claimNames(reflect.TypeFor[CustomClaims](), "")
+	return append(names, claimMapping.Load().Names()...)
+}
+
+// claimNames returns the JSON names of all fields of the given struct type.
+// Anonymous fields without a JSON name are flattened, other struct fields are
+// added with their name as a prefix.
+func claimNames(t reflect.Type, prefix string) []string {
+	names := []string{}
+
+	for i := range t.NumField() {
+		field := t.Field(i)
+		if !field.IsExported() {
+			continue
+		}
+
+		name, _, _ := strings.Cut(field.Tag.Get("json"), ",")
+		if name == "-" {
+			continue
+		}
+
+		fieldType := field.Type
+		if fieldType.Kind() == reflect.Pointer {
+			fieldType = fieldType.Elem()
+		}
+
+		switch {
+		case field.Anonymous && len(name) == 0 && fieldType.Kind() == reflect.Struct:
+			names = append(names, claimNames(fieldType, prefix)...)
+		case len(name) == 0:
+			continue
+		case fieldType.Kind() == reflect.Struct && fieldType.NumField() > 0 && !isClaimValueType(fieldType):
+			names = append(names, claimNames(fieldType, prefix+name+".")...)
+		default:
+			names = append(names, prefix+name)
+		}
+	}
+
+	return names
+}
+
+// isClaimValueType returns true for struct types that are serialized as a
+// single value, like timestamps.
+func isClaimValueType(t reflect.Type) bool {
+	return t.Implements(reflect.TypeFor[interface{ MarshalJSON() ([]byte, error) }]()) ||
+		reflect.PointerTo(t).Implements(reflect.TypeFor[interface{ MarshalJSON() ([]byte, error) }]())
+}
+
+// signingAlgorithms returns the JWA names of all algorithms used by the keys
+// published at the given time.
+func (r *keyRing) signingAlgorithms(now time.Time) []string {
+	algorithms := []string{}
+	for _, key := range r.publishedKeys(now) {
+		if alg := key.method.Alg(); !slices.Contains(algorithms, alg) {
+			algorithms = append(algorithms, alg)
+		}
+	}
+	return algorithms
+}
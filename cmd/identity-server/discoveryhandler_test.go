@@ -0,0 +1,58 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	jsoniter "github.com/json-iterator/go"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSupportedClaims(t *testing.T) {
+	assert := assert.New(t)
+
+	claims := supportedClaims()
+	assert.Contains(claims, "iss")
+	assert.Contains(claims, "sub")
+	assert.Contains(claims, "aud")
+	assert.Contains(claims, "exp")
+	assert.Contains(claims, "iat")
+	assert.Contains(claims, "nbf")
+	assert.Contains(claims, "jti")
+	assert.Contains(claims, "node_claims.identity")
+	assert.Contains(claims, "cnf.x5t#S256")
+	assert.NotContains(claims, "node_claims")
+}
+
+func TestHandleDiscoveryRequest(t *testing.T) {
+	assert := assert.New(t)
+	dir := t.TempDir()
+	defer viper.Reset()
+
+	viper.Set("server.issuer", "https://identity-server/")
+	viper.Set("server.keys", []map[string]any{
+		{"name": "first", "path": writeTestKey(t, dir, "first.pem")},
+		{"name": "second", "path": writeTestKey(t, dir, "second.pem"), "activeFrom": time.Now().Add(time.Hour).Format(time.RFC3339)},
+	})
+	assert.NoError(initJWKS())
+
+	router := gin.New()
+	router.GET("/.well-known/openid-configuration", HandleDiscoveryRequest)
+
+	req, _ := http.NewRequest("GET", "/.well-known/openid-configuration", nil)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+
+	assert.Equal(http.StatusOK, w.Code)
+
+	discovery := OpenIDConfiguration{}
+	assert.NoError(jsoniter.Unmarshal(w.Body.Bytes(), &discovery))
+	assert.Equal("https://identity-server/", discovery.Issuer)
+	assert.Equal("https://identity-server/jwks.json", discovery.JWKSURI)
+	assert.Equal([]string{"ES256"}, discovery.IDTokenSigningAlgValuesSupported)
+	assert.Contains(discovery.ClaimsSupported, "node_claims.identity")
+}
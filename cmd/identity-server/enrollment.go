@@ -0,0 +1,390 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"identity-metadata-server/internal/certificates"
+	"identity-metadata-server/internal/shared"
+
+	"github.com/gin-gonic/gin"
+	"github.com/rs/zerolog/log"
+	"github.com/spf13/viper"
+)
+
+// JoinGrant allows a single new host to request its first client certificate.
+// A grant is redeemed either with a join token or with a bootstrap
+// certificate and can only be used once.
+type JoinGrant struct {
+	// TokenHash is the hex encoded SHA-256 hash of the join token.
+	TokenHash string `json:"tokenHash,omitempty"`
+	// BootstrapSerial is the hex encoded serial number of a bootstrap
+	// certificate that can be used instead of a join token.
+	BootstrapSerial string `json:"bootstrapSerial,omitempty"`
+
+	// Host is the hostname that must be requested.
+	Host string `json:"host"`
+	// Identity is the service account that must be requested.
+	Identity string `json:"identity"`
+	// Addresses lists the IP addresses that must be requested. Enrollment
+	// requests must originate from one of these addresses.
+	Addresses []string `json:"addresses"`
+
+	ExpiresAt time.Time  `json:"expiresAt"`
+	UsedAt    *time.Time `json:"usedAt,omitempty"`
+}
+
+// HashJoinToken returns the value stored as TokenHash for a join token.
+func HashJoinToken(joinToken string) string {
+	hash := sha256.Sum256([]byte(joinToken))
+	return hex.EncodeToString(hash[:])
+}
+
+// matches returns true if the grant can be redeemed with the given join token
+// hash or bootstrap certificate serial.
+func (g JoinGrant) matches(tokenHash, bootstrapSerial string) bool {
+	switch {
+	case len(tokenHash) > 0 && len(g.TokenHash) > 0:
+		return subtle.ConstantTimeCompare([]byte(strings.ToLower(g.TokenHash)), []byte(strings.ToLower(tokenHash))) == 1
+	case len(bootstrapSerial) > 0 && len(g.BootstrapSerial) > 0:
+		return strings.EqualFold(g.BootstrapSerial, bootstrapSerial)
+	default:
+		return false
+	}
+}
+
+// isRedeemable returns true if the grant has neither been used nor expired.
+// Grants without expiry date are never redeemable.
+func (g JoinGrant) isRedeemable(now time.Time) bool {
+	return g.UsedAt == nil && !g.ExpiresAt.IsZero() && now.Before(g.ExpiresAt)
+}
+
+// ipAddresses returns the parsed grant addresses. Invalid addresses are
+// ignored.
+func (g JoinGrant) ipAddresses() []net.IP {
+	ips := make([]net.IP, 0, len(g.Addresses))
+	for _, address := range g.Addresses {
+		if ip := net.ParseIP(address); ip != nil {
+			ips = append(ips, ip)
+		}
+	}
+	return ips
+}
+
+// IsFromValidOrigin checks if the given IP address is one of the grant addresses.
+func (g JoinGrant) IsFromValidOrigin(ip net.IP) bool {
+	for _, allowedIP := range g.ipAddresses() {
+		if allowedIP.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// JoinGrantStore stores join grants in a JSON file.
+// The file is read on every access, so grants can be added without
+// restarting the server. Used grants are kept in the file, marked by usedAt.
+// Every access holds an exclusive file lock, so a grant can only be used
+// once, even if multiple instances share the file.
+type JoinGrantStore struct {
+	path  string
+	guard *sync.Mutex
+}
+
+// NewJoinGrantStore creates a new store for the given file.
+func NewJoinGrantStore(path string) *JoinGrantStore {
+	return &JoinGrantStore{
+		path:  path,
+		guard: new(sync.Mutex),
+	}
+}
+
+// lock locks the guard and the grants file. The returned function unlocks
+// both.
+func (s *JoinGrantStore) lock() (func(), error) {
+	s.guard.Lock()
+	unlockFile, err := lockFile(s.path)
+	if err != nil {
+		s.guard.Unlock()
+		return nil, err
+	}
+
+	return func() {
+		unlockFile()
+		s.guard.Unlock()
+	}, nil
+}
+
+// load reads all grants from disk. A missing file contains no grants.
+// Must be called with the store locked.
+func (s *JoinGrantStore) load() ([]JoinGrant, error) {
+	data, err := os.ReadFile(s.path)
+	switch {
+	case os.IsNotExist(err):
+		return []JoinGrant{}, nil
+	case err != nil:
+		return nil, errors.Join(err, fmt.Errorf("failed to read join grants from %s", s.path))
+	}
+
+	grants := []JoinGrant{}
+	if err := json.Unmarshal(data, &grants); err != nil {
+		return nil, errors.Join(err, fmt.Errorf("failed to parse join grants from %s", s.path))
+	}
+	return grants, nil
+}
+
+// save writes all grants to disk, replacing the file atomically.
+// Must be called with the store locked.
+func (s *JoinGrantStore) save(grants []JoinGrant) error {
+	data, err := json.MarshalIndent(grants, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmpFile, err := os.CreateTemp(filepath.Dir(s.path), filepath.Base(s.path)+".*")
+	if err != nil {
+		return errors.Join(err, fmt.Errorf("failed to write join grants to %s", s.path))
+	}
+	defer func() { _ = os.Remove(tmpFile.Name()) }()
+
+	_, err = tmpFile.Write(data)
+	if closeErr := tmpFile.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmpFile.Name(), s.path)
+	}
+	if err != nil {
+		return errors.Join(err, fmt.Errorf("failed to write join grants to %s", s.path))
+	}
+	return nil
+}
+
+// update calls fn for the redeemable grant matching the join token hash or
+// bootstrap serial and stores the modified grant.
+func (s *JoinGrantStore) update(tokenHash, bootstrapSerial string, now time.Time, fn func(*JoinGrant)) (JoinGrant, error) {
+	unlock, err := s.lock()
+	if err != nil {
+		return JoinGrant{}, err
+	}
+	defer unlock()
+
+	grants, err := s.load()
+	if err != nil {
+		return JoinGrant{}, err
+	}
+
+	for i := range grants {
+		if !grants[i].matches(tokenHash, bootstrapSerial) {
+			continue
+		}
+		if !grants[i].isRedeemable(now) {
+			return JoinGrant{}, ErrorJoinGrantInvalid
+		}
+		if fn == nil {
+			return grants[i], nil
+		}
+
+		fn(&grants[i])
+		return grants[i], s.save(grants)
+	}
+
+	return JoinGrant{}, ErrorJoinGrantInvalid
+}
+
+// Find returns the redeemable grant for the given join token or bootstrap
+// certificate serial. Only one of both is expected to be set.
+// If no grant is found, ErrorJoinGrantInvalid is returned.
+func (s *JoinGrantStore) Find(joinToken, bootstrapSerial string) (JoinGrant, error) {
+	tokenHash := ""
+	if len(joinToken) > 0 {
+		tokenHash = HashJoinToken(joinToken)
+	}
+	return s.update(tokenHash, bootstrapSerial, time.Now(), nil)
+}
+
+// Claim marks the given grant as used. If the grant has been used in the
+// meantime, ErrorJoinGrantInvalid is returned.
+func (s *JoinGrantStore) Claim(grant JoinGrant) error {
+	now := time.Now()
+	_, err := s.update(grant.TokenHash, grant.BootstrapSerial, now, func(g *JoinGrant) {
+		g.UsedAt = &now
+	})
+	return err
+}
+
+// Release marks a claimed grant as unused again. This is used if no
+// certificate could be issued for a claimed grant.
+func (s *JoinGrantStore) Release(grant JoinGrant) error {
+	unlock, err := s.lock()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	grants, err := s.load()
+	if err != nil {
+		return err
+	}
+
+	for i := range grants {
+		if grants[i].matches(grant.TokenHash, grant.BootstrapSerial) {
+			grants[i].UsedAt = nil
+			return s.save(grants)
+		}
+	}
+	return nil
+}
+
+// bootstrapSerialFromContext returns the hex encoded serial number of the
+// bootstrap certificate presented by the caller. Bootstrap certificates do
+// not need to carry an identity or origin, but must be valid and issued by
+// a known trust root.
+func bootstrapSerialFromContext(c *gin.Context, crl *CertificateRevocationList) (string, error) {
+	if c.Request.TLS == nil || len(c.Request.TLS.PeerCertificates) < 1 {
+		return "", ErrorNoClientCert
+	}
+	cert := c.Request.TLS.PeerCertificates[0]
+
+	now := time.Now()
+	switch {
+	case cert.SerialNumber == nil:
+		return "", ErrorNoSerial
+	case now.Before(cert.NotBefore):
+		return "", ErrorCertificateNotValidYet
+	case now.After(cert.NotAfter):
+		return "", ErrorCertificateExpired
+	}
+
+	chains, err := crl.VerifyChains(cert)
+	if err != nil {
+		return "", err
+	}
+	if crl.IsChainRevoked(chains) {
+		return "", ErrorCertificateRevoked
+	}
+
+	return hex.EncodeToString(cert.SerialNumber.Bytes()), nil
+}
+
+// HandleEnrollRequest issues the first client certificate for a new host.
+// The caller either sends a join token or presents a bootstrap certificate.
+// The CSR has to request exactly the host, identity and addresses of the
+// matching join grant. Each grant can only be used once.
+func HandleEnrollRequest(c *gin.Context, crl *CertificateRevocationList, grants *JoinGrantStore, authority certificates.Authority) {
+	request := shared.EnrollRequest{}
+	if err := c.BindJSON(&request); err != nil {
+		log.Error().Err(err).Msg("Failed to parse enrollment request")
+		shared.HttpError(c, http.StatusBadRequest, err)
+		return
+	}
+
+	bootstrapSerial := ""
+	if len(request.JoinToken) == 0 {
+		serial, err := bootstrapSerialFromContext(c, crl)
+		if err != nil {
+			log.Error().Err(err).Str("clientIP", c.ClientIP()).Msg("Enrollment request without join token or valid bootstrap certificate")
+			shared.HttpError(c, http.StatusUnauthorized, err)
+			return
+		}
+		bootstrapSerial = serial
+	}
+
+	grant, err := grants.Find(request.JoinToken, bootstrapSerial)
+	if err != nil {
+		log.Error().Err(err).Str("clientIP", c.ClientIP()).Msg("Enrollment request without valid join grant")
+		shared.HttpError(c, http.StatusInternalServerError, err)
+		return
+	}
+
+	if !grant.IsFromValidOrigin(net.ParseIP(c.ClientIP())) {
+		log.Error().
+			Str("client", c.ClientIP()).
+			Str("host", grant.Host).
+			Msg("enrollment request from invalid origin")
+		shared.HttpError(c, http.StatusForbidden, ErrorNotAllowedForOrigin)
+		return
+	}
+
+	csr, err := parseCSR(request.CSR)
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to parse CSR")
+		shared.HttpError(c, http.StatusBadRequest, err)
+		return
+	}
+
+	if err := VerifyEnrollRequest(csr, grant); err != nil {
+		log.Error().Err(err).Str("host", grant.Host).Msg("CSR does not match join grant")
+		shared.HttpError(c, http.StatusUnprocessableEntity, err)
+		return
+	}
+
+	if err := grants.Claim(grant); err != nil {
+		log.Error().Err(err).Str("host", grant.Host).Msg("Failed to claim join grant")
+		shared.HttpError(c, http.StatusInternalServerError, err)
+		return
+	}
+
+	ctx := certificates.ContextWithOrigin(c.Request.Context(), net.ParseIP(c.ClientIP()))
+	chain, err := issueCertificate(ctx, request.CSR, viper.GetDuration("server.certAuthority.clientCertLifetime"), authority)
+	if err != nil {
+		// Allow the host to retry
+		if releaseErr := grants.Release(grant); releaseErr != nil {
+			log.Error().Err(releaseErr).Str("host", grant.Host).Msg("Failed to release join grant")
+		}
+		shared.HttpError(c, http.StatusInternalServerError, err)
+		return
+	}
+
+	log.Info().
+		Str("host", grant.Host).
+		Str("identity", grant.Identity).
+		Msg("Enrolled new host")
+
+	writeCertificateChain(c, chain)
+}
+
+// VerifyEnrollRequest checks if the CSR requests exactly what the join grant allows.
+// If the request is valid, it returns nil, otherwise it returns an HTTP compatible error.
+func VerifyEnrollRequest(csr *x509.CertificateRequest, grant JoinGrant) error {
+	// Check 1: Hostname
+	if len(csr.DNSNames) != 1 {
+		return shared.NewErrorWithStatus(http.StatusUnprocessableEntity, "CSR must contain exactly one DNS name")
+	}
+
+	if !strings.EqualFold(csr.DNSNames[0], grant.Host) {
+		return shared.NewErrorWithStatus(http.StatusUnprocessableEntity, "CSR DNS name does not match join grant")
+	}
+
+	if !strings.EqualFold(csr.Subject.CommonName, grant.Host) {
+		return shared.NewErrorWithStatus(http.StatusUnprocessableEntity, "CSR Common Name does not match join grant")
+	}
+
+	// Check 2: Email address (identity)
+	if len(csr.EmailAddresses) != 1 || csr.EmailAddresses[0] != grant.Identity {
+		return shared.NewErrorWithStatus(http.StatusUnprocessableEntity, "CSR email address does not match join grant")
+	}
+
+	// Check 3: IP addresses (origin)
+	IpEqual := func(a, b net.IP) bool {
+		return a.Equal(b)
+	}
+	if len(csr.IPAddresses) == 0 || !shared.EqualUnorderedFunc(csr.IPAddresses, grant.ipAddresses(), IpEqual) {
+		return shared.NewErrorWithStatus(http.StatusUnprocessableEntity, "CSR IP addresses do not match join grant")
+	}
+
+	// Check 4: Key usage
+	return verifyCSRUsage(csr)
+}
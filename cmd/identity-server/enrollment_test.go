@@ -0,0 +1,193 @@
+package main
+
+import (
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"identity-metadata-server/internal/certificates"
+	"identity-metadata-server/internal/shared"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestJoinGrantStore(t *testing.T, grants ...JoinGrant) *JoinGrantStore {
+	path := filepath.Join(t.TempDir(), "grants.json")
+	data, err := json.Marshal(grants)
+	assert.NoError(t, err)
+	assert.NoError(t, os.WriteFile(path, data, 0600))
+	return NewJoinGrantStore(path)
+}
+
+func newTestJoinGrant(joinToken string) JoinGrant {
+	return JoinGrant{
+		TokenHash: HashJoinToken(joinToken),
+		Host:      "host.example.com",
+		Identity:  "host@example.iam.gserviceaccount.com",
+		Addresses: []string{testClientOrigin, "::1"},
+		ExpiresAt: time.Now().Add(time.Hour),
+	}
+}
+
+func newTestEnrollCSR(t *testing.T, hostname, identity string, ips ...string) string {
+	key, err := certificates.CreateECPrivateKeyPEM(certificates.KeyStrengthNormal)
+	assert.NoError(t, err)
+
+	addresses := []net.IP{}
+	for _, ip := range ips {
+		addresses = append(addresses, net.ParseIP(ip))
+	}
+
+	csrPEM, err := certificates.CreateClientCSR(key, hostname, identity, addresses)
+	assert.NoError(t, err)
+	return string(csrPEM)
+}
+
+func TestJoinGrantStore(t *testing.T) {
+	assert := assert.New(t)
+
+	expired := newTestJoinGrant("expired")
+	expired.ExpiresAt = time.Now().Add(-time.Minute)
+
+	bootstrap := newTestJoinGrant("")
+	bootstrap.TokenHash = ""
+	bootstrap.BootstrapSerial = "0A0B"
+
+	store := newTestJoinGrantStore(t, newTestJoinGrant("secret"), expired, bootstrap)
+
+	grant, err := store.Find("secret", "")
+	assert.NoError(err)
+	assert.Equal("host.example.com", grant.Host)
+
+	_, err = store.Find("wrong", "")
+	assert.ErrorIs(err, ErrorJoinGrantInvalid)
+
+	_, err = store.Find("expired", "")
+	assert.ErrorIs(err, ErrorJoinGrantInvalid)
+
+	_, err = store.Find("", "0a0b")
+	assert.NoError(err)
+
+	_, err = store.Find("", "")
+	assert.ErrorIs(err, ErrorJoinGrantInvalid)
+
+	// Grants can only be claimed once
+	assert.NoError(store.Claim(grant))
+	assert.ErrorIs(store.Claim(grant), ErrorJoinGrantInvalid)
+
+	_, err = store.Find("secret", "")
+	assert.ErrorIs(err, ErrorJoinGrantInvalid)
+
+	// The claim is persisted
+	_, err = NewJoinGrantStore(store.path).Find("secret", "")
+	assert.ErrorIs(err, ErrorJoinGrantInvalid)
+
+	// Released grants can be used again
+	assert.NoError(store.Release(grant))
+	_, err = store.Find("secret", "")
+	assert.NoError(err)
+
+	// A missing file contains no grants
+	_, err = NewJoinGrantStore(filepath.Join(t.TempDir(), "missing.json")).Find("secret", "")
+	assert.ErrorIs(err, ErrorJoinGrantInvalid)
+}
+
+func TestJoinGrantStoreSharedFile(t *testing.T) {
+	assert := assert.New(t)
+
+	grant := newTestJoinGrant("secret")
+	store := newTestJoinGrantStore(t, grant)
+
+	// Stores sharing a file act like instances sharing a volume.
+	// Only one of them can claim the grant.
+	claimed := atomic.Int32{}
+	wg := sync.WaitGroup{}
+	for range 8 {
+		wg.Go(func() {
+			if NewJoinGrantStore(store.path).Claim(grant) == nil {
+				claimed.Add(1)
+			}
+		})
+	}
+	wg.Wait()
+	assert.Equal(int32(1), claimed.Load())
+}
+
+func TestVerifyEnrollRequest(t *testing.T) {
+	assert := assert.New(t)
+	grant := newTestJoinGrant("secret")
+
+	parse := func(csrPEM string) *x509.CertificateRequest {
+		block, _ := pem.Decode([]byte(csrPEM))
+		csr, err := x509.ParseCertificateRequest(block.Bytes)
+		assert.NoError(err)
+		return csr
+	}
+
+	csr := parse(newTestEnrollCSR(t, grant.Host, grant.Identity, "::1", testClientOrigin))
+	assert.NoError(VerifyEnrollRequest(csr, grant))
+
+	csr = parse(newTestEnrollCSR(t, "other.example.com", grant.Identity, testClientOrigin, "::1"))
+	assert.Error(VerifyEnrollRequest(csr, grant))
+
+	csr = parse(newTestEnrollCSR(t, grant.Host, "admin@example.iam.gserviceaccount.com", testClientOrigin, "::1"))
+	assert.Error(VerifyEnrollRequest(csr, grant))
+
+	csr = parse(newTestEnrollCSR(t, grant.Host, grant.Identity, testClientOrigin))
+	assert.Error(VerifyEnrollRequest(csr, grant))
+
+	csr = parse(newTestEnrollCSR(t, grant.Host, grant.Identity, testClientOrigin, "::1", "10.0.0.2"))
+	assert.Error(VerifyEnrollRequest(csr, grant))
+}
+
+func TestHandleEnrollRequestErrors(t *testing.T) {
+	assert := assert.New(t)
+
+	wrongOrigin := newTestJoinGrant("elsewhere")
+	wrongOrigin.Addresses = []string{"10.0.0.99"}
+
+	bootstrapCert, crl := newTestClientCertificate(t, "bootstrap.example.com")
+	bootstrap := newTestJoinGrant("")
+	bootstrap.TokenHash = ""
+	bootstrap.BootstrapSerial = "0a0b"
+
+	store := newTestJoinGrantStore(t, newTestJoinGrant("secret"), wrongOrigin, bootstrap)
+	validCSR := newTestEnrollCSR(t, "host.example.com", "host@example.iam.gserviceaccount.com", testClientOrigin, "::1")
+
+	enroll := func(cert *x509.Certificate, request shared.EnrollRequest) int {
+		c, w := newTestMTLSRequest(cert, http.MethodPost, "/enroll", gin.MIMEJSON, newTestJSONBody(t, request))
+		HandleEnrollRequest(c, crl, store, nil)
+		return w.Code
+	}
+
+	// Unknown join token
+	assert.Equal(http.StatusUnauthorized, enroll(nil, shared.EnrollRequest{CSR: validCSR, JoinToken: "wrong"}))
+
+	// Neither join token nor bootstrap certificate
+	assert.Equal(http.StatusUnauthorized, enroll(nil, shared.EnrollRequest{CSR: validCSR}))
+
+	// Bootstrap certificate without grant
+	assert.Equal(http.StatusUnauthorized, enroll(bootstrapCert, shared.EnrollRequest{CSR: validCSR}))
+
+	// Request from an address not listed in the grant
+	assert.Equal(http.StatusForbidden, enroll(nil, shared.EnrollRequest{CSR: validCSR, JoinToken: "elsewhere"}))
+
+	// Invalid CSR
+	assert.Equal(http.StatusBadRequest, enroll(nil, shared.EnrollRequest{CSR: "invalid", JoinToken: "secret"}))
+
+	// CSR not matching the grant
+	otherCSR := newTestEnrollCSR(t, "other.example.com", "host@example.iam.gserviceaccount.com", testClientOrigin, "::1")
+	assert.Equal(http.StatusUnprocessableEntity, enroll(nil, shared.EnrollRequest{CSR: otherCSR, JoinToken: "secret"}))
+
+	// Failed requests do not use up the grant
+	_, err := store.Find("secret", "")
+	assert.NoError(err)
+}
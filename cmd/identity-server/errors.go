@@ -49,6 +49,12 @@ var (
 		Message: "Certificate not signed by trust root",
 		Code:    http.StatusForbidden,
 	}
+	// ErrorCertificateUsage is returned when a client certificate is not
+	// allowed to be used for client authentication.
+	ErrorCertificateUsage = shared.ErrorWithStatus{
+		Message: "Certificate not valid for client authentication",
+		Code:    http.StatusForbidden,
+	}
 	// ErrorCertificateRevoked is returned when a client certificate has been
 	// revoked.
 	ErrorCertificateRevoked = shared.ErrorWithStatus{
@@ -67,4 +73,100 @@ var (
 		Message: "Token request not allowed for given origin",
 		Code:    http.StatusForbidden,
 	}
+	// ErrorTokenRequestDenied is returned when the token policy denies all
+	// token requests for a client.
+	ErrorTokenRequestDenied = shared.ErrorWithStatus{
+		Message: "Token requests are denied for this client",
+		Code:    http.StatusForbidden,
+	}
+	// ErrorTokenLifetimeNotAllowed is returned when the requested token
+	// lifetime exceeds the maximum lifetime allowed by the token policy.
+	ErrorTokenLifetimeNotAllowed = shared.ErrorWithStatus{
+		Message: "Requested token lifetime exceeds the allowed maximum",
+		Code:    http.StatusBadRequest,
+	}
+	// ErrorTokenAudienceNotAllowed is returned when a requested audience is not
+	// allowed by the token policy.
+	ErrorTokenAudienceNotAllowed = shared.ErrorWithStatus{
+		Message: "Requested audience is not allowed",
+		Code:    http.StatusForbidden,
+	}
+	// ErrorJoinGrantInvalid is returned when an enrollment request does not
+	// match any unused and unexpired join grant.
+	ErrorJoinGrantInvalid = shared.ErrorWithStatus{
+		Message: "Join grant not found, expired or already used",
+		Code:    http.StatusUnauthorized,
+	}
+	// ErrorPendingRenewalNotFound is returned when a pending renewal does not
+	// exist, e.g. because it has expired.
+	ErrorPendingRenewalNotFound = shared.ErrorWithStatus{
+		Message: "Pending renewal not found",
+		Code:    http.StatusNotFound,
+	}
+	// ErrorPendingRenewalRejected is returned by /renew when the requested
+	// renewal has been rejected by an operator.
+	ErrorPendingRenewalRejected = shared.ErrorWithStatus{
+		Message: "Renewal has been rejected",
+		Code:    http.StatusForbidden,
+	}
+	// ErrorPendingRenewalApproved is returned when rejecting a renewal that
+	// has already been approved.
+	ErrorPendingRenewalApproved = shared.ErrorWithStatus{
+		Message: "Pending renewal is already approved",
+		Code:    http.StatusConflict,
+	}
+	// ErrorSPIFFENotConfigured is returned by the SPIFFE endpoints if no
+	// trust domain is configured.
+	ErrorSPIFFENotConfigured = shared.ErrorWithStatus{
+		Message: "SPIFFE is not configured",
+		Code:    http.StatusNotFound,
+	}
+	// ErrorX509SVIDNotConfigured is returned by /spiffe/x509-svid if no
+	// SPIFFE certificate authority is configured.
+	ErrorX509SVIDNotConfigured = shared.ErrorWithStatus{
+		Message: "No certificate authority for X.509-SVIDs configured",
+		Code:    http.StatusNotFound,
+	}
+	// ErrorJWTSVIDAlgorithm is returned when the active signing key uses an
+	// algorithm that is not allowed for JWT-SVIDs.
+	ErrorJWTSVIDAlgorithm = shared.ErrorWithStatus{
+		Message: "Signing key algorithm cannot be used for JWT-SVIDs",
+		Code:    http.StatusInternalServerError,
+	}
+	// ErrorRevocationNotAllowed is returned when a client tries to revoke a
+	// certificate other than its own without being a revocation admin.
+	ErrorRevocationNotAllowed = shared.ErrorWithStatus{
+		Message: "Only revocation admins can revoke other certificates",
+		Code:    http.StatusForbidden,
+	}
+	// ErrorNoMatchingCertificate is returned when a revocation request does not
+	// match any valid certificate.
+	ErrorNoMatchingCertificate = shared.ErrorWithStatus{
+		Message: "No matching certificate found",
+		Code:    http.StatusNotFound,
+	}
+	// ErrorAdminRoleRequired is returned when a client calls an admin endpoint
+	// without having the required admin role.
+	ErrorAdminRoleRequired = shared.ErrorWithStatus{
+		Message: "Admin role required",
+		Code:    http.StatusForbidden,
+	}
+	// ErrorCertificateQuarantined is returned when a client certificate has been
+	// quarantined by the anomaly detection.
+	ErrorCertificateQuarantined = shared.ErrorWithStatus{
+		Message: "Certificate has been quarantined",
+		Code:    http.StatusForbidden,
+	}
+	// ErrorClientVerificationUnavailable is returned by endpoints requiring a
+	// client certificate while the client root CAs or CRLs are not loaded.
+	ErrorClientVerificationUnavailable = shared.ErrorWithStatus{
+		Message: "Client certificates cannot be verified at the moment",
+		Code:    http.StatusServiceUnavailable,
+	}
+	// ErrorRevocationListStale is returned when the CRLs are past their
+	// NextUpdate time and the stale CRL policy rejects client certificates.
+	ErrorRevocationListStale = shared.ErrorWithStatus{
+		Message: "Certificate revocation list is outdated",
+		Code:    http.StatusServiceUnavailable,
+	}
 )
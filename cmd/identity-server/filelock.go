@@ -0,0 +1,32 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"syscall"
+)
+
+// lockFile takes an exclusive lock for the given file and blocks until the
+// lock is available. The returned function releases the lock.
+// The lock is held on a separate file next to the given one, as the stores
+// replace their file on every write. This synchronizes all processes using
+// the same file, including multiple instances on a shared volume, as long as
+// the file system supports flock.
+func lockFile(path string) (func(), error) {
+	lockPath := path + ".lock"
+	lock, err := os.OpenFile(lockPath, os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		return nil, errors.Join(err, fmt.Errorf("failed to open lock file %s", lockPath))
+	}
+
+	if err := syscall.Flock(int(lock.Fd()), syscall.LOCK_EX); err != nil {
+		_ = lock.Close()
+		return nil, errors.Join(err, fmt.Errorf("failed to lock %s", lockPath))
+	}
+
+	return func() {
+		_ = syscall.Flock(int(lock.Fd()), syscall.LOCK_UN)
+		_ = lock.Close()
+	}, nil
+}
@@ -58,6 +58,14 @@ func NewClientFromCert(cert *x509.Certificate) (*IdentityClient, error) {
 // If the certificate is valid, and the client is allowed to connect from the
 // client IP address, it returns a new IdentityClient.
 func NewClientFromContext(c *gin.Context, crl *CertificateRevocationList) (*IdentityClient, error) {
+	return newClientFromContext(c, crl, nil)
+}
+
+// newClientFromContext works like NewClientFromContext, but additionally
+// accepts requests from origins not listed in the certificate if acceptOrigin
+// returns true for them. This is used for renewals that move a host to new IP
+// addresses. acceptOrigin may be nil.
+func newClientFromContext(c *gin.Context, crl *CertificateRevocationList, acceptOrigin func(*x509.Certificate, net.IP) bool) (*IdentityClient, error) {
 	if len(c.Request.TLS.PeerCertificates) < 1 {
 		return nil, ErrorNoClientCert
 	}
@@ -68,12 +76,21 @@ func NewClientFromContext(c *gin.Context, crl *CertificateRevocationList) (*Iden
 		return nil, err
 	}
 
+	now := time.Now()
 	originIP := net.ParseIP(c.ClientIP())
-	if !client.IsFromValidOrigin(originIP) {
+	isAccepted := client.IsFromValidOrigin(originIP) ||
+		(acceptOrigin != nil && originIP != nil && acceptOrigin(client.Certificate, originIP))
+	if !isAccepted {
 		log.Error().
 			Str("client", c.ClientIP()).
 			Str("identity", client.Identity).
 			Msg("access request from invalid origin")
+
+		// Only valid certificates are counted, so that a forged or revoked
+		// certificate cannot get another host's certificate quarantined.
+		if client.VerifyCertificate(crl) == nil {
+			anomalyDetector.ReportInvalidOrigin(client, originIP, now)
+		}
 		return nil, ErrorNotAllowedForOrigin
 	}
 
@@ -81,6 +98,12 @@ func NewClientFromContext(c *gin.Context, crl *CertificateRevocationList) (*Iden
 		return nil, err
 	}
 
+	if anomalyDetector.IsQuarantined(client.SerialNumber, now) {
+		return nil, ErrorCertificateQuarantined
+	}
+	anomalyDetector.ReportUse(client, originIP, now)
+
+	clientInventory.Record(client, c.ClientIP(), now)
 	return client, nil
 }
 
@@ -104,14 +127,19 @@ func (client *IdentityClient) VerifyCertificate(crl *CertificateRevocationList)
 		return ErrorCertificateExpired
 	}
 
-	if !crl.IsCertFromPool(client.Certificate) {
-		return ErrorUnknownTrustRoot
+	chains, err := crl.VerifyChains(client.Certificate)
+	if err != nil {
+		return err
 	}
 
-	if crl.IsSerialRevoked(client.SerialNumber) {
+	if crl.IsChainRevoked(chains) {
 		return ErrorCertificateRevoked
 	}
 
+	if err := crl.CheckFreshness(chains, now); err != nil {
+		return err
+	}
+
 	return nil
 }
 
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"net/http"
+
+	"identity-metadata-server/pkg/identitytoken"
+
+	"github.com/gin-gonic/gin"
+	"github.com/rs/zerolog/log"
+)
+
+// HandleIntrospectRequest implements token introspection as described in
+// RFC 7662. Callers authenticate through mTLS and pass the token as "token"
+// form parameter.
+// A token is active if it has been signed by one of the published keys, the
+// issuer matches, it is not expired and the certificate it was issued to has
+// not been revoked.
+func HandleIntrospectRequest(c *gin.Context, crl *CertificateRevocationList) {
+	c.Header("Cache-Control", "no-store")
+
+	if _, err := NewClientFromContext(c, crl); err != nil {
+		log.Error().Err(err).Msg("Failed to get client from context")
+		oauthClientError(c, err)
+		return
+	}
+
+	token := c.PostForm("token")
+	if len(token) == 0 {
+		oauthError(c, http.StatusBadRequest, oauthErrorInvalidRequest, "token must be set")
+		return
+	}
+
+	claims, err := verifyServerToken(token)
+	if err != nil {
+		log.Debug().Err(err).Msg("Introspected token is not valid")
+		c.JSON(http.StatusOK, identitytoken.IntrospectionResponse{Active: false})
+		return
+	}
+
+	if len(claims.NodeClaims.Serial) > 0 && crl.IsSerialRevoked(claims.NodeClaims.Serial) {
+		log.Debug().Str("serial", claims.NodeClaims.Serial).Msg("Introspected token was issued to a revoked certificate")
+		c.JSON(http.StatusOK, identitytoken.IntrospectionResponse{Active: false})
+		return
+	}
+
+	c.JSON(http.StatusOK, identitytoken.IntrospectionResponse{
+		Active: true,
+		Claims: claims,
+	})
+}
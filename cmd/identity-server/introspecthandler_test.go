@@ -0,0 +1,75 @@
+package main
+
+import (
+	"identity-metadata-server/pkg/identitytoken"
+	"net"
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	jsoniter "github.com/json-iterator/go"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIntrospect(t *testing.T) {
+	assert := assert.New(t)
+	defer viper.Reset()
+
+	viper.Set("server.key", writeTestKey(t, t.TempDir(), "server.pem"))
+	viper.Set("server.keyName", "test")
+	viper.Set("server.issuer", "https://identity-server")
+	assert.NoError(initJWKS())
+
+	certs, crl := newTestClientCertificates(t, "host.example.com", "other.example.com")
+	client, err := NewClientFromCert(certs[0])
+	assert.NoError(err)
+
+	token, err := issueClientToken(client, net.ParseIP(testClientOrigin), []string{"https://a.example.com"}, time.Minute*5)
+	assert.NoError(err)
+
+	introspect := func(form url.Values) (int, identitytoken.IntrospectionResponse) {
+		c, w := newTestMTLSRequest(certs[1], http.MethodPost, "/introspect", gin.MIMEPOSTForm, newTestFormBody(form))
+		HandleIntrospectRequest(c, crl)
+		assert.Equal("no-store", w.Header().Get("Cache-Control"))
+
+		response := identitytoken.IntrospectionResponse{}
+		if w.Code == http.StatusOK {
+			assert.NoError(jsoniter.Unmarshal(w.Body.Bytes(), &response))
+		}
+		return w.Code, response
+	}
+
+	// Valid tokens can be introspected by any client
+	code, response := introspect(url.Values{"token": {token}})
+	assert.Equal(http.StatusOK, code)
+	assert.True(response.Active)
+	if assert.NotNil(response.Claims) {
+		assert.Equal("host.example.com", response.Claims.Subject)
+		assert.Equal(client.SerialNumber, response.Claims.NodeClaims.Serial)
+		assert.Nil(response.Claims.Extra)
+	}
+
+	// Invalid tokens are reported as inactive
+	code, response = introspect(url.Values{"token": {"not-a-token"}})
+	assert.Equal(http.StatusOK, code)
+	assert.False(response.Active)
+	assert.Nil(response.Claims)
+
+	// Missing tokens are rejected
+	code, _ = introspect(url.Values{})
+	assert.Equal(http.StatusBadRequest, code)
+
+	// Tokens issued to revoked certificates are inactive
+	crl.revoked[client.SerialNumber] = struct{}{}
+	code, response = introspect(url.Values{"token": {token}})
+	assert.Equal(http.StatusOK, code)
+	assert.False(response.Active)
+
+	// Clients without certificate are rejected
+	c, w := newTestMTLSRequest(nil, http.MethodPost, "/introspect", gin.MIMEPOSTForm, newTestFormBody(url.Values{"token": {token}}))
+	HandleIntrospectRequest(c, crl)
+	assert.Equal(http.StatusUnauthorized, w.Code)
+}
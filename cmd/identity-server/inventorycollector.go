@@ -0,0 +1,87 @@
+package main
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// inventoryCollector exports aggregated counts of the client inventory as
+// prometheus metrics. Per host data is only available through /admin/clients,
+// as a host label would create one time series per host.
+type inventoryCollector struct {
+	// days lists the windows used for the expiring and not seen counts.
+	days []int
+
+	clients  *prometheus.Desc
+	expired  *prometheus.Desc
+	expiring *prometheus.Desc
+	notSeen  *prometheus.Desc
+}
+
+// newInventoryCollector creates a collector for the global client inventory.
+func newInventoryCollector(days []int) *inventoryCollector {
+	return &inventoryCollector{
+		days: days,
+		clients: prometheus.NewDesc(
+			"identity_server_clients",
+			"Number of hosts in the client inventory",
+			nil, nil),
+		expired: prometheus.NewDesc(
+			"identity_server_clients_expired",
+			"Number of hosts whose current client certificate has expired",
+			nil, nil),
+		expiring: prometheus.NewDesc(
+			"identity_server_clients_expiring",
+			"Number of hosts with a valid client certificate expiring within the given number of days",
+			[]string{"days"}, nil),
+		notSeen: prometheus.NewDesc(
+			"identity_server_clients_not_seen",
+			"Number of hosts that have not been seen for the given number of days",
+			[]string{"days"}, nil),
+	}
+}
+
+// Describe implements prometheus.Collector.
+func (ic *inventoryCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- ic.clients
+	ch <- ic.expired
+	ch <- ic.expiring
+	ch <- ic.notSeen
+}
+
+// Collect implements prometheus.Collector.
+func (ic *inventoryCollector) Collect(ch chan<- prometheus.Metric) {
+	now := time.Now()
+	entries := clientInventory.Entries(InventoryFilter{})
+
+	expired := 0
+	expiring := make([]int, len(ic.days))
+	notSeen := make([]int, len(ic.days))
+
+	for _, entry := range entries {
+		if !entry.NotAfter.After(now) {
+			expired++
+		}
+
+		for i, days := range ic.days {
+			window := time.Duration(days) * 24 * time.Hour
+			if entry.NotAfter.After(now) && entry.NotAfter.Before(now.Add(window)) {
+				expiring[i]++
+			}
+			if entry.LastSeen.Before(now.Add(-window)) {
+				notSeen[i]++
+			}
+		}
+	}
+
+	ch <- prometheus.MustNewConstMetric(ic.clients, prometheus.GaugeValue, float64(len(entries)))
+	ch <- prometheus.MustNewConstMetric(ic.expired, prometheus.GaugeValue, float64(expired))
+
+	for i, days := range ic.days {
+		label := strconv.Itoa(days)
+		ch <- prometheus.MustNewConstMetric(ic.expiring, prometheus.GaugeValue, float64(expiring[i]), label)
+		ch <- prometheus.MustNewConstMetric(ic.notSeen, prometheus.GaugeValue, float64(notSeen[i]), label)
+	}
+}
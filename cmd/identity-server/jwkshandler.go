@@ -2,13 +2,16 @@ package main
 
 import (
 	"net/http"
+	"time"
 
 	"github.com/gin-gonic/gin"
 )
 
 // HandleJWKSRequest returns the JWKS as a JSON response.
-// This endpoint is used by clients to fetch the server's public key.
+// This endpoint is used by clients to fetch the server's public keys.
+// The set contains the active signing key, keys scheduled to become active
+// and retired keys that might still have been used to sign valid tokens.
 func HandleJWKSRequest(c *gin.Context) {
 	// This endpoint is public, no need to check the client certificate
-	c.JSON(http.StatusOK, jwks)
+	c.JSON(http.StatusOK, serverKeys.Load().jwks(time.Now()))
 }
@@ -1,12 +1,20 @@
 package main
 
 import (
+	"context"
+	"crypto"
 	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
 	"crypto/rsa"
 	"crypto/x509"
 	"encoding/pem"
 	"fmt"
 	"os"
+	"sync/atomic"
+	"time"
+
+	"identity-metadata-server/pkg/identitytoken"
 
 	"github.com/golang-jwt/jwt/v5"
 	"github.com/lestrrat-go/jwx/jwk"
@@ -15,42 +23,37 @@ import (
 )
 
 // NodeClaims holds fields we use to identify a node.
-// These claims have to be unique for each node.
-// For Workload Identity Federation, these fields need to be
-// the same as the ones used in the workload identity pool.
-type NodeClaims struct {
-	Identity string `json:"identity"`
-}
+// See identitytoken.NodeClaims.
+type NodeClaims = identitytoken.NodeClaims
 
 // CustomClaims holds the claims we want to include in the JWT.
-type CustomClaims struct {
-	NodeClaims NodeClaims `json:"node_claims"`
-	jwt.RegisteredClaims
-}
+// See identitytoken.Claims.
+type CustomClaims = identitytoken.Claims
 
 type signingKey struct {
 	signingKey interface{}
 	setKey     jwk.Key
 	method     jwt.SigningMethod
+	// keyID is used as the `kid` header of tokens signed by this key.
+	keyID string
+	// activeFrom is the time from which on this key is used for signing.
+	activeFrom time.Time
 }
 
 var (
-	jwks      jwk.Set
-	serverKey *signingKey
+	// serverKeys holds all keys published through the JWKS.
+	// The pointer is swapped atomically when the keys are reloaded.
+	serverKeys atomic.Pointer[keyRing]
 )
 
-func newSigningKey(setKey jwk.Key, nativeKey interface{}, method jwt.SigningMethod) *signingKey {
+func newSigningKey(setKey jwk.Key, nativeKey interface{}) (*signingKey, error) {
 	sk := signingKey{
 		signingKey: nativeKey,
 		setKey:     setKey,
-		method:     method,
 	}
 
-	keyId := viper.GetString("server.keyName")
-
 	// Set required fields
 	_ = sk.setKey.Set(jwk.KeyUsageKey, "sig")
-	_ = sk.setKey.Set(jwk.KeyIDKey, keyId)
 
 	// Remove unsupported fields
 	_ = sk.setKey.Remove("d")
@@ -60,7 +63,64 @@ func newSigningKey(setKey jwk.Key, nativeKey interface{}, method jwt.SigningMeth
 	_ = sk.setKey.Remove("q")
 	_ = sk.setKey.Remove("qi")
 
-	return &sk
+	// Use the default algorithm for the given key
+	if err := sk.setAlgorithm(""); err != nil {
+		return nil, err
+	}
+
+	return &sk, nil
+}
+
+// signingMethodForKey returns the signing method to use with the given key.
+// If alg is empty, the method is derived from the key type, the curve or the
+// key size. Otherwise alg is checked for compatibility with the key.
+// RSA keys default to RS256, but can also be used with any of the RSxxx and
+// PSxxx algorithms. ECDSA keys use the algorithm matching their curve.
+func signingMethodForKey(nativeKey interface{}, alg string) (jwt.SigningMethod, error) {
+	var (
+		defaultMethod jwt.SigningMethod
+		allowed       []jwt.SigningMethod
+	)
+
+	switch key := nativeKey.(type) {
+	case *rsa.PrivateKey:
+		defaultMethod = jwt.SigningMethodRS256
+		allowed = []jwt.SigningMethod{
+			jwt.SigningMethodRS256, jwt.SigningMethodRS384, jwt.SigningMethodRS512,
+			jwt.SigningMethodPS256, jwt.SigningMethodPS384, jwt.SigningMethodPS512,
+		}
+
+	case *ecdsa.PrivateKey:
+		switch key.Curve {
+		case elliptic.P256():
+			defaultMethod = jwt.SigningMethodES256
+		case elliptic.P384():
+			defaultMethod = jwt.SigningMethodES384
+		case elliptic.P521():
+			defaultMethod = jwt.SigningMethodES512
+		default:
+			return nil, fmt.Errorf("unsupported ECDSA curve %s", key.Curve.Params().Name)
+		}
+		allowed = []jwt.SigningMethod{defaultMethod}
+
+	case ed25519.PrivateKey:
+		defaultMethod = jwt.SigningMethodEdDSA
+		allowed = []jwt.SigningMethod{defaultMethod}
+
+	default:
+		return nil, fmt.Errorf("unsupported key type %T", nativeKey)
+	}
+
+	if len(alg) == 0 {
+		return defaultMethod, nil
+	}
+
+	for _, method := range allowed {
+		if method.Alg() == alg {
+			return method, nil
+		}
+	}
+	return nil, fmt.Errorf("signing algorithm %s cannot be used with key type %T", alg, nativeKey)
 }
 
 func readJwkKeyFromPKCS8(data []byte) (*signingKey, bool, error) {
@@ -69,25 +129,33 @@ func readJwkKeyFromPKCS8(data []byte) (*signingKey, bool, error) {
 		return nil, false, err
 	}
 
+	var setKey jwk.Key
 	switch nativeKey := key.(type) {
 	case *rsa.PrivateKey:
-		setKey := jwk.NewRSAPrivateKey()
-		if err := setKey.FromRaw(nativeKey); err != nil {
-			return nil, true, err
-		}
-
-		return newSigningKey(setKey, nativeKey, jwt.SigningMethodRS256), true, nil
+		rsaKey := jwk.NewRSAPrivateKey()
+		err = rsaKey.FromRaw(nativeKey)
+		setKey = rsaKey
 
 	case *ecdsa.PrivateKey:
-		setKey := jwk.NewECDSAPrivateKey()
-		if err := setKey.FromRaw(nativeKey); err != nil {
-			return nil, true, err
-		}
-		return newSigningKey(setKey, nativeKey, jwt.SigningMethodES256), true, nil
+		ecKey := jwk.NewECDSAPrivateKey()
+		err = ecKey.FromRaw(nativeKey)
+		setKey = ecKey
+
+	case ed25519.PrivateKey:
+		okpKey := jwk.NewOKPPrivateKey()
+		err = okpKey.FromRaw(nativeKey)
+		setKey = okpKey
 
 	default:
 		return nil, true, fmt.Errorf("unsupported key type")
 	}
+
+	if err != nil {
+		return nil, true, err
+	}
+
+	sk, err := newSigningKey(setKey, key)
+	return sk, true, err
 }
 
 func readJwkKeyFromPKCS1(data []byte) (*signingKey, bool, error) {
@@ -101,7 +169,8 @@ func readJwkKeyFromPKCS1(data []byte) (*signingKey, bool, error) {
 		return nil, true, err
 	}
 
-	return newSigningKey(setKey, rsaKey, jwt.SigningMethodRS256), true, nil
+	sk, err := newSigningKey(setKey, rsaKey)
+	return sk, true, err
 }
 
 func readJwkKeyFromEC(data []byte) (*signingKey, bool, error) {
@@ -115,23 +184,45 @@ func readJwkKeyFromEC(data []byte) (*signingKey, bool, error) {
 		return nil, true, err
 	}
 
-	return newSigningKey(setKey, ecKey, jwt.SigningMethodES256), true, nil
+	sk, err := newSigningKey(setKey, ecKey)
+	return sk, true, err
 }
 
-// initJWKS generates a JWKS from the server's private key.
-// Calling this function will overwrite the global jwks variable, hence it can
-// also be used to reload the JWKS.
-func initJWKS() error {
-	// Read the private key from disk
-	keyPath := viper.GetString("server.key")
-	rawKey, err := os.ReadFile(keyPath)
+// setAlgorithm sets the signing algorithm of the key, both for signing and in
+// the JWKS. If alg is empty, the default algorithm for the key is used.
+func (sk *signingKey) setAlgorithm(alg string) error {
+	method, err := signingMethodForKey(sk.signingKey, alg)
 	if err != nil {
 		return err
 	}
 
+	if err := sk.setKey.Set(jwk.AlgorithmKey, method.Alg()); err != nil {
+		return err
+	}
+	sk.method = method
+	return nil
+}
+
+// setKeyID sets the `kid` of the key, both for signing and in the JWKS.
+func (sk *signingKey) setKeyID(keyID string) error {
+	if err := sk.setKey.Set(jwk.KeyIDKey, keyID); err != nil {
+		return err
+	}
+	sk.keyID = keyID
+	return nil
+}
+
+// readSigningKey reads a PEM encoded private key from disk.
+// The returned key has no key id and no activation time set.
+func readSigningKey(keyPath string) (*signingKey, error) {
+	rawKey, err := os.ReadFile(keyPath)
+	if err != nil {
+		return nil, err
+	}
+
 	block, _ := pem.Decode(rawKey)
 	if block == nil || len(block.Bytes) == 0 {
-		return fmt.Errorf("failed to decode PEM data from file %s", keyPath)
+		return nil, fmt.Errorf("failed to decode PEM data from file %s", keyPath)
 	}
 
 	parser := []func([]byte) (*signingKey, bool, error){
@@ -146,28 +237,61 @@ func initJWKS() error {
 			continue
 		}
 		if err != nil {
-			log.Error().Err(err).Msg("Failed to parse private key")
-			return err
+			log.Error().Err(err).Str("path", keyPath).Msg("Failed to parse private key")
+			return nil, err
 		}
 
 		// The key is in a supported format
-		serverKey = candidateKey
-		jwks = jwk.NewSet()
-		jwks.Add(serverKey.setKey)
-		return nil
+		return candidateKey, nil
+	}
+
+	return nil, fmt.Errorf("failed to parse private key %s: unsupported format", keyPath)
+}
+
+// initJWKS loads all configured signing keys and generates the JWKS from them.
+// Calling this function will atomically replace the global serverKeys, hence it
+// can also be used to reload the JWKS. If loading fails, the previously loaded
+// keys are kept.
+func initJWKS() error {
+	ring, err := loadKeyRing()
+	if err != nil {
+		return err
 	}
 
-	return fmt.Errorf("failed to parse private key: unsupported format")
+	serverKeys.Store(ring)
+	return nil
+}
+
+// publicKey returns the public part of the signing key.
+func (sk *signingKey) publicKey() (crypto.PublicKey, error) {
+	signer, isSigner := sk.signingKey.(crypto.Signer)
+	if !isSigner {
+		return nil, fmt.Errorf("signing key %s has no public key", sk.keyID)
+	}
+	return signer.Public(), nil
+}
+
+// verifyServerToken verifies a token issued by this server.
+// The signature is checked against all keys currently published in the JWKS.
+// The issuer has to match server.issuer and the token must not be expired.
+func verifyServerToken(token string) (*CustomClaims, error) {
+	verifier := identitytoken.NewVerifier(serverKeys.Load(), identitytoken.Config{
+		Issuer: viper.GetString("server.issuer"),
+	})
+	return verifier.Verify(context.Background(), token)
 }
 
 func buildAndSignJWT(claims CustomClaims) (string, error) {
-	if serverKey == nil {
+	activeKey := serverKeys.Load().activeKey(time.Now())
+	if activeKey == nil {
 		return "", ErrorSigningKeyNotLoaded
 	}
+	return activeKey.sign(claims)
+}
 
-	keyId := viper.GetString("server.keyName")
-
-	token := jwt.NewWithClaims(serverKey.method, claims)
-	token.Header["kid"] = keyId
-	return token.SignedString(serverKey.signingKey)
+// sign signs the given claims with the key, setting the `kid` header.
+func (sk *signingKey) sign(claims jwt.Claims) (string, error) {
+	token := jwt.NewWithClaims(sk.method, claims)
+	token.Header["kid"] = sk.keyID
+	return token.SignedString(sk.signingKey)
 }
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"context"
+	"identity-metadata-server/internal/certificates"
+	"identity-metadata-server/pkg/identitytoken"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	jsoniter "github.com/json-iterator/go"
+	"github.com/lestrrat-go/jwx/jwk"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSigningAlgorithms(t *testing.T) {
+	assert := assert.New(t)
+	dir := t.TempDir()
+	defer viper.Reset()
+
+	testCases := []struct {
+		keyType     certificates.KeyType
+		strength    certificates.KeyStrength
+		algorithm   string
+		expectedAlg string
+	}{
+		{certificates.ECDSA, certificates.KeyStrengthNormal, "", "ES256"},
+		{certificates.ECDSA, certificates.KeyStrengthMedium, "", "ES384"},
+		{certificates.ECDSA, certificates.KeyStrengthHigh, "", "ES512"},
+		{certificates.RSA, certificates.KeyStrengthNormal, "", "RS256"},
+		{certificates.RSA, certificates.KeyStrengthNormal, "PS256", "PS256"},
+		{certificates.ED25519, certificates.KeyStrengthNormal, "", "EdDSA"},
+	}
+
+	for _, tc := range testCases {
+		keyPEM, err := certificates.CreatePrivateKeyPEM(tc.keyType, tc.strength)
+		assert.NoError(err)
+
+		keyPath := filepath.Join(dir, tc.expectedAlg+".pem")
+		assert.NoError(os.WriteFile(keyPath, keyPEM, 0600))
+
+		viper.Set("server.key", keyPath)
+		viper.Set("server.keyName", tc.expectedAlg)
+		viper.Set("server.keyAlgorithm", tc.algorithm)
+		assert.NoError(initJWKS(), tc.expectedAlg)
+
+		signedToken, err := buildAndSignJWT(CustomClaims{
+			RegisteredClaims: jwt.RegisteredClaims{
+				Subject:   "test",
+				ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Minute)),
+			},
+		})
+		assert.NoError(err, tc.expectedAlg)
+
+		// Verify the token using the public key from the JWKS
+		jwksJSON, err := jsoniter.Marshal(serverKeys.Load().jwks(time.Now()))
+		assert.NoError(err)
+
+		set, err := jwk.Parse(jwksJSON)
+		assert.NoError(err)
+
+		publishedKey, found := set.LookupKeyID(tc.expectedAlg)
+		assert.True(found, tc.expectedAlg)
+		assert.Equal(tc.expectedAlg, publishedKey.Algorithm())
+
+		publicKey := any(nil)
+		assert.NoError(publishedKey.Raw(&publicKey))
+
+		token, err := jwt.Parse(signedToken, func(token *jwt.Token) (any, error) {
+			return publicKey, nil
+		}, jwt.WithValidMethods([]string{tc.expectedAlg}))
+		assert.NoError(err, tc.expectedAlg)
+		assert.True(token.Valid)
+
+		// Make sure no private key material is published
+		it := set.Iterate(context.Background())
+		for it.Next(context.Background()) {
+			_, hasPrivate := it.Pair().Value.(jwk.Key).Get("d")
+			assert.False(hasPrivate, tc.expectedAlg)
+		}
+	}
+}
+
+func TestSigningAlgorithmMismatch(t *testing.T) {
+	assert := assert.New(t)
+	dir := t.TempDir()
+	defer viper.Reset()
+
+	viper.Set("server.key", writeTestKey(t, dir, "ec.pem"))
+	viper.Set("server.keyName", "ec")
+	viper.Set("server.keyAlgorithm", "ES384")
+	assert.Error(initJWKS())
+
+	viper.Set("server.keyAlgorithm", "PS256")
+	assert.Error(initJWKS())
+}
+
+func TestCertificateBoundToken(t *testing.T) {
+	assert := assert.New(t)
+	defer viper.Reset()
+
+	viper.Set("server.key", writeTestKey(t, t.TempDir(), "server.pem"))
+	viper.Set("server.keyName", "test")
+	assert.NoError(initJWKS())
+
+	cert := CreateDummyCertificate("host.example.com", "test@example.com", nil)
+	cert.Raw = []byte("client certificate")
+	otherCert := CreateDummyCertificate("other.example.com", "test@example.com", nil)
+	otherCert.Raw = []byte("other certificate")
+
+	boundToken, err := generateOIDCToken("test@example.com", "host.example.com", []string{"test"}, time.Minute, tokenOptions{
+		confirmation: identitytoken.NewCertificateConfirmation(cert),
+	})
+	assert.NoError(err)
+	boundClaims, err := verifyServerToken(boundToken)
+	assert.NoError(err)
+	assert.NoError(identitytoken.VerifyCertificateBinding(boundClaims, cert))
+	assert.ErrorIs(identitytoken.VerifyCertificateBinding(boundClaims, otherCert), identitytoken.ErrorCertificateMismatch)
+
+	bearerToken, err := generateOIDCToken("test@example.com", "host.example.com", []string{"test"}, time.Minute, tokenOptions{})
+	assert.NoError(err)
+	bearerClaims, err := verifyServerToken(bearerToken)
+	assert.NoError(err)
+	assert.ErrorIs(identitytoken.VerifyCertificateBinding(bearerClaims, cert), identitytoken.ErrorTokenNotBound)
+}
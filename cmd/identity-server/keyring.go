@@ -0,0 +1,254 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/lestrrat-go/jwx/jwk"
+	"github.com/rs/zerolog/log"
+	"github.com/spf13/viper"
+)
+
+// signingKeyConfig describes a single entry of the server.keys list.
+type signingKeyConfig struct {
+	// Name is used as the `kid` of the key. It must be unique.
+	Name string `mapstructure:"name"`
+	// Path points to the PEM encoded private key.
+	Path string `mapstructure:"path"`
+	// ActiveFrom is an RFC3339 timestamp from which on the key is used for
+	// signing. An empty value means "active since forever".
+	ActiveFrom string `mapstructure:"activeFrom"`
+	// Algorithm is the JWA name of the signing algorithm, e.g. PS256.
+	// An empty value selects the default algorithm for the key.
+	Algorithm string `mapstructure:"algorithm"`
+}
+
+// keyRing holds all keys that are published through the JWKS.
+// Keys are ordered by the time they become active. The key that became active
+// last is used for signing, keys with an activation time in the future are
+// published ahead of time and keys that have been superseded are published
+// until the retention period has passed.
+// A keyRing is immutable after creation, i.e. it is safe for concurrent use.
+type keyRing struct {
+	keys      []*signingKey
+	retention time.Duration
+}
+
+// newKeyRing creates a new keyRing from the given keys.
+// The keys are sorted by their activation time. An error is returned if key
+// ids or activation times are not unique.
+func newKeyRing(keys []*signingKey, retention time.Duration) (*keyRing, error) {
+	if len(keys) == 0 {
+		return nil, errors.New("no signing keys configured")
+	}
+
+	sorted := make([]*signingKey, len(keys))
+	copy(sorted, keys)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return sorted[i].activeFrom.Before(sorted[j].activeFrom)
+	})
+
+	knownIDs := make(map[string]struct{}, len(sorted))
+	for i, key := range sorted {
+		if _, exists := knownIDs[key.keyID]; exists {
+			return nil, fmt.Errorf("duplicate signing key id %s", key.keyID)
+		}
+		knownIDs[key.keyID] = struct{}{}
+
+		if i > 0 && key.activeFrom.Equal(sorted[i-1].activeFrom) {
+			return nil, fmt.Errorf("signing keys %s and %s have the same activation time", sorted[i-1].keyID, key.keyID)
+		}
+	}
+
+	return &keyRing{
+		keys:      sorted,
+		retention: retention,
+	}, nil
+}
+
+// activeKey returns the key used for signing at the given time.
+// If no key is active yet, nil is returned.
+func (r *keyRing) activeKey(now time.Time) *signingKey {
+	if r == nil {
+		return nil
+	}
+
+	var active *signingKey
+	for _, key := range r.keys {
+		if key.activeFrom.After(now) {
+			break
+		}
+		active = key
+	}
+	return active
+}
+
+// retiredAt returns the time the key at the given index has been superseded
+// by the next key. If the key is never superseded, the zero time is returned.
+func (r *keyRing) retiredAt(idx int) time.Time {
+	if idx+1 >= len(r.keys) {
+		return time.Time{}
+	}
+	return r.keys[idx+1].activeFrom
+}
+
+// publishedKeys returns all keys that should be part of the JWKS at the given
+// time. This includes the active key, all upcoming keys and all retired keys
+// that are still within the retention period.
+func (r *keyRing) publishedKeys(now time.Time) []*signingKey {
+	if r == nil {
+		return nil
+	}
+
+	published := make([]*signingKey, 0, len(r.keys))
+	for i, key := range r.keys {
+		retiredAt := r.retiredAt(i)
+		if !retiredAt.IsZero() && !now.Before(retiredAt.Add(r.retention)) {
+			continue
+		}
+		published = append(published, key)
+	}
+	return published
+}
+
+// publishedKey returns the key with the given id if it is published at the
+// given time. If there is no such key, nil is returned.
+func (r *keyRing) publishedKey(keyID string, now time.Time) *signingKey {
+	for _, key := range r.publishedKeys(now) {
+		if key.keyID == keyID {
+			return key
+		}
+	}
+	return nil
+}
+
+// PublicKey implements identitytoken.KeyProvider for all keys published at
+// the time of the call.
+func (r *keyRing) PublicKey(_ context.Context, keyID string) (any, string, error) {
+	if r == nil {
+		return nil, "", ErrorSigningKeyNotLoaded
+	}
+
+	key := r.publishedKey(keyID, time.Now())
+	if key == nil {
+		return nil, "", fmt.Errorf("unknown key id %q", keyID)
+	}
+
+	publicKey, err := key.publicKey()
+	if err != nil {
+		return nil, "", err
+	}
+	return publicKey, key.method.Alg(), nil
+}
+
+// jwks builds the JWKS that is valid at the given time.
+func (r *keyRing) jwks(now time.Time) jwk.Set {
+	set := jwk.NewSet()
+	for _, key := range r.publishedKeys(now) {
+		set.Add(key.setKey)
+	}
+	return set
+}
+
+// nextTransition returns the next time at which the active key or the set of
+// published keys changes. If there is no such time, the zero time is returned.
+func (r *keyRing) nextTransition(now time.Time) time.Time {
+	if r == nil {
+		return time.Time{}
+	}
+
+	next := time.Time{}
+	consider := func(t time.Time) {
+		if t.After(now) && (next.IsZero() || t.Before(next)) {
+			next = t
+		}
+	}
+
+	for i, key := range r.keys {
+		consider(key.activeFrom)
+		if retiredAt := r.retiredAt(i); !retiredAt.IsZero() {
+			consider(retiredAt.Add(r.retention))
+		}
+	}
+	return next
+}
+
+// readSigningKeyConfig returns the list of configured signing keys.
+// If server.keys is not set, the legacy server.key and server.keyName
+// settings are used to create a single, always active key.
+func readSigningKeyConfig() ([]signingKeyConfig, error) {
+	keyConfigs := []signingKeyConfig{}
+	if err := viper.UnmarshalKey("server.keys", &keyConfigs); err != nil {
+		return nil, errors.Join(err, errors.New("failed to parse server.keys"))
+	}
+
+	if len(keyConfigs) == 0 {
+		keyConfigs = append(keyConfigs, signingKeyConfig{
+			Name:      viper.GetString("server.keyName"),
+			Path:      viper.GetString("server.key"),
+			Algorithm: viper.GetString("server.keyAlgorithm"),
+		})
+	}
+
+	return keyConfigs, nil
+}
+
+// loadKeyRing reads all configured signing keys from disk and creates a new
+// keyRing from them. An error is returned if no key is active at the time of
+// loading.
+func loadKeyRing() (*keyRing, error) {
+	keyConfigs, err := readSigningKeyConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	keys := make([]*signingKey, 0, len(keyConfigs))
+	for _, cfg := range keyConfigs {
+		if len(cfg.Name) == 0 {
+			return nil, fmt.Errorf("signing key %s has no name", cfg.Path)
+		}
+
+		activeFrom := time.Time{}
+		if len(cfg.ActiveFrom) > 0 {
+			if activeFrom, err = time.Parse(time.RFC3339, cfg.ActiveFrom); err != nil {
+				return nil, errors.Join(err, fmt.Errorf("invalid activeFrom for signing key %s", cfg.Name))
+			}
+		}
+
+		key, err := readSigningKey(cfg.Path)
+		if err != nil {
+			return nil, errors.Join(err, fmt.Errorf("failed to load signing key %s", cfg.Name))
+		}
+
+		if err := key.setKeyID(cfg.Name); err != nil {
+			return nil, err
+		}
+		if err := key.setAlgorithm(cfg.Algorithm); err != nil {
+			return nil, errors.Join(err, fmt.Errorf("invalid algorithm for signing key %s", cfg.Name))
+		}
+		key.activeFrom = activeFrom
+		keys = append(keys, key)
+	}
+
+	ring, err := newKeyRing(keys, viper.GetDuration("server.keyRetention"))
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	active := ring.activeKey(now)
+	if active == nil {
+		return nil, errors.New("none of the configured signing keys is active yet")
+	}
+
+	log.Info().
+		Str("kid", active.keyID).
+		Int("published", len(ring.publishedKeys(now))).
+		Time("nextTransition", ring.nextTransition(now)).
+		Msg("Loaded signing keys")
+
+	return ring, nil
+}
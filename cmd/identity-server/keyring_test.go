@@ -0,0 +1,118 @@
+package main
+
+import (
+	"identity-metadata-server/internal/certificates"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+)
+
+// writeTestKey creates a new private key in the given directory and returns
+// the path to it.
+func writeTestKey(t *testing.T, dir, name string) string {
+	keyPEM, err := certificates.CreatePrivateKeyPEM(certificates.ECDSA, certificates.KeyStrengthNormal)
+	assert.NoError(t, err)
+
+	keyPath := filepath.Join(dir, name)
+	assert.NoError(t, os.WriteFile(keyPath, keyPEM, 0600))
+	return keyPath
+}
+
+func newTestSigningKey(t *testing.T, dir, name string, activeFrom time.Time) *signingKey {
+	key, err := readSigningKey(writeTestKey(t, dir, name+".pem"))
+	assert.NoError(t, err)
+	assert.NoError(t, key.setKeyID(name))
+	key.activeFrom = activeFrom
+	return key
+}
+
+func TestKeyRingRotation(t *testing.T) {
+	assert := assert.New(t)
+	dir := t.TempDir()
+
+	now := time.Now()
+	retention := time.Hour
+
+	oldKey := newTestSigningKey(t, dir, "old", time.Time{})
+	currentKey := newTestSigningKey(t, dir, "current", now.Add(-30*time.Minute))
+	nextKey := newTestSigningKey(t, dir, "next", now.Add(time.Hour))
+
+	ring, err := newKeyRing([]*signingKey{nextKey, oldKey, currentKey}, retention)
+	assert.NoError(err)
+
+	// The latest key that is already active is used for signing
+	assert.Equal("current", ring.activeKey(now).keyID)
+	assert.Equal("old", ring.activeKey(now.Add(-time.Hour)).keyID)
+	assert.Equal("next", ring.activeKey(now.Add(2*time.Hour)).keyID)
+
+	// The old key is still within the retention period, the next key is
+	// published ahead of time.
+	published := ring.publishedKeys(now)
+	assert.Len(published, 3)
+	assert.Equal(3, ring.jwks(now).Len())
+
+	// After the retention period the old key is removed
+	published = ring.publishedKeys(now.Add(45 * time.Minute))
+	assert.Len(published, 2)
+	assert.Equal("current", published[0].keyID)
+	assert.Equal("next", published[1].keyID)
+
+	// The next transition is the removal of the old key
+	assert.Equal(now.Add(30*time.Minute), ring.nextTransition(now))
+}
+
+func TestKeyRingValidation(t *testing.T) {
+	assert := assert.New(t)
+	dir := t.TempDir()
+
+	_, err := newKeyRing(nil, time.Hour)
+	assert.Error(err)
+
+	// Duplicate key ids
+	first := newTestSigningKey(t, dir, "key", time.Time{})
+	second := newTestSigningKey(t, dir, "key", time.Now())
+	_, err = newKeyRing([]*signingKey{first, second}, time.Hour)
+	assert.Error(err)
+
+	// Same activation time
+	second = newTestSigningKey(t, dir, "other", time.Time{})
+	_, err = newKeyRing([]*signingKey{first, second}, time.Hour)
+	assert.Error(err)
+}
+
+func TestLoadKeyRing(t *testing.T) {
+	assert := assert.New(t)
+	dir := t.TempDir()
+	defer viper.Reset()
+
+	// Legacy configuration
+	viper.Set("server.key", writeTestKey(t, dir, "legacy.pem"))
+	viper.Set("server.keyName", "legacy")
+
+	ring, err := loadKeyRing()
+	assert.NoError(err)
+	assert.Equal("legacy", ring.activeKey(time.Now()).keyID)
+
+	// List of keys
+	viper.Set("server.keys", []map[string]any{
+		{"name": "first", "path": writeTestKey(t, dir, "first.pem")},
+		{"name": "second", "path": writeTestKey(t, dir, "second.pem"), "activeFrom": time.Now().Add(time.Hour).Format(time.RFC3339)},
+	})
+
+	ring, err = loadKeyRing()
+	assert.NoError(err)
+	assert.Equal("first", ring.activeKey(time.Now()).keyID)
+	assert.Equal(2, ring.jwks(time.Now()).Len())
+
+	// No active key
+	viper.Set("server.keys", []map[string]any{
+		{"name": "future", "path": writeTestKey(t, dir, "future.pem"), "activeFrom": time.Now().Add(time.Hour).Format(time.RFC3339)},
+	})
+
+	_, err = loadKeyRing()
+	assert.Error(err)
+}
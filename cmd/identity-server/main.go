@@ -2,7 +2,8 @@ package main
 
 import (
 	"context"
-	"crypto/tls"
+	"crypto/x509"
+	"errors"
 	"time"
 
 	"identity-metadata-server/internal/certificates"
@@ -21,7 +22,7 @@ import (
 )
 
 // initPrometheus will initialize the prometheus metrics for the server.
-func initPrometheus(router *gin.Engine) {
+func initPrometheus(router *gin.Engine, revocationList *CertificateRevocationList) {
 	// We create a new registry as using the default registry somehow
 	// generates a go routine leak.
 	registry := prometheus.NewRegistry()
@@ -30,6 +31,9 @@ func initPrometheus(router *gin.Engine) {
 
 	prometheus.MustRegister(collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}))
 	prometheus.MustRegister(collectors.NewGoCollector())
+	prometheus.MustRegister(newInventoryCollector(viper.GetIntSlice("server.inventory.metricDays")))
+	prometheus.MustRegister(anomalyDetector.collectors()...)
+	prometheus.MustRegister(newCRLCollector(revocationList))
 
 	// Initialize the ginprom middleware with the custom registry.
 	// This will automatically register the metrics with the default registry.
@@ -54,12 +58,98 @@ func initPrometheus(router *gin.Engine) {
 func main() {
 	viper.SetDefault("port", 8443)
 	viper.SetDefault("maxRequestDuration", 5*time.Second)
-	// If the server key changes, the JWKS must be re-registered with the workload identity provider
+	// If the server key changes, the JWKS must be re-registered with the workload identity provider.
+	// Only used if server.keys is not set.
 	viper.SetDefault("server.key", "server.pem")
-	// If the keyName is changed, the JWKS must be re-registered with the workload identity provider
+	// If the keyName is changed, the JWKS must be re-registered with the workload identity provider.
+	// Only used if server.keys is not set.
 	viper.SetDefault("server.keyName", "trivago-identity-server-01")
+	// The signing algorithm used with server.key. Derived from the key if empty.
+	// Only used if server.keys is not set.
+	viper.SetDefault("server.keyAlgorithm", "")
+	// List of signing keys with activation times. See signingKeyConfig.
+	viper.SetDefault("server.keys", []signingKeyConfig{})
+	// How long a superseded key is still published. Must be at least the maximum token lifetime.
+	viper.SetDefault("server.keyRetention", "24h")
 	// The server.issuer must match the one used in the workload identity provider
 	viper.SetDefault("server.issuer", "https://identity-server")
+	// Path to the token policy file. If empty, token requests are not restricted.
+	viper.SetDefault("server.tokenPolicy", "")
+	// Bind tokens issued through /token to the client certificate (RFC 8705)
+	viper.SetDefault("server.certificateBoundTokens", false)
+	// Template for the token subject. If empty, the hostname of the client is used.
+	viper.SetDefault("server.claims.subject", "")
+	// Additional claims derived from the client certificate, see ClaimTemplateConfig
+	viper.SetDefault("server.claims.extra", []ClaimTemplateConfig{})
+	// JSON file holding the join grants for /enroll. If empty, enrollment is disabled.
+	viper.SetDefault("server.enrollment.grantsFile", "")
+	// Public key types accepted by /renew, any of "rsa", "ecdsa" and "ed25519"
+	viper.SetDefault("server.csrPolicy.keyTypes", []string{CSRKeyTypeRSA, CSRKeyTypeECDSA, CSRKeyTypeEd25519})
+	// Minimum size of RSA keys and accepted curves of ECDSA keys accepted by /renew
+	viper.SetDefault("server.csrPolicy.minRSABits", 2048)
+	viper.SetDefault("server.csrPolicy.curves", []string{"P-256", "P-384", "P-521"})
+	// Reject renewals reusing the key of the current client certificate
+	viper.SetDefault("server.csrPolicy.requireNewKey", true)
+	// Reject renewals while the current client certificate is valid for longer than this.
+	// 0 allows renewals at any time.
+	viper.SetDefault("server.csrPolicy.renewalWindow", "0s")
+	// JSON file holding renewals that change the hostname or IP addresses of a client certificate.
+	// If empty, such renewals are rejected. Multiple instances must share the same file.
+	viper.SetDefault("server.pendingRenewals.file", "")
+	// Pending renewals that have not been picked up and rejections are removed after this long.
+	viper.SetDefault("server.pendingRenewals.retention", "168h")
+	// Approve renewals keeping the hostname with all new addresses in the network of a
+	// current address with this prefix length. /renew also accepts requests from this network.
+	// 0 disables the rule.
+	viper.SetDefault("server.pendingRenewals.autoApproval.ipv4PrefixLength", 0)
+	viper.SetDefault("server.pendingRenewals.autoApproval.ipv6PrefixLength", 0)
+	// SPIFFE trust domain of issued SVIDs, e.g. "example.org". If empty, SVIDs are not issued.
+	viper.SetDefault("server.spiffe.trustDomain", "")
+	// Template for the path of SPIFFE IDs, see ClaimTemplateConfig for the available fields.
+	viper.SetDefault("server.spiffe.pathTemplate", "/host/{{ .Host }}")
+	// Maximum lifetime of X.509-SVIDs and JWT-SVIDs
+	viper.SetDefault("server.spiffe.x509Lifetime", "1h")
+	viper.SetDefault("server.spiffe.jwtLifetime", "5m")
+	// How often consumers of /spiffe/bundle should poll for changes. The root
+	// certificates of the SPIFFE certificate authority are fetched at this interval.
+	viper.SetDefault("server.spiffe.bundleRefreshHint", "5m")
+	// Certificate authority dedicated to X.509-SVIDs, configured like server.certAuthority.
+	// SVIDs are issued for server and client authentication. If the backend is empty,
+	// X.509-SVIDs are not issued. The "local" backend sets the key usages itself, GCP CA
+	// pools must allow serverAuth and clientAuth in their issuance policy.
+	viper.SetDefault("server.spiffe.certAuthority.backend", "")
+	viper.SetDefault("server.spiffe.certAuthority.pools", []CertificatePoolConfig{})
+	viper.SetDefault("server.spiffe.certAuthority.poolTimeout", "10s")
+	viper.SetDefault("server.spiffe.certAuthority.local.crlLifetime", "24h")
+	// Hostnames (client certificate CN) allowed to revoke any certificate through /revoke
+	viper.SetDefault("server.revocation.admins", []string{})
+	// JSON file the client inventory is stored in. If empty, the inventory is kept in memory only.
+	viper.SetDefault("server.inventory.file", "")
+	// Hosts that have not been seen or renewed for this long are removed from the inventory.
+	viper.SetDefault("server.inventory.retention", "2160h")
+	// How often changes to the inventory are written to disk.
+	viper.SetDefault("server.inventory.flushInterval", "1m")
+	// Windows in days used for the expiring and not seen client metrics.
+	viper.SetDefault("server.inventory.metricDays", []int{1, 7, 30})
+	// Number of requests with a valid certificate from an unlisted origin within the window
+	// that is reported as anomaly. 0 disables the check.
+	viper.SetDefault("server.anomalyDetection.invalidOrigin.threshold", 5)
+	viper.SetDefault("server.anomalyDetection.invalidOrigin.window", "10m")
+	// Number of different listed origins using the same certificate within the window
+	// that is reported as anomaly. 0 disables the check.
+	viper.SetDefault("server.anomalyDetection.concurrentOrigins.threshold", 0)
+	viper.SetDefault("server.anomalyDetection.concurrentOrigins.window", "1m")
+	// What to do with the certificate on an anomaly, either "none", "quarantine" or "revoke"
+	viper.SetDefault("server.anomalyDetection.action", "none")
+	// How long a certificate is rejected when the action is "quarantine"
+	viper.SetDefault("server.anomalyDetection.quarantineDuration", "1h")
+	// Ask clients to renew right away if the CA that issued their certificate expires
+	// within this window. 0 disables the check.
+	viper.SetDefault("server.renewalHints.caExpiryWindow", "0s")
+	// Hostnames (client certificate CN) allowed to call read-only /admin endpoints
+	viper.SetDefault("server.admin.readers", []string{})
+	// Hostnames (client certificate CN) allowed to call all /admin endpoints
+	viper.SetDefault("server.admin.operators", []string{})
 	// The service account bound to the identity server
 	viper.SetDefault("server.identity", "identity-server@trv-identity-server-testing.iam.gserviceaccount.com")
 	// This can be used to overwrite the hostname
@@ -70,12 +160,36 @@ func main() {
 	viper.SetDefault("server.workloadIdentity.projectNumber", "866597189115")
 	viper.SetDefault("server.workloadIdentity.poolName", "integration-test")
 	viper.SetDefault("server.workloadIdentity.providerName", "identity-server")
+	// The certificate authority backend, either "gcp" or "local"
+	viper.SetDefault("server.certAuthority.backend", "gcp")
 	viper.SetDefault("server.certAuthority.project", "trv-identity-server-testing")
 	viper.SetDefault("server.certAuthority.region", "europe-west1")
 	viper.SetDefault("server.certAuthority.poolName", "integration-test-ca-pool")
-	viper.SetDefault("server.certAuthority.name", "identity-server-ca")
+	// List of CA pools with priorities and origin routing, see CertificatePoolConfig.
+	// If set, project, region and poolName are ignored. Only used with the "gcp" backend.
+	viper.SetDefault("server.certAuthority.pools", []CertificatePoolConfig{})
+	// Maximum time spent on a single CA pool when issuing a certificate before
+	// falling back to the next pool. This covers the token fetch and the
+	// certificate creation. The last pool is not limited. 0 disables the timeout.
+	viper.SetDefault("server.certAuthority.poolTimeout", "10s")
 	viper.SetDefault("server.certAuthority.crlRefresh", "24h")
 	viper.SetDefault("server.certAuthority.clientCertLifetime", "2160h")
+	// Directory the last fetched client root CAs and CRLs are stored in. They are used
+	// if the certificate authority cannot be reached. If empty, nothing is cached.
+	viper.SetDefault("server.certAuthority.cacheDir", "")
+	// How often to retry fetching client root CAs and CRLs if the certificate authority
+	// cannot be reached.
+	viper.SetDefault("server.certAuthority.retryInterval", "1m")
+	// What to do once the CRLs are past their NextUpdate time plus the grace period,
+	// either "serve", "reject" or "notReady".
+	viper.SetDefault("server.certAuthority.staleCRL.policy", "serve")
+	viper.SetDefault("server.certAuthority.staleCRL.gracePeriod", "1h")
+	// Settings for the "local" backend. The key and certificate are PEM encoded,
+	// issued certificates and revocations are stored in the state directory.
+	viper.SetDefault("server.certAuthority.local.certificate", "/etc/ca/ca.crt")
+	viper.SetDefault("server.certAuthority.local.key", "/etc/ca/ca.key")
+	viper.SetDefault("server.certAuthority.local.stateDir", "/var/lib/identity-server/ca")
+	viper.SetDefault("server.certAuthority.local.crlLifetime", "24h")
 
 	viper.SetDefault("tls.certificate", "/etc/certs/tls.crt")
 	viper.SetDefault("tls.key", "/etc/certs/tls.key")
@@ -90,15 +204,40 @@ func main() {
 		return
 	}
 
+	if err := initTokenPolicy(); err != nil {
+		log.Error().Err(err).Msg("Failed to initialize token policy")
+		return
+	}
+
+	if err := initClaimMapping(); err != nil {
+		log.Error().Err(err).Msg("Failed to initialize claim mapping")
+		return
+	}
+
+	if err := initCSRPolicy(); err != nil {
+		log.Error().Err(err).Msg("Failed to initialize CSR policy")
+		return
+	}
+
+	if err := initSPIFFE(); err != nil {
+		log.Error().Err(err).Msg("Failed to initialize SPIFFE")
+		return
+	}
+
+	if err := initClientInventory(); err != nil {
+		log.Error().Err(err).Msg("Failed to initialize client inventory")
+		return
+	}
+	clientInventory.StartFlushTimer(viper.GetDuration("server.inventory.flushInterval"))
+	defer clientInventory.StopFlushTimer()
+
 	// Configure mTLS certificate verification
 	// Note: We don't require the client to present a certificate.
 	// Endpoints that require a client certificate will need to check for it.
 
-	project := viper.GetString("server.certAuthority.project")
-	region := viper.GetString("server.certAuthority.region")
-	poolName := viper.GetString("server.certAuthority.poolName")
-	caName := viper.GetString("server.certAuthority.name")
 	clientCanBeVerified := true
+	trustRootsFromCache := false
+	trustIsPartial := false
 
 	clientCertLifetime := viper.GetDuration("server.certAuthority.clientCertLifetime")
 	switch {
@@ -110,56 +249,131 @@ func main() {
 		log.Warn().Msg("Client certificate lifetime is more than 90d. This is not recommended.")
 	}
 
-	clientRootCAs, clientRootCAPool, err := InitClientRootCA(project, region, poolName)
+	authority, err := NewCertificateAuthority()
+	if err != nil {
+		log.Fatal().Err(err).Msg("Failed to initialize certificate authority")
+	}
+
+	var spiffeAuthority *SPIFFEAuthority
+	if spiffeCA, err := NewSPIFFECertificateAuthority(); err != nil {
+		log.Fatal().Err(err).Msg("Failed to initialize SPIFFE certificate authority")
+	} else if spiffeCA != nil {
+		spiffeAuthority = NewSPIFFEAuthority(spiffeCA, viper.GetDuration("server.spiffe.bundleRefreshHint"))
+	}
+
+	trustCache, err := NewTrustCache()
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to initialize trust cache. Client root CAs and CRLs will not be cached")
+		trustCache = nil
+	}
+
+	clientRootCAs, clientRootCAPool, err := InitClientRootCA(authority, trustCache)
+	if errors.Is(err, certificates.ErrPartialResult) {
+		log.Error().Err(err).Msg("Failed to load the client root CA of some pools. Using the available ones")
+		trustIsPartial = true
+		err = nil
+	}
+	if err != nil && trustCache != nil {
+		log.Error().Err(err).Msg("Failed to load client root CA. Using cached client root CA")
+		trustRootsFromCache = true
+		clientRootCAs, clientRootCAPool, err = LoadCachedClientRootCA(trustCache)
+	}
 	if err != nil {
 		log.Error().Err(err).Msg("Failed to load client root CA. Switching to JWKS mode")
 		// We won't be able to verify client certificates.
-		// As of this all mTLS based endpoints will be disabled.
+		// As of this all mTLS based endpoints will be disabled until the
+		// certificate authority can be reached.
 		clientCanBeVerified = false
 	}
 
-	var revocationList *CertificateRevocationList
-	if clientCanBeVerified {
-		revocationList = NewCertificateRevocationList(
-			clientRootCAs,
-			project,
-			region,
-			poolName,
-			caName,
-			viper.GetDuration("server.certAuthority.crlRefresh"),
-		)
+	retryInterval := viper.GetDuration("server.certAuthority.retryInterval")
+	revocationList := NewCertificateRevocationList(
+		clientRootCAs,
+		authority,
+		trustCache,
+		viper.GetDuration("server.certAuthority.crlRefresh"),
+		retryInterval,
+	)
 
+	stalePolicy := StaleCRLPolicy(viper.GetString("server.certAuthority.staleCRL.policy"))
+	if err := revocationList.SetStalePolicy(stalePolicy, viper.GetDuration("server.certAuthority.staleCRL.gracePeriod")); err != nil {
+		log.Error().Err(err).Msg("Failed to initialize stale CRL policy")
+		return
+	}
+
+	if clientCanBeVerified {
 		// Update the CRL and start the timer
-		if err := revocationList.Update(context.Background()); err != nil {
-			log.Error().Err(err).Msg("Failed to update revoked certificates. Switching to JWKS mode")
-			// We won't be able to detect revoked certificates.
-			// As of this all mTLS based endpoints will be disabled.
-			clientCanBeVerified = false
+		if err := revocationList.Update(context.Background()); errors.Is(err, certificates.ErrPartialResult) {
+			log.Error().Err(err).Msg("Failed to update the revoked certificates of some pools")
+			trustIsPartial = true
+		} else if err != nil {
+			log.Error().Err(err).Msg("Failed to update revoked certificates")
+			if cacheErr := revocationList.LoadCached(); cacheErr != nil {
+				log.Error().Err(cacheErr).Msg("Failed to load cached revoked certificates. Switching to JWKS mode")
+				// We won't be able to detect revoked certificates.
+				// As of this all mTLS based endpoints will be disabled until
+				// the certificate authority can be reached.
+				clientCanBeVerified = false
+			}
 		}
+	}
 
+	if clientCanBeVerified {
 		// Start the timer for automatic updates
 		revocationList.StartUpdateTimer()
+	}
 
-		// Ensure the timer goroutine is stopped when the server shuts down
-		defer revocationList.StopUpdateTimer()
+	// Ensure the timer goroutine is stopped when the server shuts down.
+	// The timer might also be started later on by a reload.
+	defer revocationList.StopUpdateTimer()
+
+	revokeAnomaly := func(ctx context.Context, cert *x509.Certificate) error {
+		hexSerial := certificates.SerialToHex(cert)
+		if err := authority.RevokeCertificate(ctx, hexSerial, certificates.RevocationReasonKeyCompromise); err != nil {
+			return err
+		}
+		revocationList.AddRevoked(hexSerial, cert.NotAfter)
+		return nil
 	}
 
-	caConfig := certificates.GCPCertificateAuthorityConfig{
-		ProjectID:            project,
-		Location:             region,
-		CertificatePool:      poolName,
-		CertificateAuthority: caName,
+	if err := initAnomalyDetector(revokeAnomaly); err != nil {
+		log.Error().Err(err).Msg("Failed to initialize anomaly detection")
+		return
+	}
+
+	tlsCertificate := viper.GetString("tls.certificate")
+	tlsKey := viper.GetString("tls.key")
+
+	// Key material and trust roots can be reloaded at runtime by sending
+	// a SIGHUP to the process.
+	reloader := NewServerReloader(revocationList, authority, trustCache)
+	if clientCanBeVerified {
+		reloader.EnableClientVerification()
 	}
 
+	var pendingRenewals *PendingRenewalStore
+	if pendingFile := viper.GetString("server.pendingRenewals.file"); len(pendingFile) > 0 {
+		pendingRenewals = NewPendingRenewalStore(
+			pendingFile,
+			viper.GetDuration("server.pendingRenewals.retention"),
+			PendingRenewalAutoApproval{
+				IPv4PrefixLength: viper.GetInt("server.pendingRenewals.autoApproval.ipv4PrefixLength"),
+				IPv6PrefixLength: viper.GetInt("server.pendingRenewals.autoApproval.ipv6PrefixLength"),
+			})
+	}
+
+	renewalHints := NewRenewalHints(revocationList, viper.GetDuration("server.renewalHints.caExpiryWindow"))
+
 	// Configure the server
 	config := httpserver.Config{
-		Port:        viper.GetInt("port"),
-		PathTLSCert: viper.GetString("tls.certificate"),
-		PathTLSKey:  viper.GetString("tls.key"),
-		Health:      httpserver.AlwaysOk,
-		Ready:       httpserver.AlwaysOk,
+		Port:              viper.GetInt("port"),
+		PathTLSCert:       tlsCertificate,
+		PathTLSKey:        tlsKey,
+		CertCacheDuration: viper.GetDuration("tls.reload"),
+		Health:            httpserver.AlwaysOk,
+		Ready:             func(c *gin.Context) { HandleReadyRequest(c, revocationList) },
 		InitRoutes: func(router *gin.Engine) {
-			initPrometheus(router)
+			initPrometheus(router, revocationList)
 
 			maxRequestDuration := viper.GetDuration("maxRequestDuration")
 			router.Use(func(g *gin.Context) {
@@ -171,12 +385,44 @@ func main() {
 			}
 
 			router.GET("/jwks.json", HandleJWKSRequest)
+			router.GET("/.well-known/openid-configuration", HandleDiscoveryRequest)
+			router.GET("/spiffe/bundle", func(c *gin.Context) { HandleSPIFFEBundleRequest(c, spiffeAuthority) })
+
+			// mTLS based endpoints are only available while client
+			// certificates can be verified.
+			mtls := router.Group("/", reloader.RequireClientVerification(), renewalHints.Middleware())
+			mtls.GET("/token", func(c *gin.Context) { HandleTokenRequest(c, revocationList) })
+			mtls.POST("/oauth2/token", func(c *gin.Context) { HandleOAuthTokenRequest(c, revocationList) })
+			mtls.POST("/introspect", func(c *gin.Context) { HandleIntrospectRequest(c, revocationList) })
+			mtls.GET("/identity", func(c *gin.Context) { HandleIdentityRequest(c, revocationList) })
+			mtls.POST("/renew", func(c *gin.Context) { HandleRenewRequest(c, revocationList, authority, pendingRenewals) })
+			mtls.POST("/revoke", func(c *gin.Context) { HandleRevokeRequest(c, revocationList, authority) })
+			mtls.POST("/spiffe/x509-svid", func(c *gin.Context) { HandleX509SVIDRequest(c, revocationList, spiffeAuthority) })
+			mtls.POST("/spiffe/jwt-svid", func(c *gin.Context) { HandleJWTSVIDRequest(c, revocationList) })
+
+			admin := mtls.Group("/admin")
+			requireReader := RequireAdminRole(revocationList, AdminRoleReader)
+			requireOperator := RequireAdminRole(revocationList, AdminRoleOperator)
+
+			admin.GET("/crl", requireReader, func(c *gin.Context) { HandleAdminCRLRequest(c, revocationList) })
+			admin.POST("/crl/refresh", requireOperator, func(c *gin.Context) { HandleRefreshRequest(c, revocationList) })
+			admin.GET("/keys", requireReader, HandleAdminKeysRequest)
+			admin.GET("/policy", requireReader, HandleAdminPolicyRequest)
+			admin.GET("/clients", requireReader, HandleAdminClientsRequest)
+			admin.POST("/reload", requireOperator, func(c *gin.Context) { HandleAdminReloadRequest(c, reloader) })
+			admin.GET("/renewal", requireReader, func(c *gin.Context) { HandleAdminRenewalRequest(c, renewalHints) })
+			admin.POST("/renewal", requireOperator, func(c *gin.Context) { HandleAdminSetRenewalRequest(c, renewalHints) })
+			admin.DELETE("/renewal", requireOperator, func(c *gin.Context) { HandleAdminClearRenewalRequest(c, renewalHints) })
 
-			if clientCanBeVerified {
-				router.GET("/token", func(c *gin.Context) { HandleTokenRequest(c, revocationList) })
-				router.GET("/identity", func(c *gin.Context) { HandleIdentityRequest(c, revocationList) })
-				router.POST("/refreshCrl", func(c *gin.Context) { HandleRefreshRequest(c, revocationList) })
-				router.POST("/renew", func(c *gin.Context) { HandleRenewRequest(c, revocationList, caConfig) })
+			if pendingRenewals != nil {
+				admin.GET("/renewals", requireReader, func(c *gin.Context) { HandleAdminPendingRenewalsRequest(c, pendingRenewals) })
+				admin.POST("/renewals/:id/approve", requireOperator, func(c *gin.Context) { HandleAdminApproveRenewalRequest(c, pendingRenewals) })
+				admin.DELETE("/renewals/:id", requireOperator, func(c *gin.Context) { HandleAdminRejectRenewalRequest(c, pendingRenewals) })
+			}
+
+			if grantsFile := viper.GetString("server.enrollment.grantsFile"); len(grantsFile) > 0 {
+				joinGrants := NewJoinGrantStore(grantsFile)
+				mtls.POST("/enroll", func(c *gin.Context) { HandleEnrollRequest(c, revocationList, joinGrants, authority) })
 			}
 		},
 		DisableAccessLogFor: []string{
@@ -194,13 +440,20 @@ func main() {
 	// Prevent open HTTP2 connections from piling up.
 	srv.IdleTimeout = viper.GetDuration("server.idleTimeout")
 
-	if clientCanBeVerified {
-		// We have some endpoint that don't require mTLS (like healthcheck)
-		// So we do not make the client certificate mandatory and check for the certificate
-		// in code. However, we still want the handshake to fail early if a wrong certificate is presented.
-		srv.TLSConfig.ClientAuth = tls.VerifyClientCertIfGiven
-		srv.TLSConfig.ClientCAs = clientRootCAPool
+	if !clientCanBeVerified {
+		clientRootCAPool = nil
 	}
+	reloader.AttachTLSConfig(srv.TLSConfig, clientRootCAPool)
+
+	// Keep trying to reach the certificate authority if we started without,
+	// with cached or with partial trust roots.
+	if !clientCanBeVerified || trustRootsFromCache || trustIsPartial {
+		stopTrustRecovery := reloader.StartTrustRecovery(retryInterval)
+		defer stopTrustRecovery()
+	}
+
+	stopReloadOnSignal := reloader.ReloadOnSignal()
+	defer stopReloadOnSignal()
 
 	httpserver.Listen(srv, nil)
 }
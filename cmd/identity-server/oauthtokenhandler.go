@@ -0,0 +1,216 @@
+package main
+
+import (
+	"errors"
+	"identity-metadata-server/internal/shared"
+	"net"
+	"net/http"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/rs/zerolog/log"
+)
+
+// OAuth2 error codes.
+// See https://datatracker.ietf.org/doc/html/rfc6749#section-5.2 and
+// https://datatracker.ietf.org/doc/html/rfc8707#section-2
+const (
+	oauthErrorInvalidRequest       = "invalid_request"
+	oauthErrorInvalidClient        = "invalid_client"
+	oauthErrorUnauthorizedClient   = "unauthorized_client"
+	oauthErrorUnsupportedGrantType = "unsupported_grant_type"
+	oauthErrorInvalidGrant         = "invalid_grant"
+	oauthErrorInvalidScope         = "invalid_scope"
+	oauthErrorInvalidTarget        = "invalid_target"
+	oauthErrorServerError          = "server_error"
+)
+
+const (
+	// defaultOAuthTokenLifetime is used if no lifetime is requested.
+	defaultOAuthTokenLifetime = 10 * time.Minute
+)
+
+// oauthTokenRequest holds the parameters of a request to the OAuth2 token
+// endpoint.
+type oauthTokenRequest struct {
+	grantType string
+	audiences []string
+	// lifetime is 0 if no lifetime was requested.
+	lifetime time.Duration
+	scope    string
+
+	// Parameters of the token exchange grant
+	subjectToken       string
+	subjectTokenType   string
+	requestedTokenType string
+}
+
+// HandleOAuthTokenRequest implements an OAuth2 token endpoint.
+// Parameters are expected as application/x-www-form-urlencoded body.
+// Alternatively, a JSON encoded shared.TokenExchangeRequest is accepted.
+// The following grants are supported:
+//   - client_credentials: clients authenticate through mTLS as described in
+//     RFC 8705.
+//   - urn:ietf:params:oauth:grant-type:token-exchange: tokens issued by this
+//     server are exchanged as described in RFC 8693.
+//
+// The audiences are passed as "audience" or "resource" parameters, both can be
+// repeated. The optional "lifetime" is given in seconds or as duration string.
+func HandleOAuthTokenRequest(c *gin.Context, crl *CertificateRevocationList) {
+	// Token responses must not be cached.
+	// See https://datatracker.ietf.org/doc/html/rfc6749#section-5.1
+	c.Header("Cache-Control", "no-store")
+	c.Header("Pragma", "no-cache")
+
+	request, err := parseOAuthTokenRequest(c)
+	if err != nil {
+		log.Error().Err(err).Msg("Invalid token request")
+		oauthError(c, http.StatusBadRequest, oauthErrorInvalidRequest, err.Error())
+		return
+	}
+
+	switch request.grantType {
+	case shared.GrantTypeClientCredentials:
+		handleClientCredentialsGrant(c, crl, request)
+	case shared.GrantTypeTokenExchange:
+		handleTokenExchangeGrant(c, crl, request)
+	default:
+		log.Error().Str("grant_type", request.grantType).Msg("Unsupported grant type")
+		oauthError(c, http.StatusBadRequest, oauthErrorUnsupportedGrantType, "Unsupported grant_type")
+	}
+}
+
+// handleClientCredentialsGrant issues a token to the client authenticated
+// through mTLS.
+func handleClientCredentialsGrant(c *gin.Context, crl *CertificateRevocationList, request oauthTokenRequest) {
+	client, err := NewClientFromContext(c, crl)
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to get client from context")
+		oauthClientError(c, err)
+		return
+	}
+
+	if len(request.audiences) == 0 {
+		oauthError(c, http.StatusBadRequest, oauthErrorInvalidRequest, "audience or resource must be set")
+		return
+	}
+
+	lifetime := request.lifetime
+	if lifetime == 0 {
+		lifetime = defaultOAuthTokenLifetime
+	}
+
+	oidcToken, err := issueClientToken(client, net.ParseIP(c.ClientIP()), request.audiences, lifetime)
+	if err != nil {
+		oauthIssueError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, shared.TokenExchangeResponse{
+		AccessToken: oidcToken,
+		ExpiresIn:   int(lifetime.Seconds()),
+		TokenType:   "Bearer",
+	})
+}
+
+// parseOAuthTokenRequest reads the parameters of a token request from either
+// a form or a JSON encoded shared.TokenExchangeRequest.
+func parseOAuthTokenRequest(c *gin.Context) (oauthTokenRequest, error) {
+	request := oauthTokenRequest{}
+	requestedAudiences := []string{}
+	lifetimeParam := ""
+
+	switch c.ContentType() {
+	case gin.MIMEPOSTForm:
+		request.grantType = c.PostForm("grant_type")
+		request.scope = c.PostForm("scope")
+		request.subjectToken = c.PostForm("subject_token")
+		request.subjectTokenType = c.PostForm("subject_token_type")
+		request.requestedTokenType = c.PostForm("requested_token_type")
+		requestedAudiences = append(c.PostFormArray("audience"), c.PostFormArray("resource")...)
+		lifetimeParam = c.PostForm("lifetime")
+
+	case gin.MIMEJSON:
+		exchangeRequest := shared.TokenExchangeRequest{}
+		if err := c.ShouldBindJSON(&exchangeRequest); err != nil {
+			return request, errors.Join(err, errors.New("failed to parse request"))
+		}
+		request.grantType = exchangeRequest.GrantType
+		request.scope = exchangeRequest.Scope
+		request.subjectToken = exchangeRequest.SubjectToken
+		request.subjectTokenType = exchangeRequest.SubjectTokenType
+		request.requestedTokenType = exchangeRequest.RequestedTokenType
+		requestedAudiences = append(requestedAudiences, exchangeRequest.Audience)
+		lifetimeParam = exchangeRequest.LifetimeSec
+
+	default:
+		return request, errors.New("Content-Type must be " + gin.MIMEPOSTForm + " or " + gin.MIMEJSON)
+	}
+
+	for _, audience := range requestedAudiences {
+		if len(audience) > 0 && !slices.Contains(request.audiences, audience) {
+			request.audiences = append(request.audiences, audience)
+		}
+	}
+
+	if len(lifetimeParam) > 0 {
+		var err error
+		if request.lifetime, err = parseTokenLifetime(lifetimeParam); err != nil {
+			return request, err
+		}
+	}
+
+	return request, nil
+}
+
+// parseTokenLifetime parses a lifetime given in seconds or as duration string.
+func parseTokenLifetime(value string) (time.Duration, error) {
+	lifetime, err := time.ParseDuration(value)
+	if err != nil {
+		seconds, convErr := strconv.Atoi(value)
+		if convErr != nil {
+			return 0, errors.New("invalid lifetime")
+		}
+		lifetime = time.Duration(seconds) * time.Second
+	}
+
+	if lifetime <= 0 {
+		return 0, errors.New("invalid lifetime")
+	}
+	return lifetime, nil
+}
+
+// oauthClientError converts errors returned by NewClientFromContext to
+// OAuth2 error responses.
+func oauthClientError(c *gin.Context, err error) {
+	status := http.StatusUnauthorized
+	if httpErr, ok := err.(shared.ErrorWithStatus); ok && httpErr.Code != http.StatusInternalServerError {
+		status = httpErr.Code
+	}
+	oauthError(c, status, oauthErrorInvalidClient, err.Error())
+}
+
+// oauthIssueError converts errors returned by issueClientToken to OAuth2
+// error responses.
+func oauthIssueError(c *gin.Context, err error) {
+	switch {
+	case errors.Is(err, ErrorTokenRequestDenied):
+		oauthError(c, http.StatusBadRequest, oauthErrorUnauthorizedClient, err.Error())
+	case errors.Is(err, ErrorTokenAudienceNotAllowed):
+		oauthError(c, http.StatusBadRequest, oauthErrorInvalidTarget, err.Error())
+	case errors.Is(err, ErrorTokenLifetimeNotAllowed):
+		oauthError(c, http.StatusBadRequest, oauthErrorInvalidRequest, err.Error())
+	default:
+		oauthError(c, http.StatusInternalServerError, oauthErrorServerError, "Failed to issue token")
+	}
+}
+
+// oauthError renders an OAuth2 error response.
+func oauthError(c *gin.Context, status int, code, description string) {
+	c.JSON(status, shared.OAuthErrorResponse{
+		Error:            code,
+		ErrorDescription: description,
+	})
+}
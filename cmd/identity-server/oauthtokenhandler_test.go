@@ -0,0 +1,135 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"identity-metadata-server/internal/shared"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v5"
+	jsoniter "github.com/json-iterator/go"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+)
+
+// testClientOrigin is the IP address test clients are allowed to connect from.
+const testClientOrigin = "10.0.0.1"
+
+// newTestClientCertificates creates a CA and one client certificate signed by
+// it for each of the given hostnames. The returned CRL trusts the CA.
+func newTestClientCertificates(t *testing.T, hostnames ...string) ([]*x509.Certificate, *CertificateRevocationList) {
+	ca := newTestCA(t, "test-ca", nil)
+
+	clientCerts := make([]*x509.Certificate, 0, len(hostnames))
+	for i, hostname := range hostnames {
+		clientCerts = append(clientCerts, ca.issueClient(t, hostname, int64(100+i)))
+	}
+
+	return clientCerts, NewCertificateRevocationList([]*x509.Certificate{ca.cert}, nil, nil, time.Hour, 0)
+}
+
+// newTestClientCertificate creates a CA and a client certificate signed by it.
+// The returned CRL trusts the CA.
+func newTestClientCertificate(t *testing.T, hostname string) (*x509.Certificate, *CertificateRevocationList) {
+	certs, crl := newTestClientCertificates(t, hostname)
+	return certs[0], crl
+}
+
+// newTestMTLSRequest creates a gin context for a request sent from
+// testClientOrigin with the given client certificate. cert and body may be
+// nil.
+func newTestMTLSRequest(cert *x509.Certificate, method, path, contentType string, body io.Reader) (*gin.Context, *httptest.ResponseRecorder) {
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+
+	c.Request = httptest.NewRequest(method, path, body)
+	c.Request.Header.Set("Content-Type", contentType)
+	c.Request.RemoteAddr = testClientOrigin + ":12345"
+	c.Request.TLS = &tls.ConnectionState{}
+	if cert != nil {
+		c.Request.TLS.PeerCertificates = []*x509.Certificate{cert}
+	}
+
+	return c, w
+}
+
+// newTestFormBody encodes the given form as request body.
+func newTestFormBody(form url.Values) io.Reader {
+	return strings.NewReader(form.Encode())
+}
+
+// newTestJSONBody encodes the given value as JSON request body.
+func newTestJSONBody(t *testing.T, value any) io.Reader {
+	body, err := json.Marshal(value)
+	assert.NoError(t, err)
+	return bytes.NewReader(body)
+}
+
+func TestHandleOAuthTokenRequest(t *testing.T) {
+	assert := assert.New(t)
+	defer viper.Reset()
+
+	viper.Set("server.key", writeTestKey(t, t.TempDir(), "server.pem"))
+	viper.Set("server.keyName", "test")
+	assert.NoError(initJWKS())
+
+	cert, crl := newTestClientCertificate(t, "host.example.com")
+
+	c, w := newTestMTLSRequest(cert, http.MethodPost, "/oauth2/token", gin.MIMEPOSTForm, newTestFormBody(url.Values{
+		"grant_type": {shared.GrantTypeClientCredentials},
+		"audience":   {"https://a.example.com"},
+		"resource":   {"https://b.example.com", "https://a.example.com"},
+		"lifetime":   {"5m"},
+	}))
+	HandleOAuthTokenRequest(c, crl)
+	assert.Equal(http.StatusOK, w.Code)
+	assert.Equal("no-store", w.Header().Get("Cache-Control"))
+
+	response := shared.TokenExchangeResponse{}
+	assert.NoError(jsoniter.Unmarshal(w.Body.Bytes(), &response))
+	assert.Equal("Bearer", response.TokenType)
+	assert.Equal(300, response.ExpiresIn)
+
+	claims := CustomClaims{}
+	_, _, err := jwt.NewParser().ParseUnverified(response.AccessToken, &claims)
+	assert.NoError(err)
+	assert.Equal("host.example.com", claims.Subject)
+	assert.Equal(jwt.ClaimStrings{"https://a.example.com", "https://b.example.com"}, claims.Audience)
+}
+
+func TestHandleOAuthTokenRequestErrors(t *testing.T) {
+	assert := assert.New(t)
+	cert, crl := newTestClientCertificate(t, "host.example.com")
+
+	testCases := []struct {
+		name   string
+		cert   *x509.Certificate
+		form   url.Values
+		status int
+		error  string
+	}{
+		{"no certificate", nil, url.Values{"grant_type": {shared.GrantTypeClientCredentials}, "audience": {"a"}}, http.StatusUnauthorized, oauthErrorInvalidClient},
+		{"wrong grant type", cert, url.Values{"grant_type": {"password"}, "audience": {"a"}}, http.StatusBadRequest, oauthErrorUnsupportedGrantType},
+		{"no audience", cert, url.Values{"grant_type": {shared.GrantTypeClientCredentials}}, http.StatusBadRequest, oauthErrorInvalidRequest},
+		{"invalid lifetime", cert, url.Values{"grant_type": {shared.GrantTypeClientCredentials}, "audience": {"a"}, "lifetime": {"-1m"}}, http.StatusBadRequest, oauthErrorInvalidRequest},
+	}
+
+	for _, tc := range testCases {
+		c, w := newTestMTLSRequest(tc.cert, http.MethodPost, "/oauth2/token", gin.MIMEPOSTForm, newTestFormBody(tc.form))
+		HandleOAuthTokenRequest(c, crl)
+		assert.Equal(tc.status, w.Code, tc.name)
+
+		response := shared.OAuthErrorResponse{}
+		assert.NoError(jsoniter.Unmarshal(w.Body.Bytes(), &response), tc.name)
+		assert.Equal(tc.error, response.Error, tc.name)
+	}
+}
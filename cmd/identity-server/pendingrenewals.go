@@ -0,0 +1,406 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"identity-metadata-server/internal/certificates"
+
+	"github.com/rs/zerolog/log"
+)
+
+// PendingRenewalAutoApprover is set as ApprovedBy on renewals approved by
+// the auto approval rule.
+const PendingRenewalAutoApprover = "auto-approval"
+
+// PendingRenewal is a renewal request that changes the hostname or the IP
+// addresses of a client certificate. It has to be approved before a
+// certificate is issued.
+type PendingRenewal struct {
+	// ID identifies the CSR. Clients sending the same key and subject for
+	// the same certificate map to the same ID.
+	ID string `json:"id"`
+
+	// Host, Identity, Serial and Addresses describe the current client
+	// certificate.
+	Host      string   `json:"host"`
+	Identity  string   `json:"identity"`
+	Serial    string   `json:"serial"`
+	Addresses []string `json:"addresses"`
+
+	// RequestedHost and RequestedAddresses are requested by the CSR.
+	RequestedHost      string   `json:"requestedHost"`
+	RequestedAddresses []string `json:"requestedAddresses"`
+
+	// Origin is the IP address the renewal was requested from.
+	Origin      string    `json:"origin"`
+	RequestedAt time.Time `json:"requestedAt"`
+
+	ApprovedAt *time.Time `json:"approvedAt,omitempty"`
+	ApprovedBy string     `json:"approvedBy,omitempty"`
+
+	// RejectedAt and RejectedBy are set for rejected renewals. These are
+	// kept, so sending the same request again does not create a new renewal.
+	RejectedAt *time.Time `json:"rejectedAt,omitempty"`
+	RejectedBy string     `json:"rejectedBy,omitempty"`
+}
+
+// IsApproved returns true if a certificate can be issued for the renewal.
+func (r PendingRenewal) IsApproved() bool {
+	return r.ApprovedAt != nil
+}
+
+// IsRejected returns true if the renewal has been rejected.
+func (r PendingRenewal) IsRejected() bool {
+	return r.RejectedAt != nil
+}
+
+// ipStrings converts the given IP addresses to sorted strings.
+func ipStrings(ips []net.IP) []string {
+	addresses := make([]string, 0, len(ips))
+	for _, ip := range ips {
+		addresses = append(addresses, ip.String())
+	}
+	slices.Sort(addresses)
+	return addresses
+}
+
+// NewPendingRenewal creates a pending renewal of the given certificate
+// requested by the given CSR.
+func NewPendingRenewal(csr *x509.CertificateRequest, cert *x509.Certificate, origin string, now time.Time) PendingRenewal {
+	renewal := PendingRenewal{
+		Host:               strings.ToLower(cert.Subject.CommonName),
+		Serial:             certificates.SerialToHex(cert),
+		Addresses:          ipStrings(cert.IPAddresses),
+		RequestedHost:      strings.ToLower(csr.Subject.CommonName),
+		RequestedAddresses: ipStrings(csr.IPAddresses),
+		Origin:             origin,
+		RequestedAt:        now,
+	}
+	if len(cert.EmailAddresses) > 0 {
+		renewal.Identity = cert.EmailAddresses[0]
+	}
+
+	// The CSR itself cannot be used as ID, as its signature changes with
+	// every request.
+	hash := sha256.New()
+	hash.Write([]byte(renewal.Serial))
+	hash.Write(csr.RawSubjectPublicKeyInfo)
+	hash.Write([]byte(renewal.RequestedHost))
+	for _, address := range renewal.RequestedAddresses {
+		hash.Write([]byte(address))
+	}
+	renewal.ID = hex.EncodeToString(hash.Sum(nil)[:16])
+
+	return renewal
+}
+
+// PendingRenewalAutoApproval approves renewals that keep the hostname and
+// only move to addresses within the same network as the current addresses.
+// A prefix length of 0 disables the rule for the address family.
+type PendingRenewalAutoApproval struct {
+	IPv4PrefixLength int
+	IPv6PrefixLength int
+}
+
+// sameNetwork returns true if both addresses are within the same network
+// of the configured prefix length.
+func (a PendingRenewalAutoApproval) sameNetwork(x, y net.IP) bool {
+	bits, ones := 128, a.IPv6PrefixLength
+	if x.To4() != nil {
+		bits, ones = 32, a.IPv4PrefixLength
+		x, y = x.To4(), y.To4()
+	}
+	if ones <= 0 || y == nil || len(x) != len(y) {
+		return false
+	}
+
+	mask := net.CIDRMask(ones, bits)
+	return x.Mask(mask).Equal(y.Mask(mask))
+}
+
+// CoversOrigin returns true if the given origin is in the network of one of
+// the addresses of the given certificate.
+func (a PendingRenewalAutoApproval) CoversOrigin(cert *x509.Certificate, origin net.IP) bool {
+	return slices.ContainsFunc(cert.IPAddresses, func(current net.IP) bool {
+		return a.sameNetwork(origin, current)
+	})
+}
+
+// Matches returns true if the renewal can be approved without an operator.
+func (a PendingRenewalAutoApproval) Matches(renewal PendingRenewal) bool {
+	if renewal.RequestedHost != renewal.Host || len(renewal.RequestedAddresses) == 0 {
+		return false
+	}
+
+	for _, requested := range renewal.RequestedAddresses {
+		requestedIP := net.ParseIP(requested)
+		if requestedIP == nil {
+			return false
+		}
+
+		inNetwork := slices.ContainsFunc(renewal.Addresses, func(current string) bool {
+			currentIP := net.ParseIP(current)
+			return currentIP != nil && a.sameNetwork(requestedIP, currentIP)
+		})
+		if !inNetwork {
+			return false
+		}
+	}
+	return true
+}
+
+// PendingRenewalStore stores pending renewals in a JSON file.
+// Like the JoinGrantStore, the file is read on every access and every access
+// holds an exclusive file lock, so the file can be shared between instances.
+// Only one open renewal is kept per host. Rejected renewals are kept until
+// the retention period ends.
+type PendingRenewalStore struct {
+	path  string
+	guard *sync.Mutex
+
+	// retention is the time after which renewals that have not been picked
+	// up and rejected renewals are removed. A value of 0 keeps renewals
+	// forever.
+	retention    time.Duration
+	autoApproval PendingRenewalAutoApproval
+}
+
+// NewPendingRenewalStore creates a new store for the given file.
+func NewPendingRenewalStore(path string, retention time.Duration, autoApproval PendingRenewalAutoApproval) *PendingRenewalStore {
+	return &PendingRenewalStore{
+		path:         path,
+		guard:        new(sync.Mutex),
+		retention:    retention,
+		autoApproval: autoApproval,
+	}
+}
+
+// lock locks the guard and the renewals file. The returned function unlocks
+// both.
+func (s *PendingRenewalStore) lock() (func(), error) {
+	s.guard.Lock()
+	unlockFile, err := lockFile(s.path)
+	if err != nil {
+		s.guard.Unlock()
+		return nil, err
+	}
+
+	return func() {
+		unlockFile()
+		s.guard.Unlock()
+	}, nil
+}
+
+// load reads all renewals from disk and removes renewals that exceeded the
+// retention period. The retention of rejected renewals starts when they were
+// rejected. A missing file contains no renewals.
+// Must be called with the store locked.
+func (s *PendingRenewalStore) load(now time.Time) ([]PendingRenewal, error) {
+	data, err := os.ReadFile(s.path)
+	switch {
+	case os.IsNotExist(err):
+		return []PendingRenewal{}, nil
+	case err != nil:
+		return nil, errors.Join(err, fmt.Errorf("failed to read pending renewals from %s", s.path))
+	}
+
+	renewals := []PendingRenewal{}
+	if err := json.Unmarshal(data, &renewals); err != nil {
+		return nil, errors.Join(err, fmt.Errorf("failed to parse pending renewals from %s", s.path))
+	}
+
+	if s.retention > 0 {
+		renewals = slices.DeleteFunc(renewals, func(r PendingRenewal) bool {
+			if r.IsRejected() {
+				return now.Sub(*r.RejectedAt) > s.retention
+			}
+			return now.Sub(r.RequestedAt) > s.retention
+		})
+	}
+	return renewals, nil
+}
+
+// save writes all renewals to disk, replacing the file atomically.
+// Must be called with the store locked.
+func (s *PendingRenewalStore) save(renewals []PendingRenewal) error {
+	data, err := json.MarshalIndent(renewals, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmpFile, err := os.CreateTemp(filepath.Dir(s.path), filepath.Base(s.path)+".*")
+	if err != nil {
+		return errors.Join(err, fmt.Errorf("failed to write pending renewals to %s", s.path))
+	}
+	defer func() { _ = os.Remove(tmpFile.Name()) }()
+
+	_, err = tmpFile.Write(data)
+	if closeErr := tmpFile.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmpFile.Name(), s.path)
+	}
+	if err != nil {
+		return errors.Join(err, fmt.Errorf("failed to write pending renewals to %s", s.path))
+	}
+	return nil
+}
+
+// Submit adds the given renewal to the store and returns its current state.
+// If the renewal is already stored, the stored renewal is returned, which
+// may be rejected. Other open renewals of the same host are replaced. New
+// renewals matching the auto approval rule are approved right away.
+func (s *PendingRenewalStore) Submit(renewal PendingRenewal) (PendingRenewal, error) {
+	unlock, err := s.lock()
+	if err != nil {
+		return PendingRenewal{}, err
+	}
+	defer unlock()
+
+	renewals, err := s.load(renewal.RequestedAt)
+	if err != nil {
+		return PendingRenewal{}, err
+	}
+
+	if i := slices.IndexFunc(renewals, func(r PendingRenewal) bool { return r.ID == renewal.ID }); i >= 0 {
+		return renewals[i], nil
+	}
+
+	renewals = slices.DeleteFunc(renewals, func(r PendingRenewal) bool {
+		return r.Host == renewal.Host && !r.IsRejected()
+	})
+
+	if s.autoApproval.Matches(renewal) {
+		approvedAt := renewal.RequestedAt
+		renewal.ApprovedAt = &approvedAt
+		renewal.ApprovedBy = PendingRenewalAutoApprover
+	}
+
+	log.Info().
+		Str("id", renewal.ID).
+		Str("host", renewal.Host).
+		Str("requestedHost", renewal.RequestedHost).
+		Strs("requestedAddresses", renewal.RequestedAddresses).
+		Bool("approved", renewal.IsApproved()).
+		Msg("Renewal changing the client certificate subject submitted")
+
+	renewals = append(renewals, renewal)
+	return renewal, s.save(renewals)
+}
+
+// AcceptsOrigin returns true if a renewal of the given certificate may be
+// requested from the given origin, although the origin is not listed in the
+// certificate. This is only the case for origins the auto approval rule
+// covers, so a stolen certificate cannot be used from arbitrary addresses.
+func (s *PendingRenewalStore) AcceptsOrigin(cert *x509.Certificate, origin net.IP) bool {
+	return s.autoApproval.CoversOrigin(cert, origin)
+}
+
+// List returns all stored renewals.
+func (s *PendingRenewalStore) List() ([]PendingRenewal, error) {
+	unlock, err := s.lock()
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	return s.load(time.Now())
+}
+
+// Approve marks the renewal with the given ID as approved by the given
+// admin. Rejected renewals can be approved as well. If no such renewal
+// exists, ErrorPendingRenewalNotFound is returned.
+func (s *PendingRenewalStore) Approve(id, approvedBy string) (PendingRenewal, error) {
+	unlock, err := s.lock()
+	if err != nil {
+		return PendingRenewal{}, err
+	}
+	defer unlock()
+
+	now := time.Now()
+	renewals, err := s.load(now)
+	if err != nil {
+		return PendingRenewal{}, err
+	}
+
+	i := slices.IndexFunc(renewals, func(r PendingRenewal) bool { return r.ID == id })
+	if i < 0 {
+		return PendingRenewal{}, ErrorPendingRenewalNotFound
+	}
+
+	if !renewals[i].IsApproved() {
+		renewals[i].ApprovedAt = &now
+		renewals[i].ApprovedBy = approvedBy
+		renewals[i].RejectedAt = nil
+		renewals[i].RejectedBy = ""
+	}
+	return renewals[i], s.save(renewals)
+}
+
+// Reject marks the renewal with the given ID as rejected by the given admin.
+// Clients sending the same request again receive the rejected renewal until
+// the retention period ends. Approved renewals cannot be rejected anymore.
+// If no such renewal exists, ErrorPendingRenewalNotFound is returned.
+func (s *PendingRenewalStore) Reject(id, rejectedBy string) (PendingRenewal, error) {
+	unlock, err := s.lock()
+	if err != nil {
+		return PendingRenewal{}, err
+	}
+	defer unlock()
+
+	now := time.Now()
+	renewals, err := s.load(now)
+	if err != nil {
+		return PendingRenewal{}, err
+	}
+
+	i := slices.IndexFunc(renewals, func(r PendingRenewal) bool { return r.ID == id })
+	if i < 0 {
+		return PendingRenewal{}, ErrorPendingRenewalNotFound
+	}
+
+	if renewals[i].IsApproved() {
+		return PendingRenewal{}, ErrorPendingRenewalApproved
+	}
+	if !renewals[i].IsRejected() {
+		renewals[i].RejectedAt = &now
+		renewals[i].RejectedBy = rejectedBy
+	}
+	return renewals[i], s.save(renewals)
+}
+
+// Remove deletes the renewal with the given ID. This is used after a
+// certificate was issued for it. If no such renewal exists,
+// ErrorPendingRenewalNotFound is returned.
+func (s *PendingRenewalStore) Remove(id string) error {
+	unlock, err := s.lock()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	renewals, err := s.load(time.Now())
+	if err != nil {
+		return err
+	}
+
+	count := len(renewals)
+	renewals = slices.DeleteFunc(renewals, func(r PendingRenewal) bool { return r.ID == id })
+	if len(renewals) == count {
+		return ErrorPendingRenewalNotFound
+	}
+	return s.save(renewals)
+}
@@ -0,0 +1,255 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+)
+
+// issuingTestAuthority issues certificates for CSRs signed by a test CA.
+type issuingTestAuthority struct {
+	*testAuthority
+	ca *testCA
+}
+
+func (a *issuingTestAuthority) IssueCertificate(ctx context.Context, csrPEM []byte, lifetime time.Duration) ([]*x509.Certificate, error) {
+	csr, err := parseCSR(string(csrPEM))
+	if err != nil {
+		return nil, err
+	}
+
+	template := &x509.Certificate{
+		SerialNumber:   big.NewInt(time.Now().UnixNano()),
+		Subject:        csr.Subject,
+		DNSNames:       csr.DNSNames,
+		EmailAddresses: csr.EmailAddresses,
+		IPAddresses:    csr.IPAddresses,
+		URIs:           csr.URIs,
+		NotBefore:      time.Now(),
+		NotAfter:       time.Now().Add(lifetime),
+		ExtKeyUsage:    []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, a.ca.cert, csr.PublicKey, a.ca.key)
+	if err != nil {
+		return nil, err
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, err
+	}
+	return []*x509.Certificate{cert, a.ca.cert}, nil
+}
+
+func newTestPendingRenewal(t *testing.T, host string, addresses ...string) PendingRenewal {
+	cert := CreateDummyCertificate("host.example.com", "test@example.com", []net.IP{net.ParseIP(testClientOrigin)})
+	block, _ := pem.Decode([]byte(newTestEnrollCSR(t, host, "test@example.com", addresses...)))
+	csr, err := x509.ParseCertificateRequest(block.Bytes)
+	assert.NoError(t, err)
+	return NewPendingRenewal(csr, cert, testClientOrigin, time.Now())
+}
+
+func TestPendingRenewalAutoApproval(t *testing.T) {
+	assert := assert.New(t)
+	rule := PendingRenewalAutoApproval{IPv4PrefixLength: 24}
+
+	assert.True(rule.Matches(newTestPendingRenewal(t, "host.example.com", "10.0.0.99")))
+	assert.False(rule.Matches(newTestPendingRenewal(t, "host.example.com", "10.0.1.1")))
+	assert.False(rule.Matches(newTestPendingRenewal(t, "host.example.com", "10.0.0.99", "10.0.1.1")))
+	assert.False(rule.Matches(newTestPendingRenewal(t, "other.example.com", "10.0.0.99")))
+	assert.False(rule.Matches(newTestPendingRenewal(t, "host.example.com", "::1")))
+
+	assert.False(PendingRenewalAutoApproval{}.Matches(newTestPendingRenewal(t, "host.example.com", "10.0.0.99")))
+}
+
+func TestPendingRenewalStore(t *testing.T) {
+	assert := assert.New(t)
+	path := filepath.Join(t.TempDir(), "pending.json")
+	store := NewPendingRenewalStore(path, time.Hour, PendingRenewalAutoApproval{IPv4PrefixLength: 24})
+
+	first := newTestPendingRenewal(t, "host.example.com", "10.0.1.1")
+	renewal, err := store.Submit(first)
+	assert.NoError(err)
+	assert.False(renewal.IsApproved())
+
+	// Sending the same request again does not create a new renewal
+	first.RequestedAt = time.Now()
+	renewal, err = store.Submit(first)
+	assert.NoError(err)
+	assert.Equal(first.ID, renewal.ID)
+
+	// A different request of the same host replaces the renewal
+	second := newTestPendingRenewal(t, "host.example.com", "10.0.2.1")
+	_, err = store.Submit(second)
+	assert.NoError(err)
+
+	renewals, err := NewPendingRenewalStore(path, time.Hour, PendingRenewalAutoApproval{}).List()
+	assert.NoError(err)
+	assert.Len(renewals, 1)
+	assert.Equal(second.ID, renewals[0].ID)
+
+	_, err = store.Approve(first.ID, "ops@example.com")
+	assert.ErrorIs(err, ErrorPendingRenewalNotFound)
+
+	renewal, err = store.Approve(second.ID, "ops@example.com")
+	assert.NoError(err)
+	assert.True(renewal.IsApproved())
+	assert.Equal("ops@example.com", renewal.ApprovedBy)
+
+	renewal, err = store.Submit(second)
+	assert.NoError(err)
+	assert.True(renewal.IsApproved())
+
+	assert.NoError(store.Remove(second.ID))
+	assert.ErrorIs(store.Remove(second.ID), ErrorPendingRenewalNotFound)
+
+	// Renewals within the same network are approved right away
+	renewal, err = store.Submit(newTestPendingRenewal(t, "host.example.com", "10.0.0.2"))
+	assert.NoError(err)
+	assert.Equal(PendingRenewalAutoApprover, renewal.ApprovedBy)
+
+	// Renewals are removed after the retention period
+	expired := newTestPendingRenewal(t, "other.example.com", "10.0.1.1")
+	expired.Host = "other.example.com"
+	expired.RequestedAt = time.Now().Add(-2 * time.Hour)
+	_, err = store.Submit(expired)
+	assert.NoError(err)
+
+	renewals, err = store.List()
+	assert.NoError(err)
+	assert.Len(renewals, 1)
+}
+
+func TestPendingRenewalStoreReject(t *testing.T) {
+	assert := assert.New(t)
+	path := filepath.Join(t.TempDir(), "pending.json")
+	store := NewPendingRenewalStore(path, time.Hour, PendingRenewalAutoApproval{})
+
+	rejected := newTestPendingRenewal(t, "host.example.com", "10.0.1.1")
+	_, err := store.Submit(rejected)
+	assert.NoError(err)
+
+	renewal, err := store.Reject(rejected.ID, "ops.example.com")
+	assert.NoError(err)
+	assert.True(renewal.IsRejected())
+	assert.Equal("ops.example.com", renewal.RejectedBy)
+
+	// Sending the same request again, also to another instance, stays rejected
+	rejected.RequestedAt = time.Now()
+	renewal, err = NewPendingRenewalStore(path, time.Hour, PendingRenewalAutoApproval{}).Submit(rejected)
+	assert.NoError(err)
+	assert.True(renewal.IsRejected())
+
+	// Other requests of the host do not replace the rejection
+	other := newTestPendingRenewal(t, "host.example.com", "10.0.2.1")
+	_, err = store.Submit(other)
+	assert.NoError(err)
+	renewals, err := store.List()
+	assert.NoError(err)
+	assert.Len(renewals, 2)
+
+	// Approved renewals cannot be rejected, rejected ones can be approved
+	_, err = store.Approve(other.ID, "ops.example.com")
+	assert.NoError(err)
+	_, err = store.Reject(other.ID, "ops.example.com")
+	assert.ErrorIs(err, ErrorPendingRenewalApproved)
+
+	renewal, err = store.Approve(rejected.ID, "ops.example.com")
+	assert.NoError(err)
+	assert.True(renewal.IsApproved())
+	assert.False(renewal.IsRejected())
+
+	_, err = store.Reject("unknown", "ops.example.com")
+	assert.ErrorIs(err, ErrorPendingRenewalNotFound)
+
+	// Rejections are removed after the retention period
+	third := newTestPendingRenewal(t, "other.example.com", "10.0.1.1")
+	third.Host = "other.example.com"
+	_, err = store.Submit(third)
+	assert.NoError(err)
+	_, err = store.Reject(third.ID, "ops.example.com")
+	assert.NoError(err)
+
+	renewals, err = NewPendingRenewalStore(path, time.Nanosecond, PendingRenewalAutoApproval{}).List()
+	assert.NoError(err)
+	assert.Empty(renewals)
+}
+
+func TestHandleRenewRequestPending(t *testing.T) {
+	assert := assert.New(t)
+
+	ca := newTestCA(t, "root", nil)
+	cert := ca.issueClient(t, "host.example.com", 100)
+
+	crl := NewCertificateRevocationList([]*x509.Certificate{ca.cert}, newTestAuthority(), nil, time.Hour, 0)
+	authority := &issuingTestAuthority{testAuthority: newTestAuthority(), ca: ca}
+	store := NewPendingRenewalStore(filepath.Join(t.TempDir(), "pending.json"), time.Hour, PendingRenewalAutoApproval{})
+
+	csrPEM := newTestEnrollCSR(t, "host.example.com", "test@example.com", "10.0.1.1")
+	renew := func(origin string, pending *PendingRenewalStore) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		c, _ := gin.CreateTestContext(w)
+		c.Request = httptest.NewRequest(http.MethodPost, "/renew", strings.NewReader(csrPEM))
+		c.Request.Header.Set("Content-Type", MIMEPEM)
+		c.Request.RemoteAddr = origin + ":12345"
+		c.Request.TLS = &tls.ConnectionState{PeerCertificates: []*x509.Certificate{cert}}
+		HandleRenewRequest(c, crl, authority, pending)
+		return w
+	}
+
+	// Without a store, address changes are rejected
+	assert.Equal(http.StatusUnprocessableEntity, renew(testClientOrigin, nil).Code)
+	assert.Equal(http.StatusForbidden, renew("10.0.1.1", nil).Code)
+
+	w := renew(testClientOrigin, store)
+	assert.Equal(http.StatusAccepted, w.Code)
+	renewal := PendingRenewal{}
+	assert.NoError(json.Unmarshal(w.Body.Bytes(), &renewal))
+	assert.Equal([]string{"10.0.1.1"}, renewal.RequestedAddresses)
+
+	// The addresses requested by the CSR are not accepted as origin
+	assert.Equal(http.StatusForbidden, renew("10.0.1.1", store).Code)
+	assert.Equal(http.StatusForbidden, renew("10.0.2.1", store).Code)
+
+	_, err := store.Approve(renewal.ID, "ops@example.com")
+	assert.NoError(err)
+
+	w = renew(testClientOrigin, store)
+	assert.Equal(http.StatusOK, w.Code)
+
+	block, rest := pem.Decode(w.Body.Bytes())
+	assert.NotNil(block)
+	issued, err := x509.ParseCertificate(block.Bytes)
+	assert.NoError(err)
+	assert.True(issued.IPAddresses[0].Equal(net.ParseIP("10.0.1.1")))
+	assert.NotEmpty(rest)
+
+	renewals, err := store.List()
+	assert.NoError(err)
+	assert.Empty(renewals)
+
+	// Origins in the auto approval network are accepted, others are not
+	autoStore := NewPendingRenewalStore(filepath.Join(t.TempDir(), "pending.json"), time.Hour, PendingRenewalAutoApproval{IPv4PrefixLength: 16})
+	assert.Equal(http.StatusForbidden, renew("10.1.0.1", autoStore).Code)
+	assert.Equal(http.StatusOK, renew("10.0.1.1", autoStore).Code)
+
+	// Rejected renewals stay rejected
+	rejectStore := NewPendingRenewalStore(filepath.Join(t.TempDir(), "pending.json"), time.Hour, PendingRenewalAutoApproval{})
+	assert.Equal(http.StatusAccepted, renew(testClientOrigin, rejectStore).Code)
+	_, err = rejectStore.Reject(renewal.ID, "ops.example.com")
+	assert.NoError(err)
+	assert.Equal(http.StatusForbidden, renew(testClientOrigin, rejectStore).Code)
+}
@@ -0,0 +1,19 @@
+package main
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// HandleReadyRequest answers the readiness probe. The server is not ready if
+// the CRLs are stale and the stale CRL policy is StaleCRLPolicyNotReady.
+func HandleReadyRequest(c *gin.Context, crl *CertificateRevocationList) {
+	if !crl.IsReady(time.Now()) {
+		c.String(http.StatusServiceUnavailable, "%s\n", ErrorRevocationListStale.Message)
+		return
+	}
+	c.Status(http.StatusOK)
+	c.Writer.WriteHeaderNow()
+}
@@ -0,0 +1,267 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"identity-metadata-server/internal/certificates"
+	"identity-metadata-server/internal/shared"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/rs/zerolog/log"
+)
+
+// ServerReloader reloads key material and trust roots of the server at
+// runtime. All values are swapped atomically, so requests that are currently
+// being processed continue to use the values they started with.
+// The TLS certificate of the server is not handled here, as the base TLS
+// configuration re-reads it from disk every tls.reload.
+type ServerReloader struct {
+	// reloadGuard prevents multiple reloads from happening at the same time.
+	reloadGuard *sync.Mutex
+
+	// revocationList holds the client root CAs. If this is nil, clients
+	// cannot be verified and the trust roots are not reloaded.
+	revocationList *CertificateRevocationList
+
+	// authority is used to fetch the client root CAs.
+	authority certificates.Authority
+
+	// trustCache stores the fetched client root CAs. If this is nil, the
+	// client root CAs are not cached.
+	trustCache *certificates.TrustCache
+
+	// clientVerification is true if the client root CAs and CRLs have been
+	// loaded, i.e. if client certificates can be verified.
+	clientVerification atomic.Bool
+
+	// baseTLSConfig is the TLS configuration of the server before any client
+	// specific changes are applied.
+	baseTLSConfig *tls.Config
+
+	// clientTLSConfig is the TLS configuration returned for each new client
+	// connection.
+	clientTLSConfig atomic.Pointer[tls.Config]
+}
+
+// NewServerReloader creates a new ServerReloader.
+// Pass a nil revocationList if client certificates are never verified.
+// Client verification starts disabled, see EnableClientVerification.
+func NewServerReloader(revocationList *CertificateRevocationList, authority certificates.Authority, trustCache *certificates.TrustCache) *ServerReloader {
+	return &ServerReloader{
+		reloadGuard:    new(sync.Mutex),
+		revocationList: revocationList,
+		authority:      authority,
+		trustCache:     trustCache,
+	}
+}
+
+// AttachTLSConfig makes the given TLS configuration use the reloadable
+// client root CA pool. The server certificate is still provided by the given
+// configuration.
+// If clientRootCAPool is nil, client certificates are not verified.
+// This function is meant to be called once, before the server is started.
+func (r *ServerReloader) AttachTLSConfig(tlsConfig *tls.Config, clientRootCAPool *x509.CertPool) {
+	r.baseTLSConfig = tlsConfig.Clone()
+
+	// The http server adds the supported protocols to its own config only,
+	// so we need to make sure the config returned per client supports HTTP/2.
+	if len(r.baseTLSConfig.NextProtos) == 0 {
+		r.baseTLSConfig.NextProtos = []string{"h2", "http/1.1"}
+	}
+
+	r.updateClientTLSConfig(clientRootCAPool)
+	tlsConfig.GetConfigForClient = func(*tls.ClientHelloInfo) (*tls.Config, error) {
+		return r.clientTLSConfig.Load(), nil
+	}
+}
+
+// updateClientTLSConfig creates a new TLS configuration for incoming client
+// connections using the given client root CA pool. The server certificate is
+// provided by the cloned base configuration, so file based certificate
+// reloads of the base configuration keep working.
+func (r *ServerReloader) updateClientTLSConfig(clientRootCAPool *x509.CertPool) {
+	if r.baseTLSConfig == nil {
+		return
+	}
+
+	tlsConfig := r.baseTLSConfig.Clone()
+	if clientRootCAPool != nil {
+		// We have some endpoint that don't require mTLS (like healthcheck)
+		// So we do not make the client certificate mandatory and check for the certificate
+		// in code. However, we still want the handshake to fail early if a wrong certificate is presented.
+		tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
+		tlsConfig.ClientCAs = clientRootCAPool
+	}
+
+	r.clientTLSConfig.Store(tlsConfig)
+}
+
+// Reload reloads the signing keys, the token policy, the claim mapping, the CSR policy, the
+// SPIFFE configuration and the client root CAs including the matching CRLs.
+// A failure in one of the steps does not prevent the other steps from being
+// executed. Values that failed to reload are kept as they are.
+func (r *ServerReloader) Reload(ctx context.Context) error {
+	r.reloadGuard.Lock()
+	defer r.reloadGuard.Unlock()
+
+	log.Info().Msg("Reloading server key material")
+	reloadErrors := error(nil)
+
+	if err := initJWKS(); err != nil {
+		log.Error().Err(err).Msg("Failed to reload signing keys")
+		reloadErrors = errors.Join(reloadErrors, err)
+	}
+
+	if err := initTokenPolicy(); err != nil {
+		log.Error().Err(err).Msg("Failed to reload token policy")
+		reloadErrors = errors.Join(reloadErrors, err)
+	}
+
+	if err := initClaimMapping(); err != nil {
+		log.Error().Err(err).Msg("Failed to reload claim mapping")
+		reloadErrors = errors.Join(reloadErrors, err)
+	}
+
+	if err := initCSRPolicy(); err != nil {
+		log.Error().Err(err).Msg("Failed to reload CSR policy")
+		reloadErrors = errors.Join(reloadErrors, err)
+	}
+
+	if err := initSPIFFE(); err != nil {
+		log.Error().Err(err).Msg("Failed to reload SPIFFE configuration")
+		reloadErrors = errors.Join(reloadErrors, err)
+	}
+
+	if r.revocationList != nil {
+		if err := r.reloadClientRootCA(ctx); err != nil {
+			reloadErrors = errors.Join(reloadErrors, err)
+		}
+	}
+
+	if reloadErrors == nil {
+		log.Info().Msg("Reloaded server key material")
+	}
+	return reloadErrors
+}
+
+// reloadClientRootCA fetches the client root CAs and the matching CRLs from
+// the certificate authority. Client verification is enabled if both could be
+// loaded. If only some authority pools could be reached, their values are
+// used, client verification is enabled and an error wrapping
+// certificates.ErrPartialResult is returned.
+// The caller MUST hold the reloadGuard.
+func (r *ServerReloader) reloadClientRootCA(ctx context.Context) error {
+	clientRootCAs, clientRootCAPool, err := InitClientRootCA(r.authority, r.trustCache)
+	partialErr := error(nil)
+	if errors.Is(err, certificates.ErrPartialResult) {
+		log.Error().Err(err).Msg("Failed to reload the client root CA of some pools")
+		partialErr, err = err, nil
+	}
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to reload client root CA")
+		return err
+	}
+
+	r.revocationList.SetClientRootCAs(clientRootCAs)
+	r.updateClientTLSConfig(clientRootCAPool)
+
+	if err := r.revocationList.Update(ctx); errors.Is(err, certificates.ErrPartialResult) {
+		log.Error().Err(err).Msg("Failed to update the revoked certificates of some pools after reload")
+		partialErr = errors.Join(partialErr, err)
+	} else if err != nil {
+		log.Error().Err(err).Msg("Failed to update revoked certificates after reload")
+		return err
+	}
+
+	r.revocationList.StartUpdateTimer()
+	r.EnableClientVerification()
+	return partialErr
+}
+
+// EnableClientVerification marks client certificates as verifiable, which
+// makes endpoints guarded by RequireClientVerification available.
+func (r *ServerReloader) EnableClientVerification() {
+	if !r.clientVerification.Swap(true) {
+		log.Info().Msg("Client certificate verification enabled")
+	}
+}
+
+// ClientVerificationEnabled returns true if client certificates can be
+// verified.
+func (r *ServerReloader) ClientVerificationEnabled() bool {
+	return r.clientVerification.Load()
+}
+
+// RequireClientVerification returns a middleware that rejects requests with
+// ErrorClientVerificationUnavailable as long as client certificates cannot be
+// verified.
+func (r *ServerReloader) RequireClientVerification() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !r.ClientVerificationEnabled() {
+			shared.HttpError(c, http.StatusServiceUnavailable, ErrorClientVerificationUnavailable)
+			c.Abort()
+			return
+		}
+		c.Next()
+	}
+}
+
+// StartTrustRecovery tries to fetch the client root CAs and CRLs from the
+// certificate authority every interval until it succeeds. This is meant to be
+// used if the server was started without trust roots, with cached ones or
+// with the ones of some authority pools only.
+// The returned function stops the recovery.
+func (r *ServerReloader) StartTrustRecovery(interval time.Duration) func() {
+	done := make(chan struct{})
+	ticker := time.NewTicker(interval)
+
+	go func() {
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				r.reloadGuard.Lock()
+				err := r.reloadClientRootCA(context.Background())
+				r.reloadGuard.Unlock()
+
+				if err == nil {
+					log.Info().Msg("Certificate authority is reachable again")
+					return
+				}
+				log.Warn().Dur("retryIn", interval).Msg("Certificate authority is still unreachable")
+			}
+		}
+	}()
+
+	return sync.OnceFunc(func() { close(done) })
+}
+
+// ReloadOnSignal calls Reload whenever the process receives a SIGHUP.
+// The returned function stops listening for the signal.
+func (r *ServerReloader) ReloadOnSignal() func() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+
+	go func() {
+		for range signals {
+			log.Info().Msg("Received SIGHUP")
+			_ = r.Reload(context.Background())
+		}
+	}()
+
+	return func() {
+		signal.Stop(signals)
+		close(signals)
+	}
+}
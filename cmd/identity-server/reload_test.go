@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestServerReloaderSwapsKeys(t *testing.T) {
+	assert := assert.New(t)
+	dir := t.TempDir()
+	defer viper.Reset()
+	// Reload also loads the CSR policy, which rejects all keys without defaults
+	defer csrPolicy.Store(nil)
+
+	viper.Set("server.key", writeTestKey(t, dir, "first.pem"))
+	viper.Set("server.keyName", "first")
+	assert.NoError(initJWKS())
+	assert.Equal("first", serverKeys.Load().activeKey(time.Now()).keyID)
+
+	reloader := NewServerReloader(nil, nil, nil)
+
+	// A failing reload keeps the old keys
+	viper.Set("server.key", dir+"/missing.pem")
+	assert.Error(reloader.Reload(context.Background()))
+	assert.Equal("first", serverKeys.Load().activeKey(time.Now()).keyID)
+
+	viper.Set("server.key", writeTestKey(t, dir, "second.pem"))
+	viper.Set("server.keyName", "second")
+	assert.NoError(reloader.Reload(context.Background()))
+	assert.Equal("second", serverKeys.Load().activeKey(time.Now()).keyID)
+}
+
+func TestServerReloaderTLSConfig(t *testing.T) {
+	assert := assert.New(t)
+
+	reloader := NewServerReloader(nil, nil, nil)
+	serverCert := &tls.Certificate{}
+	serverConfig := &tls.Config{
+		GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+			return serverCert, nil
+		},
+	}
+
+	reloader.AttachTLSConfig(serverConfig, nil)
+	assert.NotNil(serverConfig.GetConfigForClient)
+
+	clientConfig, err := serverConfig.GetConfigForClient(&tls.ClientHelloInfo{})
+	assert.NoError(err)
+	assert.Equal(tls.NoClientCert, clientConfig.ClientAuth)
+	assert.Contains(clientConfig.NextProtos, "h2")
+
+	// Replacing the pool changes the config for new clients only
+	pool := x509.NewCertPool()
+	reloader.updateClientTLSConfig(pool)
+
+	newClientConfig, err := serverConfig.GetConfigForClient(&tls.ClientHelloInfo{})
+	assert.NoError(err)
+	assert.Equal(tls.VerifyClientCertIfGiven, newClientConfig.ClientAuth)
+	assert.Same(pool, newClientConfig.ClientCAs)
+	assert.Nil(clientConfig.ClientCAs)
+
+	// Certificates reloaded by the base config are used right away
+	serverCert = &tls.Certificate{}
+	cert, err := newClientConfig.GetCertificate(&tls.ClientHelloInfo{})
+	assert.NoError(err)
+	assert.Same(serverCert, cert)
+}
+
+func TestServerReloaderRequireClientVerification(t *testing.T) {
+	assert := assert.New(t)
+	gin.SetMode(gin.TestMode)
+
+	reloader := NewServerReloader(nil, nil, nil)
+	router := gin.New()
+	router.GET("/identity", reloader.RequireClientVerification(), func(c *gin.Context) {
+		c.Status(http.StatusOK)
+	})
+
+	request := func() int {
+		recorder := httptest.NewRecorder()
+		router.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/identity", nil))
+		return recorder.Code
+	}
+
+	assert.False(reloader.ClientVerificationEnabled())
+	assert.Equal(http.StatusServiceUnavailable, request())
+
+	reloader.EnableClientVerification()
+	assert.True(reloader.ClientVerificationEnabled())
+	assert.Equal(http.StatusOK, request())
+}
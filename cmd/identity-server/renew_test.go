@@ -3,16 +3,22 @@ package main
 import (
 	"crypto/x509"
 	"crypto/x509/pkix"
+	"encoding/json"
 	"encoding/pem"
 	"identity-metadata-server/internal/certificates"
+	"identity-metadata-server/internal/shared"
 	"math/big"
 	"net"
+	"net/http"
+	"net/http/httptest"
 	"testing"
 
+	"github.com/gin-gonic/gin"
 	"github.com/stretchr/testify/assert"
+	"software.sslmate.com/src/go-pkcs12"
 )
 
-func TestVerifyRenewRequest(t *testing.T) {
+func TestVerifyChangeRequest(t *testing.T) {
 	assert := assert.New(t)
 
 	key, err := certificates.CreateECPrivateKeyPEM(certificates.KeyStrengthNormal)
@@ -34,11 +40,11 @@ func TestVerifyRenewRequest(t *testing.T) {
 	assert.NoError(err)
 	assert.NotNil(csr)
 
-	err = VerifyRenewRequest(csr, dummyCert)
-	assert.NoError(err)
+	assert.NoError(VerifyChangeRequest(csr, dummyCert))
+	assert.NoError(verifyRenewSubject(csr, dummyCert))
 }
 
-func TestVerifyRenewRequestSAChange(t *testing.T) {
+func TestVerifyChangeRequestSAChange(t *testing.T) {
 	assert := assert.New(t)
 
 	key, err := certificates.CreateECPrivateKeyPEM(certificates.KeyStrengthNormal)
@@ -60,11 +66,10 @@ func TestVerifyRenewRequestSAChange(t *testing.T) {
 	assert.NoError(err)
 	assert.NotNil(csr)
 
-	err = VerifyRenewRequest(csr, dummyCert)
-	assert.Error(err)
+	assert.Error(VerifyChangeRequest(csr, dummyCert))
 }
 
-func TestVerifyRenewRequestIPChange(t *testing.T) {
+func TestVerifyRenewSubjectIPChange(t *testing.T) {
 	assert := assert.New(t)
 
 	key, err := certificates.CreateECPrivateKeyPEM(certificates.KeyStrengthNormal)
@@ -87,11 +92,12 @@ func TestVerifyRenewRequestIPChange(t *testing.T) {
 	assert.NoError(err)
 	assert.NotNil(csr)
 
-	err = VerifyRenewRequest(csr, dummyCert)
-	assert.Error(err)
+	// Changes are valid, but need an approval
+	assert.NoError(VerifyChangeRequest(csr, dummyCert))
+	assert.Error(verifyRenewSubject(csr, dummyCert))
 }
 
-func TestVerifyRenewRequestIdentityChange(t *testing.T) {
+func TestVerifyRenewSubjectHostChange(t *testing.T) {
 	assert := assert.New(t)
 
 	key, err := certificates.CreateECPrivateKeyPEM(certificates.KeyStrengthNormal)
@@ -113,8 +119,58 @@ func TestVerifyRenewRequestIdentityChange(t *testing.T) {
 	assert.NoError(err)
 	assert.NotNil(csr)
 
-	err = VerifyRenewRequest(csr, dummyCert)
-	assert.Error(err)
+	// Changes are valid, but need an approval
+	assert.NoError(VerifyChangeRequest(csr, dummyCert))
+	assert.Error(verifyRenewSubject(csr, dummyCert))
+}
+
+func TestWriteCertificateChain(t *testing.T) {
+	assert := assert.New(t)
+
+	root := newTestCA(t, "root", nil)
+	intermediate := newTestCA(t, "intermediate", root)
+	chain := []*x509.Certificate{intermediate.issue(t, 42, x509.ExtKeyUsageClientAuth), intermediate.cert, root.cert}
+
+	write := func(accept string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		c, _ := gin.CreateTestContext(w)
+		c.Request = httptest.NewRequest(http.MethodPost, "/renew", nil)
+		if len(accept) > 0 {
+			c.Request.Header.Set("Accept", accept)
+		}
+		writeCertificateChain(c, chain)
+		return w
+	}
+
+	// The full chain is returned as PEM by default
+	for _, accept := range []string{"", "*/*", MIMEPEM, "text/html"} {
+		w := write(accept)
+		assert.Equal(http.StatusOK, w.Code)
+		assert.Equal(MIMEPEM, w.Header().Get("Content-Type"))
+
+		certs, err := certificates.ParseCertificatesPEM(w.Body.Bytes())
+		assert.NoError(err)
+		assert.Len(certs, 3)
+		assert.True(certs[0].Equal(chain[0]))
+	}
+
+	w := write(gin.MIMEJSON)
+	assert.Equal(http.StatusOK, w.Code)
+	response := shared.CertificateResponse{}
+	assert.NoError(json.Unmarshal(w.Body.Bytes(), &response))
+	assert.Equal("2a", response.Serial)
+	assert.Len(response.Chain, 2)
+	assert.Equal(chain[0].NotAfter.Unix(), response.NotAfter.Unix())
+	leaf, err := certificates.ParseCertificatesPEM([]byte(response.Certificate))
+	assert.NoError(err)
+	assert.True(leaf[0].Equal(chain[0]))
+
+	w = write(MIMEPKCS12)
+	assert.Equal(http.StatusOK, w.Code)
+	assert.Equal(MIMEPKCS12, w.Header().Get("Content-Type"))
+	bundle, err := pkcs12.DecodeTrustStore(w.Body.Bytes(), pkcs12.DefaultPassword)
+	assert.NoError(err)
+	assert.Len(bundle, 3)
 }
 
 func CreateDummyCertificate(hostname string, email string, ips []net.IP) *x509.Certificate {
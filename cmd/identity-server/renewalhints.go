@@ -0,0 +1,129 @@
+package main
+
+import (
+	"crypto/x509"
+	"sync/atomic"
+	"time"
+
+	"identity-metadata-server/internal/certificates"
+	"identity-metadata-server/internal/shared"
+
+	"github.com/gin-gonic/gin"
+)
+
+// renewByContextKey stores the renewal hint of the client in the gin context.
+const renewByContextKey = "renewBy"
+
+// RenewalRotation requests matching clients to renew their certificate early,
+// e.g. after a CA rotation or a mass revocation.
+type RenewalRotation struct {
+	// IssuedBefore selects the certificates issued before this time.
+	IssuedBefore time.Time `json:"issuedBefore"`
+	// RenewBy is the time matching clients should have renewed by.
+	RenewBy time.Time `json:"renewBy"`
+	// Hosts restricts the rotation to matching hosts. Patterns use the
+	// syntax of path.Match. An empty list matches all hosts.
+	Hosts []string `json:"hosts,omitempty"`
+}
+
+// matches returns true if the given certificate has to be renewed.
+// NotBefore is set back by up to certificates.NotBeforeSkew on issuance, so
+// certificates renewed right after the rotation started do not match again.
+func (r *RenewalRotation) matches(cert *x509.Certificate) bool {
+	return cert.NotBefore.Add(certificates.NotBeforeSkew).Before(r.IssuedBefore) &&
+		(len(r.Hosts) == 0 || matchesAny(r.Hosts, cert.Subject.CommonName))
+}
+
+// RenewalHints tells clients to renew their certificate before their regular
+// renewal time. Hints are either set by an operator as RenewalRotation or
+// derived from the expiry of the issuing CA.
+type RenewalHints struct {
+	crl      *CertificateRevocationList
+	rotation atomic.Pointer[RenewalRotation]
+
+	// caExpiryWindow requests an immediate renewal from clients whose issuing
+	// CA expires within this window, if another CA outlives the window.
+	// A value of 0 disables the check.
+	caExpiryWindow time.Duration
+}
+
+// NewRenewalHints creates renewal hints without an active rotation.
+// The CRL is used to look up the issuing CA of client certificates.
+func NewRenewalHints(crl *CertificateRevocationList, caExpiryWindow time.Duration) *RenewalHints {
+	return &RenewalHints{
+		crl:            crl,
+		caExpiryWindow: caExpiryWindow,
+	}
+}
+
+// SetRotation replaces the active rotation. nil removes the rotation.
+func (h *RenewalHints) SetRotation(rotation *RenewalRotation) {
+	h.rotation.Store(rotation)
+}
+
+// Rotation returns the active rotation or nil.
+func (h *RenewalHints) Rotation() *RenewalRotation {
+	return h.rotation.Load()
+}
+
+// RenewBy returns the time the given client certificate should be renewed
+// by. A zero time is returned if no early renewal is required.
+func (h *RenewalHints) RenewBy(cert *x509.Certificate, now time.Time) time.Time {
+	renewBy := time.Time{}
+
+	if rotation := h.rotation.Load(); rotation != nil && rotation.matches(cert) {
+		renewBy = rotation.RenewBy
+	}
+
+	if h.caExpiryWindow > 0 {
+		if issuer := h.crl.Issuer(cert); issuer != nil && issuer.NotAfter.Sub(now) < h.caExpiryWindow && h.hasSuccessor(cert, issuer, now) {
+			renewBy = now
+		}
+	}
+
+	return renewBy
+}
+
+// hasSuccessor returns true if a trusted CA other than issuer is valid at
+// the given time and outlives the caExpiryWindow. CAs that became valid
+// before the certificate was issued are ignored, as the certificate authority
+// used the expiring CA nevertheless and a renewal would not change the
+// issuer.
+func (h *RenewalHints) hasSuccessor(cert, issuer *x509.Certificate, now time.Time) bool {
+	issuedAt := cert.NotBefore.Add(certificates.NotBeforeSkew)
+	for _, ca := range h.crl.ClientRootCAs() {
+		if ca.Equal(issuer) || now.Before(ca.NotBefore) || ca.NotAfter.Sub(now) < h.caExpiryWindow {
+			continue
+		}
+		if ca.NotBefore.Before(issuedAt) {
+			continue
+		}
+		return true
+	}
+	return false
+}
+
+// Middleware returns a middleware adding the renewal hint header to the
+// responses for clients that should renew early. The hint is also stored in
+// the context, so handlers can check for it with IsRenewalHinted.
+// The middleware does not verify the client certificate.
+func (h *RenewalHints) Middleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if c.Request.TLS == nil || len(c.Request.TLS.PeerCertificates) == 0 {
+			return
+		}
+
+		renewBy := h.RenewBy(c.Request.TLS.PeerCertificates[0], time.Now())
+		if !renewBy.IsZero() {
+			c.Header(shared.HeaderRenewBy, renewBy.UTC().Format(time.RFC3339))
+			c.Set(renewByContextKey, renewBy)
+		}
+	}
+}
+
+// IsRenewalHinted returns true if the client of the given request was asked
+// to renew its certificate early.
+func IsRenewalHinted(c *gin.Context) bool {
+	_, hinted := c.Get(renewByContextKey)
+	return hinted
+}
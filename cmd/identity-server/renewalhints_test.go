@@ -0,0 +1,101 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"identity-metadata-server/internal/shared"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRenewalHintsRotation(t *testing.T) {
+	assert := assert.New(t)
+	now := time.Now()
+
+	ca := newTestCA(t, "root", nil)
+	cert := ca.issue(t, 1, x509.ExtKeyUsageClientAuth)
+	crl := NewCertificateRevocationList([]*x509.Certificate{ca.cert}, newTestAuthority(), nil, time.Hour, 0)
+
+	hints := NewRenewalHints(crl, 0)
+	assert.True(hints.RenewBy(cert, now).IsZero())
+
+	// The certificate has been issued right now, with NotBefore set back
+	issuedBefore := now.Add(time.Minute)
+	renewBy := now.Add(time.Hour)
+	hints.SetRotation(&RenewalRotation{IssuedBefore: issuedBefore, RenewBy: renewBy})
+	assert.Equal(renewBy, hints.RenewBy(cert, now))
+
+	// Certificates issued after the rotation are not affected
+	hints.SetRotation(&RenewalRotation{IssuedBefore: now.Add(-time.Hour), RenewBy: renewBy})
+	assert.True(hints.RenewBy(cert, now).IsZero())
+
+	// Even if NotBefore has been set back to before the rotation
+	hints.SetRotation(&RenewalRotation{IssuedBefore: now.Add(-30 * time.Second), RenewBy: renewBy})
+	assert.True(hints.RenewBy(cert, now).IsZero())
+
+	hints.SetRotation(&RenewalRotation{IssuedBefore: issuedBefore, RenewBy: renewBy, Hosts: []string{"*.prod.example.com"}})
+	assert.True(hints.RenewBy(cert, now).IsZero())
+	hints.SetRotation(&RenewalRotation{IssuedBefore: issuedBefore, RenewBy: renewBy, Hosts: []string{"*.example.com"}})
+	assert.Equal(renewBy, hints.RenewBy(cert, now))
+
+	// The header is added to responses for affected clients
+	router := gin.New()
+	router.GET("/identity", hints.Middleware(), func(c *gin.Context) {
+		assert.True(IsRenewalHinted(c))
+		c.Status(http.StatusOK)
+	})
+
+	w := httptest.NewRecorder()
+	request := httptest.NewRequest(http.MethodGet, "/identity", nil)
+	request.TLS = &tls.ConnectionState{PeerCertificates: []*x509.Certificate{cert}}
+	router.ServeHTTP(w, request)
+
+	assert.Equal(http.StatusOK, w.Code)
+	assert.Equal(renewBy.UTC().Format(time.RFC3339), w.Header().Get(shared.HeaderRenewBy))
+
+	hints.SetRotation(nil)
+	assert.True(hints.RenewBy(cert, now).IsZero())
+}
+
+func TestRenewalHintsCAExpiry(t *testing.T) {
+	assert := assert.New(t)
+	now := time.Now()
+
+	// The test CA expires within the next hour
+	ca := newTestCA(t, "root", nil)
+	cert := ca.issue(t, 1, x509.ExtKeyUsageClientAuth)
+	unknown := newTestCA(t, "unknown", nil).issue(t, 2, x509.ExtKeyUsageClientAuth)
+	crl := NewCertificateRevocationList([]*x509.Certificate{ca.cert}, newTestAuthority(), nil, time.Hour, 0)
+
+	// A renewal would get a certificate of the same CA
+	later := now.Add(10 * time.Minute)
+	hints := NewRenewalHints(crl, 2*time.Hour)
+	assert.True(hints.RenewBy(cert, later).IsZero())
+
+	// A CA created after the certificate has been issued takes over
+	successor := newTestCAValidity(t, "successor", nil, now.Add(5*time.Minute), now.Add(48*time.Hour)).cert
+	crl.SetClientRootCAs([]*x509.Certificate{ca.cert, successor})
+	assert.True(NewRenewalHints(crl, 30*time.Minute).RenewBy(cert, later).IsZero())
+	assert.Equal(later, hints.RenewBy(cert, later))
+	assert.True(hints.RenewBy(unknown, later).IsZero())
+
+	// Not yet valid
+	assert.True(hints.RenewBy(cert, now).IsZero())
+
+	// The successor has to outlive the window
+	shortLived := newTestCAValidity(t, "short-lived", nil, now.Add(5*time.Minute), now.Add(90*time.Minute)).cert
+	crl.SetClientRootCAs([]*x509.Certificate{ca.cert, shortLived})
+	assert.True(hints.RenewBy(cert, later).IsZero())
+
+	// Certificates issued after the successor became valid have been issued
+	// by the expiring CA anyway, so renewing again would not help
+	existing := newTestCAValidity(t, "existing", nil, now.Add(-30*time.Minute), now.Add(48*time.Hour)).cert
+	crl.SetClientRootCAs([]*x509.Certificate{ca.cert, existing})
+	assert.True(hints.RenewBy(cert, later).IsZero())
+}
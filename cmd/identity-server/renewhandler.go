@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"crypto/x509"
 	"encoding/pem"
 	"errors"
@@ -10,116 +11,243 @@ import (
 	"io"
 	"net"
 	"net/http"
+	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/rs/zerolog/log"
 	"github.com/spf13/viper"
 )
 
+// Response formats of /renew and /enroll besides gin.MIMEJSON.
+const (
+	MIMEPEM    = "application/x-pem-file"
+	MIMEPKCS12 = "application/x-pkcs12"
+)
+
 type RenewRequest struct {
 	CSR string `json:"csr"`
+	// Lifetime optionally requests a shorter certificate lifetime, e.g. "720h".
+	// PEM encoded requests pass it as query parameter.
+	Lifetime string `json:"lifetime,omitempty"`
 }
 
-func HandleRenewRequest(c *gin.Context, crl *CertificateRevocationList, cfg certificates.GCPCertificateAuthorityConfig) {
+// HandleRenewRequest issues a new client certificate for the calling client.
+// CSRs changing the hostname or the IP addresses of the client certificate
+// are rejected unless a PendingRenewalStore is given. In that case they are
+// stored as pending renewal and a certificate is only issued once the
+// renewal has been approved. Until then, 202 Accepted is returned and the
+// client is expected to send the same CSR again later. Rejected renewals
+// are answered with ErrorPendingRenewalRejected.
+func HandleRenewRequest(c *gin.Context, crl *CertificateRevocationList, authority certificates.Authority, pending *PendingRenewalStore) {
+	request, csr, err := readRenewRequest(c)
+	if err != nil {
+		shared.HttpError(c, http.StatusBadRequest, err)
+		return
+	}
+
+	// Hosts moved to new addresses may already connect from one of them.
+	// Only origins within the auto approval network of the current addresses
+	// are accepted, never the addresses requested by the CSR.
+	var acceptOrigin func(*x509.Certificate, net.IP) bool
+	if pending != nil {
+		acceptOrigin = pending.AcceptsOrigin
+	}
+
 	// Check if we can get a client from the context
-	client, err := NewClientFromContext(c, crl)
+	client, err := newClientFromContext(c, crl, acceptOrigin)
 	if err != nil {
 		log.Error().Err(err).Str("clientIP", c.ClientIP()).Msg("Failed to validate client identity")
 		shared.HttpError(c, http.StatusInternalServerError, err)
 		return
 	}
 
-	request := RenewRequest{}
+	// Verify the CSR doing a refresh, not a new request
+	if err := VerifyChangeRequest(csr, client.Certificate); err != nil {
+		log.Error().Err(err).Msg("CSR is not a valid refresh request")
+		shared.HttpError(c, http.StatusUnprocessableEntity, err)
+		return
+	}
 
-	// Read the body either as JSON or as a PEM file
-	if c.ContentType() == "application/x-pem-file" {
-		csrData, err := io.ReadAll(c.Request.Body)
+	subjectErr := verifyRenewSubject(csr, client.Certificate)
+	if subjectErr != nil && pending == nil {
+		log.Error().Err(subjectErr).Msg("CSR is not a valid refresh request")
+		shared.HttpError(c, http.StatusUnprocessableEntity, subjectErr)
+		return
+	}
+
+	lifetime := viper.GetDuration("server.certAuthority.clientCertLifetime")
+	if policy := csrPolicy.Load(); policy != nil {
+		// Subject changes are renewed early, as the current certificate
+		// cannot be used from the new addresses.
+		early := IsRenewalHinted(c) || subjectErr != nil
+		if err := policy.CheckRenewal(csr, client.Certificate, time.Now(), early); err != nil {
+			log.Error().Err(err).Str("host", client.Host).Msg("CSR rejected by CSR policy")
+			shared.HttpError(c, http.StatusUnprocessableEntity, err)
+			return
+		}
+
+		requested, err := parseRequestedLifetime(request.Lifetime)
+		if err == nil {
+			lifetime, err = policy.Lifetime(requested)
+		}
 		if err != nil {
-			log.Error().Err(err).Msg("Failed to read CSR from request")
+			log.Error().Err(err).Str("host", client.Host).Msg("Invalid certificate lifetime requested")
 			shared.HttpError(c, http.StatusBadRequest, err)
 			return
 		}
-		request.CSR = string(csrData)
-	} else if err := c.BindJSON(&request); err != nil {
-		log.Error().Err(err).Msg("Failed to parse request")
-		shared.HttpError(c, http.StatusBadRequest, err)
-		return
 	}
 
-	pemBlock, _ := pem.Decode([]byte(request.CSR))
-	if pemBlock == nil {
-		err = fmt.Errorf("CSR was not a valid PEM block")
-		log.Error().Err(err).Msg("Failed to decode request")
-		shared.HttpError(c, http.StatusBadRequest, err)
-		return
+	pendingID := ""
+	if subjectErr != nil {
+		renewal, err := pending.Submit(NewPendingRenewal(csr, client.Certificate, c.ClientIP(), time.Now()))
+		if err != nil {
+			log.Error().Err(err).Str("host", client.Host).Msg("Failed to store pending renewal")
+			shared.HttpError(c, http.StatusInternalServerError, err)
+			return
+		}
+		if renewal.IsRejected() {
+			log.Error().Str("id", renewal.ID).Str("host", client.Host).Msg("Renewal has been rejected")
+			shared.HttpError(c, http.StatusForbidden, ErrorPendingRenewalRejected)
+			return
+		}
+		if !renewal.IsApproved() {
+			c.JSON(http.StatusAccepted, renewal)
+			return
+		}
+		pendingID = renewal.ID
 	}
 
-	csr, err := x509.ParseCertificateRequest(pemBlock.Bytes)
+	ctx := certificates.ContextWithOrigin(c.Request.Context(), net.ParseIP(c.ClientIP()))
+	chain, err := issueCertificate(ctx, request.CSR, lifetime, authority)
 	if err != nil {
-		log.Error().Err(err).Msg("Failed to parse CSR")
-		shared.HttpError(c, http.StatusBadRequest, err)
+		shared.HttpError(c, http.StatusInternalServerError, err)
 		return
 	}
 
-	if err := csr.CheckSignature(); err != nil {
-		log.Error().Err(err).Msg("CSR signature verification failed")
-		shared.HttpError(c, http.StatusBadRequest, errors.Join(err, fmt.Errorf("CSR signature invalid")))
-		return
+	if len(pendingID) > 0 {
+		log.Info().Str("id", pendingID).Str("host", client.Host).Msg("Issued certificate for approved renewal")
+		if err := pending.Remove(pendingID); err != nil {
+			log.Error().Err(err).Str("id", pendingID).Msg("Failed to remove approved renewal")
+		}
 	}
 
-	// Verify the CSR doing a refresh, not a new request
-	if err := VerifyRenewRequest(csr, client.Certificate); err != nil {
-		log.Error().Err(err).Msg("CSR is not a valid refresh request")
-		shared.HttpError(c, http.StatusUnprocessableEntity, err)
-		return
+	writeCertificateChain(c, chain)
+}
+
+// readRenewRequest reads a RenewRequest either as JSON or as a PEM file and
+// parses the contained CSR.
+func readRenewRequest(c *gin.Context) (RenewRequest, *x509.CertificateRequest, error) {
+	request := RenewRequest{}
+
+	if c.ContentType() == MIMEPEM {
+		csrData, err := io.ReadAll(c.Request.Body)
+		if err != nil {
+			log.Error().Err(err).Msg("Failed to read CSR from request")
+			return request, nil, err
+		}
+		request.CSR = string(csrData)
+		request.Lifetime = c.Query("lifetime")
+	} else if err := c.BindJSON(&request); err != nil {
+		log.Error().Err(err).Msg("Failed to parse request")
+		return request, nil, err
 	}
 
-	// Get a token to access the GCP Certificate Authority
-	bearerToken, err := GetIdentityServerToken([]string{certificateAuthorityScope}, c.Request.Context())
+	csr, err := parseCSR(request.CSR)
 	if err != nil {
-		shared.HttpError(c, http.StatusInternalServerError, err)
-		return
+		log.Error().Err(err).Msg("Failed to parse CSR")
+		return request, nil, err
 	}
+	return request, csr, nil
+}
 
-	// Create a new certificate from the CSR
-	lifetime := viper.GetDuration("server.certAuthority.clientCertLifetime")
+// parseRequestedLifetime parses the lifetime requested by a client.
+// An empty string requests the default lifetime and returns 0.
+func parseRequestedLifetime(value string) (time.Duration, error) {
+	if len(value) == 0 {
+		return 0, nil
+	}
 
-	cert, err := certificates.CreateGCPCertificateFromCSR(cfg, bearerToken, []byte(request.CSR), lifetime, c.Request.Context())
+	lifetime, err := time.ParseDuration(value)
 	if err != nil {
-		log.Error().Err(err).Msg("failed to create certificate from CSR")
-		shared.HttpError(c, http.StatusInternalServerError, err)
-		return
+		return 0, shared.NewErrorWithStatus(http.StatusBadRequest, "invalid certificate lifetime %q", value)
 	}
+	return lifetime, nil
+}
 
-	// Return the cert to the client
-	certPEM, err := certificates.EncodeCertificateToPEM(cert)
+// issueCertificate creates a new client certificate with the given lifetime
+// from the given CSR. The certificate is returned followed by its CA
+// certificates. The CSR is expected to be verified already.
+func issueCertificate(ctx context.Context, csrPEM string, lifetime time.Duration, authority certificates.Authority) ([]*x509.Certificate, error) {
+	chain, err := authority.IssueCertificate(ctx, []byte(csrPEM), lifetime)
 	if err != nil {
-		log.Error().Err(err).Msg("failed to encode certificate to PEM")
-		shared.HttpError(c, http.StatusInternalServerError, err)
-		return
+		log.Error().Err(err).Msg("failed to create certificate from CSR")
+		return nil, err
 	}
+	clientInventory.RecordRenewal(chain[0], time.Now())
 
-	c.Header("Content-Type", "application/x-pem-file")
-	c.Header("Content-Disposition", "attachment; filename=client.cert")
-	c.String(http.StatusOK, string(certPEM))
+	return chain, nil
 }
 
-// VerifyRenewRequest checks if the CSR is a valid refresh request for the current certificate.
-// If the request is valid, it returns nil, otherwise it returns an HTTP compatible error.
-func VerifyRenewRequest(csr *x509.CertificateRequest, cert *x509.Certificate) error {
+// writeCertificateChain writes an issued certificate chain in the format
+// requested by the Accept header. If no supported format is requested, the
+// full chain is returned PEM encoded, starting with the client certificate.
+func writeCertificateChain(c *gin.Context, chain []*x509.Certificate) {
+	switch c.NegotiateFormat(MIMEPEM, gin.MIMEJSON, MIMEPKCS12) {
+	case gin.MIMEJSON:
+		response := shared.CertificateResponse{
+			Chain:     make([]string, 0, len(chain)-1),
+			Serial:    certificates.SerialToHex(chain[0]),
+			NotBefore: chain[0].NotBefore,
+			NotAfter:  chain[0].NotAfter,
+		}
+		for i, cert := range chain {
+			certPEM, err := certificates.EncodeCertificateToPEM(cert)
+			if err != nil {
+				log.Error().Err(err).Msg("failed to encode certificate to PEM")
+				shared.HttpError(c, http.StatusInternalServerError, err)
+				return
+			}
+			if i == 0 {
+				response.Certificate = string(certPEM)
+			} else {
+				response.Chain = append(response.Chain, string(certPEM))
+			}
+		}
+		c.JSON(http.StatusOK, response)
+
+	case MIMEPKCS12:
+		bundle, err := certificates.EncodeCertificatesToPKCS12(chain)
+		if err != nil {
+			log.Error().Err(err).Msg("failed to encode certificate chain to PKCS#12")
+			shared.HttpError(c, http.StatusInternalServerError, err)
+			return
+		}
+		c.Header("Content-Disposition", "attachment; filename=client.p12")
+		c.Data(http.StatusOK, MIMEPKCS12, bundle)
+
+	default:
+		chainPEM, err := certificates.EncodeCertificatesToPEM(chain)
+		if err != nil {
+			log.Error().Err(err).Msg("failed to encode certificate chain to PEM")
+			shared.HttpError(c, http.StatusInternalServerError, err)
+			return
+		}
+		c.Header("Content-Disposition", "attachment; filename=client.cert")
+		c.Data(http.StatusOK, MIMEPEM, chainPEM)
+	}
+}
 
-	// Check if the CSR is a valid refresh of the current certificate
+// VerifyChangeRequest checks if the CSR is a valid refresh request for the
+// current certificate, allowing the hostname and IP addresses to change.
+// If the request is valid, it returns nil, otherwise it returns an HTTP compatible error.
+func VerifyChangeRequest(csr *x509.CertificateRequest, cert *x509.Certificate) error {
 	// Check 1: Hostname
 	if len(csr.DNSNames) != 1 {
 		return shared.NewErrorWithStatus(http.StatusUnprocessableEntity, "CSR must contain exactly one DNS name")
 	}
 
-	if csr.DNSNames[0] != cert.Subject.CommonName {
-		return shared.NewErrorWithStatus(http.StatusUnprocessableEntity, "CSR DNS name does not match current client certificate")
-	}
-
-	if csr.Subject.CommonName != cert.Subject.CommonName {
-		return shared.NewErrorWithStatus(http.StatusUnprocessableEntity, "CSR Common Name does not match current client certificate")
+	if csr.Subject.CommonName != csr.DNSNames[0] {
+		return shared.NewErrorWithStatus(http.StatusUnprocessableEntity, "CSR Common Name does not match CSR DNS name")
 	}
 
 	// Check 2: Email address (identity)
@@ -128,6 +256,26 @@ func VerifyRenewRequest(csr *x509.CertificateRequest, cert *x509.Certificate) er
 	}
 
 	// Check 3: IP addresses (origin)
+	if len(csr.IPAddresses) == 0 {
+		return shared.NewErrorWithStatus(http.StatusUnprocessableEntity, "CSR must contain at least one IP address")
+	}
+
+	// Check 4: Key usage
+	return verifyCSRUsage(csr)
+}
+
+// verifyRenewSubject checks if the CSR requests the hostname and the IP
+// addresses of the current certificate.
+// If the request is valid, it returns nil, otherwise it returns an HTTP compatible error.
+func verifyRenewSubject(csr *x509.CertificateRequest, cert *x509.Certificate) error {
+	if csr.DNSNames[0] != cert.Subject.CommonName {
+		return shared.NewErrorWithStatus(http.StatusUnprocessableEntity, "CSR DNS name does not match current client certificate")
+	}
+
+	if csr.Subject.CommonName != cert.Subject.CommonName {
+		return shared.NewErrorWithStatus(http.StatusUnprocessableEntity, "CSR Common Name does not match current client certificate")
+	}
+
 	IpEqual := func(a, b net.IP) bool {
 		return a.Equal(b)
 	}
@@ -135,7 +283,34 @@ func VerifyRenewRequest(csr *x509.CertificateRequest, cert *x509.Certificate) er
 		return shared.NewErrorWithStatus(http.StatusUnprocessableEntity, "CSR IP addresses do not match current client certificate")
 	}
 
-	// Check 4: Key usage
+	return nil
+}
+
+// parseCSR decodes a PEM encoded CSR and checks its signature.
+// Errors are returned as HTTP compatible errors.
+func parseCSR(csrPEM string) (*x509.CertificateRequest, error) {
+	pemBlock, _ := pem.Decode([]byte(csrPEM))
+	if pemBlock == nil {
+		return nil, shared.NewErrorWithStatus(http.StatusBadRequest, "CSR was not a valid PEM block")
+	}
+
+	csr, err := x509.ParseCertificateRequest(pemBlock.Bytes)
+	if err != nil {
+		return nil, shared.WrapErrorWithStatus(err, http.StatusBadRequest)
+	}
+
+	if err := csr.CheckSignature(); err != nil {
+		err = errors.Join(err, fmt.Errorf("CSR signature invalid"))
+		return nil, shared.WrapErrorWithStatus(err, http.StatusBadRequest)
+	}
+
+	return csr, nil
+}
+
+// verifyCSRUsage checks if the CSR requests a certificate for mTLS client
+// authentication only.
+// If the request is valid, it returns nil, otherwise it returns an HTTP compatible error.
+func verifyCSRUsage(csr *x509.CertificateRequest) error {
 	if ok, err := certificates.VerifyCSRKeyUsage(csr, x509.KeyUsageDigitalSignature); !ok {
 		err = errors.Join(err, fmt.Errorf("key usage validation failed"))
 		return shared.WrapErrorWithStatus(err, http.StatusUnprocessableEntity)
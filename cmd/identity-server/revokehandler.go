@@ -0,0 +1,134 @@
+package main
+
+import (
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"identity-metadata-server/internal/certificates"
+	"identity-metadata-server/internal/shared"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/rs/zerolog/log"
+)
+
+// isRevocationAdmin returns true if the given hostname may revoke any
+// certificate. See hostListed on why hostnames are used.
+func isRevocationAdmin(host string) bool {
+	return hostListed("server.revocation.admins", host)
+}
+
+// HandleRevokeRequest revokes client certificates.
+// Without parameters, the certificate used to call the endpoint is revoked.
+// Revocation admins can select certificates by serial, host or identity.
+// Revoked serials are blocked right away, without waiting for the next CRL.
+// If revoking one of several certificates fails, the certificates revoked so
+// far are returned together with the error.
+func HandleRevokeRequest(c *gin.Context, crl *CertificateRevocationList, authority certificates.Authority) {
+	client, err := NewClientFromContext(c, crl)
+	if err != nil {
+		log.Error().Err(err).Str("clientIP", c.ClientIP()).Msg("Failed to validate client identity")
+		shared.HttpError(c, http.StatusInternalServerError, err)
+		return
+	}
+
+	// An empty body is a valid self-revocation request
+	request := shared.RevokeRequest{}
+	if err := c.ShouldBindJSON(&request); err != nil && !errors.Is(err, io.EOF) {
+		log.Error().Err(err).Msg("Failed to parse revocation request")
+		shared.HttpError(c, http.StatusBadRequest, err)
+		return
+	}
+
+	reason, err := certificates.ParseRevocationReason(request.Reason)
+	if err != nil {
+		shared.HttpError(c, http.StatusBadRequest, err)
+		return
+	}
+
+	targets, err := findRevocationTargets(c, client, authority, request)
+	if err != nil {
+		log.Error().Err(err).
+			Str("host", client.Host).
+			Str("identity", client.Identity).
+			Msg("Failed to find certificates to revoke")
+		shared.HttpError(c, http.StatusInternalServerError, err)
+		return
+	}
+
+	response := shared.RevokeResponse{
+		Revoked: make([]string, 0, len(targets)),
+	}
+
+	for _, cert := range targets {
+		hexSerial := certificates.SerialToHex(cert)
+		if err := authority.RevokeCertificate(c.Request.Context(), hexSerial, reason); err != nil {
+			log.Error().Err(err).
+				Str("serial", hexSerial).
+				Strs("revoked", response.Revoked).
+				Msg("Failed to revoke certificate")
+
+			status := http.StatusInternalServerError
+			if httpErr, ok := err.(shared.ErrorWithStatus); ok {
+				status = httpErr.Code
+			}
+			response.Error = err.Error()
+			c.JSON(status, response)
+			return
+		}
+
+		crl.AddRevoked(hexSerial, cert.NotAfter)
+		response.Revoked = append(response.Revoked, hexSerial)
+
+		log.Info().
+			Str("serial", hexSerial).
+			Str("host", cert.Subject.CommonName).
+			Str("reason", reason.String()).
+			Str("revokedBy", client.Host).
+			Msg("Revoked certificate")
+	}
+
+	c.JSON(http.StatusOK, response)
+}
+
+// findRevocationTargets returns the certificates selected by the request.
+// Clients that are not revocation admins can only select their own
+// certificate.
+func findRevocationTargets(c *gin.Context, client *IdentityClient, authority certificates.Authority, request shared.RevokeRequest) ([]*x509.Certificate, error) {
+	query := certificates.CertificateQuery{
+		Host:     request.Host,
+		Identity: request.Identity,
+	}
+	serial := strings.ToLower(request.Serial)
+
+	if query.IsEmpty() && (len(serial) == 0 || serial == client.SerialNumber) {
+		return []*x509.Certificate{client.Certificate}, nil
+	}
+
+	if !isRevocationAdmin(client.Host) {
+		return nil, ErrorRevocationNotAllowed
+	}
+
+	if len(serial) == 0 {
+		targets, err := authority.FindCertificates(c.Request.Context(), query)
+		if err == nil && len(targets) == 0 {
+			err = ErrorNoMatchingCertificate
+		}
+		return targets, err
+	}
+
+	if _, err := hex.DecodeString(serial); err != nil {
+		return nil, shared.NewErrorWithStatus(http.StatusBadRequest, "invalid serial number %q", request.Serial)
+	}
+
+	cert, err := authority.GetCertificate(c.Request.Context(), serial)
+	if err != nil {
+		return nil, err
+	}
+	if !query.Matches(cert) {
+		return nil, ErrorNoMatchingCertificate
+	}
+	return []*x509.Certificate{cert}, nil
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"context"
+	"crypto/x509"
+	"encoding/json"
+	"identity-metadata-server/internal/certificates"
+	"identity-metadata-server/internal/shared"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+)
+
+// testAuthority is an in-memory certificates.Authority that does not publish
+// any revocations in its CRLs.
+type testAuthority struct {
+	certs   map[string]*x509.Certificate
+	revoked map[string]certificates.RevocationReason
+}
+
+func newTestAuthority(certs ...*x509.Certificate) *testAuthority {
+	authority := &testAuthority{
+		certs:   map[string]*x509.Certificate{},
+		revoked: map[string]certificates.RevocationReason{},
+	}
+	for _, cert := range certs {
+		authority.certs[certificates.SerialToHex(cert)] = cert
+	}
+	return authority
+}
+
+func (a *testAuthority) IssueCertificate(ctx context.Context, csrPEM []byte, lifetime time.Duration) ([]*x509.Certificate, error) {
+	return nil, shared.NewErrorWithStatus(http.StatusNotImplemented, "not implemented")
+}
+
+func (a *testAuthority) GetCertificate(ctx context.Context, hexSerial string) (*x509.Certificate, error) {
+	if cert, ok := a.certs[hexSerial]; ok {
+		return cert, nil
+	}
+	return nil, ErrorNoMatchingCertificate
+}
+
+func (a *testAuthority) FindCertificates(ctx context.Context, query certificates.CertificateQuery) ([]*x509.Certificate, error) {
+	certs := []*x509.Certificate{}
+	for serial, cert := range a.certs {
+		if _, isRevoked := a.revoked[serial]; !isRevoked && query.Matches(cert) {
+			certs = append(certs, cert)
+		}
+	}
+	return certs, nil
+}
+
+func (a *testAuthority) RootCertificates(ctx context.Context) ([]*x509.Certificate, error) {
+	return nil, nil
+}
+
+func (a *testAuthority) RevokeCertificate(ctx context.Context, hexSerial string, reason certificates.RevocationReason) error {
+	if _, ok := a.certs[hexSerial]; !ok {
+		return ErrorNoMatchingCertificate
+	}
+	a.revoked[hexSerial] = reason
+	return nil
+}
+
+func (a *testAuthority) RevocationLists(ctx context.Context) ([]x509.RevocationList, error) {
+	return []x509.RevocationList{}, nil
+}
+
+func TestHandleRevokeRequestSelf(t *testing.T) {
+	assert := assert.New(t)
+	defer viper.Reset()
+
+	certs, crl := newTestClientCertificates(t, "host.example.com", "other.example.com")
+	authority := newTestAuthority(certs...)
+	crl.authority = authority
+	serial := certificates.SerialToHex(certs[0])
+
+	c, w := newTestMTLSRequest(certs[0], http.MethodPost, "/revoke", gin.MIMEJSON, nil)
+	HandleRevokeRequest(c, crl, authority)
+	assert.Equal(http.StatusOK, w.Code)
+
+	response := shared.RevokeResponse{}
+	assert.NoError(json.Unmarshal(w.Body.Bytes(), &response))
+	assert.Equal([]string{serial}, response.Revoked)
+	assert.Equal(certificates.RevocationReasonUnspecified, authority.revoked[serial])
+
+	// The serial is blocked right away and survives CRL updates
+	assert.True(crl.IsSerialRevoked(serial))
+	assert.NoError(crl.Update(context.Background()))
+	assert.True(crl.IsSerialRevoked(serial))
+	assert.False(crl.IsRevoked(certs[1]))
+
+	// The revoked certificate cannot be used anymore
+	c, w = newTestMTLSRequest(certs[0], http.MethodPost, "/revoke", gin.MIMEJSON, nil)
+	HandleRevokeRequest(c, crl, authority)
+	assert.Equal(http.StatusGone, w.Code)
+
+	// Clients cannot revoke other certificates
+	c, w = newTestMTLSRequest(certs[1], http.MethodPost, "/revoke", gin.MIMEJSON, newTestJSONBody(t, &shared.RevokeRequest{Host: "host.example.com"}))
+	HandleRevokeRequest(c, crl, authority)
+	assert.Equal(http.StatusForbidden, w.Code)
+
+	// Unknown reasons are rejected
+	c, w = newTestMTLSRequest(certs[1], http.MethodPost, "/revoke", gin.MIMEJSON, newTestJSONBody(t, &shared.RevokeRequest{Reason: "bored"}))
+	HandleRevokeRequest(c, crl, authority)
+	assert.Equal(http.StatusBadRequest, w.Code)
+	assert.False(crl.IsRevoked(certs[1]))
+}
+
+func TestHandleRevokeRequestAdmin(t *testing.T) {
+	assert := assert.New(t)
+	defer viper.Reset()
+
+	certs, crl := newTestClientCertificates(t, "admin.example.com", "host-a.example.com", "host-b.example.com")
+	authority := newTestAuthority(certs...)
+	viper.Set("server.revocation.admins", []string{"admin.example.com"})
+
+	// Sharing the identity of an admin is not enough
+	c, w := newTestMTLSRequest(certs[2], http.MethodPost, "/revoke", gin.MIMEJSON, newTestJSONBody(t, &shared.RevokeRequest{Host: "host-a.example.com"}))
+	HandleRevokeRequest(c, crl, authority)
+	assert.Equal(http.StatusForbidden, w.Code)
+	assert.False(crl.IsRevoked(certs[1]))
+
+	// Revoke by host
+	c, w = newTestMTLSRequest(certs[0], http.MethodPost, "/revoke", gin.MIMEJSON, newTestJSONBody(t, &shared.RevokeRequest{Host: "HOST-A.example.com", Reason: "keyCompromise"}))
+	HandleRevokeRequest(c, crl, authority)
+	assert.Equal(http.StatusOK, w.Code)
+	assert.True(crl.IsRevoked(certs[1]))
+	assert.False(crl.IsRevoked(certs[2]))
+	assert.Equal(certificates.RevocationReasonKeyCompromise, authority.revoked[certificates.SerialToHex(certs[1])])
+
+	// Revoke by serial
+	c, w = newTestMTLSRequest(certs[0], http.MethodPost, "/revoke", gin.MIMEJSON, newTestJSONBody(t, &shared.RevokeRequest{Serial: certificates.SerialToHex(certs[2])}))
+	HandleRevokeRequest(c, crl, authority)
+	assert.Equal(http.StatusOK, w.Code)
+	assert.True(crl.IsRevoked(certs[2]))
+
+	// Serial and host must match
+	c, w = newTestMTLSRequest(certs[0], http.MethodPost, "/revoke", gin.MIMEJSON, newTestJSONBody(t, &shared.RevokeRequest{Serial: certificates.SerialToHex(certs[2]), Host: "host-a.example.com"}))
+	HandleRevokeRequest(c, crl, authority)
+	assert.Equal(http.StatusNotFound, w.Code)
+
+	// No match
+	c, w = newTestMTLSRequest(certs[0], http.MethodPost, "/revoke", gin.MIMEJSON, newTestJSONBody(t, &shared.RevokeRequest{Identity: "unknown@example.com"}))
+	HandleRevokeRequest(c, crl, authority)
+	assert.Equal(http.StatusNotFound, w.Code)
+	assert.False(crl.IsRevoked(certs[0]))
+}
+
+// failingRevokeAuthority is a testAuthority failing to revoke the
+// certificate with the given serial.
+type failingRevokeAuthority struct {
+	*testAuthority
+	failSerial string
+}
+
+func (a *failingRevokeAuthority) RevokeCertificate(ctx context.Context, hexSerial string, reason certificates.RevocationReason) error {
+	if hexSerial == a.failSerial {
+		return shared.NewErrorWithStatus(http.StatusServiceUnavailable, "unavailable")
+	}
+	return a.testAuthority.RevokeCertificate(ctx, hexSerial, reason)
+}
+
+func TestHandleRevokeRequestPartialFailure(t *testing.T) {
+	assert := assert.New(t)
+	defer viper.Reset()
+
+	certs, crl := newTestClientCertificates(t, "admin.example.com", "host-a.example.com", "host-b.example.com")
+	failSerial := certificates.SerialToHex(certs[2])
+	authority := &failingRevokeAuthority{testAuthority: newTestAuthority(certs[1:]...), failSerial: failSerial}
+	viper.Set("server.revocation.admins", []string{"admin.example.com"})
+
+	// The certificates revoked before the failure are returned with the error
+	c, w := newTestMTLSRequest(certs[0], http.MethodPost, "/revoke", gin.MIMEJSON, newTestJSONBody(t, &shared.RevokeRequest{Identity: "test@example.com"}))
+	HandleRevokeRequest(c, crl, authority)
+	assert.Equal(http.StatusServiceUnavailable, w.Code)
+
+	response := shared.RevokeResponse{}
+	assert.NoError(json.Unmarshal(w.Body.Bytes(), &response))
+	assert.Contains(response.Error, "unavailable")
+	assert.NotContains(response.Revoked, failSerial)
+	for _, serial := range response.Revoked {
+		assert.True(crl.IsSerialRevoked(serial))
+	}
+	assert.False(crl.IsSerialRevoked(failSerial))
+}
@@ -108,7 +108,7 @@ func newTokenExchangeRequest(serviceAccount string, scopes []string) (string, er
 
 	log.Debug().Str("identity", workloadIdentityAudience+"/"+hostname).Msg("Creating token exchange request")
 
-	oidcToken, err := generateOIDCToken(serviceAccount, hostname, []string{workloadIdentityAudience}, time.Minute*15)
+	oidcToken, err := generateOIDCToken(serviceAccount, hostname, []string{workloadIdentityAudience}, time.Minute*15, tokenOptions{})
 	if err != nil {
 		return "", errors.Join(err, errors.New("failed to create OIDC token"))
 	}
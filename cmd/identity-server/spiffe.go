@@ -0,0 +1,323 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"text/template"
+	"time"
+
+	"identity-metadata-server/internal/certificates"
+	"identity-metadata-server/internal/shared"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/lestrrat-go/jwx/jwk"
+	"github.com/rs/zerolog/log"
+	"github.com/spf13/viper"
+)
+
+// SPIFFE key uses in bundles, see the SPIFFE trust domain and bundle
+// specification.
+const (
+	SPIFFEUseX509SVID = "x509-svid"
+	SPIFFEUseJWTSVID  = "jwt-svid"
+)
+
+// SPIFFEConfig defines how SPIFFE IDs and SVIDs are issued to clients.
+type SPIFFEConfig struct {
+	// TrustDomain is the trust domain of all issued SPIFFE IDs.
+	TrustDomain string
+	// X509Lifetime is the maximum lifetime of X.509-SVIDs.
+	X509Lifetime time.Duration
+	// JWTLifetime is the maximum lifetime of JWT-SVIDs.
+	JWTLifetime time.Duration
+	// RefreshHint tells bundle consumers how often to poll the bundle.
+	RefreshHint time.Duration
+
+	// path generates the path of the SPIFFE ID. It is executed like the
+	// claim templates, see claimTemplateData.
+	path *template.Template
+}
+
+// SPIFFEBundle is a SPIFFE bundle in JWKS format. It holds the X.509 roots
+// and the JWT signing keys of the trust domain.
+type SPIFFEBundle struct {
+	Keys        []map[string]any `json:"keys"`
+	RefreshHint int64            `json:"spiffe_refresh_hint,omitempty"`
+}
+
+// SPIFFEAuthority issues X.509-SVIDs from a certificate authority dedicated
+// to SPIFFE, so SVIDs cannot be used as client certificates of this server.
+// The root certificates of the authority are cached for rootsRefresh.
+type SPIFFEAuthority struct {
+	certificates.Authority
+
+	// roots and rootsUpdated hold the last fetched root certificates. They
+	// are protected by the guard.
+	guard        sync.Mutex
+	roots        []*x509.Certificate
+	rootsUpdated time.Time
+	rootsRefresh time.Duration
+}
+
+// NewSPIFFEAuthority creates a SPIFFEAuthority issuing SVIDs from the given
+// authority. Its root certificates are fetched again after rootsRefresh.
+func NewSPIFFEAuthority(authority certificates.Authority, rootsRefresh time.Duration) *SPIFFEAuthority {
+	return &SPIFFEAuthority{
+		Authority:    authority,
+		rootsRefresh: rootsRefresh,
+	}
+}
+
+// Roots returns the self-signed root certificates of the authority, which
+// are the X.509 authorities of the bundle. If fetching them fails, the last
+// known roots are returned together with the error and are used until the
+// next refresh.
+func (a *SPIFFEAuthority) Roots(ctx context.Context, now time.Time) ([]*x509.Certificate, error) {
+	a.guard.Lock()
+	defer a.guard.Unlock()
+
+	if len(a.roots) > 0 && now.Before(a.rootsUpdated.Add(a.rootsRefresh)) {
+		return a.roots, nil
+	}
+
+	certs, err := a.Authority.RootCertificates(ctx)
+	roots := make([]*x509.Certificate, 0, len(certs))
+	for _, cert := range certs {
+		if isSelfSigned(cert) {
+			roots = append(roots, cert)
+		}
+	}
+
+	if len(roots) == 0 {
+		if len(a.roots) > 0 {
+			a.rootsUpdated = now
+		}
+		return a.roots, errors.Join(err, errors.New("no SPIFFE root certificates found"))
+	}
+	if err != nil {
+		log.Warn().Err(err).Msg("Failed to fetch the SPIFFE root certificates of some pools")
+	}
+
+	a.roots = roots
+	a.rootsUpdated = now
+	return roots, nil
+}
+
+var (
+	// spiffeConfig holds the active SPIFFE configuration.
+	// If no configuration is loaded, SVIDs are not issued.
+	spiffeConfig atomic.Pointer[SPIFFEConfig]
+)
+
+// isSPIFFEChar returns true if the given character is allowed in SPIFFE ID
+// path segments. Trust domains only allow the lower case subset.
+func isSPIFFEChar(c rune) bool {
+	return (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9') ||
+		c == '.' || c == '-' || c == '_'
+}
+
+// validateTrustDomain checks the trust domain against the SPIFFE ID
+// specification.
+func validateTrustDomain(trustDomain string) error {
+	if len(trustDomain) == 0 || len(trustDomain) > 255 {
+		return fmt.Errorf("trust domain must be between 1 and 255 characters long")
+	}
+	for _, c := range trustDomain {
+		if !isSPIFFEChar(c) || (c >= 'A' && c <= 'Z') {
+			return fmt.Errorf("trust domain %q contains invalid character %q", trustDomain, c)
+		}
+	}
+	return nil
+}
+
+// validateSPIFFEPath checks the path of a SPIFFE ID against the SPIFFE ID
+// specification.
+func validateSPIFFEPath(path string) error {
+	if !strings.HasPrefix(path, "/") {
+		return fmt.Errorf("SPIFFE ID path %q must start with /", path)
+	}
+
+	for _, segment := range strings.Split(path[1:], "/") {
+		switch segment {
+		case "":
+			return fmt.Errorf("SPIFFE ID path %q must not contain empty segments", path)
+		case ".", "..":
+			return fmt.Errorf("SPIFFE ID path %q must not contain relative segments", path)
+		}
+		for _, c := range segment {
+			if !isSPIFFEChar(c) {
+				return fmt.Errorf("SPIFFE ID path %q contains invalid character %q", path, c)
+			}
+		}
+	}
+	return nil
+}
+
+// NewSPIFFEConfig checks the trust domain and parses the path template.
+func NewSPIFFEConfig(trustDomain, pathTemplate string, x509Lifetime, jwtLifetime, refreshHint time.Duration) (*SPIFFEConfig, error) {
+	if err := validateTrustDomain(trustDomain); err != nil {
+		return nil, err
+	}
+
+	path, err := parseClaimTemplate("spiffe", pathTemplate)
+	if err != nil {
+		return nil, errors.Join(err, errors.New("failed to parse SPIFFE ID path template"))
+	}
+
+	return &SPIFFEConfig{
+		TrustDomain:  trustDomain,
+		X509Lifetime: x509Lifetime,
+		JWTLifetime:  jwtLifetime,
+		RefreshHint:  refreshHint,
+		path:         path,
+	}, nil
+}
+
+// ID returns the SPIFFE ID of the given client.
+func (s *SPIFFEConfig) ID(client *IdentityClient, origin net.IP) (*url.URL, error) {
+	buffer := bytes.Buffer{}
+	if err := s.path.Execute(&buffer, newClaimTemplateData(client, origin)); err != nil {
+		return nil, errors.Join(err, errors.New("failed to execute SPIFFE ID path template"))
+	}
+
+	path := buffer.String()
+	if err := validateSPIFFEPath(path); err != nil {
+		return nil, err
+	}
+
+	return &url.URL{
+		Scheme: "spiffe",
+		Host:   s.TrustDomain,
+		Path:   path,
+	}, nil
+}
+
+// Bundle returns the SPIFFE bundle holding the given X.509 roots and the
+// JWT signing keys published at the given time. Certificates that are not
+// self-signed are skipped, as are Ed25519 keys, which cannot be used for
+// JWT-SVIDs.
+func (s *SPIFFEConfig) Bundle(roots []*x509.Certificate, ring *keyRing, now time.Time) (SPIFFEBundle, error) {
+	bundle := SPIFFEBundle{
+		Keys:        []map[string]any{},
+		RefreshHint: int64(s.RefreshHint.Seconds()),
+	}
+
+	addKey := func(key jwk.Key, use string, extra map[string]any) error {
+		data, err := json.Marshal(key)
+		if err != nil {
+			return err
+		}
+		entry := map[string]any{}
+		if err := json.Unmarshal(data, &entry); err != nil {
+			return err
+		}
+
+		entry[jwk.KeyUsageKey] = use
+		for name, value := range extra {
+			entry[name] = value
+		}
+		bundle.Keys = append(bundle.Keys, entry)
+		return nil
+	}
+
+	for _, root := range roots {
+		if !isSelfSigned(root) {
+			continue
+		}
+
+		key, err := jwk.New(root.PublicKey)
+		if err != nil {
+			return SPIFFEBundle{}, errors.Join(err, fmt.Errorf("failed to convert root CA %q", root.Subject))
+		}
+		if err := addKey(key, SPIFFEUseX509SVID, map[string]any{
+			jwk.X509CertChainKey: []string{base64.StdEncoding.EncodeToString(root.Raw)},
+		}); err != nil {
+			return SPIFFEBundle{}, err
+		}
+	}
+
+	for _, key := range ring.publishedKeys(now) {
+		if key.method == jwt.SigningMethodEdDSA {
+			continue
+		}
+		if err := addKey(key.setKey, SPIFFEUseJWTSVID, nil); err != nil {
+			return SPIFFEBundle{}, err
+		}
+	}
+
+	return bundle, nil
+}
+
+// svidLifetime returns the requested SVID lifetime capped at the given
+// maximum. A requested lifetime of 0 returns the maximum.
+func svidLifetime(requested, maximum time.Duration) (time.Duration, error) {
+	switch {
+	case requested < 0:
+		return 0, shared.NewErrorWithStatus(http.StatusBadRequest, "requested SVID lifetime must not be negative")
+	case requested == 0 || requested > maximum:
+		return maximum, nil
+	default:
+		return requested, nil
+	}
+}
+
+// VerifySVIDRequest checks if the CSR requests an X.509-SVID with the given
+// SPIFFE ID for the given host. The CSR must not request an identity or
+// origins, so the SVID cannot be used as client certificate for this server.
+// If the request is valid, it returns nil, otherwise it returns an HTTP compatible error.
+func VerifySVIDRequest(csr *x509.CertificateRequest, host string, spiffeID *url.URL) error {
+	if len(csr.URIs) != 1 || csr.URIs[0].String() != spiffeID.String() {
+		return shared.NewErrorWithStatus(http.StatusUnprocessableEntity, "CSR must contain exactly the URI SAN %s", spiffeID)
+	}
+
+	if !strings.EqualFold(csr.Subject.CommonName, host) {
+		return shared.NewErrorWithStatus(http.StatusUnprocessableEntity, "CSR Common Name does not match current client certificate")
+	}
+
+	if len(csr.DNSNames) != 1 || !strings.EqualFold(csr.DNSNames[0], host) {
+		return shared.NewErrorWithStatus(http.StatusUnprocessableEntity, "CSR DNS name does not match current client certificate")
+	}
+
+	if len(csr.EmailAddresses) > 0 || len(csr.IPAddresses) > 0 {
+		return shared.NewErrorWithStatus(http.StatusUnprocessableEntity, "SVID CSR must not contain email addresses or IP addresses")
+	}
+
+	return verifyCSRUsage(csr)
+}
+
+// initSPIFFE loads the SPIFFE configuration from server.spiffe.
+// If no trust domain is configured, SVIDs are not issued.
+// Calling this function will atomically replace the active configuration,
+// hence it can also be used to reload it. If loading fails, the previously
+// loaded configuration is kept.
+func initSPIFFE() error {
+	trustDomain := viper.GetString("server.spiffe.trustDomain")
+	if len(trustDomain) == 0 {
+		spiffeConfig.Store(nil)
+		return nil
+	}
+
+	config, err := NewSPIFFEConfig(
+		trustDomain,
+		viper.GetString("server.spiffe.pathTemplate"),
+		viper.GetDuration("server.spiffe.x509Lifetime"),
+		viper.GetDuration("server.spiffe.jwtLifetime"),
+		viper.GetDuration("server.spiffe.bundleRefreshHint"))
+	if err != nil {
+		return err
+	}
+
+	spiffeConfig.Store(config)
+	return nil
+}
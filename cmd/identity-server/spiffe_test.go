@@ -0,0 +1,262 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"identity-metadata-server/internal/certificates"
+	"identity-metadata-server/internal/shared"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestSPIFFEConfig(t *testing.T, pathTemplate string) *SPIFFEConfig {
+	config, err := NewSPIFFEConfig("example.org", pathTemplate, time.Hour, 5*time.Minute, time.Minute)
+	assert.NoError(t, err)
+	return config
+}
+
+func newTestSVIDCSR(t *testing.T, hostname string, uris ...*url.URL) string {
+	key, err := certificates.CreateECPrivateKeyPEM(certificates.KeyStrengthNormal)
+	assert.NoError(t, err)
+
+	csrPEM, err := certificates.CreateClientCSR(key, hostname, "", nil, uris...)
+	assert.NoError(t, err)
+	return string(csrPEM)
+}
+
+func TestSPIFFEConfigID(t *testing.T) {
+	assert := assert.New(t)
+
+	client, err := NewClientFromCert(CreateDummyCertificate("host.example.com", "test@example.com", []net.IP{net.ParseIP(testClientOrigin)}))
+	assert.NoError(err)
+	origin := net.ParseIP(testClientOrigin)
+
+	id, err := newTestSPIFFEConfig(t, "/host/{{ .Host }}").ID(client, origin)
+	assert.NoError(err)
+	assert.Equal("spiffe://example.org/host/host.example.com", id.String())
+
+	id, err = newTestSPIFFEConfig(t, "/sa/{{ .Identity | trimSuffix \"@example.com\" }}/{{ .Host }}").ID(client, origin)
+	assert.NoError(err)
+	assert.Equal("spiffe://example.org/sa/test/host.example.com", id.String())
+
+	// Generated paths must be valid SPIFFE ID paths
+	for _, path := range []string{"host/{{ .Host }}", "/host/{{ .Identity }}", "/host//{{ .Host }}", "/host/../{{ .Host }}", "/host/{{ .Host }}/"} {
+		_, err = newTestSPIFFEConfig(t, path).ID(client, origin)
+		assert.Error(err, path)
+	}
+
+	// Trust domains must be lower case and must not contain a scheme or path
+	for _, trustDomain := range []string{"", "Example.org", "spiffe://example.org", "example.org/path"} {
+		_, err = NewSPIFFEConfig(trustDomain, "/host/{{ .Host }}", time.Hour, time.Minute, 0)
+		assert.Error(err, trustDomain)
+	}
+}
+
+func TestVerifySVIDRequest(t *testing.T) {
+	assert := assert.New(t)
+	id := &url.URL{Scheme: "spiffe", Host: "example.org", Path: "/host/host.example.com"}
+	other := &url.URL{Scheme: "spiffe", Host: "example.org", Path: "/host/other.example.com"}
+
+	parse := func(csrPEM string) *x509.CertificateRequest {
+		csr, err := parseCSR(csrPEM)
+		assert.NoError(err)
+		return csr
+	}
+
+	assert.NoError(VerifySVIDRequest(parse(newTestSVIDCSR(t, "host.example.com", id)), "host.example.com", id))
+
+	assert.Error(VerifySVIDRequest(parse(newTestSVIDCSR(t, "host.example.com")), "host.example.com", id))
+	assert.Error(VerifySVIDRequest(parse(newTestSVIDCSR(t, "host.example.com", other)), "host.example.com", id))
+	assert.Error(VerifySVIDRequest(parse(newTestSVIDCSR(t, "host.example.com", id, other)), "host.example.com", id))
+	assert.Error(VerifySVIDRequest(parse(newTestSVIDCSR(t, "other.example.com", id)), "host.example.com", id))
+
+	// SVIDs must not be usable as client certificates of this server
+	assert.Error(VerifySVIDRequest(parse(newTestEnrollCSR(t, "host.example.com", "test@example.com", testClientOrigin)), "host.example.com", id))
+}
+
+func TestHandleX509SVIDRequest(t *testing.T) {
+	assert := assert.New(t)
+	defer spiffeConfig.Store(nil)
+
+	ca := newTestCA(t, "root", nil)
+	cert := ca.issueClient(t, "host.example.com", 100)
+
+	crl := NewCertificateRevocationList([]*x509.Certificate{ca.cert}, newTestAuthority(), nil, time.Hour, 0)
+	spiffeCA := newTestCA(t, "spiffe", nil)
+	authority := NewSPIFFEAuthority(&issuingTestAuthority{testAuthority: newTestAuthority(), ca: spiffeCA}, time.Minute)
+	id := &url.URL{Scheme: "spiffe", Host: "example.org", Path: "/host/host.example.com"}
+
+	request := func(csrPEM string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		c, _ := gin.CreateTestContext(w)
+		c.Request = httptest.NewRequest(http.MethodPost, "/spiffe/x509-svid", strings.NewReader(csrPEM))
+		c.Request.Header.Set("Content-Type", MIMEPEM)
+		c.Request.RemoteAddr = testClientOrigin + ":12345"
+		c.Request.TLS = &tls.ConnectionState{PeerCertificates: []*x509.Certificate{cert}}
+		HandleX509SVIDRequest(c, crl, authority)
+		return w
+	}
+
+	spiffeConfig.Store(nil)
+	assert.Equal(http.StatusNotFound, request(newTestSVIDCSR(t, "host.example.com", id)).Code)
+
+	spiffeConfig.Store(newTestSPIFFEConfig(t, "/host/{{ .Host }}"))
+	assert.Equal(http.StatusUnprocessableEntity, request(newTestSVIDCSR(t, "host.example.com")).Code)
+
+	// X.509-SVIDs require a dedicated certificate authority
+	noAuthority := authority
+	authority = nil
+	assert.Equal(http.StatusNotFound, request(newTestSVIDCSR(t, "host.example.com", id)).Code)
+	authority = noAuthority
+
+	w := request(newTestSVIDCSR(t, "host.example.com", id))
+	assert.Equal(http.StatusOK, w.Code)
+
+	block, _ := pem.Decode(w.Body.Bytes())
+	if assert.NotNil(block) {
+		svid, err := x509.ParseCertificate(block.Bytes)
+		assert.NoError(err)
+		if assert.Len(svid.URIs, 1) {
+			assert.Equal(id.String(), svid.URIs[0].String())
+		}
+		assert.Empty(svid.EmailAddresses)
+		assert.LessOrEqual(svid.NotAfter.Sub(svid.NotBefore), time.Hour)
+		assert.NoError(svid.CheckSignatureFrom(spiffeCA.cert))
+	}
+}
+
+func TestHandleJWTSVIDRequest(t *testing.T) {
+	assert := assert.New(t)
+	defer viper.Reset()
+	defer spiffeConfig.Store(nil)
+
+	viper.Set("server.key", writeTestKey(t, t.TempDir(), "server.pem"))
+	viper.Set("server.keyName", "test")
+	viper.Set("server.issuer", "https://identity-server")
+	assert.NoError(initJWKS())
+
+	cert, crl := newTestClientCertificate(t, "host.example.com")
+	request := func(body shared.JWTSVIDRequest) *httptest.ResponseRecorder {
+		data, _ := json.Marshal(body)
+		w := httptest.NewRecorder()
+		c, _ := gin.CreateTestContext(w)
+		c.Request = httptest.NewRequest(http.MethodPost, "/spiffe/jwt-svid", bytes.NewReader(data))
+		c.Request.Header.Set("Content-Type", gin.MIMEJSON)
+		c.Request.RemoteAddr = testClientOrigin + ":12345"
+		c.Request.TLS = &tls.ConnectionState{PeerCertificates: []*x509.Certificate{cert}}
+		HandleJWTSVIDRequest(c, crl)
+		return w
+	}
+
+	assert.Equal(http.StatusNotFound, request(shared.JWTSVIDRequest{Audiences: []string{"spiffe://example.org/db"}}).Code)
+
+	spiffeConfig.Store(newTestSPIFFEConfig(t, "/host/{{ .Host }}"))
+	assert.Equal(http.StatusBadRequest, request(shared.JWTSVIDRequest{}).Code)
+
+	w := request(shared.JWTSVIDRequest{Audiences: []string{"spiffe://example.org/db"}, Lifetime: "1h"})
+	assert.Equal(http.StatusOK, w.Code)
+
+	response := shared.JWTSVIDResponse{}
+	assert.NoError(json.Unmarshal(w.Body.Bytes(), &response))
+	assert.Equal("spiffe://example.org/host/host.example.com", response.SPIFFEID)
+
+	claims := jwt.RegisteredClaims{}
+	token, err := jwt.ParseWithClaims(response.Token, &claims, func(token *jwt.Token) (any, error) {
+		key := serverKeys.Load().publishedKey(token.Header["kid"].(string), time.Now())
+		return key.publicKey()
+	})
+	assert.NoError(err)
+	assert.True(token.Valid)
+	assert.Equal(response.SPIFFEID, claims.Subject)
+	assert.Equal(jwt.ClaimStrings{"spiffe://example.org/db"}, claims.Audience)
+
+	// The lifetime is capped at the configured maximum
+	assert.WithinDuration(time.Now().Add(5*time.Minute), claims.ExpiresAt.Time, 5*time.Second)
+	assert.True(claims.ExpiresAt.Time.Equal(response.ExpiresAt))
+}
+
+func TestSPIFFEBundle(t *testing.T) {
+	assert := assert.New(t)
+	defer viper.Reset()
+
+	dir := t.TempDir()
+	edKeyPEM, err := certificates.CreatePrivateKeyPEM(certificates.ED25519, certificates.KeyStrengthNormal)
+	assert.NoError(err)
+	edKeyPath := filepath.Join(dir, "ed.pem")
+	assert.NoError(os.WriteFile(edKeyPath, edKeyPEM, 0600))
+
+	viper.Set("server.keys", []map[string]any{
+		{"name": "test", "path": writeTestKey(t, dir, "server.pem")},
+		{"name": "ed", "path": edKeyPath, "activeFrom": time.Now().Add(time.Hour).Format(time.RFC3339)},
+	})
+	assert.NoError(initJWKS())
+
+	// Intermediates are not listed as X.509 authorities and Ed25519 keys
+	// cannot be used for JWT-SVIDs
+	ca := newTestCA(t, "root", nil)
+	intermediate := newTestCA(t, "intermediate", ca)
+	bundle, err := newTestSPIFFEConfig(t, "/host/{{ .Host }}").Bundle([]*x509.Certificate{ca.cert, intermediate.cert}, serverKeys.Load(), time.Now())
+	assert.NoError(err)
+	assert.Equal(int64(60), bundle.RefreshHint)
+
+	if assert.Len(bundle.Keys, 2) {
+		assert.Equal(SPIFFEUseX509SVID, bundle.Keys[0]["use"])
+		assert.Equal([]string{base64.StdEncoding.EncodeToString(ca.cert.Raw)}, bundle.Keys[0]["x5c"])
+		assert.Equal(SPIFFEUseJWTSVID, bundle.Keys[1]["use"])
+		assert.Equal("test", bundle.Keys[1]["kid"])
+	}
+}
+
+func TestSPIFFEAuthorityRoots(t *testing.T) {
+	assert := assert.New(t)
+	now := time.Now()
+
+	ca := newTestCA(t, "root", nil)
+	intermediate := newTestCA(t, "intermediate", ca)
+	backend := &crlTestAuthority{testAuthority: newTestAuthority()}
+	authority := NewSPIFFEAuthority(&rootsTestAuthority{crlTestAuthority: backend, roots: []*x509.Certificate{ca.cert, intermediate.cert}}, time.Minute)
+
+	roots, err := authority.Roots(context.Background(), now)
+	assert.NoError(err)
+	assert.Equal([]*x509.Certificate{ca.cert}, roots)
+
+	// The last known roots are used while the authority is unavailable
+	authority.Authority = &rootsTestAuthority{crlTestAuthority: backend, err: errors.New("unavailable")}
+	roots, err = authority.Roots(context.Background(), now.Add(30*time.Second))
+	assert.NoError(err)
+	assert.Len(roots, 1)
+
+	roots, err = authority.Roots(context.Background(), now.Add(2*time.Minute))
+	assert.Error(err)
+	assert.Len(roots, 1)
+}
+
+// rootsTestAuthority is a crlTestAuthority returning the given root
+// certificates. If err is set, fetching the roots fails.
+type rootsTestAuthority struct {
+	*crlTestAuthority
+	roots []*x509.Certificate
+	err   error
+}
+
+func (a *rootsTestAuthority) RootCertificates(ctx context.Context) ([]*x509.Certificate, error) {
+	return a.roots, a.err
+}
@@ -0,0 +1,237 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/hex"
+	"identity-metadata-server/internal/certificates"
+	"identity-metadata-server/internal/shared"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/rs/zerolog/log"
+	"github.com/spf13/viper"
+)
+
+// HandleX509SVIDRequest issues an X.509-SVID for the calling client from
+// the SPIFFE authority. The CSR is sent like for /renew and must contain the
+// SPIFFE ID of the client as only URI SAN. The SVID is returned in the format
+// requested by the Accept header, see writeCertificateChain.
+func HandleX509SVIDRequest(c *gin.Context, crl *CertificateRevocationList, authority *SPIFFEAuthority) {
+	config := spiffeConfig.Load()
+	if config == nil {
+		shared.HttpError(c, http.StatusNotFound, ErrorSPIFFENotConfigured)
+		return
+	}
+	if authority == nil {
+		shared.HttpError(c, http.StatusNotFound, ErrorX509SVIDNotConfigured)
+		return
+	}
+
+	request, csr, err := readRenewRequest(c)
+	if err != nil {
+		shared.HttpError(c, http.StatusBadRequest, err)
+		return
+	}
+
+	client, err := NewClientFromContext(c, crl)
+	if err != nil {
+		log.Error().Err(err).Str("clientIP", c.ClientIP()).Msg("Failed to validate client identity")
+		shared.HttpError(c, http.StatusInternalServerError, err)
+		return
+	}
+
+	origin := net.ParseIP(c.ClientIP())
+	spiffeID, err := config.ID(client, origin)
+	if err != nil {
+		log.Error().Err(err).Str("host", client.Host).Msg("Failed to generate SPIFFE ID")
+		shared.HttpError(c, http.StatusInternalServerError, err)
+		return
+	}
+
+	if err := VerifySVIDRequest(csr, client.Host, spiffeID); err != nil {
+		log.Error().Err(err).Str("host", client.Host).Msg("CSR is not a valid X.509-SVID request")
+		shared.HttpError(c, http.StatusUnprocessableEntity, err)
+		return
+	}
+
+	if policy := csrPolicy.Load(); policy != nil {
+		if err := policy.CheckKey(csr.PublicKey); err != nil {
+			log.Error().Err(err).Str("host", client.Host).Msg("CSR rejected by CSR policy")
+			shared.HttpError(c, http.StatusUnprocessableEntity, err)
+			return
+		}
+	}
+
+	requested, err := parseRequestedLifetime(request.Lifetime)
+	if err != nil {
+		shared.HttpError(c, http.StatusBadRequest, err)
+		return
+	}
+	lifetime, err := svidLifetime(requested, config.X509Lifetime)
+	if err != nil {
+		shared.HttpError(c, http.StatusBadRequest, err)
+		return
+	}
+
+	// SVIDs are not client certificates of this server, so they are not
+	// recorded in the client inventory.
+	ctx := certificates.ContextWithOrigin(c.Request.Context(), origin)
+	chain, err := authority.IssueCertificate(ctx, []byte(request.CSR), lifetime)
+	if err != nil {
+		log.Error().Err(err).Str("host", client.Host).Msg("Failed to issue X.509-SVID")
+		shared.HttpError(c, http.StatusInternalServerError, err)
+		return
+	}
+
+	log.Info().
+		Str("host", client.Host).
+		Str("spiffeId", spiffeID.String()).
+		Str("serial", certificates.SerialToHex(chain[0])).
+		Msg("Issued X.509-SVID")
+
+	writeCertificateChain(c, chain)
+}
+
+// HandleJWTSVIDRequest issues a JWT-SVID for the calling client.
+// Requests are checked against the token policy like /token requests.
+func HandleJWTSVIDRequest(c *gin.Context, crl *CertificateRevocationList) {
+	config := spiffeConfig.Load()
+	if config == nil {
+		shared.HttpError(c, http.StatusNotFound, ErrorSPIFFENotConfigured)
+		return
+	}
+
+	client, err := NewClientFromContext(c, crl)
+	if err != nil {
+		log.Error().Err(err).Str("clientIP", c.ClientIP()).Msg("Failed to validate client identity")
+		shared.HttpError(c, http.StatusInternalServerError, err)
+		return
+	}
+
+	request := shared.JWTSVIDRequest{}
+	if err := c.BindJSON(&request); err != nil {
+		log.Error().Err(err).Msg("Failed to parse JWT-SVID request")
+		shared.HttpError(c, http.StatusBadRequest, err)
+		return
+	}
+
+	if len(request.Audiences) == 0 {
+		log.Error().Msg("Blocked JWT-SVID request with empty audience")
+		shared.HttpErrorString(c, http.StatusBadRequest, "Audience must not be empty")
+		return
+	}
+
+	requested, err := parseRequestedLifetime(request.Lifetime)
+	if err != nil {
+		shared.HttpError(c, http.StatusBadRequest, err)
+		return
+	}
+	lifetime, err := svidLifetime(requested, config.JWTLifetime)
+	if err != nil {
+		shared.HttpError(c, http.StatusBadRequest, err)
+		return
+	}
+
+	if err := tokenPolicy.Load().Check(client.Host, client.Identity, request.Audiences, lifetime); err != nil {
+		log.Error().Err(err).
+			Str("host", client.Host).
+			Str("identity", client.Identity).
+			Strs("audiences", request.Audiences).
+			Dur("lifetime", lifetime).
+			Msg("JWT-SVID request rejected by policy")
+		shared.HttpError(c, http.StatusForbidden, err)
+		return
+	}
+
+	spiffeID, err := config.ID(client, net.ParseIP(c.ClientIP()))
+	if err != nil {
+		log.Error().Err(err).Str("host", client.Host).Msg("Failed to generate SPIFFE ID")
+		shared.HttpError(c, http.StatusInternalServerError, err)
+		return
+	}
+
+	token, expiresAt, err := generateJWTSVID(spiffeID.String(), request.Audiences, lifetime)
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to sign JWT-SVID")
+		shared.HttpError(c, http.StatusInternalServerError, err)
+		return
+	}
+
+	clientInventory.RecordAudiences(client.Host, request.Audiences)
+	c.JSON(http.StatusOK, shared.JWTSVIDResponse{
+		SPIFFEID:  spiffeID.String(),
+		Token:     token,
+		ExpiresAt: expiresAt,
+	})
+}
+
+// generateJWTSVID signs a JWT-SVID for the given SPIFFE ID. The JWT-SVID
+// specification only allows RSA and ECDSA signatures, so the active signing
+// key must not be an Ed25519 key.
+func generateJWTSVID(spiffeID string, audiences []string, lifetime time.Duration) (string, time.Time, error) {
+	now := time.Now()
+	activeKey := serverKeys.Load().activeKey(now)
+	if activeKey == nil {
+		return "", time.Time{}, ErrorSigningKeyNotLoaded
+	}
+	if activeKey.method == jwt.SigningMethodEdDSA {
+		return "", time.Time{}, ErrorJWTSVIDAlgorithm
+	}
+
+	jwtID := make([]byte, 16)
+	if _, err := rand.Read(jwtID); err != nil {
+		return "", time.Time{}, err
+	}
+
+	expiresAt := now.Add(lifetime)
+	token, err := activeKey.sign(jwt.RegisteredClaims{
+		Issuer:    viper.GetString("server.issuer"),
+		Subject:   spiffeID,
+		Audience:  audiences,
+		ExpiresAt: jwt.NewNumericDate(expiresAt),
+		IssuedAt:  jwt.NewNumericDate(now),
+		ID:        hex.EncodeToString(jwtID),
+	})
+	return token, expiresAt.Truncate(time.Second), err
+}
+
+// HandleSPIFFEBundleRequest returns the SPIFFE bundle of the trust domain.
+// The bundle holds the root CAs of the SPIFFE authority used to verify
+// X.509-SVIDs and the published signing keys used to verify JWT-SVIDs. If
+// authority is nil, the bundle only holds the signing keys.
+func HandleSPIFFEBundleRequest(c *gin.Context, authority *SPIFFEAuthority) {
+	// This endpoint is public, no need to check the client certificate
+	config := spiffeConfig.Load()
+	if config == nil {
+		shared.HttpError(c, http.StatusNotFound, ErrorSPIFFENotConfigured)
+		return
+	}
+
+	now := time.Now()
+	roots := []*x509.Certificate{}
+	if authority != nil {
+		var err error
+		roots, err = authority.Roots(c.Request.Context(), now)
+		if len(roots) == 0 {
+			log.Error().Err(err).Msg("Failed to fetch SPIFFE root certificates")
+			shared.HttpError(c, http.StatusServiceUnavailable, err)
+			return
+		}
+		if err != nil {
+			log.Warn().Err(err).Msg("Using last known SPIFFE root certificates")
+		}
+	}
+
+	bundle, err := config.Bundle(roots, serverKeys.Load(), now)
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to build SPIFFE bundle")
+		shared.HttpError(c, http.StatusInternalServerError, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, bundle)
+}
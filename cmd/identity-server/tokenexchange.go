@@ -0,0 +1,159 @@
+package main
+
+import (
+	"crypto/x509"
+	"identity-metadata-server/internal/shared"
+	"net/http"
+	"slices"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/rs/zerolog/log"
+	"github.com/spf13/viper"
+)
+
+// handleTokenExchangeGrant exchanges a token issued by this server for a new
+// token with different audiences or a shorter lifetime.
+// See https://datatracker.ietf.org/doc/html/rfc8693
+//
+// The exchanged token never outlives the subject token and the token policy
+// is checked again for the requested audiences. All claims describing the
+// client, including a certificate binding, are copied from the subject token.
+// If the subject token is bound to a certificate, or a client certificate is
+// presented, the certificate has to belong to the client of the subject token.
+// Tokens that are not bound to a certificate can only be exchanged through
+// mTLS. New audiences can only be requested if the subject token was issued
+// for this server, i.e. its audience contains server.issuer. Otherwise the
+// requested audiences must be a subset of the subject token audiences.
+func handleTokenExchangeGrant(c *gin.Context, crl *CertificateRevocationList, request oauthTokenRequest) {
+	switch {
+	case len(request.subjectToken) == 0:
+		oauthError(c, http.StatusBadRequest, oauthErrorInvalidRequest, "subject_token must be set")
+		return
+	case request.subjectTokenType != shared.TokenTypeJWT:
+		oauthError(c, http.StatusBadRequest, oauthErrorInvalidRequest, "Unsupported subject_token_type")
+		return
+	case len(request.requestedTokenType) > 0 && request.requestedTokenType != shared.TokenTypeJWT:
+		oauthError(c, http.StatusBadRequest, oauthErrorInvalidRequest, "Unsupported requested_token_type")
+		return
+	case len(request.scope) > 0:
+		// Our tokens don't carry scopes, so any scope would extend the
+		// permissions of the subject token.
+		oauthError(c, http.StatusBadRequest, oauthErrorInvalidScope, "Scopes are not supported")
+		return
+	case len(request.audiences) == 0:
+		oauthError(c, http.StatusBadRequest, oauthErrorInvalidRequest, "audience or resource must be set")
+		return
+	}
+
+	subject, err := verifyServerToken(request.subjectToken)
+	if err != nil {
+		log.Error().Err(err).Msg("Invalid subject token")
+		oauthError(c, http.StatusBadRequest, oauthErrorInvalidGrant, "Invalid subject token")
+		return
+	}
+
+	identity := subject.NodeClaims.Identity
+	host := subject.NodeClaims.Host
+	if len(host) == 0 {
+		host = subject.Subject
+	}
+
+	// Tokens of revoked clients must not be exchanged, even if they are
+	// still valid.
+	if len(subject.NodeClaims.Serial) > 0 && crl.IsSerialRevoked(subject.NodeClaims.Serial) {
+		log.Error().Str("host", host).Str("serial", subject.NodeClaims.Serial).Msg("Subject token issued to revoked certificate")
+		oauthError(c, http.StatusBadRequest, oauthErrorInvalidGrant, ErrorCertificateRevoked.Error())
+		return
+	}
+
+	var peerCert *x509.Certificate
+	if c.Request.TLS != nil && len(c.Request.TLS.PeerCertificates) > 0 {
+		client, err := NewClientFromContext(c, crl)
+		if err != nil {
+			log.Error().Err(err).Msg("Failed to get client from context")
+			oauthClientError(c, err)
+			return
+		}
+
+		if client.Host != host || client.Identity != identity {
+			log.Error().
+				Str("host", client.Host).
+				Str("identity", client.Identity).
+				Str("subjectHost", host).
+				Str("subjectIdentity", identity).
+				Msg("Subject token was issued to a different client")
+			oauthError(c, http.StatusBadRequest, oauthErrorInvalidGrant, "Subject token was issued to a different client")
+			return
+		}
+		peerCert = client.Certificate
+	}
+
+	if subject.Confirmation != nil {
+		if err := subject.Confirmation.Verify(peerCert); err != nil {
+			log.Error().Err(err).Str("host", host).Msg("Proof of possession failed for subject token")
+			oauthError(c, http.StatusBadRequest, oauthErrorInvalidGrant, err.Error())
+			return
+		}
+	} else if peerCert == nil {
+		// Bearer tokens could have been leaked by any of their audiences.
+		log.Error().Str("host", host).Msg("Bearer subject token exchanged without client certificate")
+		oauthError(c, http.StatusUnauthorized, oauthErrorInvalidClient, "Client certificate required to exchange bearer tokens")
+		return
+	}
+
+	if !slices.Contains(subject.Audience, viper.GetString("server.issuer")) {
+		for _, audience := range request.audiences {
+			if !slices.Contains(subject.Audience, audience) {
+				log.Error().
+					Str("host", host).
+					Strs("subjectAudiences", subject.Audience).
+					Strs("audiences", request.audiences).
+					Msg("Requested audience not in subject token")
+				oauthError(c, http.StatusBadRequest, oauthErrorInvalidGrant, "Requested audience is not an audience of the subject token")
+				return
+			}
+		}
+	}
+
+	// The exchanged token must not outlive the subject token
+	lifetime := time.Until(subject.ExpiresAt.Time)
+	if request.lifetime > 0 && request.lifetime < lifetime {
+		lifetime = request.lifetime
+	}
+
+	if err := tokenPolicy.Load().Check(host, identity, request.audiences, lifetime); err != nil {
+		log.Error().Err(err).
+			Str("host", host).
+			Str("identity", identity).
+			Strs("audiences", request.audiences).
+			Msg("Token exchange rejected by policy")
+		oauthIssueError(c, err)
+		return
+	}
+
+	oidcToken, err := generateOIDCToken(identity, subject.Subject, request.audiences, lifetime, tokenOptions{
+		extraClaims:  subject.Extra,
+		confirmation: subject.Confirmation,
+		host:         subject.NodeClaims.Host,
+		serial:       subject.NodeClaims.Serial,
+	})
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to sign jwt token")
+		oauthIssueError(c, err)
+		return
+	}
+
+	log.Info().
+		Str("host", host).
+		Strs("audiences", request.audiences).
+		Dur("lifetime", lifetime).
+		Msg("Exchanged token")
+
+	c.JSON(http.StatusOK, shared.TokenExchangeResponse{
+		AccessToken:     oidcToken,
+		ExpiresIn:       int(lifetime.Seconds()),
+		TokenType:       "Bearer",
+		IssuedTokenType: shared.TokenTypeJWT,
+	})
+}
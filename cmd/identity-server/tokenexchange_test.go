@@ -0,0 +1,147 @@
+package main
+
+import (
+	"identity-metadata-server/internal/shared"
+	"net"
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v5"
+	jsoniter "github.com/json-iterator/go"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestExchangeForm(subjectToken string, audience string) url.Values {
+	return url.Values{
+		"grant_type":         {shared.GrantTypeTokenExchange},
+		"subject_token":      {subjectToken},
+		"subject_token_type": {shared.TokenTypeJWT},
+		"audience":           {audience},
+	}
+}
+
+func TestTokenExchange(t *testing.T) {
+	assert := assert.New(t)
+	defer viper.Reset()
+
+	viper.Set("server.key", writeTestKey(t, t.TempDir(), "server.pem"))
+	viper.Set("server.keyName", "test")
+	viper.Set("server.issuer", "https://identity-server")
+	assert.NoError(initJWKS())
+
+	cert, crl := newTestClientCertificate(t, "host.example.com")
+	client, err := NewClientFromCert(cert)
+	assert.NoError(err)
+
+	subjectToken, err := issueClientToken(client, net.ParseIP(testClientOrigin), []string{"https://identity-server", "https://a.example.com"}, time.Minute*5)
+	assert.NoError(err)
+
+	// Requesting a longer lifetime is capped to the subject token
+	form := newTestExchangeForm(subjectToken, "https://b.example.com")
+	form.Set("lifetime", "3600")
+	c, w := newTestMTLSRequest(cert, http.MethodPost, "/oauth2/token", gin.MIMEPOSTForm, newTestFormBody(form))
+
+	HandleOAuthTokenRequest(c, crl)
+	assert.Equal(http.StatusOK, w.Code, w.Body.String())
+
+	response := shared.TokenExchangeResponse{}
+	assert.NoError(jsoniter.Unmarshal(w.Body.Bytes(), &response))
+	assert.Equal(shared.TokenTypeJWT, response.IssuedTokenType)
+	assert.LessOrEqual(response.ExpiresIn, 300)
+
+	subjectClaims, err := verifyServerToken(subjectToken)
+	assert.NoError(err)
+	exchangedClaims, err := verifyServerToken(response.AccessToken)
+	assert.NoError(err)
+
+	assert.Equal(jwt.ClaimStrings{"https://b.example.com"}, exchangedClaims.Audience)
+	assert.Equal(subjectClaims.Subject, exchangedClaims.Subject)
+	assert.Equal(subjectClaims.NodeClaims, exchangedClaims.NodeClaims)
+	assert.False(exchangedClaims.ExpiresAt.After(subjectClaims.ExpiresAt.Time))
+	assert.NotEqual(subjectClaims.ID, exchangedClaims.ID)
+
+	// Bearer tokens cannot be exchanged without client certificate
+	c, w = newTestMTLSRequest(nil, http.MethodPost, "/oauth2/token", gin.MIMEPOSTForm, newTestFormBody(newTestExchangeForm(subjectToken, "https://b.example.com")))
+	c.Request.TLS = nil
+	HandleOAuthTokenRequest(c, crl)
+	assert.Equal(http.StatusUnauthorized, w.Code)
+	assert.Contains(w.Body.String(), oauthErrorInvalidClient)
+
+	// Tokens not issued for this server can only be narrowed to their audiences
+	narrowToken, err := issueClientToken(client, net.ParseIP(testClientOrigin), []string{"https://a.example.com", "https://b.example.com"}, time.Minute*5)
+	assert.NoError(err)
+
+	c, w = newTestMTLSRequest(cert, http.MethodPost, "/oauth2/token", gin.MIMEPOSTForm, newTestFormBody(newTestExchangeForm(narrowToken, "https://c.example.com")))
+	HandleOAuthTokenRequest(c, crl)
+	assert.Equal(http.StatusBadRequest, w.Code)
+	assert.Contains(w.Body.String(), oauthErrorInvalidGrant)
+
+	c, w = newTestMTLSRequest(cert, http.MethodPost, "/oauth2/token", gin.MIMEPOSTForm, newTestFormBody(newTestExchangeForm(narrowToken, "https://b.example.com")))
+	HandleOAuthTokenRequest(c, crl)
+	assert.Equal(http.StatusOK, w.Code, w.Body.String())
+
+	// Revoked clients cannot exchange their tokens
+	crl.revoked[client.SerialNumber] = struct{}{}
+	c, w = newTestMTLSRequest(nil, http.MethodPost, "/oauth2/token", gin.MIMEPOSTForm, newTestFormBody(newTestExchangeForm(subjectToken, "https://b.example.com")))
+	HandleOAuthTokenRequest(c, crl)
+	assert.Equal(http.StatusBadRequest, w.Code)
+	assert.Contains(w.Body.String(), oauthErrorInvalidGrant)
+}
+
+func TestTokenExchangeErrors(t *testing.T) {
+	assert := assert.New(t)
+	defer viper.Reset()
+
+	viper.Set("server.key", writeTestKey(t, t.TempDir(), "server.pem"))
+	viper.Set("server.keyName", "test")
+	viper.Set("server.issuer", "https://identity-server")
+	viper.Set("server.certificateBoundTokens", true)
+	assert.NoError(initJWKS())
+
+	certs, crl := newTestClientCertificates(t, "host.example.com", "other.example.com")
+	cert, otherCert := certs[0], certs[1]
+	client, err := NewClientFromCert(cert)
+	assert.NoError(err)
+
+	boundToken, err := issueClientToken(client, net.ParseIP(testClientOrigin), []string{"https://identity-server"}, time.Minute*5)
+	assert.NoError(err)
+
+	withScope := newTestExchangeForm(boundToken, "https://b.example.com")
+	withScope.Set("scope", "admin")
+
+	testCases := []struct {
+		name  string
+		form  url.Values
+		error string
+	}{
+		{"bound token without certificate", newTestExchangeForm(boundToken, "https://b.example.com"), oauthErrorInvalidGrant},
+		{"invalid token", newTestExchangeForm("invalid", "https://b.example.com"), oauthErrorInvalidGrant},
+		{"scope", withScope, oauthErrorInvalidScope},
+		{"no audience", newTestExchangeForm(boundToken, ""), oauthErrorInvalidRequest},
+	}
+
+	for _, tc := range testCases {
+		c, w := newTestMTLSRequest(nil, http.MethodPost, "/oauth2/token", gin.MIMEPOSTForm, newTestFormBody(tc.form))
+		HandleOAuthTokenRequest(c, crl)
+		assert.Equal(http.StatusBadRequest, w.Code, tc.name)
+
+		response := shared.OAuthErrorResponse{}
+		assert.NoError(jsoniter.Unmarshal(w.Body.Bytes(), &response), tc.name)
+		assert.Equal(tc.error, response.Error, tc.name)
+	}
+
+	// Another client must not exchange the token
+	c, w := newTestMTLSRequest(otherCert, http.MethodPost, "/oauth2/token", gin.MIMEPOSTForm, newTestFormBody(newTestExchangeForm(boundToken, "https://b.example.com")))
+	HandleOAuthTokenRequest(c, crl)
+	assert.Equal(http.StatusBadRequest, w.Code)
+	assert.Contains(w.Body.String(), oauthErrorInvalidGrant)
+
+	// The bound client can exchange the token
+	c, w = newTestMTLSRequest(cert, http.MethodPost, "/oauth2/token", gin.MIMEPOSTForm, newTestFormBody(newTestExchangeForm(boundToken, "https://b.example.com")))
+	HandleOAuthTokenRequest(c, crl)
+	assert.Equal(http.StatusOK, w.Code, w.Body.String())
+}
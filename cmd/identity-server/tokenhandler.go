@@ -5,6 +5,8 @@ import (
 	"crypto/sha256"
 	"encoding/hex"
 	"identity-metadata-server/internal/shared"
+	"identity-metadata-server/pkg/identitytoken"
+	"net"
 	"net/http"
 	"time"
 
@@ -14,6 +16,18 @@ import (
 	"github.com/spf13/viper"
 )
 
+// tokenOptions holds optional values for generateOIDCToken.
+type tokenOptions struct {
+	// extraClaims are added as top-level claims.
+	extraClaims map[string]any
+	// confirmation binds the token to a certificate.
+	// If nil, a bearer token is generated.
+	confirmation *identitytoken.CertificateConfirmation
+	// host and serial identify the client the token is issued to.
+	host   string
+	serial string
+}
+
 type TokenRequest struct {
 	Audiences []string `json:"audiences"`
 	Lifetime  string   `json:"lifetime,omitempty"`
@@ -52,10 +66,8 @@ func HandleTokenRequest(c *gin.Context, crl *CertificateRevocationList) {
 		return
 	}
 
-	// Generate a JWT token
-	oidcToken, err := generateOIDCToken(client.Identity, client.Host, tokenRequestData.Audiences, lifetime)
+	oidcToken, err := issueClientToken(client, net.ParseIP(c.ClientIP()), tokenRequestData.Audiences, lifetime)
 	if err != nil {
-		log.Error().Err(err).Msg("Failed to sign jwt token")
 		shared.HttpError(c, http.StatusInternalServerError, err)
 		return
 	}
@@ -63,10 +75,51 @@ func HandleTokenRequest(c *gin.Context, crl *CertificateRevocationList) {
 	c.String(http.StatusOK, oidcToken)
 }
 
-// generateOIDCToken generates a new OIDC token for the given serviceAccount and hostname.
+// issueClientToken checks the token policy and generates a token for the given
+// client. Claims are derived from the client certificate and the origin using
+// the active claim mapping.
+// Errors returned by the token policy are of type shared.ErrorWithStatus.
+func issueClientToken(client *IdentityClient, origin net.IP, audiences []string, lifetime time.Duration) (string, error) {
+	if err := tokenPolicy.Load().Check(client.Host, client.Identity, audiences, lifetime); err != nil {
+		log.Error().Err(err).
+			Str("host", client.Host).
+			Str("identity", client.Identity).
+			Strs("audiences", audiences).
+			Dur("lifetime", lifetime).
+			Msg("Token request rejected by policy")
+		return "", err
+	}
+
+	subject, extraClaims, err := claimMapping.Load().Apply(client, origin)
+	if err != nil {
+		log.Error().Err(err).Str("host", client.Host).Msg("Failed to map token claims")
+		return "", err
+	}
+
+	options := tokenOptions{
+		extraClaims: extraClaims,
+		host:        client.Host,
+		serial:      client.SerialNumber,
+	}
+	if viper.GetBool("server.certificateBoundTokens") {
+		options.confirmation = identitytoken.NewCertificateConfirmation(client.Certificate)
+	}
+
+	// Generate a JWT token
+	oidcToken, err := generateOIDCToken(client.Identity, subject, audiences, lifetime, options)
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to sign jwt token")
+		return "", err
+	}
+
+	clientInventory.RecordAudiences(client.Host, audiences)
+	return oidcToken, nil
+}
+
+// generateOIDCToken generates a new OIDC token for the given serviceAccount and subject.
 // It uses the provided audiences and lifetime to create the token.
 // The token is signed using the private key of the identity server.
-func generateOIDCToken(serviceAccount, hostname string, audiences []string, lifetime time.Duration) (string, error) {
+func generateOIDCToken(serviceAccount, subject string, audiences []string, lifetime time.Duration, options tokenOptions) (string, error) {
 	now := time.Now()
 
 	// The JWTID is a unique identifier for the token. It is used to prevent replay attacks.
@@ -87,16 +140,20 @@ func generateOIDCToken(serviceAccount, hostname string, audiences []string, life
 	claims := CustomClaims{
 		NodeClaims: NodeClaims{
 			Identity: serviceAccount,
+			Host:     options.host,
+			Serial:   options.serial,
 		},
 		RegisteredClaims: jwt.RegisteredClaims{
 			Issuer:    viper.GetString("server.issuer"),
-			Subject:   hostname,
+			Subject:   subject,
 			Audience:  audiences,
 			ExpiresAt: jwt.NewNumericDate(now.Add(lifetime)),
 			IssuedAt:  jwt.NewNumericDate(now),
 			NotBefore: jwt.NewNumericDate(now),
 			ID:        hex.EncodeToString(jwtID.Sum(nil)),
 		},
+		Confirmation: options.confirmation,
+		Extra:        options.extraClaims,
 	}
 
 	return buildAndSignJWT(claims)
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"errors"
+	"path"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"identity-metadata-server/internal/shared"
+
+	"github.com/rs/zerolog/log"
+	"github.com/spf13/viper"
+)
+
+// TokenPolicyRule restricts token issuance for a set of clients.
+// A rule applies to a client if the client matches any of the host patterns
+// and any of the identity patterns. An empty list matches all clients.
+// Patterns use the syntax of path.Match, e.g. "*.prod.example.com".
+type TokenPolicyRule struct {
+	Hosts      []string `mapstructure:"hosts"`
+	Identities []string `mapstructure:"identities"`
+
+	// MaxLifetime caps the lifetime of tokens for matching clients.
+	// A value of 0 does not add a restriction.
+	MaxLifetime time.Duration `mapstructure:"maxLifetime"`
+
+	// Audiences are allowed for matching clients in addition to the
+	// audiences allowed by the policy.
+	Audiences []string `mapstructure:"audiences"`
+}
+
+// TokenPolicyDenyList lists clients that must not receive any token.
+// Patterns use the syntax of path.Match.
+type TokenPolicyDenyList struct {
+	Hosts      []string `mapstructure:"hosts" json:"hosts"`
+	Identities []string `mapstructure:"identities" json:"identities"`
+}
+
+// TokenPolicy defines which tokens may be issued to which client.
+type TokenPolicy struct {
+	// MaxLifetime caps the lifetime of all tokens.
+	// A value of 0 does not add a restriction.
+	MaxLifetime time.Duration `mapstructure:"maxLifetime"`
+
+	// RestrictAudiences enables the audience allowlist. If set, only the
+	// workload identity audience and the audiences listed in Audiences and
+	// in matching rules may be requested.
+	RestrictAudiences bool     `mapstructure:"restrictAudiences"`
+	Audiences         []string `mapstructure:"audiences"`
+
+	Rules []TokenPolicyRule   `mapstructure:"rules"`
+	Deny  TokenPolicyDenyList `mapstructure:"deny"`
+
+	// workloadIdentityAudience is always allowed when audiences are restricted.
+	workloadIdentityAudience string
+}
+
+var (
+	// tokenPolicy holds the currently active token policy.
+	// If no policy is loaded, all requests are allowed.
+	tokenPolicy atomic.Pointer[TokenPolicy]
+)
+
+// matchesAny returns true if value matches any of the given patterns.
+// Matching is case-insensitive. Invalid patterns never match.
+func matchesAny(patterns []string, value string) bool {
+	value = strings.ToLower(value)
+	for _, pattern := range patterns {
+		if matched, err := path.Match(strings.ToLower(pattern), value); err == nil && matched {
+			return true
+		}
+	}
+	return false
+}
+
+// matches returns true if the rule applies to the given client.
+func (r TokenPolicyRule) matches(host, identity string) bool {
+	return (len(r.Hosts) == 0 || matchesAny(r.Hosts, host)) &&
+		(len(r.Identities) == 0 || matchesAny(r.Identities, identity))
+}
+
+// IsDenied returns true if the given client must not receive any token.
+func (p *TokenPolicy) IsDenied(host, identity string) bool {
+	if p == nil {
+		return false
+	}
+	return matchesAny(p.Deny.Hosts, host) || matchesAny(p.Deny.Identities, identity)
+}
+
+// MaxLifetimeFor returns the maximum token lifetime for the given client.
+// A value of 0 means that the lifetime is not restricted.
+func (p *TokenPolicy) MaxLifetimeFor(host, identity string) time.Duration {
+	if p == nil {
+		return 0
+	}
+
+	maxLifetime := p.MaxLifetime
+	for _, rule := range p.Rules {
+		if rule.MaxLifetime > 0 && rule.matches(host, identity) &&
+			(maxLifetime == 0 || rule.MaxLifetime < maxLifetime) {
+			maxLifetime = rule.MaxLifetime
+		}
+	}
+	return maxLifetime
+}
+
+// IsAudienceAllowed returns true if the given client may request a token for
+// the given audience.
+func (p *TokenPolicy) IsAudienceAllowed(host, identity, audience string) bool {
+	if p == nil || !p.RestrictAudiences {
+		return true
+	}
+
+	if audience == p.workloadIdentityAudience || slices.Contains(p.Audiences, audience) {
+		return true
+	}
+
+	for _, rule := range p.Rules {
+		if slices.Contains(rule.Audiences, audience) && rule.matches(host, identity) {
+			return true
+		}
+	}
+	return false
+}
+
+// Check verifies a token request against the policy.
+// If the request is not allowed, an HTTP compatible error is returned.
+func (p *TokenPolicy) Check(host, identity string, audiences []string, lifetime time.Duration) error {
+	if p.IsDenied(host, identity) {
+		return ErrorTokenRequestDenied
+	}
+
+	if maxLifetime := p.MaxLifetimeFor(host, identity); maxLifetime > 0 && lifetime > maxLifetime {
+		return ErrorTokenLifetimeNotAllowed
+	}
+
+	for _, audience := range audiences {
+		if !p.IsAudienceAllowed(host, identity, audience) {
+			return ErrorTokenAudienceNotAllowed
+		}
+	}
+
+	return nil
+}
+
+// LoadTokenPolicy reads a token policy from the given file.
+// All file formats supported by viper can be used.
+func LoadTokenPolicy(policyPath, workloadIdentityAudience string) (*TokenPolicy, error) {
+	policyConfig := viper.New()
+	policyConfig.SetConfigFile(policyPath)
+
+	if err := policyConfig.ReadInConfig(); err != nil {
+		return nil, errors.Join(err, errors.New("failed to read token policy"))
+	}
+
+	policy := TokenPolicy{}
+	if err := policyConfig.Unmarshal(&policy); err != nil {
+		return nil, errors.Join(err, errors.New("failed to parse token policy"))
+	}
+
+	policy.workloadIdentityAudience = workloadIdentityAudience
+	return &policy, nil
+}
+
+// initTokenPolicy loads the token policy configured in server.tokenPolicy.
+// Calling this function will atomically replace the active policy, hence it
+// can also be used to reload the policy. If loading fails, the previously
+// loaded policy is kept.
+func initTokenPolicy() error {
+	policyPath := viper.GetString("server.tokenPolicy")
+	if len(policyPath) == 0 {
+		log.Warn().Msg("No token policy configured, token requests are not restricted")
+		tokenPolicy.Store(nil)
+		return nil
+	}
+
+	workloadIdentityAudience := shared.GetWorkloadIdentityAudience(
+		viper.GetString("server.workloadIdentity.projectNumber"),
+		viper.GetString("server.workloadIdentity.poolName"),
+		viper.GetString("server.workloadIdentity.providerName"))
+
+	policy, err := LoadTokenPolicy(policyPath, workloadIdentityAudience)
+	if err != nil {
+		return err
+	}
+
+	log.Info().
+		Str("path", policyPath).
+		Int("rules", len(policy.Rules)).
+		Msg("Loaded token policy")
+
+	tokenPolicy.Store(policy)
+	return nil
+}
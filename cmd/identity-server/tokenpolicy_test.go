@@ -0,0 +1,82 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const testTokenPolicy = `
+maxLifetime: 1h
+restrictAudiences: true
+audiences:
+  - "https://allowed.example.com"
+rules:
+  - hosts: ["*.prod.example.com"]
+    maxLifetime: 15m
+  - identities: ["ci@*"]
+    audiences:
+      - "https://ci.example.com"
+deny:
+  hosts: ["compromised.example.com"]
+  identities: ["blocked@*"]
+`
+
+func newTestTokenPolicy(t *testing.T) *TokenPolicy {
+	policyPath := filepath.Join(t.TempDir(), "policy.yaml")
+	assert.NoError(t, os.WriteFile(policyPath, []byte(testTokenPolicy), 0600))
+
+	policy, err := LoadTokenPolicy(policyPath, "//iam.googleapis.com/test")
+	assert.NoError(t, err)
+	return policy
+}
+
+func TestTokenPolicyLifetime(t *testing.T) {
+	assert := assert.New(t)
+	policy := newTestTokenPolicy(t)
+
+	assert.Equal(time.Hour, policy.MaxLifetimeFor("host.dev.example.com", "test@test"))
+	assert.Equal(15*time.Minute, policy.MaxLifetimeFor("host.prod.example.com", "test@test"))
+
+	audiences := []string{"//iam.googleapis.com/test"}
+	assert.NoError(policy.Check("host.dev.example.com", "test@test", audiences, time.Hour))
+	assert.Equal(ErrorTokenLifetimeNotAllowed, policy.Check("host.dev.example.com", "test@test", audiences, 2*time.Hour))
+	assert.Equal(ErrorTokenLifetimeNotAllowed, policy.Check("host.prod.example.com", "test@test", audiences, 30*time.Minute))
+}
+
+func TestTokenPolicyAudiences(t *testing.T) {
+	assert := assert.New(t)
+	policy := newTestTokenPolicy(t)
+
+	// The workload identity audience is always allowed
+	assert.True(policy.IsAudienceAllowed("host", "test@test", "//iam.googleapis.com/test"))
+	assert.True(policy.IsAudienceAllowed("host", "test@test", "https://allowed.example.com"))
+	assert.False(policy.IsAudienceAllowed("host", "test@test", "https://other.example.com"))
+
+	// Audiences from rules only apply to matching clients
+	assert.False(policy.IsAudienceAllowed("host", "test@test", "https://ci.example.com"))
+	assert.True(policy.IsAudienceAllowed("host", "ci@test", "https://ci.example.com"))
+
+	audiences := []string{"//iam.googleapis.com/test", "https://other.example.com"}
+	assert.Equal(ErrorTokenAudienceNotAllowed, policy.Check("host", "test@test", audiences, time.Minute))
+}
+
+func TestTokenPolicyDeny(t *testing.T) {
+	assert := assert.New(t)
+	policy := newTestTokenPolicy(t)
+
+	audiences := []string{"//iam.googleapis.com/test"}
+	assert.Equal(ErrorTokenRequestDenied, policy.Check("Compromised.example.com", "test@test", audiences, time.Minute))
+	assert.Equal(ErrorTokenRequestDenied, policy.Check("host", "blocked@test", audiences, time.Minute))
+	assert.NoError(policy.Check("host", "test@test", audiences, time.Minute))
+}
+
+func TestTokenPolicyNil(t *testing.T) {
+	assert := assert.New(t)
+
+	var policy *TokenPolicy
+	assert.NoError(policy.Check("host", "test@test", []string{"any"}, 24*time.Hour*7))
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"net"
 	"net/http"
 	"strings"
 	"time"
@@ -140,10 +141,69 @@ func initConfigDefaults() {
 	viper.SetDefault("host.cacert", "")
 	viper.SetDefault("host.clientCertMinimumLifetime", time.Hour*24*10)
 	viper.SetDefault("host.clientCertRefresh", time.Hour*24)
+	viper.SetDefault("host.useOAuthTokenEndpoint", false)
+	// Maximum random delay of a certificate refresh requested by the identity server.
+	viper.SetDefault("host.renewalHintJitter", 5*time.Minute)
+	// Hostname and addresses requested on renewal. Empty values keep the values of the
+	// current certificate. Changes have to be approved on the identity server.
+	viper.SetDefault("host.renewal.hostname", "")
+	viper.SetDefault("host.renewal.addresses", []string{})
+	// Enroll the host if host.clientCert does not exist. Requires either a
+	// join token file or a bootstrap certificate.
+	viper.SetDefault("host.enrollment.joinToken", "")
+	viper.SetDefault("host.enrollment.bootstrapCert", "")
+	viper.SetDefault("host.enrollment.bootstrapKey", "")
+	// Hostname requested during enrollment. Defaults to the node name.
+	viper.SetDefault("host.enrollment.hostname", "")
+	viper.SetDefault("host.enrollment.identity", "")
+	viper.SetDefault("host.enrollment.addresses", []string{})
 	viper.SetDefault("token.lifetime.access", 10*time.Minute)
 	viper.SetDefault("token.lifetime.identity", 10*time.Minute)
 }
 
+// hostEnrollmentConfig reads the enrollment configuration for host mode.
+// Enrollment is enabled if a join token or a bootstrap certificate is set.
+func hostEnrollmentConfig() (tokenprovider.EnrollmentConfig, bool) {
+	enrollment := tokenprovider.EnrollmentConfig{
+		JoinTokenPath:     viper.GetString("host.enrollment.joinToken"),
+		BootstrapCertPath: viper.GetString("host.enrollment.bootstrapCert"),
+		BootstrapKeyPath:  viper.GetString("host.enrollment.bootstrapKey"),
+		Hostname:          viper.GetString("host.enrollment.hostname"),
+		Identity:          viper.GetString("host.enrollment.identity"),
+	}
+
+	if len(enrollment.JoinTokenPath) == 0 && len(enrollment.BootstrapCertPath) == 0 {
+		return enrollment, false
+	}
+
+	if len(enrollment.Hostname) == 0 {
+		enrollment.Hostname = shared.GetNodename()
+	}
+
+	for _, address := range viper.GetStringSlice("host.enrollment.addresses") {
+		ip := net.ParseIP(address)
+		if ip == nil {
+			log.Fatal().Str("address", address).Msg("Invalid enrollment address")
+		}
+		enrollment.Addresses = append(enrollment.Addresses, ip)
+	}
+
+	return enrollment, true
+}
+
+// hostRenewalAddresses reads the IP addresses requested on renewal.
+func hostRenewalAddresses() []net.IP {
+	addresses := []net.IP{}
+	for _, address := range viper.GetStringSlice("host.renewal.addresses") {
+		ip := net.ParseIP(address)
+		if ip == nil {
+			log.Fatal().Str("address", address).Msg("Invalid renewal address")
+		}
+		addresses = append(addresses, ip)
+	}
+	return addresses
+}
+
 // configureHTTPServer enables HTTP/1.1 and unencrypted HTTP/2 on the server.
 func configureHTTPServer(srv *http.Server, idleTimeout time.Duration) {
 	srv.IdleTimeout = idleTimeout
@@ -197,7 +257,18 @@ func main() {
 			log.Fatal().Msg("The client cert refresh interval must be less than the minimum lifetime")
 		}
 
-		tokenProvider, err = tokenprovider.NewHostTokenProvider(workloadIdentityAudience, identityServerURL, caCertPath, clientCertPath, clientKeyPath, refreshInterval, minCertLifetime)
+		hostOptions := []tokenprovider.HostTokenProviderOption{
+			tokenprovider.WithRenewalHintJitter(viper.GetDuration("host.renewalHintJitter")),
+			tokenprovider.WithRenewalSubject(viper.GetString("host.renewal.hostname"), hostRenewalAddresses()),
+		}
+		if viper.GetBool("host.useOAuthTokenEndpoint") {
+			hostOptions = append(hostOptions, tokenprovider.WithOAuthTokenEndpoint())
+		}
+		if enrollment, enabled := hostEnrollmentConfig(); enabled {
+			hostOptions = append(hostOptions, tokenprovider.WithEnrollment(enrollment))
+		}
+
+		tokenProvider, err = tokenprovider.NewHostTokenProvider(workloadIdentityAudience, identityServerURL, caCertPath, clientCertPath, clientKeyPath, refreshInterval, minCertLifetime, hostOptions...)
 		if err != nil {
 			log.Fatal().Err(err).Msg("failed to create host token provider")
 		}
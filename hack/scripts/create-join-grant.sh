@@ -0,0 +1,49 @@
+#!/usr/bin/env bash
+set -euo pipefail
+
+# This script has to be executed on the identity-server host.
+# The user calling this script has to have write access to the grants file.
+# The join token is printed to stdout and has to be copied to the new host.
+#
+# Arguments:
+# [1] Grants file (server.enrollment.grantsFile)
+# [2] Node name
+# [3] Service account name
+# [4] Node IPs (comma separated)
+# [5] Validity in hours (optional, defaults to 24)
+
+GRANTS_FILE="${1:?Grants file is required}"
+NODE_NAME="${2:?Node name is required}"
+SERVICE_ACCOUNT="${3:?Service account is required}"
+NODE_IPS_CSV="${4:?Node IPs are required}"
+VALID_HOURS="${5:-24}"
+
+JOIN_TOKEN=$(openssl rand -hex 32)
+TOKEN_HASH=$(echo -n "${JOIN_TOKEN}" | sha256sum | cut -d' ' -f1)
+EXPIRES_AT=$(date -u -d "+${VALID_HOURS} hours" +'%Y-%m-%dT%H:%M:%SZ')
+
+# Take the same lock as the identity-server, so no grant update is lost
+exec 9>"${GRANTS_FILE}.lock"
+flock 9
+
+if [[ ! -f "${GRANTS_FILE}" ]]; then
+    echo '[]' > "${GRANTS_FILE}"
+fi
+
+TMP_FILE=$(mktemp "${GRANTS_FILE}.XXXXXX")
+jq --arg tokenHash "${TOKEN_HASH}" \
+    --arg host "${NODE_NAME}" \
+    --arg identity "${SERVICE_ACCOUNT}" \
+    --arg addresses "${NODE_IPS_CSV}" \
+    --arg expiresAt "${EXPIRES_AT}" \
+    '. + [{
+        tokenHash: $tokenHash,
+        host: $host,
+        identity: $identity,
+        addresses: ($addresses | split(",") | map(gsub("^\\s+|\\s+$"; ""))),
+        expiresAt: $expiresAt
+    }]' "${GRANTS_FILE}" > "${TMP_FILE}"
+mv "${TMP_FILE}" "${GRANTS_FILE}"
+
+echo "Created join grant for ${NODE_NAME}, valid until ${EXPIRES_AT}" >&2
+echo "${JOIN_TOKEN}"
@@ -0,0 +1,167 @@
+package certificates
+
+import (
+	"context"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+)
+
+// RevocationReason is the reason code of a revoked certificate as defined in
+// https://datatracker.ietf.org/doc/html/rfc5280#section-5.3.1
+type RevocationReason int
+
+const (
+	RevocationReasonUnspecified          RevocationReason = 0
+	RevocationReasonKeyCompromise        RevocationReason = 1
+	RevocationReasonAffiliationChanged   RevocationReason = 3
+	RevocationReasonSuperseded           RevocationReason = 4
+	RevocationReasonCessationOfOperation RevocationReason = 5
+	RevocationReasonCertificateHold      RevocationReason = 6
+)
+
+// revocationReasonNames maps reason codes to the names used in configs and
+// APIs.
+var revocationReasonNames = map[RevocationReason]string{
+	RevocationReasonUnspecified:          "unspecified",
+	RevocationReasonKeyCompromise:        "keyCompromise",
+	RevocationReasonAffiliationChanged:   "affiliationChanged",
+	RevocationReasonSuperseded:           "superseded",
+	RevocationReasonCessationOfOperation: "cessationOfOperation",
+	RevocationReasonCertificateHold:      "certificateHold",
+}
+
+// String returns the RFC 5280 name of the reason.
+func (r RevocationReason) String() string {
+	if name, ok := revocationReasonNames[r]; ok {
+		return name
+	}
+	return fmt.Sprintf("reason(%d)", int(r))
+}
+
+// ParseRevocationReason returns the reason for the given RFC 5280 name.
+// An empty name is treated as unspecified.
+func ParseRevocationReason(name string) (RevocationReason, error) {
+	if len(name) == 0 {
+		return RevocationReasonUnspecified, nil
+	}
+	for reason, reasonName := range revocationReasonNames {
+		if reasonName == name {
+			return reason, nil
+		}
+	}
+	return RevocationReasonUnspecified, fmt.Errorf("unknown revocation reason %q", name)
+}
+
+// CertificateQuery selects certificates by subject. Empty fields match all
+// certificates, but at least one field must be set.
+type CertificateQuery struct {
+	// Host is matched case-insensitive against the common name.
+	Host string
+	// Identity is matched against the email SANs.
+	Identity string
+}
+
+// IsEmpty returns true if no field of the query is set.
+func (q CertificateQuery) IsEmpty() bool {
+	return len(q.Host) == 0 && len(q.Identity) == 0
+}
+
+// Matches returns true if the given certificate matches the query.
+func (q CertificateQuery) Matches(cert *x509.Certificate) bool {
+	if len(q.Host) > 0 && !strings.EqualFold(cert.Subject.CommonName, q.Host) {
+		return false
+	}
+	if len(q.Identity) > 0 && !slices.Contains(cert.EmailAddresses, q.Identity) {
+		return false
+	}
+	return true
+}
+
+// Authority is a backend that issues and revokes client certificates.
+// All serial numbers are hex encoded, as returned by SerialToHex.
+type Authority interface {
+	// IssueCertificate creates a certificate from the given PEM encoded CSR.
+	// The CSR is expected to be verified by the caller. The issued
+	// certificate is returned first, followed by the CA certificates needed
+	// to verify it.
+	IssueCertificate(ctx context.Context, csrPEM []byte, lifetime time.Duration) ([]*x509.Certificate, error)
+
+	// GetCertificate returns a certificate issued by this authority.
+	GetCertificate(ctx context.Context, hexSerial string) (*x509.Certificate, error)
+
+	// FindCertificates returns all certificates issued by this authority that
+	// match the given query and are neither expired nor revoked.
+	FindCertificates(ctx context.Context, query CertificateQuery) ([]*x509.Certificate, error)
+
+	// RootCertificates returns the certificates used to verify certificates
+	// and CRLs issued by this authority.
+	RootCertificates(ctx context.Context) ([]*x509.Certificate, error)
+
+	// RevokeCertificate revokes a certificate issued by this authority.
+	// Revoking an already revoked certificate is not an error.
+	RevokeCertificate(ctx context.Context, hexSerial string, reason RevocationReason) error
+
+	// RevocationLists returns the current CRLs of this authority.
+	// The returned lists are not verified.
+	RevocationLists(ctx context.Context) ([]x509.RevocationList, error)
+}
+
+// SerialToHex returns the serial number of the given certificate in the hex
+// format used by Authority.
+func SerialToHex(cert *x509.Certificate) string {
+	if cert == nil || cert.SerialNumber == nil {
+		return ""
+	}
+	return hex.EncodeToString(cert.SerialNumber.Bytes())
+}
+
+// ParseCertificatesPEM parses all certificates contained in the given PEM data.
+// Blocks that are no certificates are ignored.
+func ParseCertificatesPEM(pemData []byte) ([]*x509.Certificate, error) {
+	certs := []*x509.Certificate{}
+	parseErrors := error(nil)
+
+	for block, remain := pem.Decode(pemData); block != nil; block, remain = pem.Decode(remain) {
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			parseErrors = errors.Join(parseErrors, err)
+			continue
+		}
+		certs = append(certs, cert)
+	}
+
+	if len(certs) == 0 {
+		return nil, errors.Join(parseErrors, errors.New("no certificates found"))
+	}
+	return certs, parseErrors
+}
+
+// ParseRevocationListsPEM parses all CRLs contained in the given PEM data.
+func ParseRevocationListsPEM(pemData []byte) ([]x509.RevocationList, error) {
+	lists := []x509.RevocationList{}
+	parseErrors := error(nil)
+
+	for block, remain := pem.Decode(pemData); block != nil; block, remain = pem.Decode(remain) {
+		if block.Type != "X509 CRL" {
+			parseErrors = errors.Join(parseErrors, fmt.Errorf("invalid PEM block type: %s", block.Type))
+			continue
+		}
+		list, err := x509.ParseRevocationList(block.Bytes)
+		if err != nil || list == nil {
+			parseErrors = errors.Join(parseErrors, err)
+			continue
+		}
+		lists = append(lists, *list)
+	}
+
+	return lists, parseErrors
+}
@@ -4,6 +4,9 @@ import (
 	"crypto/x509"
 	"encoding/pem"
 	"errors"
+	"fmt"
+
+	"software.sslmate.com/src/go-pkcs12"
 )
 
 // EncodeCertificateToPEM encodes an x509 certificate to PEM format.
@@ -23,3 +26,38 @@ func EncodeCertificateToPEM(cert *x509.Certificate) ([]byte, error) {
 
 	return pemData, nil
 }
+
+// EncodeCertificatesToPEM encodes the given certificates to PEM format, one
+// block per certificate, keeping their order.
+func EncodeCertificatesToPEM(certs []*x509.Certificate) ([]byte, error) {
+	pemData := []byte{}
+	for _, cert := range certs {
+		certPEM, err := EncodeCertificateToPEM(cert)
+		if err != nil {
+			return nil, err
+		}
+		pemData = append(pemData, certPEM...)
+	}
+	return pemData, nil
+}
+
+// EncodeCertificatesToPKCS12 encodes a certificate chain, starting with the
+// leaf, into a PKCS#12 bundle protected by pkcs12.DefaultPassword.
+// The bundle does not contain a private key. It uses the legacy encryption
+// so it can be read by older Java versions.
+func EncodeCertificatesToPKCS12(chain []*x509.Certificate) ([]byte, error) {
+	if len(chain) == 0 {
+		return nil, errors.New("certificate chain is empty")
+	}
+
+	entries := make([]pkcs12.TrustStoreEntry, 0, len(chain))
+	for i, cert := range chain {
+		name := "client"
+		if i > 0 {
+			name = fmt.Sprintf("ca-%d", i)
+		}
+		entries = append(entries, pkcs12.TrustStoreEntry{Cert: cert, FriendlyName: name})
+	}
+
+	return pkcs12.LegacyDES.EncodeTrustStoreEntries(entries, pkcs12.DefaultPassword)
+}
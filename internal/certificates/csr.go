@@ -2,6 +2,8 @@ package certificates
 
 import (
 	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
 	"crypto/rand"
 	"crypto/rsa"
 	"crypto/x509"
@@ -11,14 +13,16 @@ import (
 	"errors"
 	"identity-metadata-server/internal/shared"
 	"net"
+	"net/url"
 )
 
 // CreateClientCSR generates a Certificate Signing Request (CSR) in PEM format
 // using the provided PEM-encoded private key.
 // It includes the given hostname as Common Name and DNS SAN, the email address,
 // and the list of IP addresses in the appropriate SAN fields.
+// Optional URIs, e.g. a SPIFFE ID, are added as URI SANs.
 // The CSR is configured for mTLS client authentication usage.
-func CreateClientCSR(privateKeyPEM []byte, hostname string, email string, ips []net.IP) ([]byte, error) {
+func CreateClientCSR(privateKeyPEM []byte, hostname string, email string, ips []net.IP, uris ...*url.URL) ([]byte, error) {
 	var (
 		privateKey         any
 		err                error
@@ -26,31 +30,9 @@ func CreateClientCSR(privateKeyPEM []byte, hostname string, email string, ips []
 	)
 
 	// Decode the PEM-encoded private key
-	block, _ := pem.Decode(privateKeyPEM)
-	if block == nil {
-		return nil, errors.New("failed to decode PEM block containing private key")
-	}
-
-	switch block.Type {
-	case "RSA PRIVATE KEY":
-		signatureAlgorithm = x509.SHA256WithRSA
-		privateKey, err = x509.ParsePKCS1PrivateKey(block.Bytes)
-	case "EC PRIVATE KEY":
-		signatureAlgorithm = x509.ECDSAWithSHA256
-		privateKey, err = x509.ParseECPrivateKey(block.Bytes)
-	case "PRIVATE KEY":
-		if privateKey, err = x509.ParsePKCS8PrivateKey(block.Bytes); err == nil {
-			switch privateKey.(type) {
-			case *rsa.PrivateKey:
-				signatureAlgorithm = x509.SHA256WithRSA
-			case *ecdsa.PrivateKey:
-				signatureAlgorithm = x509.ECDSAWithSHA256
-			default:
-				err = errors.New("unsupported PKCS#8 key type")
-			}
-		}
-	default:
-		err = errors.New("unsupported private key type")
+	privateKey, err = ParsePrivateKeyPEM(privateKeyPEM)
+	if err == nil {
+		signatureAlgorithm, err = signatureAlgorithmForKey(privateKey)
 	}
 	if err != nil {
 		return nil, errors.New("failed to parse private key: " + err.Error())
@@ -84,6 +66,7 @@ func CreateClientCSR(privateKeyPEM []byte, hostname string, email string, ips []
 		DNSNames:           []string{hostname},
 		EmailAddresses:     emailAddress,
 		IPAddresses:        ips,
+		URIs:               uris,
 
 		ExtraExtensions: []pkix.Extension{
 			usage,
@@ -102,6 +85,31 @@ func CreateClientCSR(privateKeyPEM []byte, hostname string, email string, ips []
 	return csrPEM, nil
 }
 
+// signatureAlgorithmForKey returns the signature algorithm to use for CSRs
+// signed by the given private key. ECDSA keys use a hash matching the size
+// of their curve.
+func signatureAlgorithmForKey(privateKey any) (x509.SignatureAlgorithm, error) {
+	switch key := privateKey.(type) {
+	case *rsa.PrivateKey:
+		return x509.SHA256WithRSA, nil
+	case *ecdsa.PrivateKey:
+		switch key.Curve {
+		case elliptic.P256():
+			return x509.ECDSAWithSHA256, nil
+		case elliptic.P384():
+			return x509.ECDSAWithSHA384, nil
+		case elliptic.P521():
+			return x509.ECDSAWithSHA512, nil
+		default:
+			return x509.UnknownSignatureAlgorithm, errors.New("unsupported ECDSA curve")
+		}
+	case ed25519.PrivateKey:
+		return x509.PureEd25519, nil
+	default:
+		return x509.UnknownSignatureAlgorithm, errors.New("unsupported key type")
+	}
+}
+
 // CreateClientCSRFromCertificate generates a CSR from the given certificate
 // using the provided PEM-encoded private key.
 func CreateClientCSRFromCertificate(privateKeyPEM []byte, cert *x509.Certificate) ([]byte, error) {
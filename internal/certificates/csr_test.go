@@ -6,6 +6,7 @@ import (
 	"encoding/pem"
 	"identity-metadata-server/internal/shared"
 	"net"
+	"net/url"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -44,6 +45,7 @@ func TestCreateClientCSR(t *testing.T) {
 	assert.Len(csrParsed.DNSNames, 1)
 	assert.Len(csrParsed.EmailAddresses, 1)
 	assert.Len(csrParsed.IPAddresses, 2)
+	assert.Empty(csrParsed.URIs)
 
 	assert.Equal("test", csrParsed.Subject.CommonName)
 	assert.Equal("test", csrParsed.DNSNames[0])
@@ -54,6 +56,60 @@ func TestCreateClientCSR(t *testing.T) {
 	}))
 }
 
+func TestCreateClientCSRWithURI(t *testing.T) {
+	assert := assert.New(t)
+
+	key, err := CreateECPrivateKeyPEM(KeyStrengthNormal)
+	assert.NoError(err)
+
+	spiffeID, err := url.Parse("spiffe://example.org/host/test")
+	assert.NoError(err)
+
+	csr, err := CreateClientCSR(key, "test", "", nil, spiffeID)
+	assert.NoError(err)
+
+	block, _ := pem.Decode(csr)
+	csrParsed, err := x509.ParseCertificateRequest(block.Bytes)
+	assert.NoError(err)
+
+	assert.Len(csrParsed.URIs, 1)
+	assert.Equal(spiffeID.String(), csrParsed.URIs[0].String())
+	assert.Empty(csrParsed.EmailAddresses)
+	assert.Empty(csrParsed.IPAddresses)
+}
+
+func TestCreateClientCSRSignatureAlgorithm(t *testing.T) {
+	assert := assert.New(t)
+
+	clientIPs := []net.IP{net.ParseIP("127.0.0.1")}
+
+	testCases := []struct {
+		keyType   KeyType
+		strength  KeyStrength
+		algorithm x509.SignatureAlgorithm
+	}{
+		{ECDSA, KeyStrengthNormal, x509.ECDSAWithSHA256},
+		{ECDSA, KeyStrengthMedium, x509.ECDSAWithSHA384},
+		{ECDSA, KeyStrengthHigh, x509.ECDSAWithSHA512},
+		{RSA, KeyStrengthNormal, x509.SHA256WithRSA},
+		{ED25519, KeyStrengthNormal, x509.PureEd25519},
+	}
+
+	for _, tc := range testCases {
+		key, err := CreatePrivateKeyPEM(tc.keyType, tc.strength)
+		assert.NoError(err)
+
+		csr, err := CreateClientCSR(key, "test", "test@test", clientIPs)
+		assert.NoError(err)
+
+		block, _ := pem.Decode(csr)
+		csrParsed, err := x509.ParseCertificateRequest(block.Bytes)
+		assert.NoError(err)
+		assert.NoError(csrParsed.CheckSignature())
+		assert.Equal(tc.algorithm, csrParsed.SignatureAlgorithm)
+	}
+}
+
 func TestVerifyCSRKeyUsage(t *testing.T) {
 	assert := assert.New(t)
 
@@ -4,13 +4,18 @@ import (
 	"context"
 	"crypto/x509"
 	"encoding/pem"
+	"errors"
 	"fmt"
 	"hash/fnv"
 	"identity-metadata-server/internal/shared"
+	"io"
+	"net/http"
+	"net/url"
 	"regexp"
 	"strconv"
 	"strings"
 	"time"
+	"unicode"
 
 	jsoniter "github.com/json-iterator/go"
 	"github.com/rs/zerolog/log"
@@ -18,24 +23,411 @@ import (
 
 // GCPCertificateAuthorityConfig is used to reference a GCP Certificate Authority.
 type GCPCertificateAuthorityConfig struct {
-	ProjectID            string
-	Location             string
-	CertificatePool      string
-	CertificateAuthority string
+	ProjectID       string
+	Location        string
+	CertificatePool string
 }
 
 // See https://cloud.google.com/certificate-authority-service/docs/reference/rest/v1/projects.locations.caPools.certificates#Certificate
 type GCPCertificate struct {
-	Name             string `json:"name"`
-	Lifetime         string `json:"lifetime"`
-	CertificateAsPEM string `json:"pemCertificate,omitempty"`
-	CSR              string `json:"pemCsr,omitempty"`
+	Name              string                `json:"name"`
+	Lifetime          string                `json:"lifetime"`
+	CertificateAsPEM  string                `json:"pemCertificate,omitempty"`
+	CertificateChain  []string              `json:"pemCertificateChain,omitempty"`
+	CSR               string                `json:"pemCsr,omitempty"`
+	RevocationDetails *GCPRevocationDetails `json:"revocationDetails,omitempty"`
+}
+
+// Chain returns the certificate followed by the CA certificates returned in
+// pemCertificateChain, i.e. in issuer to root order.
+func (c GCPCertificate) Chain() ([]*x509.Certificate, error) {
+	if len(c.CertificateAsPEM) == 0 {
+		return nil, fmt.Errorf("empty certificate returned")
+	}
+
+	rawCertBlock, _ := pem.Decode([]byte(c.CertificateAsPEM))
+	if rawCertBlock == nil {
+		return nil, fmt.Errorf("returned certificate was not a valid PEM block")
+	}
+	cert, err := x509.ParseCertificate(rawCertBlock.Bytes)
+	if err != nil {
+		return nil, err
+	}
+
+	chain := []*x509.Certificate{cert}
+	for _, caPEM := range c.CertificateChain {
+		caCerts, err := ParseCertificatesPEM([]byte(caPEM))
+		if err != nil {
+			return nil, errors.Join(err, errors.New("failed to parse certificate chain"))
+		}
+		chain = append(chain, caCerts...)
+	}
+	return chain, nil
+}
+
+// See https://cloud.google.com/certificate-authority-service/docs/reference/rest/v1/projects.locations.caPools.certificates#RevocationDetails
+type GCPRevocationDetails struct {
+	RevocationState string `json:"revocationState"`
+	RevocationTime  string `json:"revocationTime"`
+}
+
+// See https://cloud.google.com/certificate-authority-service/docs/reference/rest/v1/projects.locations.caPools.certificates/list#response-body
+type GCPListCertificatesResponse struct {
+	Certificates  []GCPCertificate `json:"certificates"`
+	NextPageToken string           `json:"nextPageToken,omitempty"`
+}
+
+// See https://cloud.google.com/certificate-authority-service/docs/reference/rest/v1/projects.locations.caPools.certificateAuthorities#CertificateAuthority
+type GCPCertificateAuthorityData struct {
+	Name       string `json:"name"`
+	State      string `json:"state"`
+	AccessURLs struct {
+		RootCertificate string   `json:"caCertificateAccessUrl"`
+		RevocationLists []string `json:"crlAccessUrls"`
+	} `json:"accessUrls"`
+	RootCertificatePEMs []string `json:"pemCaCertificates"`
+}
+
+// See https://cloud.google.com/certificate-authority-service/docs/reference/rest/v1/projects.locations.caPools.certificateAuthorities/list#response-body
+type GCPListCertificateAuthoritiesResponse struct {
+	CertificateAuthorities []GCPCertificateAuthorityData `json:"certificateAuthorities"`
+	NextPageToken          string                        `json:"nextPageToken,omitempty"`
+}
+
+// See https://cloud.google.com/certificate-authority-service/docs/reference/rest/v1/projects.locations.caPools/fetchCaCerts#response-body
+type GCPFetchCACertsResponse struct {
+	CACerts []struct {
+		Certificates []string `json:"certificates"`
+	} `json:"caCerts"`
+}
+
+// gcpRevocationReasons maps RFC 5280 reason codes to the names used by GCP.
+// See https://cloud.google.com/certificate-authority-service/docs/reference/rest/v1/RevocationReason
+var gcpRevocationReasons = map[RevocationReason]string{
+	RevocationReasonUnspecified:          "REVOCATION_REASON_UNSPECIFIED",
+	RevocationReasonKeyCompromise:        "KEY_COMPROMISE",
+	RevocationReasonAffiliationChanged:   "AFFILIATION_CHANGED",
+	RevocationReasonSuperseded:           "SUPERSEDED",
+	RevocationReasonCessationOfOperation: "CESSATION_OF_OPERATION",
+	RevocationReasonCertificateHold:      "CERTIFICATE_HOLD",
+}
+
+// GCPAccessTokenFunc returns an access token that can be used with the
+// Certificate Authority Service API.
+type GCPAccessTokenFunc func(ctx context.Context) (string, error)
+
+// GCPAuthority is an Authority backed by Google Certificate Authority Service.
+type GCPAuthority struct {
+	config      GCPCertificateAuthorityConfig
+	accessToken GCPAccessTokenFunc
+}
+
+// NewGCPAuthority creates a new Authority for the given CA pool and
+// certificate authority.
+func NewGCPAuthority(config GCPCertificateAuthorityConfig, accessToken GCPAccessTokenFunc) *GCPAuthority {
+	return &GCPAuthority{
+		config:      config,
+		accessToken: accessToken,
+	}
+}
+
+// poolURL returns the API URL of the configured CA pool.
+func (a *GCPAuthority) poolURL() string {
+	return fmt.Sprintf("https://privateca.googleapis.com/v1/projects/%s/locations/%s/caPools/%s",
+		a.config.ProjectID,
+		a.config.Location,
+		a.config.CertificatePool)
+}
+
+// authHeader returns the headers required to call the API.
+func (a *GCPAuthority) authHeader(ctx context.Context) (map[string]string, error) {
+	token, err := a.accessToken(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return map[string]string{
+		"Content-Type":  "application/json",
+		"Authorization": "Bearer " + token,
+	}, nil
+}
+
+// IssueCertificate creates a certificate from the given CSR.
+// See CreateGCPCertificateFromCSR.
+func (a *GCPAuthority) IssueCertificate(ctx context.Context, csrPEM []byte, lifetime time.Duration) ([]*x509.Certificate, error) {
+	token, err := a.accessToken(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return CreateGCPCertificateFromCSR(a.config, token, csrPEM, lifetime, ctx)
+}
+
+// listCertificates returns all certificate resources matching the given filter.
+// See https://cloud.google.com/certificate-authority-service/docs/reference/rest/v1/projects.locations.caPools.certificates/list
+func (a *GCPAuthority) listCertificates(ctx context.Context, filter string) ([]GCPCertificate, error) {
+	header, err := a.authHeader(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	certificates := []GCPCertificate{}
+	pageToken := ""
+	for {
+		query := url.Values{"filter": {filter}}
+		if len(pageToken) > 0 {
+			query.Set("pageToken", pageToken)
+		}
+
+		response, err := shared.HttpGETJson[GCPListCertificatesResponse](a.poolURL()+"/certificates?"+query.Encode(), nil, header, nil, 2, ctx)
+		if err != nil {
+			return nil, err
+		}
+
+		certificates = append(certificates, response.Certificates...)
+		if len(response.NextPageToken) == 0 {
+			return certificates, nil
+		}
+		pageToken = response.NextPageToken
+	}
+}
+
+// findCertificate returns the certificate resource with the given serial number.
+func (a *GCPAuthority) findCertificate(ctx context.Context, hexSerial string) (*GCPCertificate, error) {
+	filter := fmt.Sprintf(`certificate_description.subject_description.hex_serial_number="%s"`, strings.ToLower(hexSerial))
+	certificates, err := a.listCertificates(ctx, filter)
+	if err != nil {
+		return nil, err
+	}
+	if len(certificates) == 0 {
+		return nil, shared.NewErrorWithStatus(http.StatusNotFound, "certificate %s not found", hexSerial)
+	}
+	return &certificates[0], nil
+}
+
+// GetCertificate returns the certificate with the given serial number.
+func (a *GCPAuthority) GetCertificate(ctx context.Context, hexSerial string) (*x509.Certificate, error) {
+	certificate, err := a.findCertificate(ctx, hexSerial)
+	if err != nil {
+		return nil, err
+	}
+
+	chain, err := certificate.Chain()
+	if err != nil {
+		return nil, err
+	}
+	return chain[0], nil
+}
+
+// gcpFilterString returns the given value as quoted string literal of a
+// list filter, see https://google.aip.dev/160. Quotes and backslashes are
+// escaped. Values containing wildcards or control characters are rejected, as
+// they are neither valid hostnames nor email addresses.
+func gcpFilterString(value string) (string, error) {
+	for _, c := range value {
+		if c == '*' || unicode.IsControl(c) {
+			return "", shared.NewErrorWithStatus(http.StatusBadRequest, "invalid character %q in certificate query", c)
+		}
+	}
+
+	escaped := strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(value)
+	return `"` + escaped + `"`, nil
+}
+
+// FindCertificates returns all valid, unrevoked certificates in the pool
+// matching the given query.
+func (a *GCPAuthority) FindCertificates(ctx context.Context, query CertificateQuery) ([]*x509.Certificate, error) {
+	if query.IsEmpty() {
+		return nil, shared.NewErrorWithStatus(http.StatusBadRequest, "empty certificate query")
+	}
+
+	filters := []string{}
+	if len(query.Host) > 0 {
+		host, err := gcpFilterString(query.Host)
+		if err != nil {
+			return nil, err
+		}
+		filters = append(filters, "certificate_description.subject_description.subject.common_name="+host)
+	}
+	if len(query.Identity) > 0 {
+		identity, err := gcpFilterString(query.Identity)
+		if err != nil {
+			return nil, err
+		}
+		filters = append(filters, "certificate_description.subject_description.subject_alt_name.email_addresses:"+identity)
+	}
+
+	resources, err := a.listCertificates(ctx, strings.Join(filters, " AND "))
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	certs := make([]*x509.Certificate, 0, len(resources))
+	for _, resource := range resources {
+		if resource.RevocationDetails != nil {
+			continue
+		}
+		parsed, err := ParseCertificatesPEM([]byte(resource.CertificateAsPEM))
+		if err != nil {
+			log.Warn().Err(err).Str("name", resource.Name).Msg("failed to parse certificate")
+			continue
+		}
+		// The GCP filter is case-sensitive and matches substrings
+		if cert := parsed[0]; now.Before(cert.NotAfter) && query.Matches(cert) {
+			certs = append(certs, cert)
+		}
+	}
+
+	return certs, nil
+}
+
+// RootCertificates returns the CA certificates of all authorities in the pool.
+// See https://cloud.google.com/certificate-authority-service/docs/reference/rest/v1/projects.locations.caPools/fetchCaCerts
+func (a *GCPAuthority) RootCertificates(ctx context.Context) ([]*x509.Certificate, error) {
+	header, err := a.authHeader(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	response, err := shared.HttpPOSTJson[GCPFetchCACertsResponse](a.poolURL()+":fetchCaCerts", nil, header, nil, 2, ctx)
+	if err != nil {
+		return nil, errors.Join(err, errors.New("failed to call fetchCaCerts"))
+	}
+
+	rootCAs := make([]*x509.Certificate, 0, len(response.CACerts))
+	for _, chain := range response.CACerts {
+		for _, pemData := range chain.Certificates {
+			certs, err := ParseCertificatesPEM([]byte(pemData))
+			if err != nil {
+				log.Warn().Msgf("failed to parse CA cert: %s", err)
+			}
+			rootCAs = append(rootCAs, certs...)
+		}
+	}
+
+	return rootCAs, nil
+}
+
+// RevokeCertificate revokes the certificate with the given serial number.
+// See https://cloud.google.com/certificate-authority-service/docs/reference/rest/v1/projects.locations.caPools.certificates/revoke
+func (a *GCPAuthority) RevokeCertificate(ctx context.Context, hexSerial string, reason RevocationReason) error {
+	certificate, err := a.findCertificate(ctx, hexSerial)
+	if err != nil {
+		return err
+	}
+	if certificate.RevocationDetails != nil {
+		return nil
+	}
+
+	gcpReason, ok := gcpRevocationReasons[reason]
+	if !ok {
+		gcpReason = gcpRevocationReasons[RevocationReasonUnspecified]
+	}
+
+	requestBody, err := jsoniter.Marshal(map[string]string{"reason": gcpReason})
+	if err != nil {
+		return err
+	}
+
+	header, err := a.authHeader(ctx)
+	if err != nil {
+		return err
+	}
+
+	// certificate.Name is the full resource name
+	requestURL := "https://privateca.googleapis.com/v1/" + certificate.Name + ":revoke"
+	_, err = shared.HttpPOSTJson[GCPCertificate](requestURL, requestBody, header, nil, 2, ctx)
+	return err
+}
+
+// listAuthorities returns all certificate authorities in the configured pool.
+// See https://cloud.google.com/certificate-authority-service/docs/reference/rest/v1/projects.locations.caPools.certificateAuthorities/list
+func (a *GCPAuthority) listAuthorities(ctx context.Context) ([]GCPCertificateAuthorityData, error) {
+	header, err := a.authHeader(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	authorities := []GCPCertificateAuthorityData{}
+	pageToken := ""
+	for {
+		requestURL := a.poolURL() + "/certificateAuthorities"
+		if len(pageToken) > 0 {
+			requestURL += "?" + url.Values{"pageToken": {pageToken}}.Encode()
+		}
+
+		response, err := shared.HttpGETJson[GCPListCertificateAuthoritiesResponse](requestURL, nil, header, nil, 2, ctx)
+		if err != nil {
+			return nil, err
+		}
+
+		authorities = append(authorities, response.CertificateAuthorities...)
+		if len(response.NextPageToken) == 0 {
+			return authorities, nil
+		}
+		pageToken = response.NextPageToken
+	}
+}
+
+// RevocationLists downloads the CRLs of all enabled or disabled certificate
+// authorities in the pool. Disabled authorities cannot issue certificates,
+// but the ones they issued are still trusted, so their revocations need to be
+// known as well.
+func (a *GCPAuthority) RevocationLists(ctx context.Context) ([]x509.RevocationList, error) {
+	authorities, err := a.listAuthorities(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	lists := make([]x509.RevocationList, 0)
+	processErrors := error(nil)
+
+	for _, authority := range authorities {
+		if !gcpAuthorityPublishesCRLs(authority.State) {
+			log.Debug().Str("authority", authority.Name).Str("state", authority.State).Msg("Skipping CRLs of certificate authority")
+			continue
+		}
+
+		for _, crlURL := range authority.AccessURLs.RevocationLists {
+			rsp, err := shared.HttpGET(crlURL, nil, map[string]string{}, nil, 2, ctx)
+			if err != nil {
+				processErrors = errors.Join(processErrors, err)
+				continue
+			}
+
+			body, _ := io.ReadAll(rsp.Body)
+			_ = rsp.Body.Close()
+
+			if rsp.StatusCode != http.StatusOK {
+				err := fmt.Errorf("%s: %d: %s", authority.Name, rsp.StatusCode, string(body))
+				processErrors = errors.Join(processErrors, err)
+				continue
+			}
+
+			crls, err := ParseRevocationListsPEM(body)
+			processErrors = errors.Join(processErrors, err)
+			lists = append(lists, crls...)
+		}
+	}
+
+	return lists, processErrors
+}
+
+// gcpAuthorityPublishesCRLs returns true if a certificate authority in the
+// given state has issued certificates that might still be in use.
+// See https://cloud.google.com/certificate-authority-service/docs/reference/rest/v1/projects.locations.caPools.certificateAuthorities#State
+func gcpAuthorityPublishesCRLs(state string) bool {
+	switch state {
+	case "ENABLED", "DISABLED":
+		return true
+	default:
+		return false
+	}
 }
 
 // GetGCPCertificate retrieves a certificate from GCP Certificate Authority
 // using the provided access token and certificate id.
-// It returns the certificate as an x509.Certificate object.
-func GetGCPCertificate(config GCPCertificateAuthorityConfig, gcpAccessToken string, certificateId string, ctx context.Context) (*x509.Certificate, error) {
+// It returns the certificate followed by its CA certificates.
+func GetGCPCertificate(config GCPCertificateAuthorityConfig, gcpAccessToken string, certificateId string, ctx context.Context) ([]*x509.Certificate, error) {
 	// https://cloud.google.com/certificate-authority-service/docs/reference/rest/v1/projects.locations.caPools.certificates/get
 	requestURL := fmt.Sprintf(
 		"https://privateca.googleapis.com/v1/projects/%s/locations/%s/caPools/%s/certificates/%s",
@@ -60,16 +452,7 @@ func GetGCPCertificate(config GCPCertificateAuthorityConfig, gcpAccessToken stri
 		return nil, err
 	}
 
-	if response.CertificateAsPEM == "" {
-		return nil, fmt.Errorf("empty certificate returned")
-	}
-
-	rawCertBlock, _ := pem.Decode([]byte(response.CertificateAsPEM))
-	if rawCertBlock == nil {
-		return nil, fmt.Errorf("returned certificate was not a valid PEM block")
-	}
-
-	return x509.ParseCertificate(rawCertBlock.Bytes)
+	return response.Chain()
 }
 
 // CreateGCPCertificateFromCSR creates a certificate from a CSR using the GCP Certificate Authority.
@@ -77,7 +460,8 @@ func GetGCPCertificate(config GCPCertificateAuthorityConfig, gcpAccessToken stri
 // If the certificate for the given CSR already exists, it is returned.
 // The provided gcpAccessToken is used to authenticate the request.
 // The lifetime parameter specifies the desired lifetime of the certificate.
-func CreateGCPCertificateFromCSR(config GCPCertificateAuthorityConfig, gcpAccessToken string, csrPEM []byte, lifetime time.Duration, ctx context.Context) (*x509.Certificate, error) {
+// The certificate is returned followed by its CA certificates.
+func CreateGCPCertificateFromCSR(config GCPCertificateAuthorityConfig, gcpAccessToken string, csrPEM []byte, lifetime time.Duration, ctx context.Context) ([]*x509.Certificate, error) {
 	if lifetime <= 0 {
 		return nil, fmt.Errorf("lifetime must be greater than 0")
 	}
@@ -115,9 +499,9 @@ func CreateGCPCertificateFromCSR(config GCPCertificateAuthorityConfig, gcpAccess
 	certificateId := fmt.Sprintf("%s-%x", sanitizedHost, certHash.Sum32())
 
 	// If the certificate already exists, we return it.
-	existingCert, err := GetGCPCertificate(config, gcpAccessToken, certificateId, ctx)
-	if existingCert != nil {
-		return existingCert, err
+	existingChain, err := GetGCPCertificate(config, gcpAccessToken, certificateId, ctx)
+	if err == nil {
+		return existingChain, nil
 	}
 
 	logEx := log.Debug().Err(err)
@@ -160,14 +544,6 @@ func CreateGCPCertificateFromCSR(config GCPCertificateAuthorityConfig, gcpAccess
 	if err != nil {
 		return nil, err
 	}
-	if len(response.CertificateAsPEM) == 0 {
-		return nil, fmt.Errorf("empty certificate returned")
-	}
-
-	rawCertBlock, _ := pem.Decode([]byte(response.CertificateAsPEM))
-	if rawCertBlock == nil {
-		return nil, fmt.Errorf("returned certificate was not a valid PEM block")
-	}
 
-	return x509.ParseCertificate(rawCertBlock.Bytes)
+	return response.Chain()
 }
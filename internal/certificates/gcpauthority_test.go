@@ -0,0 +1,29 @@
+package certificates
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGCPFilterString(t *testing.T) {
+	assert := assert.New(t)
+
+	quoted, err := gcpFilterString("host.example.com")
+	assert.NoError(err)
+	assert.Equal(`"host.example.com"`, quoted)
+
+	// Quotes cannot end the literal
+	quoted, err = gcpFilterString(`a" OR certificate_description.subject_description.subject.common_name:"`)
+	assert.NoError(err)
+	assert.Equal(`"a\" OR certificate_description.subject_description.subject.common_name:\""`, quoted)
+
+	quoted, err = gcpFilterString(`a\`)
+	assert.NoError(err)
+	assert.Equal(`"a\\"`, quoted)
+
+	for _, value := range []string{"*@example.com", "host\n.example.com"} {
+		_, err = gcpFilterString(value)
+		assert.Error(err, value)
+	}
+}
@@ -0,0 +1,389 @@
+package certificates
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"identity-metadata-server/internal/shared"
+
+	"github.com/rs/zerolog/log"
+)
+
+// NotBeforeSkew is the time the NotBefore of certificates issued by a
+// LocalAuthority is set back, to allow for clock skew.
+const NotBeforeSkew = time.Minute
+
+// LocalAuthorityConfig is used to configure a LocalAuthority.
+type LocalAuthorityConfig struct {
+	// CertificatePath is the path to the PEM encoded CA certificate.
+	CertificatePath string
+	// KeyPath is the path to the PEM encoded CA private key.
+	KeyPath string
+	// StateDir is the directory used to store issued certificates and
+	// revocations.
+	StateDir string
+	// CRLLifetime is the time between thisUpdate and nextUpdate of
+	// generated CRLs.
+	CRLLifetime time.Duration
+	// ExtKeyUsage is set on issued certificates. If empty, certificates are
+	// issued for client authentication only.
+	ExtKeyUsage []x509.ExtKeyUsage
+}
+
+// localRevocation is a single entry of the revocations file.
+type localRevocation struct {
+	RevokedAt time.Time        `json:"revokedAt"`
+	Reason    RevocationReason `json:"reason"`
+}
+
+// LocalAuthority is an Authority that signs certificates with a CA key
+// stored on disk. Issued certificates and revocations are stored in a state
+// directory, CRLs are generated on request.
+type LocalAuthority struct {
+	config      LocalAuthorityConfig
+	certificate *x509.Certificate
+	// chain holds the CA certificate followed by the remaining certificates
+	// of the certificate file, e.g. the issuers of an intermediate CA.
+	chain  []*x509.Certificate
+	signer crypto.Signer
+	guard  *sync.Mutex
+}
+
+// NewLocalAuthority loads the CA certificate and key and prepares the state
+// directory.
+func NewLocalAuthority(config LocalAuthorityConfig) (*LocalAuthority, error) {
+	if config.CRLLifetime <= 0 {
+		return nil, errors.New("CRL lifetime must be greater than 0")
+	}
+
+	certPEM, err := os.ReadFile(config.CertificatePath)
+	if err != nil {
+		return nil, errors.Join(err, fmt.Errorf("failed to read CA certificate %s", config.CertificatePath))
+	}
+	certs, err := ParseCertificatesPEM(certPEM)
+	if err != nil {
+		return nil, errors.Join(err, fmt.Errorf("failed to parse CA certificate %s", config.CertificatePath))
+	}
+
+	keyPEM, err := os.ReadFile(config.KeyPath)
+	if err != nil {
+		return nil, errors.Join(err, fmt.Errorf("failed to read CA key %s", config.KeyPath))
+	}
+	key, err := ParsePrivateKeyPEM(keyPEM)
+	if err != nil {
+		return nil, errors.Join(err, fmt.Errorf("failed to parse CA key %s", config.KeyPath))
+	}
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("CA key %s cannot be used for signing", config.KeyPath)
+	}
+
+	// The first certificate is expected to belong to the key
+	certificate := certs[0]
+	if !certificate.IsCA {
+		return nil, fmt.Errorf("certificate %s is not a CA certificate", config.CertificatePath)
+	}
+	if publicKey, ok := signer.Public().(interface{ Equal(crypto.PublicKey) bool }); !ok || !publicKey.Equal(certificate.PublicKey) {
+		return nil, fmt.Errorf("CA key %s does not match certificate %s", config.KeyPath, config.CertificatePath)
+	}
+
+	if err := os.MkdirAll(filepath.Join(config.StateDir, "issued"), 0700); err != nil {
+		return nil, errors.Join(err, fmt.Errorf("failed to create state directory %s", config.StateDir))
+	}
+
+	return &LocalAuthority{
+		config:      config,
+		certificate: certificate,
+		chain:       certs,
+		signer:      signer,
+		guard:       new(sync.Mutex),
+	}, nil
+}
+
+// issuedPath returns the path of the issued certificate with the given serial.
+func (a *LocalAuthority) issuedPath(hexSerial string) string {
+	return filepath.Join(a.config.StateDir, "issued", strings.ToLower(hexSerial)+".pem")
+}
+
+// revocationsPath returns the path of the revocations file.
+func (a *LocalAuthority) revocationsPath() string {
+	return filepath.Join(a.config.StateDir, "revoked.json")
+}
+
+// loadRevocations reads all revocations from disk. A missing file contains
+// no revocations. Must be called with the guard locked.
+func (a *LocalAuthority) loadRevocations() (map[string]localRevocation, error) {
+	revocations := map[string]localRevocation{}
+
+	data, err := os.ReadFile(a.revocationsPath())
+	switch {
+	case os.IsNotExist(err):
+		return revocations, nil
+	case err != nil:
+		return nil, err
+	}
+
+	if err := json.Unmarshal(data, &revocations); err != nil {
+		return nil, errors.Join(err, fmt.Errorf("failed to parse revocations from %s", a.revocationsPath()))
+	}
+	return revocations, nil
+}
+
+// saveRevocations writes all revocations to disk, replacing the file
+// atomically. Must be called with the guard locked.
+func (a *LocalAuthority) saveRevocations(revocations map[string]localRevocation) error {
+	data, err := json.MarshalIndent(revocations, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmpPath := a.revocationsPath() + ".tmp"
+	if err := os.WriteFile(tmpPath, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, a.revocationsPath())
+}
+
+// IssueCertificate signs the given CSR. Subject and SANs are copied from the
+// CSR, the certificate is always restricted to client authentication.
+// The lifetime is capped to the lifetime of the CA certificate.
+// The certificate is returned followed by the certificates of the CA file.
+func (a *LocalAuthority) IssueCertificate(ctx context.Context, csrPEM []byte, lifetime time.Duration) ([]*x509.Certificate, error) {
+	if lifetime <= 0 {
+		return nil, fmt.Errorf("lifetime must be greater than 0")
+	}
+
+	csr, err := parseCSRPEM(csrPEM)
+	if err != nil {
+		return nil, err
+	}
+
+	// RFC 5280 allows up to 20 octets, keep the highest bit clear so the
+	// serial is always positive.
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 127))
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	notAfter := now.Add(lifetime)
+	if notAfter.After(a.certificate.NotAfter) {
+		notAfter = a.certificate.NotAfter
+	}
+
+	extKeyUsage := a.config.ExtKeyUsage
+	if len(extKeyUsage) == 0 {
+		extKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}
+	}
+
+	template := &x509.Certificate{
+		SerialNumber:   serial,
+		Subject:        csr.Subject,
+		DNSNames:       csr.DNSNames,
+		EmailAddresses: csr.EmailAddresses,
+		IPAddresses:    csr.IPAddresses,
+		URIs:           csr.URIs,
+		NotBefore:      now.Add(-NotBeforeSkew),
+		NotAfter:       notAfter,
+		KeyUsage:       x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:    extKeyUsage,
+	}
+
+	certDER, err := x509.CreateCertificate(rand.Reader, template, a.certificate, csr.PublicKey, a.signer)
+	if err != nil {
+		return nil, err
+	}
+
+	cert, err := x509.ParseCertificate(certDER)
+	if err != nil {
+		return nil, err
+	}
+
+	certPEM, err := EncodeCertificateToPEM(cert)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.WriteFile(a.issuedPath(SerialToHex(cert)), certPEM, 0600); err != nil {
+		return nil, errors.Join(err, errors.New("failed to store issued certificate"))
+	}
+
+	return append([]*x509.Certificate{cert}, a.chain...), nil
+}
+
+// GetCertificate returns a certificate previously issued by this authority.
+func (a *LocalAuthority) GetCertificate(ctx context.Context, hexSerial string) (*x509.Certificate, error) {
+	if _, err := hex.DecodeString(hexSerial); err != nil || len(hexSerial) == 0 {
+		return nil, shared.NewErrorWithStatus(http.StatusBadRequest, "invalid serial number %q", hexSerial)
+	}
+
+	certPEM, err := os.ReadFile(a.issuedPath(hexSerial))
+	if os.IsNotExist(err) {
+		return nil, shared.NewErrorWithStatus(http.StatusNotFound, "certificate %s not found", hexSerial)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	certs, err := ParseCertificatesPEM(certPEM)
+	if err != nil {
+		return nil, err
+	}
+	return certs[0], nil
+}
+
+// FindCertificates returns all valid, unrevoked certificates issued by this
+// authority matching the given query.
+func (a *LocalAuthority) FindCertificates(ctx context.Context, query CertificateQuery) ([]*x509.Certificate, error) {
+	if query.IsEmpty() {
+		return nil, shared.NewErrorWithStatus(http.StatusBadRequest, "empty certificate query")
+	}
+
+	a.guard.Lock()
+	revocations, err := a.loadRevocations()
+	a.guard.Unlock()
+	if err != nil {
+		return nil, err
+	}
+
+	files, err := filepath.Glob(filepath.Join(a.config.StateDir, "issued", "*.pem"))
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	certs := []*x509.Certificate{}
+	for _, file := range files {
+		certPEM, err := os.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		parsed, err := ParseCertificatesPEM(certPEM)
+		if err != nil {
+			log.Warn().Err(err).Str("file", file).Msg("failed to parse issued certificate")
+			continue
+		}
+
+		cert := parsed[0]
+		if _, isRevoked := revocations[SerialToHex(cert)]; isRevoked || now.After(cert.NotAfter) {
+			continue
+		}
+		if query.Matches(cert) {
+			certs = append(certs, cert)
+		}
+	}
+
+	return certs, nil
+}
+
+// RootCertificates returns the CA certificate.
+func (a *LocalAuthority) RootCertificates(ctx context.Context) ([]*x509.Certificate, error) {
+	return []*x509.Certificate{a.certificate}, nil
+}
+
+// RevokeCertificate marks a certificate issued by this authority as revoked.
+// The revocation is included in all CRLs generated afterwards.
+func (a *LocalAuthority) RevokeCertificate(ctx context.Context, hexSerial string, reason RevocationReason) error {
+	cert, err := a.GetCertificate(ctx, hexSerial)
+	if err != nil {
+		return err
+	}
+
+	a.guard.Lock()
+	defer a.guard.Unlock()
+
+	revocations, err := a.loadRevocations()
+	if err != nil {
+		return err
+	}
+
+	serial := SerialToHex(cert)
+	if _, isRevoked := revocations[serial]; isRevoked {
+		return nil
+	}
+
+	revocations[serial] = localRevocation{
+		RevokedAt: time.Now().UTC(),
+		Reason:    reason,
+	}
+	return a.saveRevocations(revocations)
+}
+
+// RevocationLists returns a freshly signed CRL containing all revoked
+// certificates that have not expired yet.
+func (a *LocalAuthority) RevocationLists(ctx context.Context) ([]x509.RevocationList, error) {
+	a.guard.Lock()
+	revocations, err := a.loadRevocations()
+	a.guard.Unlock()
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	entries := make([]x509.RevocationListEntry, 0, len(revocations))
+	for hexSerial, revocation := range revocations {
+		serialBytes, err := hex.DecodeString(hexSerial)
+		if err != nil {
+			continue
+		}
+
+		// Expired certificates do not need to be listed
+		if cert, err := a.GetCertificate(ctx, hexSerial); err == nil && now.After(cert.NotAfter) {
+			continue
+		}
+
+		entries = append(entries, x509.RevocationListEntry{
+			SerialNumber:   new(big.Int).SetBytes(serialBytes),
+			RevocationTime: revocation.RevokedAt,
+			ReasonCode:     int(revocation.Reason),
+		})
+	}
+
+	template := &x509.RevocationList{
+		Number:                    big.NewInt(now.UnixNano()),
+		ThisUpdate:                now,
+		NextUpdate:                now.Add(a.config.CRLLifetime),
+		RevokedCertificateEntries: entries,
+	}
+
+	crlDER, err := x509.CreateRevocationList(rand.Reader, template, a.certificate, a.signer)
+	if err != nil {
+		return nil, err
+	}
+
+	crl, err := x509.ParseRevocationList(crlDER)
+	if err != nil {
+		return nil, err
+	}
+	return []x509.RevocationList{*crl}, nil
+}
+
+// parseCSRPEM decodes a PEM encoded CSR and verifies its signature.
+func parseCSRPEM(csrPEM []byte) (*x509.CertificateRequest, error) {
+	block, _ := pem.Decode(csrPEM)
+	if block == nil {
+		return nil, fmt.Errorf("CSR was not a valid PEM block")
+	}
+
+	csr, err := x509.ParseCertificateRequest(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	if err := csr.CheckSignature(); err != nil {
+		return nil, err
+	}
+	return csr, nil
+}
@@ -0,0 +1,162 @@
+package certificates
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"identity-metadata-server/internal/shared"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestLocalAuthority(t *testing.T, extKeyUsage ...x509.ExtKeyUsage) *LocalAuthority {
+	dir := t.TempDir()
+
+	keyPEM, err := CreateECPrivateKeyPEM(KeyStrengthNormal)
+	assert.NoError(t, err)
+	key, err := ParsePrivateKeyPEM(keyPEM)
+	assert.NoError(t, err)
+
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(24 * time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+	}
+	signer := key.(crypto.Signer)
+	certDER, err := x509.CreateCertificate(rand.Reader, template, template, signer.Public(), key)
+	assert.NoError(t, err)
+
+	certPath := filepath.Join(dir, "ca.crt")
+	keyPath := filepath.Join(dir, "ca.key")
+	assert.NoError(t, os.WriteFile(certPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certDER}), 0600))
+	assert.NoError(t, os.WriteFile(keyPath, keyPEM, 0600))
+
+	authority, err := NewLocalAuthority(LocalAuthorityConfig{
+		CertificatePath: certPath,
+		KeyPath:         keyPath,
+		StateDir:        filepath.Join(dir, "state"),
+		CRLLifetime:     time.Hour,
+		ExtKeyUsage:     extKeyUsage,
+	})
+	assert.NoError(t, err)
+	return authority
+}
+
+func TestLocalAuthority(t *testing.T) {
+	assert := assert.New(t)
+	ctx := context.Background()
+	authority := newTestLocalAuthority(t)
+
+	keyPEM, err := CreateECPrivateKeyPEM(KeyStrengthNormal)
+	assert.NoError(err)
+	csrPEM, err := CreateClientCSR(keyPEM, "host.example.com", "host@example.com", []net.IP{net.ParseIP("10.0.0.1")})
+	assert.NoError(err)
+
+	// Issue a certificate
+	chain, err := authority.IssueCertificate(ctx, csrPEM, 48*time.Hour)
+	assert.NoError(err)
+	assert.Len(chain, 2)
+	cert := chain[0]
+	assert.Equal("host.example.com", cert.Subject.CommonName)
+	assert.Equal([]string{"host.example.com"}, cert.DNSNames)
+	assert.Equal([]string{"host@example.com"}, cert.EmailAddresses)
+	assert.Equal([]x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}, cert.ExtKeyUsage)
+
+	roots, err := authority.RootCertificates(ctx)
+	assert.NoError(err)
+	assert.Len(roots, 1)
+	assert.NoError(cert.CheckSignatureFrom(roots[0]))
+	assert.True(chain[1].Equal(roots[0]))
+
+	// The lifetime is capped to the CA lifetime
+	assert.False(cert.NotAfter.After(roots[0].NotAfter))
+
+	// Issued certificates can be fetched
+	serial := SerialToHex(cert)
+	stored, err := authority.GetCertificate(ctx, serial)
+	assert.NoError(err)
+	assert.Equal(cert.Raw, stored.Raw)
+
+	found, err := authority.FindCertificates(ctx, CertificateQuery{Host: "HOST.example.com"})
+	assert.NoError(err)
+	assert.Len(found, 1)
+
+	found, err = authority.FindCertificates(ctx, CertificateQuery{Host: "host.example.com", Identity: "other@example.com"})
+	assert.NoError(err)
+	assert.Empty(found)
+
+	_, err = authority.GetCertificate(ctx, "0a0b")
+	assert.Equal(http.StatusNotFound, err.(shared.ErrorWithStatus).Code)
+
+	// Nothing revoked yet
+	crls, err := authority.RevocationLists(ctx)
+	assert.NoError(err)
+	assert.Len(crls, 1)
+	assert.NoError(crls[0].CheckSignatureFrom(roots[0]))
+	assert.Empty(crls[0].RevokedCertificateEntries)
+
+	// Revoke the certificate, revoking twice is not an error
+	assert.NoError(authority.RevokeCertificate(ctx, serial, RevocationReasonKeyCompromise))
+	assert.NoError(authority.RevokeCertificate(ctx, serial, RevocationReasonSuperseded))
+	assert.Error(authority.RevokeCertificate(ctx, "0a0b", RevocationReasonUnspecified))
+
+	// Revoked certificates are not found anymore
+	found, err = authority.FindCertificates(ctx, CertificateQuery{Identity: "host@example.com"})
+	assert.NoError(err)
+	assert.Empty(found)
+
+	crls, err = authority.RevocationLists(ctx)
+	assert.NoError(err)
+	assert.NoError(crls[0].CheckSignatureFrom(roots[0]))
+	assert.Len(crls[0].RevokedCertificateEntries, 1)
+
+	entry := crls[0].RevokedCertificateEntries[0]
+	assert.Equal(0, entry.SerialNumber.Cmp(cert.SerialNumber))
+	assert.Equal(int(RevocationReasonKeyCompromise), entry.ReasonCode)
+	assert.WithinDuration(time.Now().Add(time.Hour), crls[0].NextUpdate, time.Minute)
+}
+
+func TestLocalAuthorityExtKeyUsage(t *testing.T) {
+	assert := assert.New(t)
+	usages := []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth}
+	authority := newTestLocalAuthority(t, usages...)
+
+	keyPEM, err := CreateECPrivateKeyPEM(KeyStrengthNormal)
+	assert.NoError(err)
+	csrPEM, err := CreateClientCSR(keyPEM, "host.example.com", "", nil)
+	assert.NoError(err)
+
+	chain, err := authority.IssueCertificate(context.Background(), csrPEM, time.Hour)
+	assert.NoError(err)
+	assert.Equal(usages, chain[0].ExtKeyUsage)
+}
+
+func TestRevocationReason(t *testing.T) {
+	assert := assert.New(t)
+
+	reason, err := ParseRevocationReason("keyCompromise")
+	assert.NoError(err)
+	assert.Equal(RevocationReasonKeyCompromise, reason)
+	assert.Equal("keyCompromise", reason.String())
+
+	reason, err = ParseRevocationReason("")
+	assert.NoError(err)
+	assert.Equal(RevocationReasonUnspecified, reason)
+
+	_, err = ParseRevocationReason("unknown")
+	assert.Error(err)
+}
@@ -0,0 +1,306 @@
+package certificates
+
+import (
+	"bytes"
+	"context"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"identity-metadata-server/internal/shared"
+	"net"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// AuthorityPool is a single authority used by a MultiAuthority.
+type AuthorityPool struct {
+	// Name identifies the pool in logs and errors.
+	Name string
+	// Authority is the backend of this pool.
+	Authority Authority
+	// Priority defines the order in which pools are used for issuance.
+	// Pools with a lower value are used first.
+	Priority int
+	// Origins restricts issuance from this pool to clients connecting from
+	// one of the given networks. If empty, the pool is used for all clients.
+	Origins []*net.IPNet
+}
+
+// servesOrigin returns true if the pool has an origin restriction matching
+// the given IP address.
+func (p AuthorityPool) servesOrigin(origin net.IP) bool {
+	for _, network := range p.Origins {
+		if network.Contains(origin) {
+			return true
+		}
+	}
+	return false
+}
+
+// ErrPartialResult is returned together with the results of the reachable
+// pools if some pools of a MultiAuthority fail.
+var ErrPartialResult = errors.New("some certificate authority pools are unavailable")
+
+// MultiAuthority combines multiple authorities into one. Certificates are
+// issued by the first available pool for the client's origin, while trust
+// roots, CRLs and lookups are aggregated across all pools.
+type MultiAuthority struct {
+	pools []AuthorityPool
+	// timeout limits the time spent on a single pool when issuing a
+	// certificate, so there is time left to fall back to the next pool.
+	// The last pool is not limited.
+	timeout time.Duration
+
+	// lastRoots and lastLists hold the last root certificates and CRLs
+	// fetched from each pool. They are used while a pool is unavailable.
+	// Both are protected by the guard.
+	guard     sync.Mutex
+	lastRoots map[string][]*x509.Certificate
+	lastLists map[string][]x509.RevocationList
+}
+
+// originContextKey is the context key of the client origin.
+type originContextKey struct{}
+
+// ContextWithOrigin returns a context carrying the IP address of the client a
+// certificate is issued for. MultiAuthority uses it to select pools.
+func ContextWithOrigin(ctx context.Context, origin net.IP) context.Context {
+	return context.WithValue(ctx, originContextKey{}, origin)
+}
+
+// originFromContext returns the origin stored by ContextWithOrigin or nil.
+func originFromContext(ctx context.Context) net.IP {
+	origin, _ := ctx.Value(originContextKey{}).(net.IP)
+	return origin
+}
+
+// NewMultiAuthority creates an authority using the given pools. timeout is
+// the maximum time spent on a single pool when issuing a certificate. A value
+// of 0 disables the per pool timeout.
+func NewMultiAuthority(pools []AuthorityPool, timeout time.Duration) (*MultiAuthority, error) {
+	if len(pools) == 0 {
+		return nil, errors.New("no certificate authority pools configured")
+	}
+
+	sorted := append([]AuthorityPool{}, pools...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return sorted[i].Priority < sorted[j].Priority
+	})
+
+	return &MultiAuthority{
+		pools:     sorted,
+		timeout:   timeout,
+		lastRoots: make(map[string][]*x509.Certificate),
+		lastLists: make(map[string][]x509.RevocationList),
+	}, nil
+}
+
+// issuingPools returns the pools to issue a certificate from, in the order
+// they should be tried. Pools with an origin restriction matching the origin
+// come first, followed by pools without restriction. Pools restricted to
+// other origins are not used.
+func (a *MultiAuthority) issuingPools(origin net.IP) []AuthorityPool {
+	matching := []AuthorityPool{}
+	unrestricted := []AuthorityPool{}
+
+	for _, pool := range a.pools {
+		switch {
+		case len(pool.Origins) == 0:
+			unrestricted = append(unrestricted, pool)
+		case origin != nil && pool.servesOrigin(origin):
+			matching = append(matching, pool)
+		}
+	}
+	return append(matching, unrestricted...)
+}
+
+// IsUnavailableError returns true if the given error indicates that an
+// authority could not be reached or failed to process a valid request, i.e.
+// if the request can be retried with another authority.
+func IsUnavailableError(err error) bool {
+	var statusErr shared.ErrorWithStatus
+	if errors.As(err, &statusErr) {
+		return statusErr.Code >= http.StatusInternalServerError
+	}
+
+	var netErr net.Error
+	return errors.Is(err, context.DeadlineExceeded) || errors.As(err, &netErr)
+}
+
+// IssueCertificate issues the certificate from the first pool serving the
+// origin stored in the context by ContextWithOrigin. If a pool is unavailable,
+// the next pool is used. Other errors are returned right away.
+// The last pool is not limited by the per pool timeout, as there is no pool
+// left to fall back to.
+func (a *MultiAuthority) IssueCertificate(ctx context.Context, csrPEM []byte, lifetime time.Duration) ([]*x509.Certificate, error) {
+	origin := originFromContext(ctx)
+	pools := a.issuingPools(origin)
+	if len(pools) == 0 {
+		return nil, shared.NewErrorWithStatus(http.StatusForbidden, "no certificate authority pool serves origin %s", origin)
+	}
+
+	issueErrors := error(nil)
+	for i, pool := range pools {
+		if ctx.Err() != nil {
+			break
+		}
+
+		poolCtx, cancel := ctx, context.CancelFunc(func() {})
+		if a.timeout > 0 && i < len(pools)-1 {
+			poolCtx, cancel = context.WithTimeout(ctx, a.timeout)
+		}
+		chain, err := pool.Authority.IssueCertificate(poolCtx, csrPEM, lifetime)
+		cancel()
+
+		if err == nil {
+			return chain, nil
+		}
+		if !IsUnavailableError(err) {
+			return nil, err
+		}
+
+		log.Warn().Err(err).Str("pool", pool.Name).Msg("Certificate authority pool unavailable, trying next pool")
+		issueErrors = errors.Join(issueErrors, fmt.Errorf("%s: %w", pool.Name, err))
+	}
+
+	return nil, shared.WrapErrorWithStatus(
+		errors.Join(errors.New("all certificate authority pools are unavailable"), issueErrors, ctx.Err()),
+		http.StatusServiceUnavailable)
+}
+
+// GetCertificate returns the certificate from the first pool knowing it.
+func (a *MultiAuthority) GetCertificate(ctx context.Context, hexSerial string) (*x509.Certificate, error) {
+	lookupErrors := error(nil)
+	for _, pool := range a.pools {
+		cert, err := pool.Authority.GetCertificate(ctx, hexSerial)
+		if err == nil {
+			return cert, nil
+		}
+		if !isNotFoundError(err) {
+			lookupErrors = errors.Join(lookupErrors, fmt.Errorf("%s: %w", pool.Name, err))
+		}
+	}
+
+	if lookupErrors != nil {
+		return nil, lookupErrors
+	}
+	return nil, shared.NewErrorWithStatus(http.StatusNotFound, "certificate %s not found", hexSerial)
+}
+
+// FindCertificates returns the matching certificates of all pools.
+// An error is returned if any of the pools fails, so no certificate is missed.
+func (a *MultiAuthority) FindCertificates(ctx context.Context, query CertificateQuery) ([]*x509.Certificate, error) {
+	certs := []*x509.Certificate{}
+	for _, pool := range a.pools {
+		poolCerts, err := pool.Authority.FindCertificates(ctx, query)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", pool.Name, err)
+		}
+		certs = append(certs, poolCerts...)
+	}
+	return certs, nil
+}
+
+// RootCertificates returns the CA certificates of all pools. Certificates
+// shared by multiple pools are only returned once.
+// For pools that fail, the certificates of their last successful call are
+// used. If any pool fails, the certificates are returned together with an
+// error wrapping ErrPartialResult. If no certificates are left, only the
+// error is returned.
+func (a *MultiAuthority) RootCertificates(ctx context.Context) ([]*x509.Certificate, error) {
+	a.guard.Lock()
+	defer a.guard.Unlock()
+
+	rootCAs := []*x509.Certificate{}
+	poolErrors := error(nil)
+	for _, pool := range a.pools {
+		poolRootCAs, err := pool.Authority.RootCertificates(ctx)
+		if err != nil {
+			poolErrors = errors.Join(poolErrors, fmt.Errorf("%s: %w", pool.Name, err))
+			poolRootCAs = a.lastRoots[pool.Name]
+		} else {
+			a.lastRoots[pool.Name] = poolRootCAs
+		}
+
+		for _, cert := range poolRootCAs {
+			isKnown := false
+			for _, knownCert := range rootCAs {
+				if bytes.Equal(cert.Raw, knownCert.Raw) {
+					isKnown = true
+					break
+				}
+			}
+			if !isKnown {
+				rootCAs = append(rootCAs, cert)
+			}
+		}
+	}
+
+	if poolErrors == nil {
+		return rootCAs, nil
+	}
+	if len(rootCAs) == 0 {
+		return nil, poolErrors
+	}
+	return rootCAs, errors.Join(ErrPartialResult, poolErrors)
+}
+
+// RevokeCertificate revokes the certificate in the pool that issued it.
+func (a *MultiAuthority) RevokeCertificate(ctx context.Context, hexSerial string, reason RevocationReason) error {
+	revokeErrors := error(nil)
+	for _, pool := range a.pools {
+		err := pool.Authority.RevokeCertificate(ctx, hexSerial, reason)
+		if err == nil {
+			return nil
+		}
+		if !isNotFoundError(err) {
+			revokeErrors = errors.Join(revokeErrors, fmt.Errorf("%s: %w", pool.Name, err))
+		}
+	}
+
+	if revokeErrors != nil {
+		return revokeErrors
+	}
+	return shared.NewErrorWithStatus(http.StatusNotFound, "certificate %s not found", hexSerial)
+}
+
+// RevocationLists returns the CRLs of all pools.
+// For pools that fail, the CRLs of their last successful call are used. If
+// any pool fails, the CRLs are returned together with an error wrapping
+// ErrPartialResult. If no CRLs are left, only the error is returned.
+func (a *MultiAuthority) RevocationLists(ctx context.Context) ([]x509.RevocationList, error) {
+	a.guard.Lock()
+	defer a.guard.Unlock()
+
+	lists := []x509.RevocationList{}
+	poolErrors := error(nil)
+
+	for _, pool := range a.pools {
+		poolLists, err := pool.Authority.RevocationLists(ctx)
+		if err != nil {
+			poolErrors = errors.Join(poolErrors, fmt.Errorf("%s: %w", pool.Name, err))
+			poolLists = a.lastLists[pool.Name]
+		} else {
+			a.lastLists[pool.Name] = poolLists
+		}
+		lists = append(lists, poolLists...)
+	}
+
+	if poolErrors == nil {
+		return lists, nil
+	}
+	if len(lists) == 0 {
+		return nil, poolErrors
+	}
+	return lists, errors.Join(ErrPartialResult, poolErrors)
+}
+
+// isNotFoundError returns true if the given error is a 404 error.
+func isNotFoundError(err error) bool {
+	var statusErr shared.ErrorWithStatus
+	return errors.As(err, &statusErr) && statusErr.Code == http.StatusNotFound
+}
@@ -0,0 +1,201 @@
+package certificates
+
+import (
+	"context"
+	"crypto/x509"
+	"identity-metadata-server/internal/shared"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// failingAuthority is an Authority that fails all calls with err. If err is
+// nil, calls are passed to the embedded Authority. Issuance waits for delay
+// or until the context is done.
+type failingAuthority struct {
+	Authority
+	err   error
+	delay time.Duration
+	calls int
+}
+
+func (a *failingAuthority) IssueCertificate(ctx context.Context, csrPEM []byte, lifetime time.Duration) ([]*x509.Certificate, error) {
+	a.calls++
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-time.After(a.delay):
+	}
+	if a.err != nil {
+		return nil, a.err
+	}
+	return a.Authority.IssueCertificate(ctx, csrPEM, lifetime)
+}
+
+func (a *failingAuthority) RootCertificates(ctx context.Context) ([]*x509.Certificate, error) {
+	if a.err != nil {
+		return nil, a.err
+	}
+	return a.Authority.RootCertificates(ctx)
+}
+
+func (a *failingAuthority) RevocationLists(ctx context.Context) ([]x509.RevocationList, error) {
+	if a.err != nil {
+		return nil, a.err
+	}
+	return a.Authority.RevocationLists(ctx)
+}
+
+// newTestCSR creates a PEM encoded client CSR for the given origin.
+func newTestCSR(t *testing.T, origin string) []byte {
+	keyPEM, err := CreateECPrivateKeyPEM(KeyStrengthNormal)
+	assert.NoError(t, err)
+	csrPEM, err := CreateClientCSR(keyPEM, "host.example.com", "host@example.com", []net.IP{net.ParseIP(origin)})
+	assert.NoError(t, err)
+	return csrPEM
+}
+
+func TestMultiAuthorityIssuance(t *testing.T) {
+	assert := assert.New(t)
+
+	_, regionA, _ := net.ParseCIDR("10.1.0.0/16")
+	_, regionB, _ := net.ParseCIDR("10.2.0.0/16")
+
+	poolA := newTestLocalAuthority(t)
+	poolB := newTestLocalAuthority(t)
+	fallback := newTestLocalAuthority(t)
+
+	authority, err := NewMultiAuthority([]AuthorityPool{
+		{Name: "fallback", Authority: fallback, Priority: 10},
+		{Name: "b", Authority: poolB, Priority: 0, Origins: []*net.IPNet{regionB}},
+		{Name: "a", Authority: poolA, Priority: 0, Origins: []*net.IPNet{regionA}},
+	}, time.Second)
+	assert.NoError(err)
+
+	issue := func(origin string) *x509.Certificate {
+		ctx := ContextWithOrigin(context.Background(), net.ParseIP(origin))
+		chain, err := authority.IssueCertificate(ctx, newTestCSR(t, "10.1.0.1"), time.Hour)
+		assert.NoError(err)
+		return chain[0]
+	}
+
+	roots, err := authority.RootCertificates(context.Background())
+	assert.NoError(err)
+	assert.Len(roots, 3)
+
+	// Routed by origin, unknown origins use the unrestricted pool
+	assert.NoError(issue("10.1.0.1").CheckSignatureFrom(poolA.certificate))
+	assert.NoError(issue("10.2.0.1").CheckSignatureFrom(poolB.certificate))
+	assert.NoError(issue("192.168.0.1").CheckSignatureFrom(fallback.certificate))
+
+	// Lookups and revocations find the issuing pool
+	cert := issue("10.2.0.1")
+	serial := SerialToHex(cert)
+	found, err := authority.GetCertificate(context.Background(), serial)
+	assert.NoError(err)
+	assert.True(cert.Equal(found))
+
+	assert.NoError(authority.RevokeCertificate(context.Background(), serial, RevocationReasonKeyCompromise))
+	crls, err := authority.RevocationLists(context.Background())
+	assert.NoError(err)
+	assert.Len(crls, 3)
+
+	_, err = authority.GetCertificate(context.Background(), "ff")
+	assert.True(isNotFoundError(err))
+}
+
+func TestMultiAuthorityFailover(t *testing.T) {
+	assert := assert.New(t)
+
+	unavailable := &failingAuthority{err: shared.NewErrorWithStatus(http.StatusServiceUnavailable, "unavailable")}
+	fallback := newTestLocalAuthority(t)
+
+	authority, err := NewMultiAuthority([]AuthorityPool{
+		{Name: "unavailable", Authority: unavailable, Priority: 0},
+		{Name: "fallback", Authority: fallback, Priority: 1},
+	}, time.Second)
+	assert.NoError(err)
+
+	chain, err := authority.IssueCertificate(context.Background(), newTestCSR(t, "10.1.0.1"), time.Hour)
+	assert.NoError(err)
+	assert.NoError(chain[0].CheckSignatureFrom(fallback.certificate))
+	assert.Equal(1, unavailable.calls)
+
+	// Trust roots and CRLs of reachable pools are returned together with
+	// the error
+	roots, err := authority.RootCertificates(context.Background())
+	assert.ErrorIs(err, ErrPartialResult)
+	assert.Len(roots, 1)
+
+	crls, err := authority.RevocationLists(context.Background())
+	assert.ErrorIs(err, ErrPartialResult)
+	assert.Len(crls, 1)
+
+	// Client errors are not retried with another pool
+	unavailable.err = shared.NewErrorWithStatus(http.StatusBadRequest, "invalid CSR")
+	_, err = authority.IssueCertificate(context.Background(), newTestCSR(t, "10.1.0.1"), time.Hour)
+	assert.ErrorIs(err, unavailable.err)
+
+	// All pools unavailable
+	unavailable.err = context.DeadlineExceeded
+	authority, err = NewMultiAuthority([]AuthorityPool{{Name: "unavailable", Authority: unavailable}}, 0)
+	assert.NoError(err)
+	_, err = authority.IssueCertificate(context.Background(), newTestCSR(t, "10.1.0.1"), time.Hour)
+	assert.True(IsUnavailableError(err))
+	assert.NotErrorIs(err, ErrPartialResult)
+
+	_, err = authority.RootCertificates(context.Background())
+	assert.Error(err)
+	assert.NotErrorIs(err, ErrPartialResult)
+}
+
+func TestMultiAuthorityLastKnown(t *testing.T) {
+	assert := assert.New(t)
+
+	flaky := &failingAuthority{Authority: newTestLocalAuthority(t)}
+	stable := newTestLocalAuthority(t)
+
+	authority, err := NewMultiAuthority([]AuthorityPool{
+		{Name: "flaky", Authority: flaky, Priority: 0},
+		{Name: "stable", Authority: stable, Priority: 1},
+	}, 0)
+	assert.NoError(err)
+
+	roots, err := authority.RootCertificates(context.Background())
+	assert.NoError(err)
+	assert.Len(roots, 2)
+	crls, err := authority.RevocationLists(context.Background())
+	assert.NoError(err)
+	assert.Len(crls, 2)
+
+	// The last known values of a failing pool are kept
+	flaky.err = shared.NewErrorWithStatus(http.StatusServiceUnavailable, "unavailable")
+	roots, err = authority.RootCertificates(context.Background())
+	assert.ErrorIs(err, ErrPartialResult)
+	assert.Len(roots, 2)
+	crls, err = authority.RevocationLists(context.Background())
+	assert.ErrorIs(err, ErrPartialResult)
+	assert.Len(crls, 2)
+}
+
+func TestMultiAuthorityPoolTimeout(t *testing.T) {
+	assert := assert.New(t)
+
+	slow := &failingAuthority{Authority: newTestLocalAuthority(t), delay: 100 * time.Millisecond}
+	fallback := &failingAuthority{Authority: newTestLocalAuthority(t), delay: 100 * time.Millisecond}
+
+	authority, err := NewMultiAuthority([]AuthorityPool{
+		{Name: "slow", Authority: slow, Priority: 0},
+		{Name: "fallback", Authority: fallback, Priority: 1},
+	}, 10*time.Millisecond)
+	assert.NoError(err)
+
+	// The timeout only applies to pools with a fallback
+	_, err = authority.IssueCertificate(context.Background(), newTestCSR(t, "10.1.0.1"), time.Hour)
+	assert.NoError(err)
+	assert.Equal(1, slow.calls)
+	assert.Equal(1, fallback.calls)
+}
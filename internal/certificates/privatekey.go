@@ -2,6 +2,7 @@ package certificates
 
 import (
 	"crypto/ecdsa"
+	"crypto/ed25519"
 	"crypto/elliptic"
 	"crypto/rand"
 	"crypto/rsa"
@@ -32,14 +33,12 @@ const (
 )
 
 // CreatePrivateKeyPEM generates a private key in PEM format based on the specified key type.
-// It currently supports ECDSA and RSA key types.
+// It supports ECDSA, RSA and ED25519 key types.
 // Returns the PEM encoded private key or an error if the key type is unsupported.
 func CreatePrivateKeyPEM(t KeyType, s KeyStrength) ([]byte, error) {
 	switch t {
 	case ED25519:
-		// we can use  "golang.org/x/crypto/ed25519" for this, but the standard
-		// library does not support x509 encoding for ED25519 keys yet.
-		return nil, errors.New("ED25519 key type is not supported yet")
+		return CreateED25519PrivateKeyPEM()
 	case ECDSA:
 		return CreateECPrivateKeyPEM(s)
 	case RSA:
@@ -105,3 +104,40 @@ func CreateRSAPrivateKeyPEM(s KeyStrength) ([]byte, error) {
 	privateKeyPEM := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: privKeyBytes})
 	return privateKeyPEM, nil
 }
+
+// CreateED25519PrivateKeyPEM generates an ED25519 private key in PEM format.
+// Returns the PKCS#8 encoded private key or an error if the key generation fails.
+// ED25519 keys have a fixed size, so there is no strength parameter.
+func CreateED25519PrivateKeyPEM() ([]byte, error) {
+	_, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+
+	privKeyBytes, err := x509.MarshalPKCS8PrivateKey(privateKey)
+	if err != nil {
+		return nil, err
+	}
+
+	privateKeyPEM := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: privKeyBytes})
+	return privateKeyPEM, nil
+}
+
+// ParsePrivateKeyPEM parses a PEM encoded PKCS#1, PKCS#8 or SEC 1 private key.
+func ParsePrivateKeyPEM(privateKeyPEM []byte) (any, error) {
+	block, _ := pem.Decode(privateKeyPEM)
+	if block == nil {
+		return nil, errors.New("failed to decode PEM block containing private key")
+	}
+
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		return x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "EC PRIVATE KEY":
+		return x509.ParseECPrivateKey(block.Bytes)
+	case "PRIVATE KEY":
+		return x509.ParsePKCS8PrivateKey(block.Bytes)
+	default:
+		return nil, errors.New("unsupported private key type")
+	}
+}
@@ -1,6 +1,8 @@
 package certificates
 
 import (
+	"crypto/ed25519"
+	"crypto/x509"
 	"encoding/pem"
 	"testing"
 
@@ -24,4 +26,16 @@ func TestCreatePrivateKeyPEM(t *testing.T) {
 
 	rsaKeyBlock, _ := pem.Decode(rsaKey)
 	assert.Equal("RSA PRIVATE KEY", rsaKeyBlock.Type)
+
+	// Test ED25519 key generation
+	edKey, err := CreatePrivateKeyPEM(ED25519, KeyStrengthNormal)
+	assert.NoError(err)
+	assert.NotNil(edKey)
+
+	edKeyBlock, _ := pem.Decode(edKey)
+	assert.Equal("PRIVATE KEY", edKeyBlock.Type)
+
+	parsedKey, err := x509.ParsePKCS8PrivateKey(edKeyBlock.Bytes)
+	assert.NoError(err)
+	assert.IsType(ed25519.PrivateKey{}, parsedKey)
 }
@@ -0,0 +1,117 @@
+package certificates
+
+import (
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// TrustCache stores the last root certificates and revocation lists fetched
+// from an Authority on disk, so they can be used if the authority cannot be
+// reached. Everything is stored in its original DER encoding, so signatures
+// can be verified again after loading.
+type TrustCache struct {
+	dir string
+}
+
+// NewTrustCache creates a cache in the given directory. The directory is
+// created if it does not exist.
+func NewTrustCache(dir string) (*TrustCache, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, errors.Join(err, fmt.Errorf("failed to create trust cache directory %s", dir))
+	}
+	return &TrustCache{dir: dir}, nil
+}
+
+// rootsPath returns the path of the cached root certificates.
+func (c *TrustCache) rootsPath() string {
+	return filepath.Join(c.dir, "roots.pem")
+}
+
+// revocationListsPath returns the path of the cached revocation lists.
+func (c *TrustCache) revocationListsPath() string {
+	return filepath.Join(c.dir, "crls.pem")
+}
+
+// write replaces the given file atomically.
+func (c *TrustCache) write(path string, data []byte) error {
+	tmpPath := path + ".tmp"
+	if err := os.WriteFile(tmpPath, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, path)
+}
+
+// StoreRootCertificates replaces the cached root certificates.
+func (c *TrustCache) StoreRootCertificates(certs []*x509.Certificate) error {
+	data := []byte{}
+	for _, cert := range certs {
+		data = append(data, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw})...)
+	}
+	return c.write(c.rootsPath(), data)
+}
+
+// RootCertificates returns the cached root certificates. Certificates that
+// are no CA or have expired at the given time are skipped. An error is
+// returned if no usable certificate is cached.
+func (c *TrustCache) RootCertificates(now time.Time) ([]*x509.Certificate, error) {
+	data, err := os.ReadFile(c.rootsPath())
+	if err != nil {
+		return nil, errors.Join(err, errors.New("failed to read cached root certificates"))
+	}
+
+	cached, err := ParseCertificatesPEM(data)
+	if len(cached) == 0 {
+		return nil, errors.Join(err, errors.New("failed to parse cached root certificates"))
+	}
+
+	roots := make([]*x509.Certificate, 0, len(cached))
+	for _, cert := range cached {
+		if cert.IsCA && now.After(cert.NotBefore) && now.Before(cert.NotAfter) {
+			roots = append(roots, cert)
+		}
+	}
+
+	if len(roots) == 0 {
+		return nil, fmt.Errorf("no valid root certificates found in %s", c.rootsPath())
+	}
+	return roots, nil
+}
+
+// StoreRevocationLists replaces the cached revocation lists.
+func (c *TrustCache) StoreRevocationLists(crls []x509.RevocationList) error {
+	data := []byte{}
+	for _, list := range crls {
+		data = append(data, pem.EncodeToMemory(&pem.Block{Type: "X509 CRL", Bytes: list.Raw})...)
+	}
+	return c.write(c.revocationListsPath(), data)
+}
+
+// RevocationLists returns the cached revocation lists that are signed by one
+// of the given root certificates. Lists with an invalid signature are skipped.
+func (c *TrustCache) RevocationLists(roots []*x509.Certificate) ([]x509.RevocationList, error) {
+	data, err := os.ReadFile(c.revocationListsPath())
+	if err != nil {
+		return nil, errors.Join(err, errors.New("failed to read cached revocation lists"))
+	}
+
+	cached, err := ParseRevocationListsPEM(data)
+	if len(cached) == 0 && err != nil {
+		return nil, errors.Join(err, errors.New("failed to parse cached revocation lists"))
+	}
+
+	crls := make([]x509.RevocationList, 0, len(cached))
+	for _, list := range cached {
+		for _, root := range roots {
+			if list.CheckSignatureFrom(root) == nil {
+				crls = append(crls, list)
+				break
+			}
+		}
+	}
+	return crls, nil
+}
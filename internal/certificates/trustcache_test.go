@@ -0,0 +1,52 @@
+package certificates
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTrustCache(t *testing.T) {
+	assert := assert.New(t)
+	ctx := context.Background()
+
+	cache, err := NewTrustCache(filepath.Join(t.TempDir(), "cache"))
+	assert.NoError(err)
+
+	// Nothing has been cached yet
+	_, err = cache.RootCertificates(time.Now())
+	assert.Error(err)
+
+	authority := newTestLocalAuthority(t)
+	roots, err := authority.RootCertificates(ctx)
+	assert.NoError(err)
+	crls, err := authority.RevocationLists(ctx)
+	assert.NoError(err)
+
+	assert.NoError(cache.StoreRootCertificates(roots))
+	assert.NoError(cache.StoreRevocationLists(crls))
+
+	cachedRoots, err := cache.RootCertificates(time.Now())
+	assert.NoError(err)
+	assert.Len(cachedRoots, 1)
+	assert.True(roots[0].Equal(cachedRoots[0]))
+
+	cachedCRLs, err := cache.RevocationLists(cachedRoots)
+	assert.NoError(err)
+	assert.Len(cachedCRLs, 1)
+	assert.Equal(crls[0].Raw, cachedCRLs[0].Raw)
+
+	// Expired roots are not used
+	_, err = cache.RootCertificates(time.Now().Add(48 * time.Hour))
+	assert.Error(err)
+
+	// CRLs not signed by the given roots are dropped
+	otherRoots, err := newTestLocalAuthority(t).RootCertificates(ctx)
+	assert.NoError(err)
+	cachedCRLs, err = cache.RevocationLists(otherRoots)
+	assert.NoError(err)
+	assert.Empty(cachedCRLs)
+}
@@ -1,5 +1,18 @@
 package shared
 
+import "time"
+
+// OAuth2 grant and token types used by the identity server token endpoint.
+const (
+	GrantTypeClientCredentials = "client_credentials"
+	GrantTypeTokenExchange     = "urn:ietf:params:oauth:grant-type:token-exchange"
+	TokenTypeJWT               = "urn:ietf:params:oauth:token-type:jwt"
+)
+
+// HeaderRenewBy is set by the identity server on responses to clients that
+// should renew their client certificate before the given RFC 3339 time.
+const HeaderRenewBy = "X-Renew-By"
+
 // https://cloud.google.com/iam/docs/reference/sts/rest/v1/TopLevel/token#request-body
 type TokenExchangeRequest struct {
 	GrantType          string `json:"grantType,omitempty"`
@@ -18,6 +31,63 @@ type HostTokenRequest struct {
 	Lifetime  string   `json:"lifetime,omitempty"`
 }
 
+// As defined in the identity server.
+// JoinToken may be empty if a bootstrap certificate is used.
+type EnrollRequest struct {
+	CSR       string `json:"csr"`
+	JoinToken string `json:"joinToken,omitempty"`
+}
+
+// As defined in the identity server.
+// An empty request revokes the certificate used to call the endpoint.
+// Serial, Host and Identity can only be used by revocation admins.
+type RevokeRequest struct {
+	Serial   string `json:"serial,omitempty"`
+	Host     string `json:"host,omitempty"`
+	Identity string `json:"identity,omitempty"`
+	Reason   string `json:"reason,omitempty"`
+}
+
+// As defined in the identity server.
+// If revoking one of the selected certificates fails, Error is set and
+// Revoked lists the certificates revoked before the failure.
+type RevokeResponse struct {
+	Revoked []string `json:"revoked"`
+	Error   string   `json:"error,omitempty"`
+}
+
+// As defined in the identity server.
+// Returned by /renew and /enroll if JSON is requested.
+// Certificate and the entries of Chain are PEM encoded.
+type CertificateResponse struct {
+	Certificate string    `json:"certificate"`
+	Chain       []string  `json:"chain"`
+	Serial      string    `json:"serial"`
+	NotBefore   time.Time `json:"notBefore"`
+	NotAfter    time.Time `json:"notAfter"`
+}
+
+// As defined in the identity server.
+// Sent to /spiffe/jwt-svid. Lifetime is optional, e.g. "5m".
+type JWTSVIDRequest struct {
+	Audiences []string `json:"audiences"`
+	Lifetime  string   `json:"lifetime,omitempty"`
+}
+
+// As defined in the identity server.
+// Returned by /spiffe/jwt-svid.
+type JWTSVIDResponse struct {
+	SPIFFEID  string    `json:"spiffeId"`
+	Token     string    `json:"token"`
+	ExpiresAt time.Time `json:"expiresAt"`
+}
+
+// https://datatracker.ietf.org/doc/html/rfc6749#section-5.2
+type OAuthErrorResponse struct {
+	Error            string `json:"error"`
+	ErrorDescription string `json:"error_description,omitempty"`
+}
+
 // https://cloud.google.com/iam/docs/reference/sts/rest/v1/TopLevel/token#response-body
 type TokenExchangeResponse struct {
 	AccessToken              string `json:"access_token,omitempty"`
@@ -11,7 +11,10 @@ import (
 	"identity-metadata-server/internal/certificates"
 	"identity-metadata-server/internal/shared"
 	"io"
+	"math/rand/v2"
+	"net"
 	"net/http"
+	"net/url"
 	"os"
 	"path/filepath"
 	"strconv"
@@ -38,7 +41,100 @@ type HostTokenProvider struct {
 	refreshCertTick *time.Ticker
 	tickerDone      chan struct{}
 
+	// useOAuthTokenEndpoint makes the provider request tokens through the
+	// OAuth2 token endpoint instead of the /token endpoint.
+	useOAuthTokenEndpoint bool
+
+	// enrollment is used to request the first client certificate if no
+	// client certificate exists yet.
+	enrollment *EnrollmentConfig
+
+	// renewalHostname and renewalAddresses replace the hostname and the IP
+	// addresses of the current certificate on renewal, if set.
+	renewalHostname  string
+	renewalAddresses []net.IP
+
+	// renewalHintJitter is the maximum delay of a refresh requested by a
+	// renewal hint of the identity server.
+	renewalHintJitter time.Duration
+	// hintedRefresh is set while a refresh requested by a renewal hint is
+	// scheduled. lastHintedRefresh is the time the last one was executed.
+	hintedRefresh     *time.Timer
+	lastHintedRefresh time.Time
+	hintGuard         *sync.Mutex
+
 	identityGuard *sync.Mutex
+	refreshGuard  *sync.Mutex
+}
+
+const (
+	// defaultRenewalHintJitter is used if WithRenewalHintJitter is not set.
+	defaultRenewalHintJitter = 5 * time.Minute
+	// renewalHintCooldown is the minimum time between two refreshes
+	// requested by renewal hints. This prevents renewal loops if the
+	// identity server keeps sending hints for new certificates.
+	renewalHintCooldown = 15 * time.Minute
+)
+
+// HostTokenProviderOption configures optional behavior of a HostTokenProvider.
+type HostTokenProviderOption func(*HostTokenProvider)
+
+// WithOAuthTokenEndpoint makes the provider request identity tokens with a
+// POST request to the OAuth2 token endpoint of the identity server.
+// By default, the /token endpoint is called with a GET request carrying a
+// JSON body, which is stripped or rejected by some proxies.
+func WithOAuthTokenEndpoint() HostTokenProviderOption {
+	return func(tp *HostTokenProvider) {
+		tp.useOAuthTokenEndpoint = true
+	}
+}
+
+// WithRenewalHintJitter sets the maximum random delay of a certificate
+// refresh requested by a renewal hint of the identity server. The delay
+// spreads the renewals of many hosts receiving the same hint.
+func WithRenewalHintJitter(jitter time.Duration) HostTokenProviderOption {
+	return func(tp *HostTokenProvider) {
+		tp.renewalHintJitter = jitter
+	}
+}
+
+// WithRenewalSubject requests the given hostname and IP addresses when the
+// client certificate is renewed. Empty values keep the values of the current
+// certificate. If they differ from the current certificate, the certificate
+// is renewed on the next refresh. Such renewals have to be approved on the
+// identity server and are retried on every refresh until they are.
+func WithRenewalSubject(hostname string, addresses []net.IP) HostTokenProviderOption {
+	return func(tp *HostTokenProvider) {
+		tp.renewalHostname = hostname
+		tp.renewalAddresses = addresses
+	}
+}
+
+// EnrollmentConfig holds everything needed to request the first client
+// certificate of a new host. Either JoinTokenPath or BootstrapCertPath and
+// BootstrapKeyPath have to be set.
+// Hostname, Identity and Addresses must match the join grant registered on
+// the identity server.
+type EnrollmentConfig struct {
+	// JoinTokenPath points to a file containing the single-use join token.
+	JoinTokenPath string
+	// BootstrapCertPath and BootstrapKeyPath point to a bootstrap
+	// certificate, used if no join token is given.
+	BootstrapCertPath string
+	BootstrapKeyPath  string
+
+	Hostname  string
+	Identity  string
+	Addresses []net.IP
+}
+
+// WithEnrollment makes the provider enroll the host at the identity server
+// if the client certificate does not exist yet. The generated key and the
+// issued certificate are stored at the client certificate and key paths.
+func WithEnrollment(config EnrollmentConfig) HostTokenProviderOption {
+	return func(tp *HostTokenProvider) {
+		tp.enrollment = &config
+	}
 }
 
 type hostIdentity struct {
@@ -52,7 +148,7 @@ func (h hostIdentity) Equal(other SourceIdentity) bool {
 }
 
 // NewKubernetesTokenProvider creates a new KubernetesToGCPTokenProvider.
-func NewHostTokenProvider(workloadIdentityAudience, identityServerURL, caCertPath, clientCertPath, clientKeyPath string, refreshInterval, clientCertMinLifetime time.Duration) (*HostTokenProvider, error) {
+func NewHostTokenProvider(workloadIdentityAudience, identityServerURL, caCertPath, clientCertPath, clientKeyPath string, refreshInterval, clientCertMinLifetime time.Duration, options ...HostTokenProviderOption) (*HostTokenProvider, error) {
 	if caCertPath != "" {
 		// Load the CA certificate
 		// The certificate is expected to be in PEM format
@@ -61,6 +157,37 @@ func NewHostTokenProvider(workloadIdentityAudience, identityServerURL, caCertPat
 		}
 	}
 
+	provider := &HostTokenProvider{
+		GcpTokenProvider: GcpTokenProvider{
+			metrics: shared.NewAPIMetrics("metadata_server_host", map[string]string{}),
+		},
+		mainAudience:    workloadIdentityAudience,
+		serverUrl:       identityServerURL,
+		clientCertPath:  clientCertPath,
+		clientKeyPath:   clientKeyPath,
+		identityGuard:   new(sync.Mutex),
+		refreshGuard:    new(sync.Mutex),
+		hintGuard:       new(sync.Mutex),
+		tickerDone:      make(chan struct{}),
+		certMinLifetime: clientCertMinLifetime,
+
+		renewalHintJitter: defaultRenewalHintJitter,
+	}
+
+	for _, option := range options {
+		option(provider)
+	}
+
+	// New hosts need to enroll before they can load their client certificate
+	if provider.enrollment != nil {
+		if _, err := os.Stat(clientCertPath); os.IsNotExist(err) {
+			log.Info().Str("path", clientCertPath).Msg("No client certificate found, enrolling host")
+			if err := provider.Enroll(context.Background()); err != nil {
+				return nil, errors.Join(err, errors.New("failed to enroll host"))
+			}
+		}
+	}
+
 	clientCert, err := tls.LoadX509KeyPair(clientCertPath, clientKeyPath)
 	if err != nil {
 		return nil, errors.Join(err, errors.New("failed to load client certificate"))
@@ -82,20 +209,8 @@ func NewHostTokenProvider(workloadIdentityAudience, identityServerURL, caCertPat
 		return nil, fmt.Errorf("client certificate min lifetime of %s is shorter than or equal to the total certificate lifetime of %s", clientCertMinLifetime.String(), certLifetime.String())
 	}
 
-	provider := &HostTokenProvider{
-		GcpTokenProvider: GcpTokenProvider{
-			metrics: shared.NewAPIMetrics("metadata_server_host", map[string]string{}),
-		},
-		mainAudience:    workloadIdentityAudience,
-		serverUrl:       identityServerURL,
-		certificate:     clientCert,
-		clientCertPath:  clientCertPath,
-		clientKeyPath:   clientKeyPath,
-		identityGuard:   new(sync.Mutex),
-		refreshCertTick: time.NewTicker(refreshInterval),
-		tickerDone:      make(chan struct{}),
-		certMinLifetime: clientCertMinLifetime,
-	}
+	provider.certificate = clientCert
+	provider.refreshCertTick = time.NewTicker(refreshInterval)
 
 	// Always try to refresh the certificate on startup
 	err = provider.TryRefreshCertificate()
@@ -130,6 +245,71 @@ func (tp *HostTokenProvider) Close() {
 	// to let the goroutine stop the ticker. Stop() does not close the ticker
 	// channel, i.e. the goroutine would block forever.
 	close(tp.tickerDone)
+
+	tp.hintGuard.Lock()
+	defer tp.hintGuard.Unlock()
+	if tp.hintedRefresh != nil {
+		tp.hintedRefresh.Stop()
+		tp.hintedRefresh = nil
+	}
+}
+
+// observeRenewalHint schedules a certificate refresh if the given response of
+// the identity server asks for an early renewal. The refresh is delayed by a
+// random jitter, but not beyond the requested renew-by time.
+func (tp *HostTokenProvider) observeRenewalHint(rsp *http.Response) {
+	if rsp == nil {
+		return
+	}
+
+	value := rsp.Header.Get(shared.HeaderRenewBy)
+	if len(value) == 0 {
+		return
+	}
+
+	renewBy, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		log.Warn().Err(err).Str("value", value).Msg("Invalid renewal hint returned by identity server")
+		return
+	}
+
+	tp.hintGuard.Lock()
+	defer tp.hintGuard.Unlock()
+
+	select {
+	case <-tp.tickerDone:
+		return // closed
+	default:
+	}
+
+	if tp.hintedRefresh != nil || time.Since(tp.lastHintedRefresh) < renewalHintCooldown {
+		return
+	}
+
+	window := tp.renewalHintJitter
+	if untilRenewBy := time.Until(renewBy); untilRenewBy > 0 && untilRenewBy < window {
+		window = untilRenewBy
+	}
+	delay := time.Duration(0)
+	if window > 0 {
+		delay = rand.N(window)
+	}
+
+	log.Info().
+		Time("renewBy", renewBy).
+		Dur("delay", delay).
+		Msg("Identity server requested an early certificate renewal")
+
+	tp.hintedRefresh = time.AfterFunc(delay, func() {
+		if err := tp.refreshCertificate(true); err != nil {
+			log.Error().Err(err).Msg("Failed to refresh certificate as requested by identity server")
+		}
+
+		tp.hintGuard.Lock()
+		defer tp.hintGuard.Unlock()
+		tp.hintedRefresh = nil
+		tp.lastHintedRefresh = time.Now()
+	})
 }
 
 // ClearIdentityCache clears the cached identity.
@@ -157,6 +337,7 @@ func (tp *HostTokenProvider) GetIdentityForIP(ctx context.Context, ip string) So
 	rsp, err := shared.HttpGET(tp.serverUrl+"/identity", nil, nil, &tp.certificate, 2, ctx)
 
 	tp.metrics.TrackCallResponse(tp.serverUrl, metricPath, requestStart, rsp, err)
+	tp.observeRenewalHint(rsp)
 	if err != nil {
 		log.Error().Err(err).Msg("Failed to get identity for current host")
 		return hostIdentity{}
@@ -251,9 +432,61 @@ func (tp *HostTokenProvider) getSignedRequestToken(ctx context.Context, requestT
 		audiences = append(audiences, additionalAudiences...)
 	}
 
+	var (
+		oidcToken []byte
+		err       error
+	)
+	if tp.useOAuthTokenEndpoint {
+		oidcToken, err = tp.requestOAuthIdentityToken(ctx, audiences, requestTokenLifetime)
+	} else {
+		oidcToken, err = tp.requestIdentityToken(ctx, audiences, requestTokenLifetime)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// We need to add the identity token scope if it is not already present.
+	// Otherwise we cannot impersonate the service account.
+	scopes = shared.AssureIdentityScope(scopes)
+
+	tokenRequest := shared.TokenExchangeRequest{
+		Audience:           tp.mainAudience,
+		GrantType:          "urn:ietf:params:oauth:grant-type:token-exchange",
+		RequestedTokenType: "urn:ietf:params:oauth:token-type:access_token",
+		Scope:              strings.Join(scopes, " "), // see endpoint reference below
+		SubjectToken:       string(oidcToken),
+		SubjectTokenType:   "urn:ietf:params:oauth:token-type:jwt",
+		LifetimeSec:        strconv.Itoa(int(requestTokenLifetime.Seconds())),
+	}
+
+	tokenRequestBody, err := jsoniter.Marshal(tokenRequest)
+	if err != nil {
+		log.Error().Msg("Failed to marshal token request")
+		return nil, shared.WrapErrorWithStatus(err, http.StatusBadRequest)
+	}
+
+	requestStart := time.Now()
+
+	// See https://cloud.google.com/iam/docs/reference/sts/rest/v1/TopLevel/token
+	rsp, err := shared.HttpPOST("https://"+shared.EndpointSTS+"/token",
+		tokenRequestBody,
+		map[string]string{
+			"Content-Type": "application/json",
+		},
+		nil, 2, ctx)
+
+	tp.metrics.TrackCallResponse(shared.EndpointSTS, metricPath, requestStart, rsp, err)
+	return rsp, err
+}
+
+// requestIdentityToken requests an identity token for the given audiences
+// from the /token endpoint of the identity server.
+func (tp *HostTokenProvider) requestIdentityToken(ctx context.Context, audiences []string, lifetime time.Duration) ([]byte, error) {
+	const metricPath = "request_token"
+
 	identityTokenRequest, err := jsoniter.Marshal(shared.HostTokenRequest{
 		Audiences: audiences,
-		Lifetime:  requestTokenLifetime.String(),
+		Lifetime:  lifetime.String(),
 	})
 	if err != nil {
 		log.Error().Err(err).Msg("Failed to marshal identity server token request")
@@ -264,6 +497,7 @@ func (tp *HostTokenProvider) getSignedRequestToken(ctx context.Context, requestT
 	oidcTokenRsp, err := shared.HttpGET(tp.serverUrl+"/token", identityTokenRequest, nil, &tp.certificate, 2, ctx)
 
 	tp.metrics.TrackCallResponse(tp.serverUrl, metricPath, requestStart, oidcTokenRsp, err)
+	tp.observeRenewalHint(oidcTokenRsp)
 	if err != nil {
 		log.Error().Err(err).Msg("Failed to get identity token")
 		return nil, shared.WrapErrorWithStatus(err, http.StatusInternalServerError)
@@ -283,48 +517,80 @@ func (tp *HostTokenProvider) getSignedRequestToken(ctx context.Context, requestT
 		return nil, shared.WrapErrorWithStatus(err, oidcTokenRsp.StatusCode)
 	}
 
-	// We need to add the identity token scope if it is not already present.
-	// Otherwise we cannot impersonate the service account.
-	scopes = shared.AssureIdentityScope(scopes)
+	return oidcTokenBody, nil
+}
 
-	tokenRequest := shared.TokenExchangeRequest{
-		Audience:           tp.mainAudience,
-		GrantType:          "urn:ietf:params:oauth:grant-type:token-exchange",
-		RequestedTokenType: "urn:ietf:params:oauth:token-type:access_token",
-		Scope:              strings.Join(scopes, " "), // see endpoint reference below
-		SubjectToken:       string(oidcTokenBody),
-		SubjectTokenType:   "urn:ietf:params:oauth:token-type:jwt",
-		LifetimeSec:        strconv.Itoa(int(requestTokenLifetime.Seconds())),
+// requestOAuthIdentityToken requests an identity token for the given audiences
+// from the OAuth2 token endpoint of the identity server.
+func (tp *HostTokenProvider) requestOAuthIdentityToken(ctx context.Context, audiences []string, lifetime time.Duration) ([]byte, error) {
+	const metricPath = "oauth2_token"
+
+	form := url.Values{
+		"grant_type": {shared.GrantTypeClientCredentials},
+		"audience":   audiences,
+		"lifetime":   {lifetime.String()},
 	}
 
-	tokenRequestBody, err := jsoniter.Marshal(tokenRequest)
+	requestStart := time.Now()
+	rsp, err := shared.HttpPOST(tp.serverUrl+"/oauth2/token",
+		[]byte(form.Encode()),
+		map[string]string{
+			"Content-Type": "application/x-www-form-urlencoded",
+			"Accept":       "application/json",
+		},
+		&tp.certificate, 2, ctx)
+
+	tp.metrics.TrackCallResponse(tp.serverUrl, metricPath, requestStart, rsp, err)
+	tp.observeRenewalHint(rsp)
 	if err != nil {
-		log.Error().Msg("Failed to marshal token request")
-		return nil, shared.WrapErrorWithStatus(err, http.StatusBadRequest)
+		log.Error().Err(err).Msg("Failed to get identity token")
+		return nil, shared.WrapErrorWithStatus(err, http.StatusInternalServerError)
 	}
+	defer func() { _ = rsp.Body.Close() }()
 
-	requestStart = time.Now()
+	if rsp.StatusCode != http.StatusOK {
+		oauthErr := shared.OAuthErrorResponse{}
+		body, _ := shared.ReadBodyWithLimit(rsp, 32*1024)
+		if err := json.Unmarshal(body, &oauthErr); err != nil || len(oauthErr.Error) == 0 {
+			oauthErr.ErrorDescription = string(body)
+		}
 
-	// See https://cloud.google.com/iam/docs/reference/sts/rest/v1/TopLevel/token
-	rsp, err := shared.HttpPOST("https://"+shared.EndpointSTS+"/token",
-		tokenRequestBody,
-		map[string]string{
-			"Content-Type": "application/json",
-		},
-		nil, 2, ctx)
+		err := fmt.Errorf("%s: %s", oauthErr.Error, oauthErr.ErrorDescription)
+		log.Error().Err(err).Msg("Identity token request failed")
+		return nil, shared.WrapErrorWithStatus(err, rsp.StatusCode)
+	}
 
-	tp.metrics.TrackCallResponse(shared.EndpointSTS, metricPath, requestStart, rsp, err)
-	return rsp, err
+	tokenRsp := shared.TokenExchangeResponse{}
+	if err := json.NewDecoder(rsp.Body).Decode(&tokenRsp); err != nil {
+		log.Error().Err(err).Msg("Failed to read identity token response")
+		return nil, shared.WrapErrorWithStatus(err, http.StatusInternalServerError)
+	}
+
+	if len(tokenRsp.AccessToken) == 0 {
+		log.Error().Msg("Identity server returned an empty token")
+		return nil, shared.NewErrorWithStatus(http.StatusInternalServerError, "empty token returned by identity server")
+	}
+
+	return []byte(tokenRsp.AccessToken), nil
 }
 
+// TryRefreshCertificate renews the client certificate if its remaining
+// lifetime is below the minimum lifetime.
 func (tp *HostTokenProvider) TryRefreshCertificate() error {
+	return tp.refreshCertificate(false)
+}
+
+// refreshCertificate renews the client certificate. Unless force is set, the
+// certificate is only renewed if its remaining lifetime is below the minimum
+// lifetime.
+func (tp *HostTokenProvider) refreshCertificate(force bool) error {
 	const metricPath = "renew"
 
-	// As we're calling this function in long intervals, a short lock like this
-	// is currently considered ok.
-	// If we ever expose this function via a REST API, we need to
-	// make sure we have a proper locking mechanism in place to avoid
-	// this function being called multiple times in parallel.
+	// The refresh ticker and renewal hints may trigger a refresh at the
+	// same time, so only one refresh is executed at a time.
+	tp.refreshGuard.Lock()
+	defer tp.refreshGuard.Unlock()
+
 	tp.identityGuard.Lock()
 	oldCert := tp.certificate.Leaf
 	tp.identityGuard.Unlock()
@@ -334,7 +600,11 @@ func (tp *HostTokenProvider) TryRefreshCertificate() error {
 		return fmt.Errorf("client certificate already expired %s ago. A manual refresh is needed", -remaining)
 	}
 
-	if remaining > tp.certMinLifetime {
+	hostname, addresses := tp.renewalSubject(oldCert)
+	subjectChanged := hostname != oldCert.Subject.CommonName ||
+		!shared.EqualUnorderedFunc(addresses, oldCert.IPAddresses, func(a, b net.IP) bool { return a.Equal(b) })
+
+	if !force && !subjectChanged && remaining > tp.certMinLifetime {
 		log.Info().Msg("Certificate is still valid, no need to refresh")
 		return nil
 	}
@@ -371,8 +641,12 @@ func (tp *HostTokenProvider) TryRefreshCertificate() error {
 		return errors.Join(err, errors.New("failed to check private key"))
 	}
 
-	// Create a CSR from the current certificate
-	csr, err := certificates.CreateClientCSRFromCertificate(privateKeyPEM, tp.certificate.Leaf)
+	// Create a CSR for the current certificate with the requested subject
+	email := ""
+	if len(oldCert.EmailAddresses) > 0 {
+		email = oldCert.EmailAddresses[0]
+	}
+	csr, err := certificates.CreateClientCSR(privateKeyPEM, hostname, email, addresses)
 	if err != nil {
 		return errors.Join(err, errors.New("failed to create CSR"))
 	}
@@ -390,7 +664,17 @@ func (tp *HostTokenProvider) TryRefreshCertificate() error {
 	}
 
 	defer func() { _ = rsp.Body.Close() }()
-	if rsp.StatusCode != http.StatusOK {
+	switch rsp.StatusCode {
+	case http.StatusOK:
+	case http.StatusAccepted:
+		// The private key is kept on disk, so the same request is sent
+		// again on the next refresh.
+		log.Info().
+			Str("hostname", hostname).
+			Any("addresses", addresses).
+			Msg("Certificate renewal is pending approval on the identity server")
+		return nil
+	default:
 		body, _ := io.ReadAll(rsp.Body)
 		return errors.Join(errors.New(string(body)), errors.New("failed to get new certificate from identity server"))
 	}
@@ -400,11 +684,50 @@ func (tp *HostTokenProvider) TryRefreshCertificate() error {
 		return errors.Join(err, errors.New("failed to read new certificate"))
 	}
 
+	clientCert, err := tp.installCertificate(newCertPEM, privateKeyPEM, keyFilePath, fileSuffix)
+	if err != nil {
+		return err
+	}
+
+	// Everything is fine, we can use the new certificate.
+	// Make sure to use the identity guard so we wait for
+	// any ongoing identity server requests to finish.
+	tp.identityGuard.Lock()
+	defer tp.identityGuard.Unlock()
+
+	tp.certificate = clientCert
+	return nil
+}
+
+// renewalSubject returns the hostname and IP addresses to request when
+// renewing the given certificate.
+func (tp *HostTokenProvider) renewalSubject(cert *x509.Certificate) (string, []net.IP) {
+	hostname, addresses := cert.Subject.CommonName, cert.IPAddresses
+	if len(tp.renewalHostname) > 0 {
+		hostname = tp.renewalHostname
+	}
+	if len(tp.renewalAddresses) > 0 {
+		addresses = tp.renewalAddresses
+	}
+	return hostname, addresses
+}
+
+// installCertificate writes the new certificate to disk and points the
+// client certificate and key symlinks to the new files.
+// newCertPEM may contain the CA certificates of the client certificate, which
+// are stored in the same file after the client certificate, so the full chain
+// is sent to the identity server.
+// The private key is expected to be stored at keyFilePath already.
+func (tp *HostTokenProvider) installCertificate(newCertPEM, privateKeyPEM []byte, keyFilePath, fileSuffix string) (tls.Certificate, error) {
 	// Create a new keypair. This will also validate the certificate
 	// and make sure it is valid.
 	clientCert, err := tls.X509KeyPair(newCertPEM, privateKeyPEM)
 	if err != nil {
-		return errors.Join(err, errors.New("failed to create new client certificate"))
+		return tls.Certificate{}, errors.Join(err, errors.New("failed to create new client certificate"))
+	}
+
+	if err := verifyChainOrder(clientCert); err != nil {
+		return tls.Certificate{}, errors.Join(err, errors.New("invalid certificate chain"))
 	}
 
 	// Write the new certificate to disk
@@ -414,7 +737,7 @@ func (tp *HostTokenProvider) TryRefreshCertificate() error {
 	log.Info().Str("path", certFilePath).Msg("Writing new client certificate to disk")
 
 	if err := os.WriteFile(certFilePath, newCertPEM, 0644); err != nil {
-		return errors.Join(err, errors.New("failed to write new client certificate"))
+		return tls.Certificate{}, errors.Join(err, errors.New("failed to write new client certificate"))
 	}
 
 	// Rotate the symlinks for the client certificate and key.
@@ -425,12 +748,116 @@ func (tp *HostTokenProvider) TryRefreshCertificate() error {
 	rotateFiles.Add(tp.clientKeyPath, keyFilePath)
 
 	if err := shared.RotateSymlinkList(rotateFiles); err != nil {
-		return errors.Join(err, errors.New("failed to rotate symlinks for new certificate"))
+		return tls.Certificate{}, errors.Join(err, errors.New("failed to rotate symlinks for new certificate"))
+	}
+
+	return clientCert, nil
+}
+
+// verifyChainOrder checks that every certificate of the given chain is signed
+// by the certificate following it.
+func verifyChainOrder(clientCert tls.Certificate) error {
+	chain := []*x509.Certificate{clientCert.Leaf}
+	for _, certDER := range clientCert.Certificate[1:] {
+		cert, err := x509.ParseCertificate(certDER)
+		if err != nil {
+			return err
+		}
+		chain = append(chain, cert)
+	}
+
+	for i := 1; i < len(chain); i++ {
+		if err := chain[i-1].CheckSignatureFrom(chain[i]); err != nil {
+			return fmt.Errorf("certificate %q is not signed by %q: %w", chain[i-1].Subject, chain[i].Subject, err)
+		}
+	}
+	return nil
+}
+
+// Enroll requests the first client certificate for this host using the
+// configured join token or bootstrap certificate. A new private key is
+// created for the certificate. Both are stored at the client certificate
+// and key paths.
+func (tp *HostTokenProvider) Enroll(ctx context.Context) error {
+	const metricPath = "enroll"
+
+	if tp.enrollment == nil {
+		return errors.New("enrollment is not configured")
+	}
+
+	request := shared.EnrollRequest{}
+	var bootstrapCert *tls.Certificate
+
+	switch {
+	case len(tp.enrollment.JoinTokenPath) > 0:
+		joinToken, err := os.ReadFile(tp.enrollment.JoinTokenPath)
+		if err != nil {
+			return errors.Join(err, errors.New("failed to read join token"))
+		}
+		request.JoinToken = strings.TrimSpace(string(joinToken))
+
+	case len(tp.enrollment.BootstrapCertPath) > 0:
+		cert, err := tls.LoadX509KeyPair(tp.enrollment.BootstrapCertPath, tp.enrollment.BootstrapKeyPath)
+		if err != nil {
+			return errors.Join(err, errors.New("failed to load bootstrap certificate"))
+		}
+		bootstrapCert = &cert
+
+	default:
+		return errors.New("enrollment requires a join token or a bootstrap certificate")
+	}
+
+	fileSuffix := time.Now().Format("20060102150405")
+	keyFilePath := filepath.Join(filepath.Dir(tp.clientKeyPath), fmt.Sprintf("client.key.%s", fileSuffix))
+
+	privateKeyPEM, err := certificates.CreatePrivateKeyPEM(certificates.ECDSA, certificates.KeyStrengthMedium)
+	if err != nil {
+		return errors.Join(err, errors.New("failed to create private key"))
+	}
+
+	csr, err := certificates.CreateClientCSR(privateKeyPEM, tp.enrollment.Hostname, tp.enrollment.Identity, tp.enrollment.Addresses)
+	if err != nil {
+		return errors.Join(err, errors.New("failed to create CSR"))
+	}
+	request.CSR = string(csr)
+
+	requestBody, err := jsoniter.Marshal(request)
+	if err != nil {
+		return errors.Join(err, errors.New("failed to marshal enrollment request"))
+	}
+
+	requestStart := time.Now()
+	rsp, err := shared.HttpPOST(tp.serverUrl+"/enroll", requestBody, map[string]string{
+		"Content-Type": "application/json",
+		"Accept":       "application/x-pem-file",
+	}, bootstrapCert, 2, ctx)
+
+	tp.metrics.TrackCallResponse(tp.serverUrl, metricPath, requestStart, rsp, err)
+	if err != nil {
+		return errors.Join(err, errors.New("failed to enroll at identity server"))
+	}
+
+	defer func() { _ = rsp.Body.Close() }()
+	if rsp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(rsp.Body)
+		return errors.Join(errors.New(string(body)), errors.New("identity server rejected enrollment"))
+	}
+
+	newCertPEM, err := io.ReadAll(rsp.Body)
+	if err != nil {
+		return errors.Join(err, errors.New("failed to read new certificate"))
+	}
+
+	log.Info().Str("path", keyFilePath).Msg("Writing new private key to disk")
+	if err := os.WriteFile(keyFilePath, privateKeyPEM, 0600); err != nil {
+		return errors.Join(err, errors.New("failed to write private key"))
+	}
+
+	clientCert, err := tp.installCertificate(newCertPEM, privateKeyPEM, keyFilePath, fileSuffix)
+	if err != nil {
+		return err
 	}
 
-	// Everything is fine, we can use the new certificate.
-	// Make sure to use the identity guard so we wait for
-	// any ongoing identity server requests to finish.
 	tp.identityGuard.Lock()
 	defer tp.identityGuard.Unlock()
 
@@ -16,10 +16,15 @@ import (
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"path/filepath"
 	"strconv"
+	"strings"
 	"testing"
 	"time"
 
+	"identity-metadata-server/internal/certificates"
+	"identity-metadata-server/internal/shared"
+
 	"github.com/gin-gonic/gin"
 	"github.com/stretchr/testify/assert"
 )
@@ -39,6 +44,16 @@ type hostProviderTestContext struct {
 
 	ca    *x509.Certificate
 	caKey *rsa.PrivateKey
+
+	// hintFirstCert makes the mock server send a renewal hint to clients
+	// using the first certificate.
+	hintFirstCert bool
+
+	// pendingRenewals is the number of renewals answered as pending before
+	// a certificate is issued. renewKeys holds the public keys of all
+	// renewal requests.
+	pendingRenewals int
+	renewKeys       [][]byte
 }
 
 func (t *hostProviderTestContext) Add(name string, data []byte) error {
@@ -168,6 +183,18 @@ func NewMockIdentityServer(testContext *hostProviderTestContext) (*httptest.Serv
 			return
 		}
 
+		if block, _ := pem.Decode(csrPEM); block != nil {
+			if csr, err := x509.ParseCertificateRequest(block.Bytes); err == nil {
+				testContext.renewKeys = append(testContext.renewKeys, csr.RawSubjectPublicKeyInfo)
+			}
+		}
+
+		if testContext.pendingRenewals > 0 {
+			testContext.pendingRenewals--
+			c.JSON(http.StatusAccepted, gin.H{"id": "pending"})
+			return
+		}
+
 		certPEM, err := NewClientCertFromCSR(csrPEM, testContext.ca, testContext.caKey)
 		if err != nil {
 			c.String(http.StatusBadRequest, "failed to create client cert")
@@ -176,6 +203,29 @@ func NewMockIdentityServer(testContext *hostProviderTestContext) (*httptest.Serv
 		c.Header("Content-Type", "application/x-pem-file")
 		c.Header("Content-Disposition", "attachment; filename=cert.pem")
 
+		// Return the full chain like the identity server
+		c.String(http.StatusOK, string(certPEM)+caPEM.String())
+	})
+
+	// Issue a certificate for the join token "secret" or any bootstrap
+	// certificate signed by the test CA
+	router.POST("/enroll", func(c *gin.Context) {
+		request := shared.EnrollRequest{}
+		if err := c.BindJSON(&request); err != nil {
+			return
+		}
+
+		hasBootstrapCert := c.Request.TLS != nil && len(c.Request.TLS.PeerCertificates) > 0
+		if request.JoinToken != "secret" && !hasBootstrapCert {
+			c.String(http.StatusUnauthorized, "invalid join token")
+			return
+		}
+
+		certPEM, err := NewClientCertFromCSR([]byte(request.CSR), testContext.ca, testContext.caKey)
+		if err != nil {
+			c.String(http.StatusBadRequest, "failed to create client cert")
+			return
+		}
 		c.String(http.StatusOK, string(certPEM))
 	})
 
@@ -186,9 +236,30 @@ func NewMockIdentityServer(testContext *hostProviderTestContext) (*httptest.Serv
 			c.String(http.StatusBadRequest, "no client cert")
 			return
 		}
+		if testContext.hintFirstCert && c.Request.TLS.PeerCertificates[0].SerialNumber.Int64() == firstCertSerial {
+			c.Header(shared.HeaderRenewBy, time.Now().Format(time.RFC3339))
+		}
 		c.String(http.StatusOK, c.Request.TLS.PeerCertificates[0].SerialNumber.String()+"\n")
 	})
 
+	// Return the client certificate serial number as token
+	// This is used to verify that the OAuth2 request is well formed
+	router.POST("/oauth2/token", func(c *gin.Context) {
+		if c.Request.TLS == nil || len(c.Request.TLS.PeerCertificates) == 0 {
+			c.JSON(http.StatusUnauthorized, shared.OAuthErrorResponse{Error: "invalid_client"})
+			return
+		}
+		if c.PostForm("grant_type") != shared.GrantTypeClientCredentials || len(c.PostFormArray("audience")) == 0 {
+			c.JSON(http.StatusBadRequest, shared.OAuthErrorResponse{Error: "invalid_request"})
+			return
+		}
+		c.JSON(http.StatusOK, shared.TokenExchangeResponse{
+			AccessToken: c.Request.TLS.PeerCertificates[0].SerialNumber.String() + "/" + strings.Join(c.PostFormArray("audience"), ","),
+			ExpiresIn:   600,
+			TokenType:   "Bearer",
+		})
+	})
+
 	certPool := x509.NewCertPool()
 	certPool.AppendCertsFromPEM(caPEM.Bytes())
 
@@ -222,6 +293,7 @@ func NewClientCertFromCSR(csrPEM []byte, ca *x509.Certificate, caKey *rsa.Privat
 		NotBefore:             time.Now(),
 		NotAfter:              time.Now().Add(time.Hour),
 		DNSNames:              csr.DNSNames,
+		IPAddresses:           csr.IPAddresses,
 		KeyUsage:              x509.KeyUsageDigitalSignature,
 		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
 		EmailAddresses:        csr.EmailAddresses,
@@ -400,6 +472,14 @@ func TestHostTokenProviderRenew(t *testing.T) {
 	// The mock server will return the new cert serial number
 	identity = provider.GetIdentityForIP(context.Background(), "127.0.0.1")
 	assert.Equal(strconv.Itoa(newCertSerial), identity.GetBoundGSA())
+
+	// The chain is stored after the client certificate
+	certPEM, err := os.ReadFile(files.path[fileIdClientCert])
+	assert.NoError(err)
+	chain, err := certificates.ParseCertificatesPEM(certPEM)
+	assert.NoError(err)
+	assert.Len(chain, 2)
+	assert.True(chain[1].IsCA)
 }
 
 func TestHostTokenProviderAutoRenew(t *testing.T) {
@@ -444,3 +524,238 @@ func TestHostTokenProviderAutoRenew(t *testing.T) {
 	identity = provider.GetIdentityForIP(context.Background(), "127.0.0.1")
 	assert.Equal(strconv.Itoa(newCertSerial), identity.GetBoundGSA())
 }
+
+func TestHostTokenProviderRenewalHint(t *testing.T) {
+	assert := assert.New(t)
+	files := &hostProviderTestContext{
+		path:          make(map[string]string),
+		hintFirstCert: true,
+	}
+	defer files.Clean()
+
+	srv, err := NewMockIdentityServer(files)
+	assert.NoError(err)
+	defer srv.Close()
+
+	err = NewMockClientCert(files)
+	assert.NoError(err)
+
+	// The certificate is far from its minimum lifetime
+	provider, err := NewHostTokenProvider(
+		"test",
+		srv.URL,
+		files.path[fileIdCACert],
+		files.path[fileIdClientCert],
+		files.path[fileIdClientKey],
+		time.Hour,
+		time.Minute,
+		WithRenewalHintJitter(100*time.Millisecond))
+
+	assert.NoError(err)
+	assert.NotNil(provider)
+	defer provider.Close()
+
+	// The response carries the hint, which schedules the refresh
+	identity := provider.GetIdentityForIP(context.Background(), "127.0.0.1")
+	assert.Equal(strconv.Itoa(firstCertSerial), identity.GetBoundGSA())
+
+	assert.Eventually(func() bool {
+		provider.ClearIdentityCache()
+		identity := provider.GetIdentityForIP(context.Background(), "127.0.0.1")
+		return identity.GetBoundGSA() == strconv.Itoa(newCertSerial)
+	}, 5*time.Second, 200*time.Millisecond)
+}
+
+func TestHostTokenProviderRenewalSubject(t *testing.T) {
+	assert := assert.New(t)
+	files := &hostProviderTestContext{
+		path:            make(map[string]string),
+		pendingRenewals: 2,
+	}
+	defer files.Clean()
+
+	srv, err := NewMockIdentityServer(files)
+	assert.NoError(err)
+	defer srv.Close()
+
+	err = NewMockClientCert(files)
+	assert.NoError(err)
+
+	// The certificate is far from its minimum lifetime
+	newAddresses := []net.IP{net.IPv4(127, 0, 0, 1), net.IPv4(10, 0, 0, 1)}
+	provider, err := NewHostTokenProvider(
+		"test",
+		srv.URL,
+		files.path[fileIdCACert],
+		files.path[fileIdClientCert],
+		files.path[fileIdClientKey],
+		time.Hour,
+		time.Minute,
+		WithRenewalSubject("", newAddresses))
+
+	assert.NoError(err)
+	assert.NotNil(provider)
+	defer provider.Close()
+
+	// The renewals on startup and on the first refresh are pending, the
+	// current certificate is kept
+	assert.NoError(provider.TryRefreshCertificate())
+	identity := provider.GetIdentityForIP(context.Background(), "127.0.0.1")
+	assert.Equal(strconv.Itoa(firstCertSerial), identity.GetBoundGSA())
+
+	// The next renewal sends the same key and receives the certificate
+	assert.NoError(provider.TryRefreshCertificate())
+	provider.ClearIdentityCache()
+	identity = provider.GetIdentityForIP(context.Background(), "127.0.0.1")
+	assert.Equal(strconv.Itoa(newCertSerial), identity.GetBoundGSA())
+
+	assert.Len(files.renewKeys, 3)
+	assert.Equal(files.renewKeys[0], files.renewKeys[2])
+
+	certPEM, err := os.ReadFile(files.path[fileIdClientCert])
+	assert.NoError(err)
+	chain, err := certificates.ParseCertificatesPEM(certPEM)
+	assert.NoError(err)
+	assert.Len(chain[0].IPAddresses, 2)
+	assert.True(chain[0].IPAddresses[1].Equal(newAddresses[1]))
+
+	// The subject matches, so no further renewal is needed
+	assert.NoError(provider.TryRefreshCertificate())
+	assert.Len(files.renewKeys, 3)
+}
+
+func TestHostTokenProviderOAuthTokenEndpoint(t *testing.T) {
+	assert := assert.New(t)
+	files := &hostProviderTestContext{
+		path: make(map[string]string),
+	}
+	defer files.Clean()
+
+	srv, err := NewMockIdentityServer(files)
+	assert.NoError(err)
+	defer srv.Close()
+
+	err = NewMockClientCert(files)
+	assert.NoError(err)
+
+	provider, err := NewHostTokenProvider(
+		"test",
+		srv.URL,
+		files.path[fileIdCACert],
+		files.path[fileIdClientCert],
+		files.path[fileIdClientKey],
+		time.Minute,
+		time.Hour-time.Second,
+		WithOAuthTokenEndpoint())
+
+	assert.NoError(err)
+	assert.NotNil(provider)
+	defer provider.Close()
+	assert.True(provider.useOAuthTokenEndpoint)
+
+	token, err := provider.requestOAuthIdentityToken(context.Background(), []string{"test", "other"}, time.Minute*10)
+	assert.NoError(err)
+	assert.Equal(strconv.Itoa(firstCertSerial)+"/test,other", string(token))
+
+	_, err = provider.requestOAuthIdentityToken(context.Background(), nil, time.Minute*10)
+	assert.Error(err)
+	assert.Contains(err.Error(), "invalid_request")
+}
+
+func TestHostTokenProviderEnroll(t *testing.T) {
+	assert := assert.New(t)
+	files := &hostProviderTestContext{
+		path: make(map[string]string),
+	}
+	defer files.Clean()
+
+	srv, err := NewMockIdentityServer(files)
+	assert.NoError(err)
+	defer srv.Close()
+
+	certDir := t.TempDir()
+	clientCertPath := filepath.Join(certDir, "client.cert")
+	clientKeyPath := filepath.Join(certDir, "client.key")
+	joinTokenPath := filepath.Join(certDir, "join-token")
+
+	enrollment := EnrollmentConfig{
+		JoinTokenPath: joinTokenPath,
+		Hostname:      "host.example.com",
+		Identity:      "test@test.com",
+		Addresses:     []net.IP{net.IPv4(127, 0, 0, 1)},
+	}
+
+	// An invalid join token fails enrollment
+	assert.NoError(os.WriteFile(joinTokenPath, []byte("wrong\n"), 0600))
+	_, err = NewHostTokenProvider("test", srv.URL, files.path[fileIdCACert], clientCertPath, clientKeyPath,
+		time.Minute, time.Minute, WithEnrollment(enrollment))
+	assert.Error(err)
+
+	_, err = os.Lstat(clientCertPath)
+	assert.True(os.IsNotExist(err))
+
+	// A valid join token creates key and certificate
+	assert.NoError(os.WriteFile(joinTokenPath, []byte("secret\n"), 0600))
+	provider, err := NewHostTokenProvider("test", srv.URL, files.path[fileIdCACert], clientCertPath, clientKeyPath,
+		time.Minute, time.Minute, WithEnrollment(enrollment))
+	assert.NoError(err)
+	if !assert.NotNil(provider) {
+		return
+	}
+	defer provider.Close()
+
+	assert.Equal("host.example.com", provider.certificate.Leaf.Subject.CommonName)
+
+	certLinkInfo, err := os.Lstat(clientCertPath)
+	assert.NoError(err)
+	assert.Equal(os.ModeSymlink, certLinkInfo.Mode()&os.ModeSymlink)
+
+	keyLinkInfo, err := os.Lstat(clientKeyPath)
+	assert.NoError(err)
+	assert.Equal(os.ModeSymlink, keyLinkInfo.Mode()&os.ModeSymlink)
+
+	identity := provider.GetIdentityForIP(context.Background(), "127.0.0.1")
+	assert.Equal(strconv.Itoa(newCertSerial), identity.GetBoundGSA())
+
+	// Existing certificates are not replaced
+	assert.NoError(os.WriteFile(joinTokenPath, []byte("wrong\n"), 0600))
+	second, err := NewHostTokenProvider("test", srv.URL, files.path[fileIdCACert], clientCertPath, clientKeyPath,
+		time.Minute, time.Minute, WithEnrollment(enrollment))
+	assert.NoError(err)
+	if assert.NotNil(second) {
+		second.Close()
+	}
+}
+
+func TestHostTokenProviderEnrollBootstrapCertificate(t *testing.T) {
+	assert := assert.New(t)
+	files := &hostProviderTestContext{
+		path: make(map[string]string),
+	}
+	defer files.Clean()
+
+	srv, err := NewMockIdentityServer(files)
+	assert.NoError(err)
+	defer srv.Close()
+
+	// The regular mock client certificate acts as bootstrap certificate
+	assert.NoError(NewMockClientCert(files))
+
+	certDir := t.TempDir()
+	provider, err := NewHostTokenProvider("test", srv.URL, files.path[fileIdCACert],
+		filepath.Join(certDir, "client.cert"), filepath.Join(certDir, "client.key"),
+		time.Minute, time.Minute,
+		WithEnrollment(EnrollmentConfig{
+			BootstrapCertPath: files.path[fileIdClientCert],
+			BootstrapKeyPath:  files.path[fileIdClientKey],
+			Hostname:          "host.example.com",
+			Identity:          "test@test.com",
+			Addresses:         []net.IP{net.IPv4(127, 0, 0, 1)},
+		}))
+
+	assert.NoError(err)
+	if assert.NotNil(provider) {
+		defer provider.Close()
+		assert.Equal("host.example.com", provider.certificate.Leaf.Subject.CommonName)
+	}
+}
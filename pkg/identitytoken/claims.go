@@ -0,0 +1,89 @@
+// Package identitytoken verifies and decodes tokens issued by the
+// identity-server. It can be used by any Go service that accepts these tokens.
+package identitytoken
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// ReservedClaims are set by the identity-server itself. They are never part
+// of Claims.Extra.
+var ReservedClaims = []string{"iss", "sub", "aud", "exp", "nbf", "iat", "jti", "cnf", "node_claims"}
+
+// NodeClaims holds fields we use to identify a node.
+// These claims have to be unique for each node.
+// For Workload Identity Federation, these fields need to be
+// the same as the ones used in the workload identity pool.
+type NodeClaims struct {
+	Identity string `json:"identity"`
+	// Host is the hostname of the client the token was issued to.
+	Host string `json:"host,omitempty"`
+	// Serial is the hex encoded serial number of the client certificate the
+	// token was issued to.
+	Serial string `json:"serial,omitempty"`
+}
+
+// Claims holds all claims of a token issued by the identity-server.
+type Claims struct {
+	NodeClaims NodeClaims `json:"node_claims"`
+	// Confirmation binds the token to the client certificate, if enabled.
+	Confirmation *CertificateConfirmation `json:"cnf,omitempty"`
+	jwt.RegisteredClaims
+
+	// Extra holds additional top-level claims generated by the claim mapping.
+	// Extra claims never override any of the claims above.
+	Extra map[string]any `json:"-"`
+}
+
+// MarshalJSON adds the extra claims to the JSON representation of the claims.
+func (c Claims) MarshalJSON() ([]byte, error) {
+	// Use a type without MarshalJSON to avoid recursion
+	type plainClaims Claims
+	data, err := json.Marshal(plainClaims(c))
+	if err != nil || len(c.Extra) == 0 {
+		return data, err
+	}
+
+	claims := make(map[string]json.RawMessage, len(c.Extra))
+	for name, value := range c.Extra {
+		encoded, err := json.Marshal(value)
+		if err != nil {
+			return nil, fmt.Errorf("failed to encode claim %s: %w", name, err)
+		}
+		claims[name] = encoded
+	}
+
+	// Unmarshalling the regular claims last makes sure they take precedence
+	if err := json.Unmarshal(data, &claims); err != nil {
+		return nil, err
+	}
+	return json.Marshal(claims)
+}
+
+// UnmarshalJSON reads all claims. Claims that are not part of Claims are
+// stored in Extra.
+func (c *Claims) UnmarshalJSON(data []byte) error {
+	// Use a type without UnmarshalJSON to avoid recursion
+	type plainClaims Claims
+	claims := plainClaims{}
+	if err := json.Unmarshal(data, &claims); err != nil {
+		return err
+	}
+
+	extra := map[string]any{}
+	if err := json.Unmarshal(data, &extra); err != nil {
+		return err
+	}
+	for _, name := range ReservedClaims {
+		delete(extra, name)
+	}
+	if len(extra) > 0 {
+		claims.Extra = extra
+	}
+
+	*c = Claims(claims)
+	return nil
+}
@@ -0,0 +1,67 @@
+package identitytoken
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+)
+
+var (
+	ErrorTokenNotBound         = errors.New("token is not bound to a certificate")
+	ErrorNoPeerCertificate     = errors.New("no peer certificate presented")
+	ErrorCertificateMismatch   = errors.New("token is bound to a different certificate")
+	ErrorMalformedConfirmation = errors.New("malformed token confirmation claim")
+)
+
+// CertificateConfirmation is the `cnf` claim of a certificate-bound token.
+// See https://datatracker.ietf.org/doc/html/rfc8705#section-3.1
+type CertificateConfirmation struct {
+	X509Thumbprint string `json:"x5t#S256"`
+}
+
+// CertificateThumbprint returns the base64url encoded SHA-256 hash of the DER
+// encoded certificate, as used in the `x5t#S256` confirmation method.
+func CertificateThumbprint(cert *x509.Certificate) string {
+	hash := sha256.Sum256(cert.Raw)
+	return base64.RawURLEncoding.EncodeToString(hash[:])
+}
+
+// NewCertificateConfirmation creates a `cnf` claim binding a token to the
+// given certificate.
+func NewCertificateConfirmation(cert *x509.Certificate) *CertificateConfirmation {
+	return &CertificateConfirmation{
+		X509Thumbprint: CertificateThumbprint(cert),
+	}
+}
+
+// Verify checks if the confirmation matches the given peer certificate.
+func (cnf *CertificateConfirmation) Verify(peerCert *x509.Certificate) error {
+	switch {
+	case cnf == nil:
+		return ErrorTokenNotBound
+	case len(cnf.X509Thumbprint) == 0:
+		return ErrorMalformedConfirmation
+	case peerCert == nil:
+		return ErrorNoPeerCertificate
+	}
+
+	thumbprint := CertificateThumbprint(peerCert)
+	if subtle.ConstantTimeCompare([]byte(thumbprint), []byte(cnf.X509Thumbprint)) != 1 {
+		return ErrorCertificateMismatch
+	}
+	return nil
+}
+
+// VerifyCertificateBinding checks if the token the given claims were taken
+// from is bound to the given peer certificate, i.e. the certificate presented
+// during the TLS handshake of the request that carried the token.
+// The claims MUST be returned by Verifier.Verify. Claims of unverified tokens
+// can be created by anybody, so their binding proves nothing.
+func VerifyCertificateBinding(claims *Claims, peerCert *x509.Certificate) error {
+	if claims == nil {
+		return ErrorTokenNotBound
+	}
+	return claims.Confirmation.Verify(peerCert)
+}
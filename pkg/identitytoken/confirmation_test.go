@@ -0,0 +1,35 @@
+package identitytoken
+
+import (
+	"context"
+	"crypto/x509"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestVerifyCertificateBinding(t *testing.T) {
+	assert := assert.New(t)
+	issuer := newTestIssuer(t)
+	verifier := NewRemoteVerifier(issuer.server.URL, "https://service.example.com")
+
+	cert := &x509.Certificate{Raw: []byte("client certificate")}
+	otherCert := &x509.Certificate{Raw: []byte("other certificate")}
+
+	verify := func(confirmation *CertificateConfirmation) *Claims {
+		claims := newTestClaims(issuer.server.URL, "https://service.example.com")
+		claims.Confirmation = confirmation
+		verified, err := verifier.Verify(context.Background(), issuer.sign(t, "key-1", claims))
+		assert.NoError(err)
+		return verified
+	}
+
+	boundClaims := verify(NewCertificateConfirmation(cert))
+	assert.NoError(VerifyCertificateBinding(boundClaims, cert))
+	assert.ErrorIs(VerifyCertificateBinding(boundClaims, otherCert), ErrorCertificateMismatch)
+	assert.ErrorIs(VerifyCertificateBinding(boundClaims, nil), ErrorNoPeerCertificate)
+
+	assert.ErrorIs(VerifyCertificateBinding(verify(nil), cert), ErrorTokenNotBound)
+	assert.ErrorIs(VerifyCertificateBinding(verify(&CertificateConfirmation{}), cert), ErrorMalformedConfirmation)
+	assert.ErrorIs(VerifyCertificateBinding(nil, cert), ErrorTokenNotBound)
+}
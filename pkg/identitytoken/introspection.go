@@ -0,0 +1,67 @@
+package identitytoken
+
+import (
+	"encoding/json"
+)
+
+// IntrospectionResponse is returned by the /introspect endpoint of the
+// identity-server. Active tokens carry all claims of the token as top-level
+// fields. See https://datatracker.ietf.org/doc/html/rfc7662#section-2.2
+type IntrospectionResponse struct {
+	Active bool
+	// Claims is only set for active tokens.
+	Claims *Claims
+}
+
+// introspectionState holds the fields added to the claims of a token.
+type introspectionState struct {
+	Active    bool   `json:"active"`
+	TokenType string `json:"token_type,omitempty"`
+}
+
+// MarshalJSON encodes the response as described in RFC 7662.
+func (r IntrospectionResponse) MarshalJSON() ([]byte, error) {
+	if !r.Active || r.Claims == nil {
+		return json.Marshal(introspectionState{Active: false})
+	}
+
+	data, err := json.Marshal(r.Claims)
+	if err != nil {
+		return nil, err
+	}
+
+	fields := map[string]json.RawMessage{}
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return nil, err
+	}
+
+	fields["active"] = json.RawMessage("true")
+	fields["token_type"] = json.RawMessage(`"Bearer"`)
+	return json.Marshal(fields)
+}
+
+// UnmarshalJSON decodes a response as described in RFC 7662.
+func (r *IntrospectionResponse) UnmarshalJSON(data []byte) error {
+	state := introspectionState{}
+	if err := json.Unmarshal(data, &state); err != nil {
+		return err
+	}
+
+	*r = IntrospectionResponse{Active: state.Active}
+	if !state.Active {
+		return nil
+	}
+
+	claims := Claims{}
+	if err := json.Unmarshal(data, &claims); err != nil {
+		return err
+	}
+	delete(claims.Extra, "active")
+	delete(claims.Extra, "token_type")
+	if len(claims.Extra) == 0 {
+		claims.Extra = nil
+	}
+
+	r.Claims = &claims
+	return nil
+}
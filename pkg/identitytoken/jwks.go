@@ -0,0 +1,118 @@
+package identitytoken
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lestrrat-go/jwx/jwk"
+)
+
+// KeyProvider returns the public key for a given key id.
+// The returned algorithm is the JWA name of the algorithm the key is used
+// with. It may be empty if the algorithm is not known.
+type KeyProvider interface {
+	PublicKey(ctx context.Context, keyID string) (key any, algorithm string, err error)
+}
+
+// JWKSCache is a KeyProvider that fetches keys from a remote JWKS.
+// The JWKS is fetched on first use and refreshed after maxAge. If an unknown
+// key id is requested, the JWKS is fetched again. Fetches are never attempted
+// more often than minRefresh, so unknown key ids cannot be used to flood the
+// issuer. If a fetch fails, the previously fetched keys are kept.
+type JWKSCache struct {
+	url        string
+	client     *http.Client
+	minRefresh time.Duration
+	maxAge     time.Duration
+
+	guard       *sync.Mutex
+	keys        jwk.Set
+	fetchedAt   time.Time
+	attemptedAt time.Time
+	fetchError  error
+}
+
+// JWKSURL returns the URL of the JWKS published by the given issuer.
+func JWKSURL(issuer string) string {
+	return strings.TrimSuffix(issuer, "/") + "/jwks.json"
+}
+
+// NewJWKSCache creates a new JWKSCache for the given URL.
+// If client is nil, http.DefaultClient is used.
+func NewJWKSCache(jwksURL string, client *http.Client, minRefresh, maxAge time.Duration) *JWKSCache {
+	if client == nil {
+		client = http.DefaultClient
+	}
+
+	return &JWKSCache{
+		url:        jwksURL,
+		client:     client,
+		minRefresh: minRefresh,
+		maxAge:     maxAge,
+		guard:      new(sync.Mutex),
+	}
+}
+
+// PublicKey returns the public key with the given key id.
+func (c *JWKSCache) PublicKey(ctx context.Context, keyID string) (any, string, error) {
+	c.guard.Lock()
+	defer c.guard.Unlock()
+
+	now := time.Now()
+	if c.keys == nil || now.Sub(c.fetchedAt) >= c.maxAge {
+		c.refresh(ctx, now)
+	}
+
+	key, found := c.lookup(keyID)
+	if !found {
+		// The key might have been added since the last fetch
+		c.refresh(ctx, now)
+		key, found = c.lookup(keyID)
+	}
+
+	switch {
+	case c.keys == nil:
+		return nil, "", c.fetchError
+	case !found:
+		return nil, "", fmt.Errorf("unknown key id %q", keyID)
+	}
+
+	var publicKey any
+	if err := key.Raw(&publicKey); err != nil {
+		return nil, "", errors.Join(err, fmt.Errorf("failed to read key %q", keyID))
+	}
+	return publicKey, key.Algorithm(), nil
+}
+
+// lookup returns the key with the given id from the last fetched JWKS.
+// Must be called with the guard locked.
+func (c *JWKSCache) lookup(keyID string) (jwk.Key, bool) {
+	if c.keys == nil {
+		return nil, false
+	}
+	return c.keys.LookupKeyID(keyID)
+}
+
+// refresh fetches the JWKS unless the last attempt was less than minRefresh
+// ago. Errors are stored in fetchError. Must be called with the guard locked.
+func (c *JWKSCache) refresh(ctx context.Context, now time.Time) {
+	if !c.attemptedAt.IsZero() && now.Sub(c.attemptedAt) < c.minRefresh {
+		return
+	}
+	c.attemptedAt = now
+
+	keys, err := jwk.Fetch(ctx, c.url, jwk.WithHTTPClient(c.client))
+	if err != nil {
+		c.fetchError = errors.Join(err, fmt.Errorf("failed to fetch JWKS from %s", c.url))
+		return
+	}
+
+	c.keys = keys
+	c.fetchedAt = now
+	c.fetchError = nil
+}
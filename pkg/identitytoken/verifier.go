@@ -0,0 +1,110 @@
+package identitytoken
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+const (
+	// DefaultJWKSMinRefresh is the minimum time between two JWKS fetches
+	// used by NewRemoteVerifier.
+	DefaultJWKSMinRefresh = time.Minute
+	// DefaultJWKSMaxAge is the time after which the JWKS is fetched again
+	// by NewRemoteVerifier.
+	DefaultJWKSMaxAge = time.Hour
+)
+
+// supportedAlgorithms lists all algorithms the identity-server signs with.
+var supportedAlgorithms = []string{
+	"RS256", "RS384", "RS512",
+	"PS256", "PS384", "PS512",
+	"ES256", "ES384", "ES512",
+	"EdDSA",
+}
+
+// Config defines which tokens are accepted by a Verifier.
+type Config struct {
+	// Issuer must match the `iss` claim.
+	Issuer string
+	// Audiences lists the accepted audiences. A token must contain at least
+	// one of them. If empty, the audience is not checked.
+	Audiences []string
+	// Leeway is the allowed clock skew when checking the token times.
+	Leeway time.Duration
+	// Now returns the current time. Defaults to time.Now.
+	Now func() time.Time
+}
+
+// Verifier verifies tokens issued by the identity-server.
+// A Verifier is safe for concurrent use.
+type Verifier struct {
+	keys   KeyProvider
+	config Config
+}
+
+// NewVerifier creates a new Verifier using the given key provider.
+func NewVerifier(keys KeyProvider, config Config) *Verifier {
+	if config.Now == nil {
+		config.Now = time.Now
+	}
+
+	return &Verifier{
+		keys:   keys,
+		config: config,
+	}
+}
+
+// NewRemoteVerifier creates a new Verifier that fetches keys from the JWKS
+// published by the given issuer.
+func NewRemoteVerifier(issuer string, audiences ...string) *Verifier {
+	return NewVerifier(
+		NewJWKSCache(JWKSURL(issuer), nil, DefaultJWKSMinRefresh, DefaultJWKSMaxAge),
+		Config{
+			Issuer:    issuer,
+			Audiences: audiences,
+		})
+}
+
+// Verify checks the signature, the issuer, the audience and the validity
+// period of the given token and returns its claims.
+// Certificate bound tokens have to be checked with
+// CertificateConfirmation.Verify in addition.
+func (v *Verifier) Verify(ctx context.Context, token string) (*Claims, error) {
+	options := []jwt.ParserOption{
+		jwt.WithValidMethods(supportedAlgorithms),
+		jwt.WithIssuer(v.config.Issuer),
+		jwt.WithExpirationRequired(),
+		jwt.WithIssuedAt(),
+		jwt.WithLeeway(v.config.Leeway),
+		jwt.WithTimeFunc(v.config.Now),
+	}
+	if len(v.config.Audiences) > 0 {
+		options = append(options, jwt.WithAudience(v.config.Audiences...))
+	}
+
+	claims := Claims{}
+	_, err := jwt.ParseWithClaims(token, &claims, func(t *jwt.Token) (any, error) {
+		keyID, _ := t.Header["kid"].(string)
+		if len(keyID) == 0 {
+			return nil, errors.New("token has no key id")
+		}
+
+		key, algorithm, err := v.keys.PublicKey(ctx, keyID)
+		if err != nil {
+			return nil, err
+		}
+		if len(algorithm) > 0 && algorithm != t.Method.Alg() {
+			return nil, fmt.Errorf("algorithm %s does not match key %s", t.Method.Alg(), keyID)
+		}
+		return key, nil
+	}, options...)
+
+	if err != nil {
+		return nil, err
+	}
+	return &claims, nil
+}
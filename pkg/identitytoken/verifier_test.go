@@ -0,0 +1,166 @@
+package identitytoken
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/lestrrat-go/jwx/jwk"
+	"github.com/stretchr/testify/assert"
+)
+
+type testIssuer struct {
+	server  *httptest.Server
+	keys    map[string]*ecdsa.PrivateKey
+	fetches atomic.Int32
+}
+
+func newTestIssuer(t *testing.T) *testIssuer {
+	issuer := &testIssuer{keys: map[string]*ecdsa.PrivateKey{}}
+	issuer.addKey(t, "key-1")
+
+	issuer.server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		issuer.fetches.Add(1)
+
+		set := jwk.NewSet()
+		for keyID, privateKey := range issuer.keys {
+			key, err := jwk.New(privateKey.Public())
+			assert.NoError(t, err)
+			assert.NoError(t, key.Set(jwk.KeyIDKey, keyID))
+			assert.NoError(t, key.Set(jwk.AlgorithmKey, "ES256"))
+			set.Add(key)
+		}
+		assert.NoError(t, json.NewEncoder(w).Encode(set))
+	}))
+	t.Cleanup(issuer.server.Close)
+
+	return issuer
+}
+
+func (i *testIssuer) addKey(t *testing.T, keyID string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+	i.keys[keyID] = key
+}
+
+func (i *testIssuer) sign(t *testing.T, keyID string, claims Claims) string {
+	token := jwt.NewWithClaims(jwt.SigningMethodES256, claims)
+	token.Header["kid"] = keyID
+
+	signed, err := token.SignedString(i.keys[keyID])
+	assert.NoError(t, err)
+	return signed
+}
+
+func newTestClaims(issuer string, audience string) Claims {
+	now := time.Now()
+	return Claims{
+		NodeClaims: NodeClaims{Identity: "service@example.com", Host: "host.example.com"},
+		RegisteredClaims: jwt.RegisteredClaims{
+			Issuer:    issuer,
+			Subject:   "host.example.com",
+			Audience:  jwt.ClaimStrings{audience},
+			IssuedAt:  jwt.NewNumericDate(now),
+			ExpiresAt: jwt.NewNumericDate(now.Add(time.Minute)),
+		},
+		Extra: map[string]any{"team": "platform"},
+	}
+}
+
+func TestVerifier(t *testing.T) {
+	assert := assert.New(t)
+	issuer := newTestIssuer(t)
+
+	verifier := NewRemoteVerifier(issuer.server.URL, "https://a.example.com")
+
+	claims, err := verifier.Verify(context.Background(), issuer.sign(t, "key-1", newTestClaims(issuer.server.URL, "https://a.example.com")))
+	assert.NoError(err)
+	if assert.NotNil(claims) {
+		assert.Equal("host.example.com", claims.Subject)
+		assert.Equal("service@example.com", claims.NodeClaims.Identity)
+		assert.Equal(map[string]any{"team": "platform"}, claims.Extra)
+	}
+
+	// Wrong audience
+	_, err = verifier.Verify(context.Background(), issuer.sign(t, "key-1", newTestClaims(issuer.server.URL, "https://b.example.com")))
+	assert.ErrorIs(err, jwt.ErrTokenInvalidAudience)
+
+	// Wrong issuer
+	_, err = verifier.Verify(context.Background(), issuer.sign(t, "key-1", newTestClaims("https://other", "https://a.example.com")))
+	assert.ErrorIs(err, jwt.ErrTokenInvalidIssuer)
+
+	// Expired
+	expired := newTestClaims(issuer.server.URL, "https://a.example.com")
+	expired.ExpiresAt = jwt.NewNumericDate(time.Now().Add(-time.Minute))
+	_, err = verifier.Verify(context.Background(), issuer.sign(t, "key-1", expired))
+	assert.ErrorIs(err, jwt.ErrTokenExpired)
+
+	assert.Equal(int32(1), issuer.fetches.Load())
+}
+
+func TestJWKSCacheRefresh(t *testing.T) {
+	assert := assert.New(t)
+	issuer := newTestIssuer(t)
+
+	cache := NewJWKSCache(JWKSURL(issuer.server.URL), nil, time.Hour, time.Hour)
+	verifier := NewVerifier(cache, Config{Issuer: issuer.server.URL})
+
+	_, err := verifier.Verify(context.Background(), issuer.sign(t, "key-1", newTestClaims(issuer.server.URL, "x")))
+	assert.NoError(err)
+
+	// Unknown key ids do not trigger a fetch within minRefresh
+	issuer.addKey(t, "key-2")
+	token := issuer.sign(t, "key-2", newTestClaims(issuer.server.URL, "x"))
+
+	_, err = verifier.Verify(context.Background(), token)
+	assert.Error(err)
+	assert.Equal(int32(1), issuer.fetches.Load())
+
+	// Unknown key ids trigger a fetch after minRefresh
+	cache.minRefresh = 0
+	_, err = verifier.Verify(context.Background(), token)
+	assert.NoError(err)
+	assert.Equal(int32(2), issuer.fetches.Load())
+
+	// Known keys are kept if the issuer is not reachable
+	issuer.server.Close()
+	cache.maxAge = 0
+	_, err = verifier.Verify(context.Background(), token)
+	assert.NoError(err)
+}
+
+func TestIntrospectionResponse(t *testing.T) {
+	assert := assert.New(t)
+
+	data, err := json.Marshal(IntrospectionResponse{Active: false})
+	assert.NoError(err)
+	assert.JSONEq(`{"active":false}`, string(data))
+
+	claims := newTestClaims("https://issuer", "https://a.example.com")
+	data, err = json.Marshal(IntrospectionResponse{Active: true, Claims: &claims})
+	assert.NoError(err)
+
+	fields := map[string]any{}
+	assert.NoError(json.Unmarshal(data, &fields))
+	assert.Equal(true, fields["active"])
+	assert.Equal("Bearer", fields["token_type"])
+	assert.Equal("platform", fields["team"])
+	assert.Equal("host.example.com", fields["sub"])
+
+	decoded := IntrospectionResponse{}
+	assert.NoError(json.Unmarshal(data, &decoded))
+	assert.True(decoded.Active)
+	if assert.NotNil(decoded.Claims) {
+		assert.Equal(claims.Subject, decoded.Claims.Subject)
+		assert.Equal(claims.NodeClaims, decoded.Claims.NodeClaims)
+		assert.Equal(claims.Extra, decoded.Claims.Extra)
+	}
+}
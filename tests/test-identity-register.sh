@@ -1,11 +1,28 @@
 #!/usr/bin/env bash
 
+# Enrolls a new host using the bootstrap certificate.
+# Requires a join grant with the serial of the bootstrap certificate as
+# bootstrapSerial in server.enrollment.grantsFile.
+
 CA_ROOT='mtls'
-cert=$(cat ${CA_ROOT}/generated/bootstrap.cert | base64 -w0)
 identity='bootstrap'
+hostname='localhost'
+email='test@trv-identity-server-testing.iam.gserviceaccount.com'
+
+openssl ecparam -genkey -name secp384r1 -out "${CA_ROOT}/generated/enrolled.key"
+openssl req -new -nodes \
+    -key "${CA_ROOT}/generated/enrolled.key" \
+    -subj "/CN=${hostname}" \
+    -addext "subjectAltName=DNS:${hostname},IP:127.0.0.1,IP:::1,email:${email}" \
+    -addext "keyUsage=digitalSignature" \
+    -addext "extendedKeyUsage=clientAuth" \
+    -out "${CA_ROOT}/generated/enrolled.csr"
+
+csr=$(jq -Rs . < "${CA_ROOT}/generated/enrolled.csr")
 
 curl -vvv -f -X POST -H "Content-Type: application/json" \
     --cacert "${CA_ROOT}/cacert.pem" \
     --cert "${CA_ROOT}/generated/${identity}.cert" --key "${CA_ROOT}/generated/${identity}.key"  \
-    -d "{\"identity\": \"test\", \"addresses\": [\"127.0.0.1\", \"::1\"], \"certificate\": \"${cert}\"}" \
-    'https://127.0.0.1:8443/identity'
+    -d "{\"csr\": ${csr}}" \
+    -o "${CA_ROOT}/generated/enrolled.cert" \
+    'https://127.0.0.1:8443/enroll'